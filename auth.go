@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// authorize checks that a websocket upgrade request comes from an allowed
+// origin, and carries the auth token, if one is configured.
+func (c Config) authorize(r *http.Request) error {
+	if c.WSNoAuth {
+		return nil
+	}
+	if !c.checkOrigin(r) {
+		return errors.New("origin not allowed")
+	}
+	if !c.checkToken(r) {
+		return errors.New("missing or invalid token")
+	}
+	return nil
+}
+
+// checkOrigin reports whether the Origin header of r is one of
+// WSAllowedOrigins. If none are configured, any origin is allowed, as
+// Koha's intranet is usually served from another host than the hub.
+// Requests without Origin are not from browsers, and are allowed.
+func (c Config) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(c.WSAllowedOrigins) == 0 {
+		return true
+	}
+	for _, o := range c.WSAllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkToken reports whether r carries WSAuthToken, as a bearer token in
+// the Authorization header or in the token query parameter. Any request is
+// accepted if no token is configured.
+func (c Config) checkToken(r *http.Request) bool {
+	if c.WSAuthToken == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.WSAuthToken)) == 1
+}
+
+// stringList is a flag.Value for a comma separated list of strings.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	cfg := Config{
+		WSAllowedOrigins: []string{"https://koha.example.org", "https://intra.example.org/"},
+		WSAuthToken:      "s3cret",
+	}
+
+	tests := []struct {
+		desc    string
+		target  string
+		headers map[string]string
+		ok      bool
+	}{
+		{"allowed origin, token in query", "/ws?token=s3cret", map[string]string{"Origin": "https://koha.example.org"}, true},
+		{"allowed origin, bearer token", "/ws", map[string]string{"Origin": "https://intra.example.org", "Authorization": "Bearer s3cret"}, true},
+		{"no origin", "/ws?token=s3cret", nil, true},
+		{"disallowed origin", "/ws?token=s3cret", map[string]string{"Origin": "https://evil.example.com"}, false},
+		{"missing token", "/ws", map[string]string{"Origin": "https://koha.example.org"}, false},
+		{"invalid token", "/ws?token=guess", map[string]string{"Origin": "https://koha.example.org"}, false},
+		{"invalid bearer token", "/ws?token=s3cret", map[string]string{"Authorization": "Bearer guess"}, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.target, nil)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if err := cfg.authorize(r); (err == nil) != test.ok {
+			t.Errorf("%s: authorize() => %v; want ok=%v", test.desc, err, test.ok)
+		}
+	}
+
+	// Without allowed origins, any origin is allowed, as Koha is usually
+	// on another host than the hub.
+	cfg = Config{}
+	r := httptest.NewRequest("GET", "http://rfidhub.example.org/ws", nil)
+	r.Header.Set("Origin", "http://rfidhub.example.org")
+	if err := cfg.authorize(r); err != nil {
+		t.Errorf("authorize() same origin => %v; want nil", err)
+	}
+	r.Header.Set("Origin", "https://koha.example.org")
+	if err := cfg.authorize(r); err != nil {
+		t.Errorf("authorize() cross origin => %v; want nil", err)
+	}
+
+	// Auth can be disabled for local development.
+	cfg = Config{WSAuthToken: "s3cret", WSNoAuth: true}
+	if err := cfg.authorize(r); err != nil {
+		t.Errorf("authorize() with WSNoAuth => %v; want nil", err)
+	}
+}
+
+func TestServeWsForbidden(t *testing.T) {
+	h := newHub(Config{WSAuthToken: "s3cret"})
+	defer h.Close()
+
+	rec := httptest.NewRecorder()
+	serveWs(h, rec, httptest.NewRequest("GET", "/ws?token=guess", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GET /ws with invalid token => %d; want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeClients(rec, httptest.NewRequest("GET", "/clients", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GET /clients without token => %d; want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeRecovery(rec, httptest.NewRequest("GET", "/recovery", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GET /recovery without token => %d; want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestStringListFlag(t *testing.T) {
+	var l stringList
+	if err := l.Set("https://a.example.org, https://b.example.org,"); err != nil {
+		t.Fatal(err)
+	}
+	want := stringList{"https://a.example.org", "https://b.example.org"}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("Set() => %q; want %q", l, want)
+	}
+	if got := l.String(); got != "https://a.example.org,https://b.example.org" {
+		t.Errorf("String() => %q", got)
+	}
+}
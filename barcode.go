@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// BarcodeRules are the rules for normalizing and validating the barcode of
+// a tag, which is the part of the tag id before the first ':'. The rules
+// are applied in the order of the fields.
+type BarcodeRules struct {
+	Strip      string // Regular expression; matching parts are removed, ex "^0+"
+	TrimPrefix string // Prefix removed if present, ex "10"
+	TrimSuffix string // Suffix removed if present
+	MinLength  int    // Minimum length, 0 for none
+	MaxLength  int    // Maximum length, 0 for none
+	CheckDigit string // Check digit of the last character: "", "mod10" (Luhn) or "mod11"
+}
+
+// maxTagLength is the maximum length of a tag id read by the RFID-unit.
+// Longer ids are misreads.
+const maxTagLength = 64
+
+// cleanTag returns the tag id read by the RFID-unit without control
+// characters. It fails if the id is empty or too long, or contains one of
+// the reserved bytes, ex the SIP field delimiter, as it cannot be sent in
+// a SIP field.
+func cleanTag(tag string, reserved ...byte) (string, error) {
+	tag = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, tag)
+	if tag == "" || len(tag) > maxTagLength {
+		return "", fmt.Errorf("invalid tag %q: wrong length", tag)
+	}
+	for _, b := range reserved {
+		if strings.IndexByte(tag, b) != -1 {
+			return "", fmt.Errorf("invalid tag %q: contains %q", tag, b)
+		}
+	}
+	return tag, nil
+}
+
+// defaultBarcodeRules strips the "10" prefix of tags with Deichman's
+// library number.
+var defaultBarcodeRules = map[string]BarcodeRules{
+	"02030000": {TrimPrefix: "10"},
+}
+
+func (r BarcodeRules) validate() error {
+	if _, err := regexp.Compile(r.Strip); err != nil {
+		return fmt.Errorf("invalid barcode strip pattern: %v", err)
+	}
+	if r.MinLength < 0 || r.MaxLength < 0 || (r.MaxLength > 0 && r.MinLength > r.MaxLength) {
+		return fmt.Errorf("invalid barcode length limits: %d-%d", r.MinLength, r.MaxLength)
+	}
+	switch r.CheckDigit {
+	case "", "mod10", "mod11":
+	default:
+		return fmt.Errorf("unknown barcode check digit: %q", r.CheckDigit)
+	}
+	return nil
+}
+
+// barcodeRule is a compiled BarcodeRules.
+type barcodeRule struct {
+	BarcodeRules
+	strip *regexp.Regexp
+}
+
+// barcodeNormalizer normalizes the barcodes of tags, with the rules of the
+// library number of the tag, or else the rules keyed by "".
+type barcodeNormalizer map[string]barcodeRule
+
+// newBarcodeNormalizer compiles the rules, which must have been validated.
+func newBarcodeNormalizer(rules map[string]BarcodeRules) barcodeNormalizer {
+	n := make(barcodeNormalizer, len(rules))
+	for lib, r := range rules {
+		rule := barcodeRule{BarcodeRules: r}
+		if r.Strip != "" {
+			rule.strip = regexp.MustCompile(r.Strip)
+		}
+		n[lib] = rule
+	}
+	return n
+}
+
+// normalize returns the barcode of the tag, or an error if it fails validation.
+// Ex: 1003011596802008:NO:02030000 => 03011596802008
+func (n barcodeNormalizer) normalize(tag string) (string, error) {
+	id := strings.Split(tag, ":")
+	barcode := id[0]
+	var lib string
+	if len(id) == 3 {
+		lib = id[2]
+	}
+	rule, ok := n[lib]
+	if !ok {
+		rule, ok = n[""]
+	}
+	if !ok {
+		return barcode, nil
+	}
+
+	if rule.strip != nil {
+		barcode = rule.strip.ReplaceAllString(barcode, "")
+	}
+	barcode = strings.TrimPrefix(barcode, rule.TrimPrefix)
+	barcode = strings.TrimSuffix(barcode, rule.TrimSuffix)
+	if barcode == "" || len(barcode) < rule.MinLength || (rule.MaxLength > 0 && len(barcode) > rule.MaxLength) {
+		return "", fmt.Errorf("invalid barcode %q: wrong length", barcode)
+	}
+	switch rule.CheckDigit {
+	case "mod10":
+		if !validMod10(barcode) {
+			return "", fmt.Errorf("invalid barcode %q: wrong check digit", barcode)
+		}
+	case "mod11":
+		if !validMod11(barcode) {
+			return "", fmt.Errorf("invalid barcode %q: wrong check digit", barcode)
+		}
+	}
+	return barcode, nil
+}
+
+// validMod10 reports whether the last digit of s is its Luhn check digit.
+func validMod10(s string) bool {
+	if len(s) < 2 {
+		return false
+	}
+	var sum int
+	for i := len(s) - 1; i >= 0; i-- {
+		d := int(s[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if (len(s)-1-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// validMod11 reports whether the last character of s is its modulus 11
+// check digit, with weights 2-7 from the right, and X for 10.
+func validMod11(s string) bool {
+	if len(s) < 2 {
+		return false
+	}
+	var sum int
+	for i, w := len(s)-2, 2; i >= 0; i, w = i-1, w+1 {
+		if w > 7 {
+			w = 2
+		}
+		d := int(s[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		sum += d * w
+	}
+	check := (11 - sum%11) % 11
+	last := s[len(s)-1]
+	if check == 10 {
+		return last == 'X' || last == 'x'
+	}
+	return int(last-'0') == check
+}
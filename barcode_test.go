@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeBarcode(t *testing.T) {
+	var tests = []struct {
+		desc  string
+		rules map[string]BarcodeRules
+		tag   string
+		want  string
+		err   string
+	}{
+		// Default rules: only Deichman tags should strip 10
+		{"deichman", nil, "1003011596802008:NO:02030000", "03011596802008", ""},
+		{"other library", nil, "1003011596802008:NO:02030001", "1003011596802008", ""},
+		{"no library number", nil, "10123456789012", "10123456789012", ""},
+
+		// Codabar with Luhn check digit, as used by many public libraries
+		{"codabar", map[string]BarcodeRules{"": {MinLength: 14, MaxLength: 14, CheckDigit: "mod10"}},
+			"31234000012342", "31234000012342", ""},
+		{"codabar wrong check digit", map[string]BarcodeRules{"": {MinLength: 14, MaxLength: 14, CheckDigit: "mod10"}},
+			"31234000012343", "", "wrong check digit"},
+		{"codabar too short", map[string]BarcodeRules{"": {MinLength: 14, MaxLength: 14, CheckDigit: "mod10"}},
+			"3123400001234", "", "wrong length"},
+
+		// Padded with zeros, and prefixed with the institution code
+		{"padded", map[string]BarcodeRules{"": {Strip: "^0+", TrimPrefix: "HB"}},
+			"000HB1234567:SE:01020000", "1234567", ""},
+
+		// Prefix and suffix, with modulus 11 check digit
+		{"mod11", map[string]BarcodeRules{"02030000": {TrimPrefix: "10", CheckDigit: "mod11"}},
+			"1003011596802004:NO:02030000", "03011596802004", ""},
+		{"mod11 X", map[string]BarcodeRules{"": {TrimPrefix: "A", TrimSuffix: "B", CheckDigit: "mod11"}},
+			"A100008XB", "100008X", ""},
+		{"mod11 wrong check digit", map[string]BarcodeRules{"": {CheckDigit: "mod11"}},
+			"1234567891", "", "wrong check digit"},
+		{"mod11 not digits", map[string]BarcodeRules{"": {CheckDigit: "mod11"}},
+			"12E4567892", "", "wrong check digit"},
+
+		// Rules of the library number take precedence over the fallback
+		{"library rules", map[string]BarcodeRules{"02030000": {TrimPrefix: "10"}, "": {MinLength: 20}},
+			"1003011596802008:NO:02030000", "03011596802008", ""},
+		{"fallback rules", map[string]BarcodeRules{"02030000": {TrimPrefix: "10"}, "": {MinLength: 20}},
+			"1003011596802008:NO:02030001", "", "wrong length"},
+		{"empty", map[string]BarcodeRules{"": {Strip: "[^0-9]"}},
+			"ABC", "", "wrong length"},
+	}
+
+	for _, tt := range tests {
+		n := newBarcodeNormalizer(Config{BarcodeRules: tt.rules}.barcodeRules())
+		got, err := n.normalize(tt.tag)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: normalize(%q) => %q, %v; want error containing %q", tt.desc, tt.tag, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: normalize(%q) => %q, %v; want %q", tt.desc, tt.tag, got, err, tt.want)
+		}
+	}
+}
+
+func TestBarcodeRulesValidate(t *testing.T) {
+	for _, r := range []BarcodeRules{
+		{Strip: "[0-9"},
+		{MinLength: 10, MaxLength: 5},
+		{MinLength: -1},
+		{CheckDigit: "mod97"},
+	} {
+		if err := r.validate(); err == nil {
+			t.Errorf("%+v.validate() => nil; want error", r)
+		}
+	}
+	if err := (BarcodeRules{Strip: "^0+", MinLength: 5, MaxLength: 14, CheckDigit: "mod10"}).validate(); err != nil {
+		t.Errorf("validate() => %v; want nil", err)
+	}
+}
+
+func TestCleanTag(t *testing.T) {
+	var tests = []struct {
+		tag  string
+		want string
+		err  string
+	}{
+		{"1003011596802008:NO:02030000", "1003011596802008:NO:02030000", ""},
+		{"\x001003011596802008\x07:NO:02030000\n", "1003011596802008:NO:02030000", ""},
+		{"\x00\x01", "", "wrong length"},
+		{strings.Repeat("1", maxTagLength+1), "", "wrong length"},
+		{"10030115|96802008:NO:02030000", "", "contains '|'"},
+		{"10030115^96802008:NO:02030000", "", "contains '^'"},
+	}
+
+	for _, tt := range tests {
+		got, err := cleanTag(tt.tag, '|', '^', '\r')
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("cleanTag(%q) => %q, %v; want error containing %q", tt.tag, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("cleanTag(%q) => %q, %v; want %q", tt.tag, got, err, tt.want)
+		}
+	}
+}
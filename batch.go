@@ -0,0 +1,93 @@
+package main
+
+import "fmt"
+
+// A WRITE-BATCH writes the tags of many items, ex new items from
+// acquisitions, one item at a time. Koha gives the items, each with its
+// number of tags and, if not the default ones, its owner and country, and is
+// told which item to place the tags of next with a WRITE-BATCH message. When
+// the tags are on the RFID-unit, Koha sends WRITE-NEXT, and they are written
+// and verified as on WRITE, with the result sent as a WRITE message.
+//
+// An item whose tags failed to be written is kept as pending, and the batch
+// moves on to the next item. The last WRITE-BATCH message, without an item,
+// tells which items were written and which still need tags, to be written
+// in a new batch.
+
+// writeBatch is a WRITE-BATCH in progress.
+type writeBatch struct {
+	items   []Item   // Items remaining to be written, the next one first
+	written []string // Barcodes of the items written
+	failed  []string // Barcodes of the items whose tags failed to be written
+}
+
+// pending returns the barcodes of the items of the batch which still need
+// tags: the ones which failed, then the ones remaining.
+func (b *writeBatch) pending() []string {
+	pending := append([]string(nil), b.failed...)
+	for _, item := range b.items {
+		pending = append(pending, item.Barcode)
+	}
+	return pending
+}
+
+// startBatch starts a WRITE-BATCH of the given items, if they can all be
+// written to tags, and tells Koha which item to place the tags of first.
+func (c *Client) startBatch(items []Item) {
+	c.batch = nil
+	if len(items) == 0 {
+		c.sendToKoha(Message{Action: "WRITE-BATCH", UserError: true, ErrorMessage: "no items to write"})
+		return
+	}
+	for _, item := range items {
+		if _, err := encodeTag(c.writeData(item.Barcode, item)); err != nil {
+			c.sendToKoha(Message{Action: "WRITE-BATCH", UserError: true,
+				ErrorMessage: fmt.Sprintf("cannot write item %s to tags: %v", item.Barcode, err)})
+			return
+		}
+	}
+	c.logger().Info("starting write batch", "items", len(items))
+	c.batch = &writeBatch{items: append([]Item(nil), items...)}
+	c.batchProgress()
+}
+
+// writeNext writes the tags of the next item of the WRITE-BATCH, which
+// Koha has told to be on the RFID-unit.
+func (c *Client) writeNext() {
+	if c.batch == nil {
+		c.sendToKoha(Message{Action: "WRITE-NEXT", UserError: true, ErrorMessage: "no WRITE-BATCH in progress"})
+		return
+	}
+	item := c.batch.items[0]
+	c.current = Message{Action: "WRITE", Item: Item{Label: item.Label, Barcode: item.Barcode, NumTags: item.NumTags}}
+	c.writing = c.writeData(item.Barcode, item)
+	c.startWrite()
+}
+
+// batchWritten records the result of writing the tags of the current item
+// of the WRITE-BATCH, and tells Koha which item is next.
+func (c *Client) batchWritten() {
+	b := c.batch
+	if c.current.Item.WriteFailed || c.current.Item.TagCountFailed {
+		b.failed = append(b.failed, c.current.Item.Barcode)
+	} else {
+		b.written = append(b.written, c.current.Item.Barcode)
+	}
+	b.items = b.items[1:]
+	c.batchProgress()
+}
+
+// batchProgress tells Koha the progress of the WRITE-BATCH: the item to
+// place the tags of next, the items written, and the items which still need
+// tags. The batch ends when there is no item left.
+func (c *Client) batchProgress() {
+	b := c.batch
+	msg := Message{Action: "WRITE-BATCH", Written: append([]string(nil), b.written...), Pending: b.pending()}
+	if len(b.items) > 0 {
+		msg.Item = b.items[0]
+	} else {
+		c.logger().Info("write batch done", "written", len(b.written), "failed", len(b.failed))
+		c.batch = nil
+	}
+	c.sendToKoha(msg)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errSIPBreakerOpen is returned instead of calling a SIP server which has
+// failed too many times in a row, until it has had time to recover.
+var errSIPBreakerOpen = errors.New("SIP server unavailable, calls suspended after repeated failures")
+
+// States of a breaker.
+const (
+	breakerClosed   = "closed"    // Calls go through
+	breakerOpen     = "open"      // Calls fail fast
+	breakerHalfOpen = "half-open" // A single call probes whether the server has recovered
+)
+
+// breaker is a circuit breaker in front of a SIP server. After threshold
+// consecutive failures it opens, and calls fail fast with errSIPBreakerOpen
+// for the cooldown. Then a single call is let through to probe the server:
+// if it succeeds, the breaker closes, otherwise it opens again. A nil
+// breaker lets all calls through.
+type breaker struct {
+	name      string // Address of the SIP server, for logging
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	mu        sync.Mutex // Protects the following:
+	state     string
+	failures  int       // Consecutive failures, while closed
+	openedAt  time.Time // When the breaker last opened
+	probing   bool      // The probe is in flight, while half-open
+}
+
+// newBreaker returns a breaker opening after threshold consecutive
+// failures, or nil if threshold is 0.
+func newBreaker(name string, threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{name: name, threshold: threshold, cooldown: cooldown, now: time.Now, state: breakerClosed}
+}
+
+// allow reports whether a call may go through, or fails with
+// errSIPBreakerOpen. A call allowed must be followed by done.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return errSIPBreakerOpen
+		}
+		b.transition(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return errSIPBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the result of a call allowed by allow. Only errors of the
+// server, not ex of the request, count as failures; other errors are
+// passed as nil.
+func (b *breaker) done(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		if err == nil {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open(err)
+		}
+	case breakerHalfOpen:
+		b.probing = false
+		if err != nil {
+			b.open(err)
+			return
+		}
+		b.failures = 0
+		b.transition(breakerClosed)
+	}
+}
+
+// abort records that a call allowed by allow was cancelled, without
+// telling whether the server is up. If it was the probe, the next call
+// probes instead.
+func (b *breaker) abort() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// State returns the state of the breaker.
+func (b *breaker) State() string {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breaker) open(err error) {
+	b.openedAt = b.now()
+	b.transition(breakerOpen)
+	logger.Warn("SIP circuit breaker opened, failing calls fast", "server", b.name,
+		"failures", b.failures, "cooldown", b.cooldown, "err", err)
+}
+
+// transition changes the state of the breaker, and counts it.
+func (b *breaker) transition(state string) {
+	b.state = state
+	metrics.breakerTransitions.Inc(state)
+	if state != breakerOpen {
+		logger.Info("SIP circuit breaker "+state, "server", b.name)
+	}
+}
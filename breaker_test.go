@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	now := time.Now()
+	b := newBreaker("sip.example.org:6001", 2, time.Minute)
+	b.now = func() time.Time { return now }
+	errDown := errors.New("connection refused")
+
+	opened := metrics.breakerTransitions.Value(breakerOpen)
+	closed := metrics.breakerTransitions.Value(breakerClosed)
+
+	// A success resets the consecutive failures
+	for _, err := range []error{errDown, nil, errDown} {
+		if err := b.allow(); err != nil {
+			t.Fatalf("allow() while closed => %v; want nil", err)
+		}
+		b.done(err)
+	}
+	if s := b.State(); s != breakerClosed {
+		t.Fatalf("state after failure, success, failure => %s; want %s", s, breakerClosed)
+	}
+
+	// Open
+	b.allow()
+	b.done(errDown)
+	if s := b.State(); s != breakerOpen {
+		t.Fatalf("state after 2 consecutive failures => %s; want %s", s, breakerOpen)
+	}
+	now = now.Add(time.Minute - time.Second)
+	if err := b.allow(); err != errSIPBreakerOpen {
+		t.Errorf("allow() during cooldown => %v; want %v", err, errSIPBreakerOpen)
+	}
+
+	// Half-open: a single probe is let through, and fails
+	now = now.Add(time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow() after cooldown => %v; want probe let through", err)
+	}
+	if s := b.State(); s != breakerHalfOpen {
+		t.Errorf("state while probing => %s; want %s", s, breakerHalfOpen)
+	}
+	if err := b.allow(); err != errSIPBreakerOpen {
+		t.Errorf("allow() while probing => %v; want %v", err, errSIPBreakerOpen)
+	}
+	b.done(errDown)
+	if s := b.State(); s != breakerOpen {
+		t.Fatalf("state after failed probe => %s; want %s", s, breakerOpen)
+	}
+	if err := b.allow(); err != errSIPBreakerOpen {
+		t.Errorf("allow() after failed probe => %v; want %v", err, errSIPBreakerOpen)
+	}
+
+	// Half-open again: the probe is cancelled, and the next call probes
+	// instead, which succeeds, and the breaker closes
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow() after second cooldown => %v; want probe let through", err)
+	}
+	b.abort()
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow() after cancelled probe => %v; want probe let through", err)
+	}
+	b.done(nil)
+	if s := b.State(); s != breakerClosed {
+		t.Fatalf("state after successful probe => %s; want %s", s, breakerClosed)
+	}
+	if err := b.allow(); err != nil {
+		t.Errorf("allow() after close => %v; want nil", err)
+	}
+
+	if n := metrics.breakerTransitions.Value(breakerOpen) - opened; n != 2 {
+		t.Errorf("breaker opened %d times; want 2", n)
+	}
+	if n := metrics.breakerTransitions.Value(breakerClosed) - closed; n != 1 {
+		t.Errorf("breaker closed %d times; want 1", n)
+	}
+
+	// A nil breaker, when disabled, lets all calls through
+	if b := newBreaker("", 0, time.Minute); b != nil || b.allow() != nil || b.State() != breakerClosed {
+		t.Errorf("newBreaker with threshold 0 => %v; want nil breaker letting calls through", b)
+	}
+}
+
+func TestSIPBreaker(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+	srv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+
+	cfg := Config{SIPServer: srv.Addr(), SIPTimeout: time.Second, SIPBreakerThreshold: 2, SIPBreakerCooldown: time.Minute}
+	h := newHub(cfg)
+	defer h.Close()
+	now := time.Now()
+	h.settings().sipPool.breaker.now = func() time.Time { return now }
+
+	// Each DoSIPCall tries twice, so the two calls fail, and open the breaker
+	srv.FailNext(4)
+	for i := 0; i < 2; i++ {
+		if _, err := DoSIPCall(cfg, h.settings().sipPool, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP"); err == nil {
+			t.Fatal("DoSIPCall to failing SIP server => nil; want error")
+		}
+	}
+
+	// The SIP server is back, but isn't called during the cooldown
+	_, err := DoSIPCall(cfg, h.settings().sipPool, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP")
+	if err != errSIPBreakerOpen {
+		t.Fatalf("DoSIPCall with open breaker => %v; want %v", err, errSIPBreakerOpen)
+	}
+	if code := sipErrorCode(err); code != CodeSIPUnavailable {
+		t.Errorf("sipErrorCode(%v) => %s; want %s", err, code, CodeSIPUnavailable)
+	}
+
+	// After the cooldown, the probe succeeds
+	now = now.Add(time.Minute)
+	res, err := DoSIPCall(cfg, h.settings().sipPool, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP")
+	if err != nil || res.Item.Label != "Heavy metal in Baghdad" {
+		t.Fatalf("DoSIPCall after cooldown => %+v, %v; want item", res, err)
+	}
+	if s := h.settings().sipPool.breaker.State(); s != breakerClosed {
+		t.Errorf("breaker state after successful probe => %s; want %s", s, breakerClosed)
+	}
+}
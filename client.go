@@ -2,126 +2,464 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Defaults for the websocket settings in Config.
 const (
 	// Time allowed to write a message to the peer.
-	writeWait = 5 * time.Second
+	defaultWriteWait = 5 * time.Second
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer, room for a WRITE-BATCH of
+	// some dozen items.
+	defaultMaxMessageSize = 16 << 10
+
+	// Time a reader waits for a client to take a message, before the
+	// client is considered stuck.
+	defaultStallTimeout = time.Minute
 )
 
+// errRFIDNOK is returned when the RFID-unit refuses the initialization.
+var errRFIDNOK = errors.New("RFID-unit responded with NOK")
+
+// errTagUnreadable is the status of an item whose tag the RFID-unit
+// detected, but couldn't read.
+var errTagUnreadable = errors.New("tag could not be read, reposition the item on the RFID-unit")
+
+// rfidErrorCode returns the ErrorCode of a failed connection to the RFID-unit.
+func rfidErrorCode(err error) ErrorCode {
+	if err == errRFIDNOK {
+		return CodeRFIDNOK
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CodeRFIDTimeout
+	}
+	return CodeRFIDDisconnected
+}
+
 // Client represents a connected Koha intra UI client with RFID-capabilities.
 type Client struct {
 	state          RFIDState
 	branch         string
 	patron         string
+	noBlock        bool // Check out in offline mode, with the SIP no block flag
 	current        Message
-	items          map[string]Message // Keep items around for retries, keyed by barcode TODO drop Message, store only Item
-	failedAlarmOn  map[string]string  // map[Barcode]Tag
-	failedAlarmOff map[string]string  // map[Barcode]Tag
+	items          map[string]Message   // Keep items around for retries, keyed by barcode TODO drop Message, store only Item
+	failedAlarmOn  map[string]failedTag // Keyed by barcode
+	failedAlarmOff map[string]failedTag // Keyed by barcode
+	endRetries     int                  // Number of times END has been resent
+	alarmResent    int                  // Number of times the alarm of the current item has been resent, with alarmFailBlock
+	graceTag       string               // Tag read as an incomplete set, and read again after Config.MissingTagsGrace
+	heldReads      []RFIDResp           // Tags read while busy with another item, or a command, handled when scanning again
+	lastRead       map[string]time.Time // When tags were last read at checkin or checkout, when Config.GhostReadWindow > 0
+	sessionReset   time.Time            // When the last session ended
+	retryQueue     []string             // Barcodes remaining to be retried in current RETRY-ALARM-ON/OFF
+	sentAt         time.Time            // When the last command was sent to the RFID-unit, zero if answered, guarded by rfidLock
+	closeRequested bool                 // The hub is shutting down; stop scanning and refuse new transactions
+	afi            afiCheck             // AFI being set, when Config.UseAFI
+	journaled      string               // Barcode, from the tag, the current item's transaction is journaled under
+	setInfoBarcode string               // Barcode of the item whose set info is being read, when Config.ReadSetInfo
+	setInfoRead    RFIDResp             // Tag read of the item whose set info is being read
+	desecured      RFIDResp             // Tag read whose alarm is turned off before its SIP checkout, with checkoutAlarmBefore
+	testSecurity   string               // Security of the test tag of a TEST, SECURE or UNSECURE, restored when done
+	endResult      *Message             // Result to send to Koha when scanning has stopped, in single checkin mode
+	writing        tagData              // Data of the tags of the item being written
+	writeIDs       []string             // Ids of the tags remaining to be written, the current first, with Config.WriteTagBlocks
+	writeBlocks    []byte               // Blocks written to the current tag
+	batch          *writeBatch          // WRITE-BATCH in progress, nil if none
+	paused         RFIDState            // State the session was scanning in when paused, to resume in
+	inventory      []inventoryTag       // Tags read by the INVENTORY in progress, in the order read
+	inventoryDue   bool                 // The window of the INVENTORY in progress has passed
 	IP             string
 	hub            *Hub
+	pinned         atomic.Value // *settings of the client's transactions, see settings
+	log            *Logger
 	wlock          sync.Mutex
-	conn           *websocket.Conn
+	connLock       sync.Mutex      // Serializes writes to conn, which doesn't support concurrent writers, and guards conn
+	conn           *websocket.Conn // Replaced when Koha resumes the session
+	session        string          // Token with which Koha can resume the session, when Config.WSResumeWindow > 0
+	protocol       int             // Version of the protocol negotiated with Koha
+	format         string          // Subprotocol of the format of the messages negotiated with Koha, "" for JSON
+	detached       bool            // The websocket has dropped, and messages are held until Koha resumes, guarded by wlock
+	held           [][]byte        // Messages to Koha held while detached, guarded by wlock
+	expiry         *time.Timer     // Tears down the client if Koha doesn't resume in time, guarded by hub.mu
 	rfidLock       sync.Mutex
 	rfidconn       net.Conn
-	rfid           *RFIDManager
+	rfidPending    *RFIDReq  // Command sent to the RFID-unit, waiting for its response, guarded by rfidLock
+	rfidQueue      []RFIDReq // Commands waiting for the pending command to be answered, guarded by rfidLock
+	rfidDrain      bool      // The pending command was abandoned, and its response is discarded, guarded by rfidLock
+	rfidRedialing  bool      // The connection to the RFID-unit was lost, and commands are queued until Run resumes them, guarded by rfidLock
+	rfid           RFIDProtocol
 	fromKoha       chan Message
 	fromRFID       chan RFIDResp
-	quit           chan bool
+	closeReq       chan struct{}          // Receives a request to close from the hub
+	parts          map[string]*partSet    // Items read as incomplete sets whose parts are collected, keyed by barcode
+	reconnected    chan struct{}          // Receives a signal from readFromRFID when the RFID-unit has been reconnected
+	ctx            context.Context        // Done when the client shuts down, or the hub is closed, ending its goroutines and SIP calls
+	stop           context.CancelFunc     // Cancels ctx
+	lastID         uint64                 // ID of the last message sent to Koha, guarded by wlock
+	unacked        map[uint64]*unackedMsg // Messages to Koha waiting for ACK, keyed by ID, guarded by wlock
+	running        sync.WaitGroup         // Goroutines of the client: Run, readFromRFID, readFromKoha, ping and retransmit, added to before they start
+	statusLock     sync.Mutex
+	status         ClientStatus // Snapshot of the state, updated by Run
+	rfidVersion    string       // Firmware version of the RFID-unit, guarded by statusLock
+}
+
+// failedTag is the tag of an item whose alarm failed to be changed, kept
+// to retry the alarm.
+type failedTag struct {
+	tag string // Data of the tag
+	uid string // UID of the tag, if the RFID-unit reported it
+}
+
+// ClientStatus describes the state of a client, as shown by the /clients endpoint.
+type ClientStatus struct {
+	IP             string
+	Branch         string
+	State          RFIDState
+	Barcode        string // Barcode of the current item
+	FailedAlarmOn  int    // Number of items which failed to get alarm turned on
+	FailedAlarmOff int    // Number of items which failed to get alarm turned off
+	RFIDVersion    string // Firmware version of the RFID-unit
+}
+
+// unackedMsg is a message sent to Koha, which Koha hasn't acknowledged.
+type unackedMsg struct {
+	payload []byte
+	sentAt  time.Time // When it was last sent
+	resent  int       // Number of times it has been retransmitted
+}
+
+// afiStep is a step in setting the AFI of a tag.
+type afiStep int
+
+const (
+	afiNone      afiStep = iota
+	afiReading           // Waiting for the RFID-unit to read the AFI before it is set
+	afiSetting           // Waiting for the RFID-unit to set the AFI
+	afiVerifying         // Waiting for the RFID-unit to read back the AFI
+)
+
+// afiCheck keeps track of setting the AFI of a tag, which takes three
+// commands: reading the AFI, setting it, and reading it back.
+type afiCheck struct {
+	step   afiStep
+	tag    string
+	want   byte
+	set    RFIDReq // Command setting the AFI, sent when it has been read
+	before string  // Security of the tag before the AFI was set, if read
 }
 
 // Run the state-machine of the client
 func (c *Client) Run(cfg Config) {
+	defer c.running.Done()
+	// timeout fires if the RFID-unit doesn't respond to a command in time.
+	timeout := c.hub.clock.NewTimer(time.Hour)
+	stopTimer(timeout)
+	// idle fires if a transaction session has been idle for too long.
+	idle := c.hub.clock.NewTimer(time.Hour)
+	stopTimer(idle)
+	// missing fires when the parts of an incomplete set have been collected
+	// for Config.MissingPartsTimeout.
+	missing := c.hub.clock.NewTimer(time.Hour)
+	stopTimer(missing)
+	// grace fires when an incomplete set is to be read again at checkin.
+	grace := c.hub.clock.NewTimer(time.Hour)
+	stopTimer(grace)
+	// window fires when an INVENTORY has collected tags for long enough.
+	window := c.hub.clock.NewTimer(time.Hour)
+	stopTimer(window)
+	// deadman fires if the client has been stuck waiting for a response
+	// for too long. It is only reset when the state changes.
+	deadman := c.hub.clock.NewTimer(time.Hour)
+	stopTimer(deadman)
+	deadmanState := RFIDIdle
+	// replay holds the first of the held reads, when it is due.
+	replay := make(chan RFIDResp, 1)
 	for {
+		select {
+		case <-replay:
+		default:
+		}
+		fromRFID := c.fromRFID
+		if len(c.heldReads) > 0 && c.state.pausable() {
+			replay <- c.heldReads[0]
+			fromRFID = replay
+		}
+		// active is when a message or response was got, from which the
+		// session idle timeout runs; zero if none was.
+		var active time.Time
 		select {
 		case msg := <-c.fromKoha:
+			active = c.hub.clock.Now()
+			if c.closeRequested {
+				c.sendToKoha(Message{Action: "CLOSE"})
+				break
+			}
+			if c.state == RFIDIdle {
+				// A new transaction starts on the hub's settings, if they
+				// were reloaded while idle.
+				c.reloadSettings()
+				cfg = *c.config()
+			}
+			c.afi = afiCheck{}
+			if !c.supports(msg.Action) {
+				c.sendToKoha(Message{Action: msg.Action, UserError: true, ErrorCode: CodeProtocolVersion,
+					ErrorMessage: fmt.Sprintf("%s is not supported by protocol version %d", msg.Action, c.protocol)})
+				break
+			}
 			switch msg.Action {
 			case "CHECKIN":
 				c.state = RFIDCheckinWaitForBegOK
 				c.rfid.Reset()
 				c.branch = msg.Branch
+				c.graceTag = ""
 				c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
 			case "END":
+				if c.state == RFIDCheckin && cfg.CheckinMode == checkinSingle {
+					// Scanning only continues for the items to retry, which
+					// are forgotten when it ends, so Koha is told of them.
+					if attention := c.unresolved(); len(attention) > 0 {
+						c.endResult = &Message{Action: "END", Attention: attention}
+					}
+				}
 				c.state = RFIDWaitForEndOK
+				c.endRetries = 0
 				c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+			case "CANCEL":
+				c.cancel()
 			case "ITEM-INFO":
+				if msg.Item.Barcode == "" {
+					// No barcode given; scan items on the reader and look them
+					// up, without touching the state of any transaction.
+					c.state = RFIDItemInfoWaitForBegOK
+					c.branch = msg.Branch
+					c.rfid.Reset()
+					c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
+					break
+				}
 				var err error
-				c.current, err = DoSIPCall(c.hub.config, c.hub.sipPool, sipFormMsgItemStatus(msg.Item.Barcode), itemStatusParse, c.IP)
+				c.current, err = DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(msg.Branch), sipFormMsgItemStatus(msg.Item.Barcode), c.config().localized(c.branch, itemInfoParse), c.IP)
 				if err != nil {
-					log.Printf("ER [%s] SIP call: %v", c.IP, err)
-					c.sendToKoha(Message{Action: "ITEM-INFO", SIPError: true, ErrorMessage: err.Error()})
-					c.quit <- true // really?
+					c.logger().Error("SIP call failed", "action", msg.Action, "err", err)
+					c.sendToKoha(Message{Action: "ITEM-INFO", SIPError: true, ErrorCode: sipErrorCode(err), ErrorMessage: err.Error()})
+					c.current = Message{}
+					c.state = RFIDIdle
 					break
 				}
 				c.state = RFIDWaitForTagCount
 				c.rfid.Reset()
 				c.sendToRFID(RFIDReq{Cmd: cmdTagCount})
+			case "INVENTORY":
+				c.state = RFIDInventoryWaitForBegOK
+				c.branch = msg.Branch
+				c.inventory = nil
+				c.inventoryDue = false
+				c.rfid.Reset()
+				c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
 			case "WRITE":
-				c.state = RFIDPreWriteStep1
+				c.batch = nil
 				c.current.Action = "WRITE"
+				if msg.Item.Barcode != "" {
+					c.current.Item.Barcode = msg.Item.Barcode
+				}
 				c.current.Item.NumTags = msg.Item.NumTags
-				c.rfid.Reset()
-				c.sendToRFID(RFIDReq{Cmd: cmdSLPLBN})
+				c.writing = c.writeData(c.current.Item.Barcode, msg.Item)
+				if _, err := encodeTag(c.writing); err != nil {
+					c.sendToKoha(Message{Action: "WRITE", UserError: true,
+						ErrorMessage: fmt.Sprintf("cannot write item to tags: %v", err)})
+					c.state = RFIDIdle
+					break
+				}
+				c.startWrite()
+			case "WRITE-BATCH":
+				c.startBatch(msg.Batch)
+			case "WRITE-NEXT":
+				c.writeNext()
+			case "PAUSE":
+				c.pause()
+			case "RESUME":
+				c.resume()
+			case "DEACTIVATE", "SENSITIZE":
+				c.startManualAlarm(msg)
 			case "CHECKOUT":
+				if !c.patronAllowed(msg) {
+					c.state = RFIDIdle
+					break
+				}
+				c.state = RFIDCheckoutWaitForBegOK
+				c.patron = msg.Patron
+				c.branch = msg.Branch
+				c.rfid.Reset()
+				c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
+			case "CHECKIN-CHECKOUT":
+				if !cfg.CheckinCheckout {
+					c.sendToKoha(Message{Action: "CHECKIN-CHECKOUT", UserError: true,
+						ErrorMessage: "CHECKIN-CHECKOUT is not enabled"})
+					break
+				}
+				if !c.patronAllowed(msg) {
+					c.state = RFIDIdle
+					break
+				}
+				c.state = RFIDExchangeWaitForBegOK
+				c.patron = msg.Patron
+				c.branch = msg.Branch
+				c.rfid.Reset()
+				c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
+			case "RENEW":
 				if msg.Patron == "" {
-					c.sendToKoha(Message{Action: "CHECKOUT",
+					c.sendToKoha(Message{Action: "RENEW",
 						UserError: true, ErrorMessage: "Patron not supplied"})
 					c.state = RFIDIdle
 					break
 				}
-				c.state = RFIDCheckoutWaitForBegOK
+				c.state = RFIDRenewWaitForBegOK
 				c.patron = msg.Patron
 				c.branch = msg.Branch
 				c.rfid.Reset()
 				c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
+			case "PATRON-INFO":
+				// The patron's account, for staff to review before a
+				// checkout; the RFID-unit is not involved.
+				if msg.Patron == "" {
+					c.sendToKoha(Message{Action: "PATRON-INFO",
+						UserError: true, ErrorMessage: "Patron not supplied"})
+					break
+				}
+				info, err := DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(msg.Branch), sipFormMsgPatronInfo(msg.Branch, msg.Patron, msg.PIN, summaryHoldItems), c.config().localized(msg.Branch, patronInfoParse), c.IP)
+				if err != nil {
+					c.logger().Error("SIP call failed", "action", msg.Action, "err", err)
+					c.sendToKoha(Message{Action: "PATRON-INFO", SIPError: true, ErrorCode: sipErrorCode(err), ErrorMessage: err.Error()})
+					break
+				}
+				c.sendToKoha(info)
 			case "RETRY-ALARM-ON":
-				c.state = RFIDWaitForRetryAlarmOn
-				for k, v := range c.failedAlarmOn {
-					c.current = c.items[k]
+				if c.retrying() {
+					c.sendToKoha(Message{Action: "RETRY-ALARM-ON",
+						UserError: true, ErrorCode: CodeRetryInProgress, ErrorMessage: "Retry already in progress"})
+					break
+				}
+				c.queueRetries(c.failedAlarmOn)
+				if c.retryNext(c.failedAlarmOn, cmdRetryAlarmOn) {
 					c.current.Item.Transfer = ""
-					c.sendToRFID(RFIDReq{Cmd: cmdRetryAlarmOn, Data: []byte(v)})
-					break // Remaining will be triggered in case RFIDWaitForRetryAlarmOn
+					c.state = RFIDWaitForRetryAlarmOn
 				}
 			case "RETRY-ALARM-OFF":
-				c.state = RFIDWaitForRetryAlarmOff
-				for k, v := range c.failedAlarmOff {
-					c.current = c.items[k]
-					c.sendToRFID(RFIDReq{Cmd: cmdRetryAlarmOff, Data: []byte(v)})
-					break // Remaining will be triggered in case RFIDWaitForRetryAlarmOff
+				if c.retrying() {
+					c.sendToKoha(Message{Action: "RETRY-ALARM-OFF",
+						UserError: true, ErrorCode: CodeRetryInProgress, ErrorMessage: "Retry already in progress"})
+					break
+				}
+				c.queueRetries(c.failedAlarmOff)
+				if c.retryNext(c.failedAlarmOff, cmdRetryAlarmOff) {
+					c.state = RFIDWaitForRetryAlarmOff
 				}
+			case "TEST":
+				// Test the round-trip to the RFID-unit, for technicians
+				// installing it. The alarm of the test tag in Item.Tag, if
+				// given, is toggled, and left in its original state: with
+				// Config.UseAFI it is read from the tag, otherwise
+				// Item.SecurityBefore tells if it is UNSECURE.
+				if c.state != RFIDIdle {
+					c.sendToKoha(Message{Action: "TEST", UserError: true, ErrorCode: CodeInvalidRequest,
+						ErrorMessage: "RFID-unit can only be tested when idle"})
+					break
+				}
+				c.current = Message{Action: "TEST", Item: Item{Tag: msg.Item.Tag}}
+				c.testSecurity = "SECURE"
+				if msg.Item.SecurityBefore == "UNSECURE" {
+					c.testSecurity = "UNSECURE"
+				}
+				c.branch = msg.Branch
+				c.state = RFIDTestVersion
+				c.rfid.Reset()
+				c.sendToRFID(RFIDReq{Cmd: cmdInitVersion})
 				// TODO default case -> ERROR
 			}
-		case resp := <-c.fromRFID:
+		case resp := <-fromRFID:
+			active = c.hub.clock.Now()
+			if fromRFID == replay {
+				c.heldReads = c.heldReads[1:]
+			}
+			if !c.rfidResponse(resp) {
+				break
+			}
+			if c.state.pausable() {
+				// An item read between the items of a session is handled
+				// on the hub's settings, if they were reloaded.
+				c.reloadSettings()
+				cfg = *c.config()
+			}
+			if c.afi.step != afiNone {
+				var done bool
+				if resp, done = c.checkAFI(resp); !done {
+					break
+				}
+			}
+			if resp.ReadStatus == readError {
+				// Not a missing tag: staff are told to place the item
+				// better on the RFID-unit, for it to be read again.
+				c.logger().Warn("tag detected but unreadable", "id", resp.TagID)
+				if c.rejectInvalidTag(resp.TagID, errTagUnreadable) {
+					break
+				}
+			} else if resp.tagRead() {
+				var err error
+				if resp, err = c.cleanTag(resp); err != nil && c.rejectInvalidTag(resp.Tag, err) {
+					break
+				}
+			}
 			switch c.state {
 			case RFIDCheckinWaitForBegOK:
 				if !resp.OK {
-					log.Printf("ERR: [%v] RFID failed to start scanning", c.IP)
-					c.sendToKoha(Message{Action: "CONNECT", RFIDError: true})
-					c.quit <- true
+					c.logger().Error("RFID failed to start scanning")
+					c.sendToKoha(Message{Action: "CONNECT", RFIDError: true, ErrorCode: CodeRFIDNOK})
+					c.shutdown()
 					break
 				}
 				c.state = RFIDCheckin
 			case RFIDWaitForCheckinAlarmLeave:
+				c.incompleteAlarmFailed(resp)
 				c.state = RFIDCheckin
 				c.current.Item.Date = ""
-				c.sendToKoha(c.current)
+				c.checkinDone()
+			case RFIDWaitForCheckinRereadLeave:
+				c.state = RFIDCheckin
+			case RFIDWaitForCheckoutRereadLeave:
+				c.state = RFIDCheckout
+			case RFIDWaitForCheckinAlarmKept:
+				// The alarm was left as is by the security policy, and the
+				// checkin is complete whatever the response.
+				if !resp.OK {
+					c.logger().Warn("RFID reader failed to leave alarm in current state")
+				}
+				resp.OK = true
+				fallthrough
 			case RFIDWaitForCheckinAlarmOn:
+				if !resp.OK && c.resendAlarmOn() {
+					break
+				}
+				c.alarmResent = 0
 				c.state = RFIDCheckin
 				if !resp.OK {
 					c.current.Item.AlarmOnFailed = true
 					c.current.Item.Status = "Feil: fikk ikke skrudd på alarm."
+					if c.config().AlarmFailPolicy == alarmFailCompensate {
+						c.revertCheckin()
+					}
 				} else {
 					delete(c.failedAlarmOn, c.current.Item.Barcode)
 					c.current.Item.AlarmOnFailed = false
@@ -130,8 +468,22 @@ func (c *Client) Run(cfg Config) {
 				// Discard branchcode if issuing branch is the same as target branch
 				if c.branch == c.current.Item.Transfer {
 					c.current.Item.Transfer = ""
+					c.current.Item.InTransit = false
 				}
-				c.sendToKoha(c.current)
+				c.journalResult("CHECKIN")
+				c.emit(Event{Type: EventCheckinComplete, Item: c.current.Item})
+				c.route()
+				c.checkinDone()
+			case RFIDWaitForCheckinTransitAlarmOff:
+				c.state = RFIDCheckin
+				if !resp.OK {
+					c.current.Item.AlarmOffFailed = true
+					c.current.Item.Status = "Feil: fikk ikke skrudd av alarm."
+				}
+				c.journalResult("CHECKIN")
+				c.emit(Event{Type: EventCheckinComplete, Item: c.current.Item})
+				c.route()
+				c.checkinDone()
 			case RFIDWaitForRetryAlarmOn:
 				if !resp.OK {
 					c.current.Item.AlarmOnFailed = true
@@ -143,127 +495,263 @@ func (c *Client) Run(cfg Config) {
 				}
 				c.sendToKoha(c.current)
 
-				if len(c.failedAlarmOn) > 0 {
-					for k, v := range c.failedAlarmOn {
-						c.current = c.items[k]
-						c.current.Item.Transfer = ""
-						c.state = RFIDWaitForRetryAlarmOn
-						c.sendToRFID(RFIDReq{Cmd: cmdRetryAlarmOn, Data: []byte(v)})
-						break
-					}
+				// Remaining failed items are retried one at a time. Items that
+				// failed again are kept for the next RETRY-ALARM-ON.
+				if c.retryNext(c.failedAlarmOn, cmdRetryAlarmOn) {
+					c.current.Item.Transfer = ""
 				} else {
+					c.state = c.scanState(RFIDCheckin)
+				}
+			case RFIDCheckinGrace:
+				if resp.Tag != c.graceTag {
+					// Another item is handled when done with the set.
+					c.heldReads = append(c.heldReads, resp)
+					break
+				}
+				if !resp.OK {
+					// Still incomplete; it is read again when the grace
+					// period is over.
+					break
+				}
+				// The rest of the set was placed on the RFID-unit in time.
+				stopTimer(grace)
+				fallthrough
+			case RFIDWaitForCheckinReread:
+				if !resp.tagRead() {
+					// The item was removed during the grace period.
+					c.logger().Info("incomplete set removed", "tag", c.graceTag)
+					c.graceTag = ""
 					c.state = RFIDCheckin
+					break
 				}
+				// The read is handled as any other, but an incomplete set
+				// is now reported.
+				c.state = RFIDCheckin
+				fallthrough
 			case RFIDCheckin:
-				var err error
+				barcode, err := c.hub.barcodes.normalize(resp.Tag)
+				if err != nil {
+					c.rejectTag("CHECKIN", resp.Tag, err)
+					c.state = RFIDWaitForCheckinAlarmLeave
+					break
+				}
+				if c.ghostRead(resp.Tag) {
+					c.logger().Info("ignoring item left from the previous session", "barcode", barcode)
+					c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+					c.state = RFIDWaitForCheckinRereadLeave
+					break
+				}
+				if !resp.OK && cfg.MissingTagsGrace > 0 && c.graceTag != resp.Tag {
+					c.graceTag = resp.Tag
+					c.state = RFIDCheckinGrace
+					grace.Reset(cfg.MissingTagsGrace)
+					break
+				}
+				c.graceTag = ""
+				if resp.OK && c.checkedIn(barcode) {
+					// Read again while lying on the RFID-unit. It is not
+					// checked in again, and Koha is not told again. A set
+					// read as incomplete is still reported below.
+					c.logger().Debug("ignoring item read again", "barcode", barcode)
+					c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+					c.state = RFIDWaitForCheckinRereadLeave
+					break
+				}
+				if !resp.OK && c.parts[barcode] != nil {
+					// Another part of a set being collected. The alarm is
+					// changed once all parts are read.
+					if c.config().ReadSetInfo {
+						c.readSetInfo(barcode, resp, RFIDWaitForCheckinSetInfo)
+						break
+					}
+					if !c.collectPart(barcode, resp) {
+						c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+						c.state = RFIDWaitForCheckinPartLeave
+						break
+					}
+					resp.OK = true
+				}
 				if !resp.OK {
 					// Not OK on checkin means missing tags
 
 					// Get item info from SIP, in order to have a title to display
 					// Don't bother calling SIP if this is already the current item
-					if barcodeFromTag(resp.Tag) != c.current.Item.Barcode {
-						c.current, err = DoSIPCall(c.hub.config, c.hub.sipPool, sipFormMsgItemStatus(resp.Tag), itemStatusParse, c.IP)
+					if barcode != c.current.Item.Barcode {
+						c.current, err = DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgItemStatus(resp.Tag), c.config().localized(c.branch, itemStatusParse), c.IP)
 						if err != nil {
-							log.Printf("ER [%s] SIP: %v", c.IP, err)
-							c.sendToKoha(Message{Action: "CONNECT", SIPError: true, ErrorMessage: err.Error()})
-							c.quit <- true
+							c.itemSIPError("CHECKIN", barcode, resp.Tag, err)
+							c.state = RFIDWaitForCheckinAlarmLeave
 							break
 						}
 					}
+					c.current.Item.RSSI = resp.RSSI
+					if c.current.Item.Unknown {
+						// The tag is not of any item, ex a foreign tag or one with a
+						// malformed barcode. It must be removed and investigated, and
+						// is not kept with the items, so that it isn't retried.
+						c.logger().Warn("unknown tag on RFID-unit", "tag", resp.Tag)
+						c.current = unknownTag(barcode, resp)
+						c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+						c.state = RFIDWaitForCheckinAlarmLeave
+						break
+					}
+					// The RFID-unit knows the number of parts in the set from the
+					// tag data, and reports the set as incomplete.
 					c.current.Action = "CHECKIN"
-					c.items[barcodeFromTag(resp.Tag)] = c.current
+					c.current.Item.TagCountFailed = true
+					if c.config().ReadSetInfo {
+						c.readSetInfo(barcode, resp, RFIDWaitForCheckinSetInfo)
+						break
+					}
+					c.sendItemEvent(barcode)
+					if c.startParts(barcode, resp) {
+						c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+						c.state = RFIDWaitForCheckinPartLeave
+						break
+					}
+					c.alarmIncompleteSet(barcode, resp.Tag, RFIDWaitForCheckinAlarmLeave)
+					break
+				}
+				delete(c.parts, barcode)
+				c.checkinItem(barcode, resp)
+			case RFIDCheckout:
+				barcode, err := c.hub.barcodes.normalize(resp.Tag)
+				if err != nil {
+					c.rejectTag("CHECKOUT", resp.Tag, err)
+					c.state = RFIDWaitForCheckoutAlarmLeave
+					break
+				}
+				if c.ghostRead(resp.Tag) {
+					c.logger().Info("ignoring item left from the previous session", "barcode", barcode)
 					c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
-					c.state = RFIDWaitForCheckinAlarmLeave
+					c.state = RFIDWaitForCheckoutRereadLeave
 					break
-				} else {
-					// Proceed with checkin transaction
-					c.current, err = DoSIPCall(c.hub.config, c.hub.sipPool, sipFormMsgCheckin(c.branch, resp.Tag), checkinParse, c.IP)
-					if err != nil {
-						log.Printf("ER [%s] SIP call failed: %v", c.IP, err)
-						c.sendToKoha(Message{Action: "CHECKIN", SIPError: true, ErrorMessage: err.Error()})
-						// TODO send cmdAlarmLeave to RFID?
+				}
+				if !resp.OK && c.parts[barcode] != nil {
+					// Another part of a set being collected. The alarm is
+					// changed once all parts are read.
+					if c.config().ReadSetInfo {
+						c.readSetInfo(barcode, resp, RFIDWaitForCheckoutSetInfo)
 						break
 					}
-					if c.current.Item.Unknown || c.current.Item.TransactionFailed {
+					if !c.collectPart(barcode, resp) {
 						c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
-						c.state = RFIDWaitForCheckinAlarmLeave
-					} else {
-						c.items[barcodeFromTag(resp.Tag)] = c.current
-						c.failedAlarmOn[barcodeFromTag(resp.Tag)] = resp.Tag // Store tag id for potential retry
-						c.sendToRFID(RFIDReq{Cmd: cmdAlarmOn})
-						c.state = RFIDWaitForCheckinAlarmOn
+						c.state = RFIDWaitForCheckoutPartLeave
+						break
 					}
+					resp.OK = true
 				}
-			case RFIDCheckout:
-				var err error
 				if !resp.OK {
 					// Missing tags case
-					// TODO test this case
 
 					// Get status of item, to have title to display on screen,
 					// Don't bother calling SIP if this is already the current item
-					if barcodeFromTag(resp.Tag) != c.current.Item.Barcode {
-						c.current, err = DoSIPCall(c.hub.config, c.hub.sipPool, sipFormMsgItemStatus(resp.Tag), itemStatusParse, c.IP)
+					if barcode != c.current.Item.Barcode {
+						c.current, err = DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgItemStatus(resp.Tag), c.config().localized(c.branch, itemStatusParse), c.IP)
 						if err != nil {
-							log.Printf("ER [%s] SIP call failed: %v", c.IP, err)
-							c.sendToKoha(Message{Action: "CHECKOUT", SIPError: true, ErrorMessage: err.Error()})
-							// c.quit <- true // really?
+							c.itemSIPError("CHECKOUT", barcode, resp.Tag, err)
+							c.state = RFIDWaitForCheckoutAlarmLeave
 							break
 						}
 					}
+					c.current.Item.RSSI = resp.RSSI
 					c.current.Action = "CHECKOUT"
-					c.items[barcodeFromTag(resp.Tag)] = c.current
-					c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
-					c.state = RFIDWaitForCheckoutAlarmLeave
-				} else {
-					// proced with checkout transaction
-					c.current, err = DoSIPCall(c.hub.config, c.hub.sipPool, sipFormMsgCheckout(c.branch, c.patron, resp.Tag), checkoutParse, c.IP)
-					if err != nil {
-						log.Printf("ER [%s] SIP call failed: %v", c.IP, err)
-						c.sendToKoha(Message{Action: "CHECKOUT", SIPError: true, ErrorMessage: err.Error()})
-						// c.quit <- true // really?
+					c.current.Item.TagCountFailed = true
+					if c.config().ReadSetInfo {
+						c.readSetInfo(barcode, resp, RFIDWaitForCheckoutSetInfo)
 						break
 					}
-					c.current.Action = "CHECKOUT"
-					if c.current.Item.Unknown || c.current.Item.TransactionFailed {
+					if c.startParts(barcode, resp) {
 						c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
-						c.state = RFIDWaitForCheckoutAlarmLeave
+						c.state = RFIDWaitForCheckoutPartLeave
 						break
-					} else {
-						c.items[barcodeFromTag(resp.Tag)] = c.current
-						c.failedAlarmOff[barcodeFromTag(resp.Tag)] = resp.Tag // Store tag id for potential retry
-						c.sendToRFID(RFIDReq{Cmd: cmdAlarmOff})
-						c.state = RFIDWaitForCheckoutAlarmOff
 					}
+					c.alarmIncompleteSet(barcode, resp.Tag, RFIDWaitForCheckoutAlarmLeave)
+					break
+				}
+				delete(c.parts, barcode)
+				c.checkoutItem(barcode, resp)
+			case RFIDWaitForCheckinSetInfo:
+				if c.parts[c.setInfoBarcode] == nil {
+					c.setParts(resp)
+					c.sendItemEvent(c.setInfoBarcode)
+				}
+				read, collected := c.setInfoPart(resp)
+				switch {
+				case read.OK:
+					// The last part of the set was read.
+					c.state = RFIDCheckin
+					c.checkinItem(c.setInfoBarcode, read)
+				case collected:
+					c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+					c.state = RFIDWaitForCheckinPartLeave
+				default:
+					c.alarmIncompleteSet(c.setInfoBarcode, read.Tag, RFIDWaitForCheckinAlarmLeave)
+				}
+			case RFIDWaitForCheckoutSetInfo:
+				if c.parts[c.setInfoBarcode] == nil {
+					c.setParts(resp)
+				}
+				read, collected := c.setInfoPart(resp)
+				switch {
+				case read.OK:
+					c.state = RFIDCheckout
+					c.checkoutItem(c.setInfoBarcode, read)
+				case collected:
+					c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+					c.state = RFIDWaitForCheckoutPartLeave
+				default:
+					c.alarmIncompleteSet(c.setInfoBarcode, read.Tag, RFIDWaitForCheckoutAlarmLeave)
 				}
 			case RFIDCheckoutWaitForBegOK:
 				if !resp.OK {
-					log.Printf("ER [%v] RFID failed to start scanning, shutting down.", c.IP)
-					c.sendToKoha(Message{Action: "CHECKOUT", RFIDError: true})
-					c.quit <- true // really?
+					c.logger().Error("RFID failed to start scanning, shutting down")
+					c.sendToKoha(Message{Action: "CHECKOUT", RFIDError: true, ErrorCode: CodeRFIDNOK})
+					c.shutdown() // really?
 					break
 				}
 				c.state = RFIDCheckout
+			case RFIDWaitForCheckoutAlarmKept:
+				if !resp.OK {
+					c.logger().Warn("RFID reader failed to leave alarm in current state")
+				}
+				c.state = RFIDCheckout
+				c.checkoutDone(RFIDResp{OK: true})
 			case RFIDWaitForCheckoutAlarmOff:
+				c.state = RFIDCheckout
+				c.checkoutDone(resp)
+			case RFIDWaitForCheckoutEarlyAlarmOff:
+				c.state = RFIDCheckout
+				c.checkoutDesecured(resp)
+			case RFIDWaitForCheckoutResecure:
 				c.state = RFIDCheckout
 				if !resp.OK {
-					// TODO unit-test for this
-					c.current.Item.AlarmOffFailed = true
-					c.current.Item.Status = "Feil: fikk ikke skrudd av alarm."
-				} else {
-					delete(c.failedAlarmOff, c.current.Item.Barcode)
-					c.current.Item.Status = ""
-					c.current.Item.AlarmOffFailed = false
+					c.logger().Error("alarm of item whose checkout was denied could not be turned on again", "barcode", c.current.Item.Barcode)
+					c.current.Item.AlarmOnFailed = true
+					c.current.Item.Status = "Feil: fikk ikke skrudd på alarm igjen, utlånet ble avvist."
 				}
+				c.journalResult("CHECKOUT")
 				c.sendToKoha(c.current)
 			case RFIDWaitForCheckoutAlarmLeave:
 				if !resp.OK {
 					// I can't imagine the RFID-reader fails to leave the
 					// alarm in it current state. In any case, we continue
-					log.Printf("ER [%v] RFID reader failed to leave alarm in current state", c.IP)
+					c.logger().Warn("RFID reader failed to leave alarm in current state")
 				}
+				c.incompleteAlarmFailed(resp)
 				c.state = RFIDCheckout
 				c.sendToKoha(c.current)
+			case RFIDWaitForCheckinPartLeave, RFIDWaitForCheckoutPartLeave:
+				if !resp.OK {
+					c.logger().Warn("RFID reader failed to leave alarm in current state")
+				}
+				// Koha is told when all parts of the set are read, or
+				// when they are reported missing.
+				if c.state == RFIDWaitForCheckinPartLeave {
+					c.state = RFIDCheckin
+				} else {
+					c.state = RFIDCheckout
+				}
 			case RFIDWaitForRetryAlarmOff:
 				if !resp.OK {
 					c.current.Item.AlarmOffFailed = true
@@ -275,16 +763,161 @@ func (c *Client) Run(cfg Config) {
 				}
 				c.sendToKoha(c.current)
 
-				if len(c.failedAlarmOff) > 0 {
-					for k, v := range c.failedAlarmOff {
-						c.current = c.items[k]
-						c.state = RFIDWaitForCheckoutAlarmOff
-						c.sendToRFID(RFIDReq{Cmd: cmdRetryAlarmOff, Data: []byte(v)})
+				// Remaining failed items are retried one at a time. Items that
+				// failed again are kept for the next RETRY-ALARM-OFF.
+				if !c.retryNext(c.failedAlarmOff, cmdRetryAlarmOff) {
+					c.state = c.scanState(RFIDCheckout)
+				}
+			case RFIDWaitForEndOK:
+				if !resp.OK {
+					if c.endRetries < cfg.EndScanRetries {
+						c.endRetries++
+						c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
 						break
 					}
+					c.logger().Error("RFID failed to stop scanning")
+					c.sendToKoha(Message{Action: "END", RFIDError: true, ErrorCode: CodeRFIDNOK,
+						ErrorMessage: "RFID-unit failed to stop scanning"})
+				}
+				c.state = RFIDIdle
+				c.patron = ""
+				c.current = Message{}
+				c.heldReads = nil
+				c.resetReads()
+				c.items = make(map[string]Message)
+				c.failedAlarmOn = make(map[string]failedTag)
+				c.failedAlarmOff = make(map[string]failedTag)
+				c.parts = nil
+				if c.endResult != nil {
+					c.sendToKoha(*c.endResult)
+					c.endResult = nil
+				}
+			case RFIDWaitForPauseOK:
+				c.pauseDone(resp)
+			case RFIDWaitForResumeOK:
+				c.resumeDone(resp)
+			case RFIDManualAlarmWaitForBegOK:
+				c.manualAlarmScanning(resp)
+			case RFIDManualAlarm:
+				c.manualAlarmRead(resp)
+			case RFIDWaitForManualAlarm:
+				c.manualAlarmDone(resp)
+			case RFIDExchangeWaitForBegOK:
+				if !resp.OK {
+					c.logger().Error("RFID failed to start scanning")
+					c.sendToKoha(Message{Action: "CHECKIN-CHECKOUT", RFIDError: true, ErrorCode: CodeRFIDNOK})
+					c.state = RFIDIdle
+					break
+				}
+				c.state = RFIDExchange
+			case RFIDExchange:
+				c.exchange(resp)
+			case RFIDWaitForExchangeAlarmKept:
+				if !resp.OK {
+					c.logger().Warn("RFID reader failed to leave alarm in current state")
+				}
+				c.exchangeDone(RFIDResp{OK: true})
+			case RFIDWaitForExchangeAlarm:
+				c.exchangeDone(resp)
+			case RFIDWaitForExchangeAlarmLeave:
+				c.incompleteAlarmFailed(resp)
+				c.state = RFIDExchange
+				c.sendToKoha(c.current)
+			case RFIDWaitForExchangeRereadLeave:
+				c.state = RFIDExchange
+			case RFIDRenewWaitForBegOK:
+				if !resp.OK {
+					c.logger().Error("RFID failed to start scanning")
+					c.sendToKoha(Message{Action: "RENEW", RFIDError: true, ErrorCode: CodeRFIDNOK})
+					c.state = RFIDIdle
+					break
+				}
+				c.state = RFIDRenew
+			case RFIDRenew:
+				// Renewals don't change the alarm, so missing tags doesn't
+				// matter, and the alarm is left as is. The item is renewed
+				// by its tag, as it is checked in and out.
+				_, err := c.hub.barcodes.normalize(resp.Tag)
+				if err != nil {
+					c.rejectTag("RENEW", resp.Tag, err)
+					c.state = RFIDWaitForRenewAlarmLeave
+					break
+				}
+				c.current, err = DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgRenew(c.branch, c.patron, resp.Tag), c.config().localized(c.branch, renewParse), c.IP)
+				if err != nil {
+					c.logger().Error("SIP call failed", "err", err)
+					c.sendToKoha(Message{Action: "RENEW", SIPError: true, ErrorCode: sipErrorCode(err), ErrorMessage: err.Error()})
+				}
+				c.current.Item.RSSI = resp.RSSI
+				c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+				c.state = RFIDWaitForRenewAlarmLeave
+			case RFIDWaitForRenewAlarmLeave:
+				if !resp.OK {
+					c.logger().Warn("RFID reader failed to leave alarm in current state")
+				}
+				c.state = RFIDRenew
+				if c.current.Action == "RENEW" {
+					c.sendToKoha(c.current)
+				}
+			case RFIDItemInfoWaitForBegOK:
+				if !resp.OK {
+					c.logger().Error("RFID failed to start scanning")
+					c.sendToKoha(Message{Action: "ITEM-INFO", RFIDError: true, ErrorCode: CodeRFIDNOK})
+					c.state = RFIDIdle
+					break
+				}
+				c.state = RFIDItemInfo
+			case RFIDItemInfo:
+				// The lookup result is sent directly to Koha, and must not be
+				// stored in c.current or c.items.
+				info, err := DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgItemStatus(resp.Tag), c.config().localized(c.branch, itemInfoParse), c.IP)
+				if err != nil {
+					c.logger().Error("SIP call failed", "err", err)
+					c.sendToKoha(Message{Action: "ITEM-INFO", SIPError: true, ErrorCode: sipErrorCode(err), ErrorMessage: err.Error()})
 				} else {
-					c.state = RFIDCheckin
+					info.Item.TagCountFailed = !resp.OK
+					info.Item.RSSI = resp.RSSI
+					c.sendToKoha(info)
+				}
+				c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+				c.state = RFIDItemInfoWaitForAlarmLeave
+			case RFIDItemInfoWaitForAlarmLeave:
+				if !resp.OK {
+					c.logger().Warn("RFID reader failed to leave alarm in current state")
+				}
+				c.state = RFIDItemInfo
+			case RFIDInventoryWaitForBegOK:
+				if !resp.OK {
+					c.logger().Error("RFID failed to start scanning")
+					c.sendToKoha(Message{Action: "INVENTORY", RFIDError: true, ErrorCode: CodeRFIDNOK})
+					c.state = RFIDIdle
+					break
+				}
+				c.state = RFIDInventory
+				window.Reset(cfg.inventoryWindow())
+			case RFIDInventory:
+				// The alarm is left as is; the items are only listed.
+				c.readInventoryTag(inventoryTag{tag: resp.Tag, complete: resp.OK, rssi: resp.RSSI})
+				c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+				c.state = RFIDInventoryWaitForAlarmLeave
+			case RFIDInventoryWaitForAlarmLeave:
+				if !resp.OK {
+					c.logger().Warn("RFID reader failed to leave alarm in current state")
+				}
+				c.state = RFIDInventory
+			case RFIDInventoryWaitForEndOK:
+				if !resp.OK && c.endRetries < cfg.EndScanRetries {
+					c.endRetries++
+					c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+					break
 				}
+				if !resp.OK {
+					c.logger().Error("RFID failed to stop scanning")
+				}
+				c.state = RFIDIdle
+				manifest := c.inventoryManifest()
+				c.inventory = nil
+				c.sendToKoha(manifest)
 			case RFIDWaitForTagCount:
 				c.current.Item.TransactionFailed = !resp.OK
 				c.state = RFIDIdle
@@ -293,72 +926,56 @@ func (c *Client) Run(cfg Config) {
 				c.sendToKoha(c.current)
 			case RFIDPreWriteStep1:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
 				c.state = RFIDPreWriteStep2
-				c.sendToRFID(RFIDReq{Cmd: cmdSLPLBC})
+				c.sendToRFID(RFIDReq{Cmd: cmdSLPLBC, Data: []byte(c.writing.Country)})
 			case RFIDPreWriteStep2:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
 				c.state = RFIDPreWriteStep3
 				c.sendToRFID(RFIDReq{Cmd: cmdSLPDTM})
 			case RFIDPreWriteStep3:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
 				c.state = RFIDPreWriteStep4
 				c.sendToRFID(RFIDReq{Cmd: cmdSLPSSB})
 			case RFIDPreWriteStep4:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
 				c.state = RFIDPreWriteStep5
 				c.sendToRFID(RFIDReq{Cmd: cmdSLPCRD})
 			case RFIDPreWriteStep5:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
 				c.state = RFIDPreWriteStep6
 				c.sendToRFID(RFIDReq{Cmd: cmdSLPWTM})
 			case RFIDPreWriteStep6:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
 				c.state = RFIDPreWriteStep7
 				c.sendToRFID(RFIDReq{Cmd: cmdSLPRSS})
 			case RFIDPreWriteStep7:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
 				c.state = RFIDPreWriteStep8
 				c.sendToRFID(RFIDReq{Cmd: cmdTagCount})
 			case RFIDPreWriteStep8:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
 				if resp.TagCount != c.current.Item.NumTags {
@@ -368,11 +985,14 @@ func (c *Client) Run(cfg Config) {
 						c.current.Item.NumTags, resp.TagCount)
 					c.current.Item.Status = errMsg
 					c.current.Item.TagCountFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeDone()
+					break
+				}
+				c.current.Item.TagCountFailed = false
+				if c.config().WriteTagBlocks {
+					c.state = RFIDWaitForTagIDs
+					c.sendToRFID(RFIDReq{Cmd: cmdReadIDs})
 					break
-				} else {
-					c.current.Item.TagCountFailed = false
 				}
 				c.state = RFIDWriting
 				c.sendToRFID(
@@ -381,179 +1001,1932 @@ func (c *Client) Run(cfg Config) {
 						TagCount: c.current.Item.NumTags})
 			case RFIDWriting:
 				if !resp.OK {
-					c.current.Item.WriteFailed = true
-					c.sendToKoha(c.current)
-					c.state = RFIDIdle
+					c.writeFailed("")
 					break
 				}
-				c.state = RFIDIdle
-				c.current.Item.WriteFailed = false
-				c.current.Item.Status = "OK, preget"
-				c.sendToKoha(c.current)
-				// TODO default case -> ERROR
-			}
-		case <-c.quit:
+				// Read the tag back, to verify that it was programmed
+				// with the requested barcode.
+				c.state = RFIDWaitForWriteVerify
+				c.rfid.Reset()
+				c.sendToRFID(RFIDReq{Cmd: cmdRereadTag})
+			case RFIDWaitForWriteVerify:
+				if !resp.OK {
+					c.writeFailed("Feil: fikk ikke lest brikken etter preging.")
+					break
+				}
+				got, err := c.hub.barcodes.normalize(resp.Tag)
+				if err != nil {
+					c.writeFailed(fmt.Sprintf("Feil: brikken ble preget med ugyldig strekkode: %v", err))
+					break
+				}
+				if got != c.current.Item.Barcode {
+					c.writeFailed(fmt.Sprintf("Feil: brikken ble preget med %s, forventet %s.",
+						got, c.current.Item.Barcode))
+					break
+				}
+				c.current.Item.WriteFailed = false
+				c.current.Item.Status = "OK, preget"
+				c.writeDone()
+			case RFIDWaitForTagIDs:
+				if !resp.OK || len(resp.TagIDs) != c.writing.Parts {
+					c.writeFailed("")
+					break
+				}
+				c.writeIDs = resp.TagIDs
+				c.writing.Part = 0
+				c.writeNextTag()
+			case RFIDWritingBlocks:
+				if !resp.OK {
+					c.writeFailed(fmt.Sprintf("Feil: fikk ikke preget brikke %d av %d.", c.writing.Part, c.writing.Parts))
+					break
+				}
+				c.state = RFIDWaitForBlocksVerify
+				c.sendToRFID(RFIDReq{Cmd: cmdReadBlocks, Data: []byte(c.writeIDs[0]), Blocks: c.writeBlocks})
+			case RFIDWaitForBlocksVerify:
+				if !resp.OK || resp.TagID != c.writeIDs[0] {
+					c.writeFailed(fmt.Sprintf("Feil: fikk ikke lest brikke %d av %d etter preging.", c.writing.Part, c.writing.Parts))
+					break
+				}
+				if n := badBlock(c.writeBlocks, resp.Blocks); n >= 0 {
+					c.writeFailed(fmt.Sprintf("Feil: blokk %d av brikke %d av %d ble ikke preget riktig.", n, c.writing.Part, c.writing.Parts))
+					break
+				}
+				if d, err := decodeTag(resp.Blocks); err == nil {
+					c.logger().Debug("tag written", "id", c.writeIDs[0], "barcode", d.Barcode, "part", d.Part, "parts", d.Parts)
+				}
+				c.writeIDs = c.writeIDs[1:]
+				c.writeNextTag()
+			case RFIDTestVersion:
+				c.rfid.Reset()
+				c.current.RFIDVersion = resp.Version
+				c.testStep("VERSION", resp.OK)
+				c.state = RFIDTestBeginScan
+				c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
+			case RFIDTestBeginScan:
+				// Scanning is stopped also if it failed to start, to leave
+				// the RFID-unit as it was. Tags read meanwhile are discarded.
+				c.testStep("BEGIN-SCAN", resp.OK)
+				c.state = RFIDTestEndScan
+				c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+			case RFIDTestEndScan:
+				c.testStep("END-SCAN", resp.OK)
+				if c.current.Item.Tag == "" || c.config().security(c.branch).Disabled {
+					c.testDone()
+					break
+				}
+				if c.config().UseAFI {
+					c.state = RFIDTestReadAFI
+					c.sendToRFID(RFIDReq{Cmd: cmdReadAFI, Data: []byte(c.current.Item.Tag)})
+					break
+				}
+				c.testAlarm(c.testSecurity == "UNSECURE")
+			case RFIDTestReadAFI:
+				// The alarm of a tag in an unknown state is left as is.
+				c.testStep("READ-AFI", resp.AFIRead)
+				if !resp.AFIRead {
+					c.testDone()
+					break
+				}
+				c.testSecurity = c.config().security(c.branch).securityState(resp.AFI)
+				if c.testSecurity != "SECURE" && c.testSecurity != "UNSECURE" {
+					c.current.Item.SecurityBefore = c.testSecurity
+					c.testDone()
+					break
+				}
+				c.testAlarm(c.testSecurity == "UNSECURE")
+			case RFIDTestAlarmOff:
+				c.testStep("ALARM-OFF", resp.OK)
+				if c.testSecurity == "UNSECURE" {
+					c.testDone()
+					break
+				}
+				c.testAlarm(true)
+			case RFIDTestAlarmOn:
+				c.testStep("ALARM-ON", resp.OK)
+				if c.testSecurity == "SECURE" {
+					c.testDone()
+					break
+				}
+				c.testAlarm(false)
+				// TODO default case -> ERROR
+			}
+		case <-c.closeReq:
+			c.closeRequested = true
+			c.sendToKoha(Message{Action: "CLOSE"})
+		case <-c.reconnected:
+			c.resumeRFID()
+		case <-timeout.C():
+			c.logger().Error("RFID-unit didn't respond in time")
+			c.sendToKoha(Message{Action: "CONNECT", RFIDError: true, ErrorCode: CodeRFIDTimeout,
+				ErrorMessage: "RFID-unit didn't respond in time"})
+			c.shutdown()
+		case <-missing.C():
+			// The items due are reported below, when no command is pending.
+		case <-grace.C():
+			if c.state == RFIDCheckinGrace {
+				c.state = RFIDWaitForCheckinReread
+				c.sendToRFID(RFIDReq{Cmd: cmdRereadTag})
+			}
+		case <-window.C():
+			c.inventoryDue = true
+		case <-idle.C():
+			if c.state == RFIDIdle || c.state.awaitsResponse() {
+				break
+			}
+			// Stop scanning, so that items of the next patron are not
+			// processed in the stale session.
+			c.logger().Info("session idle for too long, ending it", "timeout", cfg.SessionIdleTimeout)
+			c.sendToKoha(Message{Action: "TIMEOUT"})
+			c.state = RFIDWaitForEndOK
+			c.endRetries = 0
+			c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+		case <-deadman.C():
+			// Whatever the client waits for is not coming, and none of the
+			// other timeouts caught it; start afresh, as after a CANCEL.
+			c.logger().Error("client stuck, resetting it", "timeout", cfg.DeadmanTimeout)
+			c.sendToKoha(Message{Action: "CANCEL", ErrorCode: CodeClientReset,
+				ErrorMessage: fmt.Sprintf("client stuck for %v, and reset", cfg.DeadmanTimeout), Attention: c.abort(false)})
+			// Rearmed also if stuck again in the same state.
+			deadmanState = RFIDIdle
+		case <-c.ctx.Done():
 			//c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
-			c.wlock.Lock()
-			c.write(websocket.CloseMessage, []byte{})
-			c.wlock.Unlock()
+			c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			// Closing the connections makes readFromKoha and readFromRFID return.
+			c.closeConn()
+			c.closeRFID()
 			return
 		}
+
+		for (c.state == RFIDCheckin || c.state == RFIDCheckout) && c.reportMissingParts() {
+			// No command is pending, so the missing parts of incomplete
+			// sets collected for too long can be reported.
+		}
+
+		if n := len(c.items); cfg.MaxSessionItems > 0 && n >= cfg.MaxSessionItems &&
+			(c.state == RFIDCheckin || c.state == RFIDCheckout || c.state == RFIDExchange) {
+			// No command is pending, so the session can be ended. Koha
+			// is told first, so that it starts a new session when ended.
+			c.logger().Warn("session has too many items, ending it", "items", n, "max", cfg.MaxSessionItems)
+			c.sendToKoha(Message{Action: "SESSION-FULL",
+				ErrorMessage: fmt.Sprintf("Session has %d items, the maximum", n)})
+			c.state = RFIDWaitForEndOK
+			c.endRetries = 0
+			c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+		}
+
+		if c.inventoryDue && c.state == RFIDInventory {
+			// No command is pending, so scanning can be stopped, and the
+			// items read looked up.
+			c.inventoryDue = false
+			c.state = RFIDInventoryWaitForEndOK
+			c.endRetries = 0
+			c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+		}
+
+		if c.closeRequested && c.state != RFIDIdle && c.state != RFIDWaitForEndOK && !c.state.awaitsResponse() {
+			// No command is pending, so scanning can be stopped without
+			// leaving an item with the alarm in an unknown state.
+			c.state = RFIDWaitForEndOK
+			c.endRetries = 0
+			c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+		}
+
+		if c.state == RFIDIdle {
+			c.reloadSettings()
+			cfg = *c.config()
+		}
+		c.updateStatus()
+
+		stopTimer(timeout)
+		if cfg.RFIDResponseTimeout > 0 && c.state.awaitsResponse() {
+			timeout.Reset(cfg.RFIDResponseTimeout)
+		}
+		stopTimer(missing)
+		if d, ok := c.partsDue(); ok {
+			missing.Reset(d)
+		}
+		if !active.IsZero() {
+			// The timeout runs from when the message or response was got,
+			// however long it took to handle.
+			stopTimer(idle)
+			if cfg.SessionIdleTimeout > 0 && c.state != RFIDIdle {
+				idle.Reset(active.Add(cfg.SessionIdleTimeout).Sub(c.hub.clock.Now()))
+			}
+		}
+		if c.state != deadmanState {
+			deadmanState = c.state
+			stopTimer(deadman)
+			if cfg.DeadmanTimeout > 0 && c.state.awaitsResponse() {
+				deadman.Reset(cfg.DeadmanTimeout)
+			}
+		}
+	}
+}
+
+// stopTimer stops t and drains its channel, so that it can be safely reset.
+func stopTimer(t timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C():
+		default:
+		}
 	}
 }
 
-func (c *Client) initRFID(port string) (*bufio.Reader, bool) {
+// shutdown signals the client to shut down. It is safe to call any number
+// of times, from any goroutine.
+func (c *Client) shutdown() {
+	c.stop()
+}
+
+// closing reports whether the client is shutting down.
+func (c *Client) closing() bool {
+	select {
+	case <-c.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// patronAllowed reports whether the patron of msg may check out items,
+// telling Koha if not. In offline mode, the patron is not checked.
+func (c *Client) patronAllowed(msg Message) bool {
+	if msg.Patron == "" {
+		c.sendToKoha(Message{Action: msg.Action,
+			UserError: true, ErrorMessage: "Patron not supplied"})
+		return false
+	}
+	c.noBlock = msg.NoBlock || c.config().NoBlockCheckout
+	if c.noBlock {
+		// The patron cannot be checked offline; the SIP server
+		// reconciles the checkouts later.
+		c.logger().Info("checking out in offline mode", "patron", msg.Patron)
+		return true
+	}
+	patron, err := DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(msg.Branch), sipFormMsgPatronStatus(msg.Branch, msg.Patron, msg.PIN), c.config().localized(msg.Branch, patronStatusParse), c.IP)
+	if err != nil {
+		c.logger().Error("SIP call failed", "action", msg.Action, "err", err)
+		c.sendToKoha(Message{Action: msg.Action, SIPError: true, ErrorCode: sipErrorCode(err), ErrorMessage: err.Error()})
+		return false
+	}
+	if patron.PatronError {
+		patron.Action = msg.Action
+		c.sendToKoha(patron)
+		return false
+	}
+	return true
+}
+
+// sendItemEvent tells Koha about the item being checked in, as soon as its
+// SIP status is known, when Config.ItemEvents is set. The final message of
+// the item, sent when the alarm is changed, has the same barcode, so that
+// Koha can update the item instead of adding it again.
+func (c *Client) sendItemEvent(barcode string) {
+	if !c.config().ItemEvents {
+		return
+	}
+	c.current.Item.Barcode = barcode
+	c.sendToKoha(Message{Action: "ITEM", Item: c.current.Item})
+}
+
+// route tells Koha where to send the current item, when it has been checked
+// in to be sent in transit to another branch, with Config.TransitRouting.
+// The ROUTE message precedes the result of the checkin.
+func (c *Client) route() {
+	if !c.config().TransitRouting || !c.inTransit() || c.current.Item.TransactionFailed {
+		return
+	}
+	c.logger().Info("item to be sent in transit", "barcode", c.current.Item.Barcode, "to", c.current.Item.Transfer)
+	c.sendToKoha(Message{Action: "ROUTE", Item: c.current.Item})
+}
+
+// checkinDone tells Koha the result of the checkin of the current item. In
+// single checkin mode, scanning is stopped first, which ends the session,
+// and the result is sent when the RFID-unit has stopped, so that Koha can
+// start the next checkin right away. Scanning continues if items failed to
+// get their alarm turned on, so that they can be retried.
+func (c *Client) checkinDone() {
+	if c.config().CheckinMode != checkinSingle || len(c.failedAlarmOn) > 0 {
+		c.sendToKoha(c.current)
+		return
+	}
+	result := c.current
+	c.endResult = &result
+	c.state = RFIDWaitForEndOK
+	c.endRetries = 0
+	c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+}
+
+// checkinItem checks in the item read, whose tags are all on the RFID-unit,
+// and changes its alarm.
+func (c *Client) checkinItem(barcode string, resp RFIDResp) {
 	var err error
-	c.rfidLock.Lock()
-	defer c.rfidLock.Unlock()
-	c.rfidconn, err = net.Dial("tcp", net.JoinHostPort(c.IP, port))
+	c.current, err = DoSIPCallWithRetry(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgCheckin(c.branch, resp.Tag), c.config().localized(c.branch, checkinParse), c.IP, c.sipRetrying)
 	if err != nil {
-		log.Printf("ER [%s] RFID server tcp connect: %v", c.IP, err)
-		c.sendToKoha(Message{Action: "CONNECT", RFIDError: true, ErrorMessage: err.Error()})
-		return nil, false
+		c.itemSIPError("CHECKIN", barcode, resp.Tag, err)
+		c.state = RFIDWaitForCheckinAlarmLeave
+		return
+	}
+	c.current.Item.RSSI = resp.RSSI
+	c.sendItemEvent(barcode)
+	if c.current.Item.Blocked {
+		c.logger().Warn("item must be handled manually", "barcode", barcode, "reason", c.current.Item.Status)
+	}
+	if c.current.Item.Unknown {
+		// Koha is told to have the tag removed, as for an incomplete set,
+		// besides the failed checkin.
+		c.logger().Warn("unknown tag on RFID-unit", "tag", resp.Tag)
+		c.sendToKoha(unknownTag(barcode, resp))
 	}
-	// Init the RFID-unit with version command
-	var initError string
-	req := c.rfid.GenRequest(RFIDReq{Cmd: cmdInitVersion})
-	_, err = c.rfidconn.Write(req)
+	if c.current.Item.Unknown || c.current.Item.TransactionFailed || c.current.Item.Blocked {
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDWaitForCheckinAlarmLeave
+		return
+	}
+	metrics.checkins.Inc(c.branch)
+	c.items[barcode] = c.current
+	c.failedAlarmOn[barcode] = failedTag{tag: resp.Tag, uid: resp.TagID} // Store tag for potential retry
+	c.journal("CHECKIN", barcode, resp.Tag, stepSIP)
+	switch {
+	case c.alarmLeft(true):
+		// The alarm is not changed, so there is nothing to retry.
+		delete(c.failedAlarmOn, barcode)
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDWaitForCheckinAlarmKept
+	case c.inTransit() && c.config().security(c.branch).transitAlarm() == transitAlarmOff:
+		// The item is secured when checked in at its destination, so a
+		// failure is not retried.
+		delete(c.failedAlarmOn, barcode)
+		c.setAlarm(cmdAlarmOff, resp.Tag)
+		c.state = RFIDWaitForCheckinTransitAlarmOff
+	default:
+		c.setAlarm(cmdAlarmOn, resp.Tag)
+		c.state = RFIDWaitForCheckinAlarmOn
+	}
+}
+
+// checkoutItem checks out the item read, whose tags are all on the
+// RFID-unit, and turns off its alarm, after the checkout, or else before it
+// with checkoutAlarmBefore.
+func (c *Client) checkoutItem(barcode string, resp RFIDResp) {
+	if c.config().CheckoutAlarmOrder == checkoutAlarmBefore {
+		// The item is checked out when the RFID-unit has responded, see
+		// checkoutDesecured. The desecure is journaled first, so that an
+		// item left without alarm, but not checked out, is recovered at a
+		// crash.
+		resp.Barcode = barcode
+		c.desecured = resp
+		c.current = Message{}
+		c.journal("CHECKOUT", barcode, resp.Tag, stepDesecure)
+		c.setAlarm(cmdAlarmOff, resp.Tag)
+		c.state = RFIDWaitForCheckoutEarlyAlarmOff
+		return
+	}
+	req := sipFormMsgCheckoutAt(c.branch, c.patron, resp.Tag, c.noBlock, time.Now())
+	var err error
+	c.current, err = DoSIPCallWithRetry(c.ctx, *c.config(), c.sipPoolFor(c.branch), req, c.config().localized(c.branch, checkoutParse), c.IP, c.sipRetrying)
 	if err != nil {
-		initError = err.Error()
+		c.itemSIPError("CHECKOUT", barcode, resp.Tag, err)
+		c.state = RFIDWaitForCheckoutAlarmLeave
+		return
+	}
+	c.current.Item.RSSI = resp.RSSI
+	c.current.Action = "CHECKOUT"
+	if c.current.Item.Unknown || c.current.Item.TransactionFailed {
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDWaitForCheckoutAlarmLeave
+		return
+	}
+	metrics.checkouts.Inc(c.branch)
+	c.items[barcode] = c.current
+	c.failedAlarmOff[barcode] = failedTag{tag: resp.Tag, uid: resp.TagID} // Store tag for potential retry
+	c.journal("CHECKOUT", barcode, resp.Tag, stepSIP)
+	if c.alarmLeft(false) {
+		delete(c.failedAlarmOff, barcode)
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDWaitForCheckoutAlarmKept
+		return
 	}
-	log.Printf("-> [%s] %q", c.IP, string(req))
+	c.setAlarm(cmdAlarmOff, resp.Tag)
+	c.state = RFIDWaitForCheckoutAlarmOff
+}
 
-	r := bufio.NewReader(c.rfidconn)
-	b, err := r.ReadBytes('\r')
+// resendAlarmOn resends the alarm command of the current item, which failed
+// after it was checked in, with the block policy, until it has been resent
+// AlarmRetries times. It reports whether it was resent.
+func (c *Client) resendAlarmOn() bool {
+	if c.config().AlarmFailPolicy != alarmFailBlock || c.alarmResent >= c.config().AlarmRetries {
+		return false
+	}
+	tag, ok := c.failedAlarmOn[c.current.Item.Barcode]
+	if !ok {
+		return false
+	}
+	c.alarmResent++
+	c.logger().Warn("alarm failed, resending", "barcode", c.current.Item.Barcode, "attempt", c.alarmResent)
+	c.setTagAlarm(cmdRetryAlarmOn, tag)
+	return true
+}
+
+// revertCheckin checks the current item out again, with no block, to the
+// patron it was checked out to, as its alarm could not be turned on, so
+// that the ILS doesn't have it as returned. If it cannot, ex when the
+// checkin response didn't tell the patron, the item is kept for
+// RETRY-ALARM-ON.
+func (c *Client) revertCheckin() {
+	barcode := c.current.Item.Barcode
+	tag := c.failedAlarmOn[barcode]
+	if c.current.checkedOutTo == "" {
+		c.logger().Warn("cannot revert checkin, patron not known", "barcode", barcode)
+		return
+	}
+	res, err := DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgCheckoutAt(c.branch, c.current.checkedOutTo, tag.tag, true, time.Now()), checkoutParse, c.IP)
+	if err == nil && res.Item.TransactionFailed {
+		err = errors.New(res.Item.Status)
+	}
 	if err != nil {
-		initError = err.Error()
+		c.logger().Error("cannot revert checkin", "barcode", barcode, "err", err)
+		return
 	}
-	resp, err := c.rfid.ParseResponse(b)
+	c.logger().Warn("checkin reverted, as the alarm could not be turned on", "barcode", barcode)
+	delete(c.failedAlarmOn, barcode)
+	delete(c.items, barcode)
+	c.current.Item.TransactionFailed = true
+	c.current.Item.Status = "Feil: fikk ikke skrudd på alarm, innleveringen er angret."
+	c.current.ErrorCode = CodeCheckinReverted
+}
+
+// checkoutDone tells Koha the result of the checkout of the current item,
+// when its alarm has been turned off.
+func (c *Client) checkoutDone(resp RFIDResp) {
+	if !resp.OK {
+		// TODO unit-test for this
+		c.current.Item.AlarmOffFailed = true
+		c.current.Item.Status = "Feil: fikk ikke skrudd av alarm."
+	} else {
+		delete(c.failedAlarmOff, c.current.Item.Barcode)
+		c.current.Item.Status = ""
+		c.current.Item.AlarmOffFailed = false
+	}
+	c.sendToKoha(c.current)
+	c.journalResult("CHECKOUT")
+	c.emit(Event{Type: EventCheckoutComplete, Patron: c.patron, Item: c.current.Item})
+}
+
+// checkoutDesecured checks out the item whose alarm has been turned off
+// before its SIP checkout, with checkoutAlarmBefore, given the response to
+// the alarm command. If the checkout is denied, or fails, the alarm is
+// turned on again before Koha is told.
+func (c *Client) checkoutDesecured(alarm RFIDResp) {
+	read := c.desecured
+	c.desecured = RFIDResp{}
+	// The security of the tag is known from the alarm command, with UseAFI.
+	before, after := c.current.Item.SecurityBefore, c.current.Item.SecurityAfter
+
+	req := sipFormMsgCheckoutAt(c.branch, c.patron, read.Tag, c.noBlock, time.Now())
+	res, err := DoSIPCallWithRetry(c.ctx, *c.config(), c.sipPoolFor(c.branch), req, c.config().localized(c.branch, checkoutParse), c.IP, c.sipRetrying)
 	if err != nil {
-		initError = err.Error()
+		c.logger().Error("SIP call failed", "err", err)
+		res = Message{SIPError: true, ErrorCode: sipErrorCode(err), ErrorMessage: err.Error(),
+			Item: Item{Barcode: read.Barcode, TransactionFailed: true}}
 	}
-	log.Printf("<- [%s] %q", c.IP, string(b))
+	c.current = res
+	c.current.Action = "CHECKOUT"
+	c.current.Item.RSSI = read.RSSI
+	c.current.Item.SecurityBefore, c.current.Item.SecurityAfter = before, after
 
-	if initError == "" && !resp.OK {
-		initError = "RFID-unit responded with NOK"
+	if err != nil || c.current.Item.Unknown || c.current.Item.TransactionFailed {
+		if !alarm.OK {
+			// The alarm was never turned off.
+			c.journalResult("CHECKOUT")
+			c.sendToKoha(c.current)
+			return
+		}
+		c.logger().Warn("checkout denied, turning the alarm on again", "barcode", read.Barcode)
+		c.setAlarm(cmdAlarmOn, read.Tag)
+		c.state = RFIDWaitForCheckoutResecure
+		return
+	}
+	metrics.checkouts.Inc(c.branch)
+	c.items[read.Barcode] = c.current
+	c.failedAlarmOff[read.Barcode] = failedTag{tag: read.Tag, uid: read.TagID} // Store tag for potential retry
+	c.journal("CHECKOUT", read.Barcode, read.Tag, stepSIP)
+	c.checkoutDone(alarm)
+}
+
+// checkedIn reports whether the item with the given barcode has been
+// checked in, with its alarm turned on, in the current session. Incomplete
+// sets, and items whose alarm failed, are not, so they are handled again
+// when read again.
+func (c *Client) checkedIn(barcode string) bool {
+	item, ok := c.items[barcode]
+	_, alarmFailed := c.failedAlarmOn[barcode]
+	return ok && item.Action == "CHECKIN" && !item.Item.TagCountFailed && !alarmFailed
+}
+
+// ghostRead reports whether a tag read is a ghost: a tag read in the
+// previous session within Config.GhostReadWindow, which is probably still
+// lying on the RFID-unit. Other reads are recorded.
+func (c *Client) ghostRead(tag string) bool {
+	window := c.config().GhostReadWindow
+	if window <= 0 {
+		return false
+	}
+	now := c.hub.clock.Now()
+	if t, ok := c.lastRead[tag]; ok && t.Before(c.sessionReset) && now.Sub(t) < window {
+		return true
+	}
+	if c.lastRead == nil {
+		c.lastRead = make(map[string]time.Time)
+	}
+	c.lastRead[tag] = now
+	return false
+}
+
+// resetReads marks the end of a session, after which tags read in it are
+// ghosts, until Config.GhostReadWindow has passed. Older reads are forgotten.
+func (c *Client) resetReads() {
+	now := c.hub.clock.Now()
+	for tag, t := range c.lastRead {
+		if now.Sub(t) >= c.config().GhostReadWindow {
+			delete(c.lastRead, tag)
+		}
+	}
+	c.sessionReset = now
+}
+
+// alarmIncompleteSet keeps the current item, which the RFID-unit reports
+// as an incomplete set, for retries, and sends the alarm command configured
+// for incomplete sets, by default leaving the alarm as is. The state is set
+// to next, which waits for the response.
+func (c *Client) alarmIncompleteSet(barcode, tag string, next RFIDState) {
+	c.items[barcode] = c.current
+	switch c.incompleteAlarm() {
+	case incompleteAlarmOn:
+		c.setAlarm(cmdAlarmOn, tag)
+	case incompleteAlarmOff:
+		c.setAlarm(cmdAlarmOff, tag)
+	default:
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+	}
+	c.state = next
+}
+
+// unresolved returns the sorted barcodes of the items of the session whose
+// alarm failed to be changed, or which were read as incomplete sets.
+func (c *Client) unresolved() []string {
+	var barcodes []string
+	for barcode, item := range c.items {
+		_, failedOn := c.failedAlarmOn[barcode]
+		_, failedOff := c.failedAlarmOff[barcode]
+		if failedOn || failedOff || item.Item.TagCountFailed {
+			barcodes = append(barcodes, barcode)
+		}
+	}
+	sort.Strings(barcodes)
+	return barcodes
+}
+
+// incompleteAlarm returns the alarm command configured for incomplete sets
+// in the current transaction.
+func (c *Client) incompleteAlarm() string {
+	if c.current.Action == "CHECKIN" {
+		return c.config().CheckinIncompleteAlarm
+	}
+	return c.config().CheckoutIncompleteAlarm
+}
+
+// incompleteAlarmFailed marks the alarm of the current item as failed, if
+// it is an incomplete set whose alarm was to be changed, and resp is not
+// OK, ex because the AFI read back is not the one set.
+func (c *Client) incompleteAlarmFailed(resp RFIDResp) {
+	if resp.OK || !c.current.Item.TagCountFailed {
+		return
+	}
+	switch c.incompleteAlarm() {
+	case incompleteAlarmOn:
+		c.logger().Warn("alarm of incomplete set not turned on", "barcode", c.current.Item.Barcode)
+		c.current.Item.AlarmOnFailed = true
+	case incompleteAlarmOff:
+		c.logger().Warn("alarm of incomplete set not turned off", "barcode", c.current.Item.Barcode)
+		c.current.Item.AlarmOffFailed = true
+	}
+}
+
+// readSetInfo reads the part number and set size of a tag read as an
+// incomplete set, with Config.ReadSetInfo. The state is set to next, which
+// waits for the response.
+func (c *Client) readSetInfo(barcode string, resp RFIDResp, next RFIDState) {
+	c.setInfoBarcode = barcode
+	c.setInfoRead = resp
+	c.sendToRFID(RFIDReq{Cmd: cmdReadSetInfo, Data: []byte(resp.Tag)})
+	c.state = next
+}
+
+// setInfoPart returns the tag read whose set info was read, with its part
+// number, and collects it as a part of its item, or starts collecting the
+// parts of the current item. It reports whether the parts of the item are
+// collected; the read returned is OK if all are read.
+func (c *Client) setInfoPart(resp RFIDResp) (RFIDResp, bool) {
+	read := c.setInfoRead
+	if resp.OK {
+		read.Part = resp.Part
+	}
+	if c.parts[c.setInfoBarcode] == nil {
+		return read, c.startParts(c.setInfoBarcode, read)
+	}
+	read.OK = c.collectPart(c.setInfoBarcode, read)
+	return read, true
+}
+
+// setParts sets the number of parts of the current item to the set size
+// read from its tag, so that Koha can tell how many parts to look for. If
+// the RFID-unit couldn't read it, the number is left as is.
+func (c *Client) setParts(resp RFIDResp) {
+	if !resp.OK || resp.SetSize == 0 {
+		c.logger().Warn("cannot read set info of tag", "barcode", c.setInfoBarcode)
+		return
+	}
+	c.current.Item.NumTags = resp.SetSize
+}
+
+// journal records that the transaction of the item with the given barcode
+// has completed step, so that it can be reconciled after a crash.
+func (c *Client) journal(action, barcode, tag, step string) {
+	if step == stepSIP || step == stepDesecure {
+		c.journaled = barcode
+	}
+	r := journalRecord{Time: time.Now(), IP: c.IP, Branch: c.branch,
+		Action: action, Barcode: barcode, Tag: tag, Step: step}
+	if err := c.hub.journal.record(r); err != nil {
+		c.logger().Error("cannot write to journal", "err", err)
+	}
+}
+
+// journalResult records that the result of the transaction of the current
+// item has been sent to Koha, and whether its alarm could be changed.
+func (c *Client) journalResult(action string) {
+	step := stepDone
+	if c.current.Item.AlarmOnFailed || c.current.Item.AlarmOffFailed {
+		step = stepAlarmFail
 	}
+	c.journal(action, c.journaled, "", step)
+}
+
+// cancel aborts the transaction in progress, and tells Koha which items
+// may need manual attention. Scanning is stopped when the RFID-unit has
+// answered the pending command, if any, so that its response is not taken
+// as the response to END.
+func (c *Client) cancel() {
+	c.sendToKoha(Message{Action: "CANCEL", Attention: c.abort(true)})
+}
 
-	if initError != "" {
-		log.Printf("ER [%s] RFID initialization: %s", c.IP, initError)
-		c.sendToKoha(Message{Action: "CONNECT", RFIDError: true, ErrorMessage: initError})
+// abort forgets the transaction in progress, whatever the state, and stops
+// scanning; with drain, after the response to the pending command, if any,
+// otherwise right away. It returns the barcodes of the items which may need
+// manual attention: the item being written or getting its alarm changed,
+// and items which failed to get their alarm changed.
+func (c *Client) abort(drain bool) []string {
+	var attention []string
+	switch c.state {
+	case RFIDWriting, RFIDWaitForWriteVerify, RFIDWritingBlocks, RFIDWaitForBlocksVerify,
+		RFIDWaitForCheckinAlarmOn, RFIDWaitForCheckoutAlarmOff, RFIDWaitForExchangeAlarm,
+		RFIDWaitForRetryAlarmOn, RFIDWaitForRetryAlarmOff, RFIDWaitForCheckoutResecure,
+		RFIDWaitForCheckinTransitAlarmOff:
+		if c.current.Item.Barcode != "" {
+			attention = append(attention, c.current.Item.Barcode)
+		}
+	case RFIDWaitForCheckoutEarlyAlarmOff:
+		attention = append(attention, c.desecured.Barcode)
+	}
+	for _, failed := range []map[string]failedTag{c.failedAlarmOn, c.failedAlarmOff} {
+		for barcode := range failed {
+			// The current item may be among the failed ones
+			if len(attention) == 0 || attention[0] != barcode {
+				attention = append(attention, barcode)
+			}
+		}
+	}
+	switch c.state {
+	case RFIDWaitForCheckinAlarmOn, RFIDWaitForCheckinTransitAlarmOff, RFIDWaitForCheckinAlarmKept:
+		c.journal("CHECKIN", c.journaled, "", stepCancelled)
+	case RFIDWaitForCheckoutAlarmOff, RFIDWaitForCheckoutAlarmKept, RFIDWaitForCheckoutEarlyAlarmOff,
+		RFIDWaitForCheckoutResecure:
+		c.journal("CHECKOUT", c.journaled, "", stepCancelled)
+	case RFIDWaitForExchangeAlarm, RFIDWaitForExchangeAlarmKept:
+		c.journal(c.exchangeAction(), c.journaled, "", stepCancelled)
+	}
+	sort.Strings(attention)
+	if len(attention) > 0 {
+		c.logger().Warn("transaction cancelled, items may need attention", "barcodes", strings.Join(attention, ","))
+	}
+
+	if !drain {
+		// Otherwise the late response to the pending command is parsed as
+		// such; the next transaction resets the parser when it starts.
+		c.rfid.Reset()
+	}
+	c.patron = ""
+	c.current = Message{}
+	c.journaled = ""
+	c.desecured = RFIDResp{}
+	c.batch = nil
+	c.items = make(map[string]Message)
+	c.parts = nil
+	c.failedAlarmOn = make(map[string]failedTag)
+	c.failedAlarmOff = make(map[string]failedTag)
+	c.retryQueue = c.retryQueue[:0]
+	c.endResult = nil
+	c.alarmResent = 0
+	c.state = RFIDWaitForEndOK
+	c.endRetries = 0
+	c.abandonRFID(drain)
+	c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+	return attention
+}
+
+// testStep records the result of a step of a TEST of the RFID-unit.
+func (c *Client) testStep(step string, ok bool) {
+	c.current.TestReport = append(c.current.TestReport, TestStep{Step: step, OK: ok})
+}
+
+// testAlarm turns the alarm of the test tag on, or else off; the first
+// command toggles it, and the second restores its original state.
+func (c *Client) testAlarm(on bool) {
+	if on {
+		c.state = RFIDTestAlarmOn
+		c.setAlarm(cmdRetryAlarmOn, c.current.Item.Tag)
+		return
+	}
+	c.state = RFIDTestAlarmOff
+	c.setAlarm(cmdRetryAlarmOff, c.current.Item.Tag)
+}
+
+// testDone sends the report of a TEST of the RFID-unit to Koha. With the
+// AFI read back, the security of the test tag is given as it was before the
+// TEST, and after it was restored.
+func (c *Client) testDone() {
+	c.state = RFIDIdle
+	if c.current.Item.SecurityAfter != "" {
+		c.current.Item.SecurityBefore = c.testSecurity
+	}
+	for _, s := range c.current.TestReport {
+		if !s.OK {
+			c.current.ErrorCode = CodeRFIDNOK
+			c.current.ErrorMessage = "RFID-unit failed step " + s.Step
+			break
+		}
+	}
+	c.logger().Info("RFID-unit tested", "failed", c.current.ErrorMessage)
+	c.sendToKoha(c.current)
+	c.current = Message{}
+}
+
+// alarmLeft reports whether the alarm of the current item is left as is on
+// checkin, or else checkout, by the security policy of the branch.
+func (c *Client) alarmLeft(checkin bool) bool {
+	policy := c.config().security(c.branch)
+	if policy.MagneticUnsecured && c.current.Item.Magnetic {
+		return true
+	}
+	return checkin && policy.transitAlarm() == transitAlarmLeave && c.inTransit()
+}
+
+// inTransit returns true if the current item is to be sent to another branch.
+func (c *Client) inTransit() bool {
+	return c.current.Item.InTransit && c.current.Item.Transfer != c.branch
+}
+
+// setAlarm turns the alarm of the tag on or off, with cmd being one of the
+// alarm commands. With Config.UseAFI, the AFI of the tag is set instead,
+// and the response is handled by checkAFI. At branches with security
+// disabled, the alarm is left as is, and the transaction completes as if
+// the alarm was changed.
+func (c *Client) setAlarm(cmd RFIDCommand, tag string) {
+	c.setTagAlarm(cmd, failedTag{tag: tag})
+}
+
+// setTagAlarm is setAlarm of a tag whose UID may be known, ex one whose
+// alarm is retried. The commands carry the data of the tag, and its UID
+// for protocols able to address a tag by it; the default one is not.
+func (c *Client) setTagAlarm(cmd RFIDCommand, tag failedTag) {
+	policy := c.config().security(c.branch)
+	if policy.Disabled {
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		return
+	}
+	if !c.config().UseAFI {
+		c.sendToRFID(RFIDReq{Cmd: cmd, Data: []byte(tag.tag), UID: tag.uid})
+		return
+	}
+	req := RFIDReq{Cmd: cmdSetAFIUnsecure, Data: []byte(tag.tag), UID: tag.uid, AFI: policy.AFIUnsecure}
+	if cmd == cmdAlarmOn || cmd == cmdRetryAlarmOn {
+		req = RFIDReq{Cmd: cmdSetAFISecure, Data: []byte(tag.tag), UID: tag.uid, AFI: policy.AFISecure}
+	}
+	c.afi = afiCheck{step: afiReading, tag: tag.tag, want: req.AFI, set: req}
+	c.sendToRFID(RFIDReq{Cmd: cmdReadAFI, Data: req.Data, UID: req.UID})
+}
+
+// checkAFI handles the responses to setting the AFI of a tag. The AFI is
+// read before it is set, and read back after, and the security of the tag
+// before and after is given in the current item. It returns done=false
+// while waiting for the RFID-unit, otherwise a response which is OK only if
+// the tag has the wanted AFI.
+func (c *Client) checkAFI(resp RFIDResp) (RFIDResp, bool) {
+	policy := c.config().security(c.branch)
+	switch c.afi.step {
+	case afiReading:
+		// A tag whose AFI cannot be read may still be set.
+		if resp.AFIRead {
+			c.afi.before = policy.securityState(resp.AFI)
+		}
+		c.afi.step = afiSetting
+		c.sendToRFID(c.afi.set)
+		return resp, false
+	case afiSetting:
+		if !resp.OK {
+			c.afi.step = afiNone
+			c.current.Item.SecurityBefore = c.afi.before
+			c.current.Item.SecurityAfter = ""
+			return resp, true
+		}
+		c.afi.step = afiVerifying
+		c.sendToRFID(RFIDReq{Cmd: cmdReadAFI, Data: c.afi.set.Data, UID: c.afi.set.UID})
+		return resp, false
+	case afiVerifying:
+		c.afi.step = afiNone
+		c.current.Item.SecurityBefore = c.afi.before
+		c.current.Item.SecurityAfter = ""
+		if resp.AFIRead {
+			c.current.Item.SecurityAfter = policy.securityState(resp.AFI)
+		}
+		if !resp.AFIRead || resp.AFI != c.afi.want {
+			c.logger().Warn("AFI not set", "tag", c.afi.tag,
+				"want", fmt.Sprintf("%02X", c.afi.want), "got", fmt.Sprintf("%02X", resp.AFI))
+			resp.OK = false
+		}
+		return resp, true
+	}
+	return resp, true
+}
+
+// sipRetrying notifies Koha that a failed SIP call is being retried.
+func (c *Client) sipRetrying(err error) {
+	// Not a SIPError, as the transaction has not failed yet.
+	c.sendToKoha(Message{Action: "RETRYING", ErrorCode: sipErrorCode(err), ErrorMessage: err.Error()})
+}
+
+// closeRFID closes the connection to the RFID-unit, if any.
+func (c *Client) closeRFID() {
+	c.rfidLock.Lock()
+	defer c.rfidLock.Unlock()
+	if c.rfidconn != nil {
+		c.rfidconn.Close()
+	}
+}
+
+// requestClose asks the client to stop scanning as soon as no command is
+// pending, and to refuse new transactions. It does not block.
+func (c *Client) requestClose() {
+	select {
+	case c.closeReq <- struct{}{}:
+	default:
+	}
+}
+
+// updateStatus updates the status snapshot. It must only be called from Run.
+func (c *Client) updateStatus() {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.status = ClientStatus{
+		IP:             c.IP,
+		Branch:         c.branch,
+		State:          c.state,
+		Barcode:        c.current.Item.Barcode,
+		FailedAlarmOn:  len(c.failedAlarmOn),
+		FailedAlarmOff: len(c.failedAlarmOff),
+		RFIDVersion:    c.rfidVersion,
+	}
+}
+
+// setRFIDVersion records the firmware version of the RFID-unit.
+func (c *Client) setRFIDVersion(version string) {
+	c.statusLock.Lock()
+	c.rfidVersion = version
+	c.status.RFIDVersion = version
+	c.statusLock.Unlock()
+}
+
+// Status returns a snapshot of the client's state. It is safe to call from
+// any goroutine.
+func (c *Client) Status() ClientStatus {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	status := c.status
+	status.IP = c.IP
+	return status
+}
+
+// logger returns the client's Logger, with the current branch and state.
+// It must only be called from Run.
+func (c *Client) logger() *Logger {
+	return c.log.With("branch", c.branch, "state", c.state)
+}
+
+// retrying reports whether a RETRY-ALARM-ON/OFF is already in progress.
+func (c *Client) retrying() bool {
+	return c.state == RFIDWaitForRetryAlarmOn || c.state == RFIDWaitForRetryAlarmOff
+}
+
+// queueRetries queues all the barcodes in failed for retry.
+func (c *Client) queueRetries(failed map[string]failedTag) {
+	c.retryQueue = c.retryQueue[:0]
+	for barcode := range failed {
+		c.retryQueue = append(c.retryQueue, barcode)
+	}
+}
+
+// retryNext sends cmd to the RFID-unit for the next queued barcode, and makes
+// it the current item. It returns false if there is nothing left to retry.
+func (c *Client) retryNext(failed map[string]failedTag, cmd RFIDCommand) bool {
+	for len(c.retryQueue) > 0 {
+		barcode := c.retryQueue[0]
+		c.retryQueue = c.retryQueue[1:]
+		tag, ok := failed[barcode]
+		if !ok {
+			continue
+		}
+		c.current = c.items[barcode]
+		c.setTagAlarm(cmd, tag)
+		return true
+	}
+	return false
+}
+
+// partSet is an item read as an incomplete set, whose parts are collected
+// until all are read, with Config.MissingPartsTimeout.
+type partSet struct {
+	item     Message         // The item, as reported if parts are missing
+	tag      failedTag       // Tag first read, whose alarm is changed if parts are missing
+	seen     map[string]bool // Parts read, keyed by partKey
+	deadline time.Time       // When the missing parts are reported
+}
+
+// startParts starts collecting the parts of the current item, read as an
+// incomplete set, with Config.MissingPartsTimeout, if its number of parts
+// is known, and the parts can be told apart. Its alarm is left as is until
+// all parts are read, or its missing parts are reported; meanwhile it is
+// kept with the items, as an incomplete set. It reports whether collecting
+// started.
+func (c *Client) startParts(barcode string, resp RFIDResp) bool {
+	timeout := c.config().MissingPartsTimeout
+	if timeout <= 0 || c.current.Item.NumTags < 2 || partKey(resp) == "" {
+		return false
+	}
+	if c.parts == nil {
+		c.parts = make(map[string]*partSet)
+	}
+	c.parts[barcode] = &partSet{item: c.current, tag: failedTag{tag: resp.Tag, uid: resp.TagID},
+		seen: make(map[string]bool), deadline: c.hub.clock.Now().Add(timeout)}
+	c.items[barcode] = c.current
+	c.collectPart(barcode, resp)
+	return true
+}
+
+// partKey returns the key by which a part of a set is told apart from the
+// others: its part number, if read with Config.ReadSetInfo, or else its
+// UID. It returns "" if the part cannot be told apart.
+func partKey(resp RFIDResp) string {
+	if resp.Part > 0 {
+		return fmt.Sprintf("part %d", resp.Part)
+	}
+	return resp.TagID
+}
+
+// collectPart records a part read of the item with the given barcode,
+// whose parts are collected. It reports whether all parts are read, and
+// then stops collecting; the item is then handled as read complete.
+func (c *Client) collectPart(barcode string, resp RFIDResp) bool {
+	set := c.parts[barcode]
+	if key := partKey(resp); key != "" {
+		set.seen[key] = true
+	}
+	if len(set.seen) < set.item.Item.NumTags {
+		c.logger().Debug("part of set read", "barcode", barcode, "seen", len(set.seen), "expected", set.item.Item.NumTags)
+		return false
+	}
+	delete(c.parts, barcode)
+	delete(c.items, barcode)
+	return true
+}
+
+// reportMissingParts reports the first item whose parts have been
+// collected for Config.MissingPartsTimeout, as an incomplete set, with the
+// number of parts read of those expected. The alarm command configured for
+// incomplete sets is addressed to its tag, as no read awaits a response.
+// It reports whether an item was due.
+func (c *Client) reportMissingParts() bool {
+	now := c.hub.clock.Now()
+	var due []string
+	for barcode, set := range c.parts {
+		if !set.deadline.After(now) {
+			due = append(due, barcode)
+		}
+	}
+	if len(due) == 0 {
+		return false
+	}
+	sort.Strings(due)
+	set := c.parts[due[0]]
+	delete(c.parts, due[0])
+	c.current = set.item
+	c.current.Item.PartsSeen = len(set.seen)
+	c.items[due[0]] = c.current
+	c.logger().Warn("parts of set missing", "barcode", due[0], "seen", len(set.seen), "expected", set.item.Item.NumTags)
+	next := RFIDWaitForCheckinAlarmLeave
+	if c.state == RFIDCheckout {
+		next = RFIDWaitForCheckoutAlarmLeave
+	}
+	switch c.incompleteAlarm() {
+	case incompleteAlarmOn:
+		c.setTagAlarm(cmdRetryAlarmOn, set.tag)
+	case incompleteAlarmOff:
+		c.setTagAlarm(cmdRetryAlarmOff, set.tag)
+	default:
+		if c.state == RFIDCheckin {
+			c.current.Item.Date = ""
+			c.checkinDone()
+		} else {
+			c.sendToKoha(c.current)
+		}
+		return true
+	}
+	c.state = next
+	return true
+}
+
+// partsDue returns the time until the next item whose parts are collected
+// is due to be reported, or false if none is.
+func (c *Client) partsDue() (time.Duration, bool) {
+	now := c.hub.clock.Now()
+	var next time.Duration
+	for _, set := range c.parts {
+		if d := set.deadline.Sub(now); d > 0 && (next == 0 || d < next) {
+			next = d
+		}
+	}
+	return next, next > 0
+}
+
+// initRFID connects to and initializes the RFID-unit, retrying up to
+// Config.RFIDInitRetries times, and tells Koha the result on CONNECT. It
+// gives up if ctx is done while waiting to retry.
+func (c *Client) initRFID(ctx context.Context, port string) (*bufio.Reader, bool) {
+	conn, r, version, err := c.dialRFID(port)
+	for i := 1; err != nil && i <= c.config().RFIDInitRetries; i++ {
+		// The RFID-unit may still be booting, ex if powered on with the
+		// computer; Koha is told it is being waited for.
+		c.log.Warn("RFID initialization failed, retrying", "attempt", i, "wait", c.config().RFIDInitRetryWait, "err", err)
+		c.sendToKoha(Message{Action: "RETRYING", RFIDError: true, ErrorCode: rfidErrorCode(err), ErrorMessage: err.Error()})
+		select {
+		case <-time.After(c.config().RFIDInitRetryWait):
+		case <-ctx.Done():
+			return nil, false
+		}
+		conn, r, version, err = c.dialRFID(port)
+	}
+	if err != nil {
+		c.log.Error("RFID initialization failed", "err", err)
+		c.sendToKoha(Message{Action: "CONNECT", RFIDError: true, ErrorCode: rfidErrorCode(err), ErrorMessage: err.Error()})
 		return nil, false
 	}
+	c.rfidLock.Lock()
+	defer c.rfidLock.Unlock()
+	c.rfidconn = conn
+	c.setRFIDVersion(version)
 
-	log.Printf("OK [%s] RIFD connected & initialized", c.IP)
+	c.log.Info("RFID connected & initialized", "version", version)
 
 	// Notify UI of success:
-	c.sendToKoha(Message{Action: "CONNECT"})
+	c.sendToKoha(c.connected(version))
 	return r, true
 }
 
-func (c *Client) readFromKoha() {
+// dialRFID connects to the RFID-unit, and initializes it. The RFID-unit
+// is on the client's IP, unless another RFIDHost is configured.
+func (c *Client) dialRFID(port string) (net.Conn, *bufio.Reader, string, error) {
+	host := c.IP
+	if c.config().RFIDHost != "" {
+		host = c.config().RFIDHost
+	}
+	conn, err := c.hub.dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err := setRFIDConnOptions(conn, *c.config()); err != nil {
+		conn.Close()
+		return nil, nil, "", err
+	}
+	r, version, err := c.initRFIDConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, "", err
+	}
+	return conn, r, version, nil
+}
+
+// tcpOptions are the socket options of *net.TCPConn set on connections to
+// the RFID-units.
+type tcpOptions interface {
+	SetNoDelay(bool) error
+	SetKeepAlive(bool) error
+	SetKeepAlivePeriod(time.Duration) error
+}
+
+// setRFIDConnOptions sets the TCP options of cfg on a connection to an
+// RFID-unit. Connections which are not TCP are left as they are.
+func setRFIDConnOptions(conn net.Conn, cfg Config) error {
+	tc, ok := conn.(tcpOptions)
+	if !ok {
+		return nil
+	}
+	if err := tc.SetNoDelay(!cfg.RFIDNagle); err != nil {
+		return err
+	}
+	if cfg.RFIDKeepAlive <= 0 {
+		return tc.SetKeepAlive(false)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tc.SetKeepAlivePeriod(cfg.RFIDKeepAlive)
+}
+
+// initRFIDConn initializes the RFID-unit on conn with the version command,
+// and returns a reader for the following responses, and the firmware
+// version of the RFID-unit, if given.
+func (c *Client) initRFIDConn(conn net.Conn) (*bufio.Reader, string, error) {
+	// The RFID-unit may be reinitialized while Run uses c.rfid, so the
+	// handshake gets its own RFIDProtocol.
+	rfid := newRFIDProtocol(c.config().RFIDVendor)
+	req := rfid.GenRequest(RFIDReq{Cmd: cmdInitVersion})
+	c.hub.tracer.trace(c.IP, "->", req)
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return nil, "", err
+	}
+
+	r := getReader(conn)
+	var resp RFIDResp
+	b, err := c.readRFIDFrame(r)
+	if err == nil {
+		resp, err = rfid.ParseResponse(b)
+		if err == nil && !resp.OK {
+			err = errRFIDNOK
+		}
+	}
+	if err != nil {
+		putReader(r)
+		return nil, "", err
+	}
+	rtt := time.Since(sent)
+	metrics.rfidRTT.Observe(rtt)
+	c.log.Info("RFID-unit answered init command", "rtt", rtt, "nagle", c.config().RFIDNagle)
+	return r, resp.Version, nil
+}
+
+// readRFIDFrame reads a complete response from the RFID-unit, however it is
+// split up in transit. A final response without the terminator is returned
+// when the connection is closed.
+func (c *Client) readRFIDFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.ReadBytes(c.rfid.FrameEnd())
+	if err != nil && len(b) == 0 {
+		return nil, err
+	}
+	c.hub.tracer.trace(c.IP, "<-", b)
+	return b, nil
+}
+
+// reconnectRFID tries to reestablish a lost connection to the RFID-unit,
+// waiting longer between each attempt, see reconnectWait. It returns nil if
+// all attempts failed, if Config.RFIDReconnectMaxTime has passed, or if the
+// client disconnected, or ctx is done, in the meantime. Commands sent by Run
+// meanwhile are queued, and sent by Run when signalled on c.reconnected, so
+// that only Run uses c.rfid; the handshake has its own, see initRFIDConn.
+func (c *Client) reconnectRFID(ctx context.Context, cfg Config) (r *bufio.Reader) {
+	// Commands sent on the lost connection won't be answered.
+	c.rfidLock.Lock()
+	c.rfidRedialing = true
+	c.rfidPending, c.rfidQueue, c.rfidDrain = nil, nil, false
+	c.rfidLock.Unlock()
 	defer func() {
-		c.hub.Disconnect(c)
-		c.conn.Close()
+		if r != nil {
+			return
+		}
 		c.rfidLock.Lock()
-		if c.rfidconn != nil {
-			c.rfidconn.Close()
+		c.rfidRedialing = false
+		c.rfidQueue = nil
+		c.rfidLock.Unlock()
+	}()
+
+	start := time.Now()
+	for i := 1; i <= cfg.RFIDReconnectAttempts; i++ {
+		wait := reconnectWait(cfg, i, rand.Int63n)
+		if cfg.RFIDReconnectMaxTime > 0 && time.Since(start)+wait > cfg.RFIDReconnectMaxTime {
+			c.log.Warn("RFID reconnect given up", "attempts", i-1, "elapsed", time.Since(start))
+			return nil
 		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
+
+		c.rfidLock.Lock()
+		gone := c.rfidconn == nil
 		c.rfidLock.Unlock()
+		if gone {
+			return nil
+		}
+
+		conn, r, version, err := c.dialRFID(cfg.RFIDPort)
+		if err != nil {
+			c.log.Warn("RFID reconnect failed", "attempt", i, "err", err)
+			continue
+		}
+
+		c.rfidLock.Lock()
+		defer c.rfidLock.Unlock()
+		if c.rfidconn == nil {
+			putReader(r)
+			conn.Close()
+			return nil
+		}
+		c.rfidconn.Close()
+		c.rfidconn = conn
+		c.setRFIDVersion(version)
+		c.log.Info("RFID reconnected", "version", version)
+		metrics.reconnects.Inc("")
+		select {
+		case c.reconnected <- struct{}{}:
+		default:
+		}
+		return r
+	}
+	return nil
+}
+
+// reconnectWait returns the time to wait before the given attempt, from 1,
+// to reconnect to the RFID-unit: Config.RFIDReconnectWait, doubled for each
+// attempt up to Config.RFIDReconnectMaxWait, of which the second half is
+// random, given by rnd as rand.Int63n. A wait is thus never shorter than the
+// one before.
+func reconnectWait(cfg Config, attempt int, rnd func(int64) int64) time.Duration {
+	wait := cfg.RFIDReconnectWait
+	for i := 1; i < attempt; i++ {
+		if cfg.RFIDReconnectMaxWait > 0 && wait >= cfg.RFIDReconnectMaxWait || wait > math.MaxInt64/2 {
+			break
+		}
+		wait *= 2
+	}
+	if cfg.RFIDReconnectMaxWait > 0 && wait > cfg.RFIDReconnectMaxWait {
+		wait = cfg.RFIDReconnectMaxWait
+	}
+	if half := int64(wait / 2); half > 0 {
+		return wait - time.Duration(half) + time.Duration(rnd(half+1))
+	}
+	return wait
+}
+
+// readFromKoha reads the messages from Koha, and passes them to Run, until
+// the websocket is closed, or ctx is done. The client is then torn down,
+// unless it is suspended for Koha to resume the session.
+func (c *Client) readFromKoha(ctx context.Context) {
+	defer c.running.Done()
+	var closed bool // Koha closed the websocket cleanly, ex when the page was left
+	defer func() {
+		c.detach()
+		if c.hub.suspend(c) {
+			c.log.Info("websocket closed, waiting for Koha to resume the session", "window", c.config().WSResumeWindow)
+			return
+		}
+		if closed {
+			c.endScan()
+		}
+		c.teardown()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(c.hub.config.RFIDTimeout))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(c.hub.config.RFIDTimeout)); return nil })
+	done := make(chan struct{})
+	defer close(done)
+	c.running.Add(2)
+	go c.ping(done)
+	go c.retransmit(done)
+
+	c.connLock.Lock()
+	conn := c.conn
+	c.connLock.Unlock()
+	pongWait := c.config().pongWait()
+	conn.SetReadLimit(c.config().maxMessageSize())
+	if pongWait > 0 {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	}
+	var limiter *tokenBucket
+	if rate := c.config().WSRateLimit; rate > 0 {
+		limiter = newTokenBucket(rate, c.config().rateBurst(), time.Now())
+	}
+	var dropped int // Messages dropped since throttling started
 	for {
-		_, jsonMsg, err := c.conn.ReadMessage()
+		_, b, err := conn.ReadMessage()
 		if err != nil {
+			closed = websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
 			break
 		}
 		var msg Message
-		if err := json.Unmarshal(jsonMsg, &msg); err != nil {
-			log.Printf("ER [%s] unmarshal message: %v", c.IP, err)
+		err = c.wsFormat().unmarshal(b, &msg)
+		if err == nil && msg.Action == "ACK" {
+			// Acks are not limited, as Koha sends one for every message.
+			c.ack(msg.ID)
+			continue
+		}
+		if limiter != nil && !(err == nil && unlimitedActions[msg.Action]) {
+			if !limiter.allow(time.Now()) {
+				if dropped == 0 {
+					c.log.Warn("too many messages from Koha, throttling", "rate", c.config().WSRateLimit)
+				}
+				dropped++
+				metrics.throttled.Inc("")
+				action := msg.Action
+				if err != nil {
+					action = "CONNECT"
+				}
+				c.sendToKoha(Message{Action: action, UserError: true, ErrorCode: CodeThrottled,
+					ErrorMessage: "too many messages, message dropped"})
+				continue
+			}
+			if dropped > 0 {
+				c.log.Warn("throttling of messages from Koha ended", "dropped", dropped)
+				dropped = 0
+			}
+		}
+		if err != nil {
+			c.log.Warn("cannot unmarshal message from Koha", "err", err)
 			c.sendToKoha(Message{Action: "CONNECT", UserError: true, ErrorMessage: err.Error()})
 			continue
 		}
-		c.fromKoha <- msg
+		select {
+		case c.fromKoha <- msg:
+		case <-ctx.Done():
+			return
+		case <-time.After(c.config().stallTimeout()):
+			c.log.Error("client is stuck, not taking messages from Koha", "action", msg.Action)
+			c.shutdown()
+			return
+		}
+	}
+}
+
+// endScan tells the RFID-unit to stop scanning, if a transaction is in
+// progress, before its connection is closed, so that it isn't left scanning
+// when Koha is gone. The response is not waited for.
+func (c *Client) endScan() {
+	if s := c.Status().State; s == RFIDIdle || s == RFIDWaitForEndOK {
+		return
+	}
+	c.rfidLock.Lock()
+	defer c.rfidLock.Unlock()
+	if c.rfidconn == nil {
+		return
+	}
+	b := c.rfid.GenRequest(RFIDReq{Cmd: cmdEndScan})
+	c.hub.tracer.trace(c.IP, "->", b)
+	if _, err := c.rfidconn.Write(b); err != nil {
+		c.log.Warn("cannot stop RFID-unit from scanning", "err", err)
+		return
+	}
+	c.log.Info("websocket closed during transaction, RFID-unit told to stop scanning")
+}
+
+// teardown disconnects c from the hub, and closes its connections.
+func (c *Client) teardown() {
+	c.hub.Disconnect(c)
+	c.closeConn()
+	c.rfidLock.Lock()
+	if c.rfidconn != nil {
+		c.rfidconn.Close()
+		c.rfidconn = nil // Signals to reconnectRFID that the client is gone
+	}
+	c.rfidLock.Unlock()
+}
+
+// closeConn closes the websocket, which ends readFromKoha.
+func (c *Client) closeConn() {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	c.conn.Close()
+}
+
+// detach closes the websocket, and holds the messages to Koha until it
+// resumes the session, if it does.
+func (c *Client) detach() {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.detached = true
+	c.closeConn()
+}
+
+// attach binds c to conn, on which Koha resumes the session. Koha is told
+// that the session is resumed, and is sent the messages held meanwhile.
+func (c *Client) attach(conn *websocket.Conn) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.connLock.Lock()
+	c.conn = conn
+	c.connLock.Unlock()
+	c.detached = false
+	held := c.held
+	c.held = nil
+	c.send(c.connected(c.Status().RFIDVersion))
+	for _, b := range held {
+		if err := c.write(c.wsFormat().messageType(), b); err != nil {
+			c.log.Error("cannot send held message to Koha", "err", err)
+			return
+		}
 	}
 }
 
-// write writes a message with the given message type and payload.
+// ping pings Koha periodically, so that the read deadline is extended as
+// long as Koha answers with a pong. A failed ping closes the connection,
+// which ends readFromKoha. It runs until done is closed.
+func (c *Client) ping(done chan struct{}) {
+	defer c.running.Done()
+	pongWait := c.config().pongWait()
+	if pongWait <= 0 {
+		return
+	}
+	ticker := time.NewTicker((pongWait * 9) / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(websocket.PingMessage, nil); err != nil {
+				c.log.Error("websocket ping failed", "err", err)
+				c.closeConn()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// write writes a message with the given message type and payload. It is
+// safe to call from several goroutines.
 func (c *Client) write(mt int, payload []byte) error {
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.config().writeWait()))
 	return c.conn.WriteMessage(mt, payload)
 }
 
-func (c *Client) sendToKoha(msg Message) {
+// sendToKoha sends msg to Koha. With Config.WSAckTimeout, msg is given
+// the next ID, and is kept until Koha acknowledges it, to be retransmitted
+// by retransmit.
+func (c *Client) sendToKoha(msg Message) error {
+	if msg.RFIDError {
+		metrics.rfidErrors.Inc("")
+	}
+	if code := msg.errorCode(); code != "" {
+		c.emit(Event{Type: EventError, Action: msg.Action, ErrorCode: code, ErrorMessage: msg.ErrorMessage})
+	}
 	c.wlock.Lock()
 	defer c.wlock.Unlock()
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	w, err := c.conn.NextWriter(websocket.TextMessage)
-	if err != nil {
-		return
+	return c.send(msg)
+}
+
+// send sends msg to Koha like sendToKoha, or holds it if the websocket has
+// dropped. It must be called with wlock held.
+func (c *Client) send(msg Message) error {
+	msg.ErrorCode = msg.errorCode()
+	acks := c.config().WSAckTimeout > 0
+	if acks {
+		c.lastID++
+		msg.ID = c.lastID
 	}
-	b, err := json.Marshal(msg)
+	b, err := c.wsFormat().marshal(msg)
 	if err != nil {
-		log.Printf("ERR sendToKoha json.Marshal(msg): %v", err)
-		return
+		c.log.Error("cannot marshal message to Koha", "action", msg.Action, "id", msg.ID, "err", err)
+		return err
+	}
+	if c.detached {
+		c.held = append(c.held, b)
+	} else if err := c.write(c.wsFormat().messageType(), b); err != nil {
+		c.log.Error("cannot send message to Koha", "action", msg.Action, "id", msg.ID, "err", err)
+		return err
 	}
-	w.Write(b)
+	if acks {
+		if c.unacked == nil {
+			c.unacked = make(map[uint64]*unackedMsg)
+		}
+		c.unacked[msg.ID] = &unackedMsg{payload: b, sentAt: time.Now()}
+	}
+	return nil
+}
 
-	if err := w.Close(); err != nil {
+// ack removes the message with the given ID from the unacknowledged messages.
+func (c *Client) ack(id uint64) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	delete(c.unacked, id)
+}
+
+// retransmit resends messages which Koha hasn't acknowledged within
+// WSAckTimeout, up to WSAckRetries times. If a message is still not
+// acknowledged, Koha is considered gone, and the connection is closed,
+// which ends readFromKoha. It runs until done is closed.
+func (c *Client) retransmit(done chan struct{}) {
+	defer c.running.Done()
+	timeout := c.config().WSAckTimeout
+	if timeout <= 0 {
 		return
 	}
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.resendUnacked(timeout, c.config().WSAckRetries); err != nil {
+				c.log.Error("giving up on Koha", "err", err)
+				c.closeConn()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
 }
 
-func (c *Client) readFromRFID(r *bufio.Reader) {
+// resendUnacked resends, in order, the messages which have waited longer
+// than timeout for an ACK. It returns an error if a message has already
+// been resent retries times, or if it cannot be resent.
+func (c *Client) resendUnacked(timeout time.Duration, retries int) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	ids := make([]uint64, 0, len(c.unacked))
+	for id := range c.unacked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	now := time.Now()
+	for _, id := range ids {
+		m := c.unacked[id]
+		if now.Sub(m.sentAt) < timeout {
+			continue
+		}
+		if m.resent >= retries {
+			return fmt.Errorf("message %d not acknowledged after %d retransmits", id, m.resent)
+		}
+		m.resent++
+		m.sentAt = now
+		c.log.Warn("retransmitting message to Koha", "id", id, "attempt", m.resent)
+		if err := c.write(c.wsFormat().messageType(), m.payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFromRFID reads the responses from the RFID-unit, and passes them to
+// Run, reconnecting if the connection is lost, until ctx is done.
+func (c *Client) readFromRFID(ctx context.Context, r *bufio.Reader) {
+	defer c.running.Done()
+	defer func() { putReader(r) }()
+	parseErrors := 0 // Consecutive malformed responses
 	for {
-		b, err := r.ReadBytes('\r')
-		if err != nil && len(b) == 0 {
-			log.Printf("ER [%v] RFID server tcp read failed: %v", c.IP, err)
+		b, err := c.readRFIDFrame(r)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.log.Error("RFID read failed", "err", err)
+			if c.config().RFIDReconnectAttempts > 0 {
+				c.sendToKoha(Message{Action: "RECONNECTING", RFIDError: true, ErrorMessage: err.Error()})
+				if newR := c.reconnectRFID(ctx, *c.config()); newR != nil {
+					putReader(r)
+					r = newR
+					parseErrors = 0
+					c.sendToKoha(Message{Action: "CONNECT"})
+					continue
+				}
+			}
 			c.sendToKoha(Message{Action: "CONNECT", RFIDError: true, ErrorMessage: err.Error()})
-			c.quit <- true
+			c.shutdown()
 			break
 		}
-		log.Printf("<- [%v] %q", c.IP, string(b))
-
 		resp, err := c.rfid.ParseResponse(b)
+		if ignorableFrame(err) {
+			c.log.Warn("skipping frame from RFID-unit", "err", err)
+			metrics.discarded.Inc("")
+			continue
+		}
 		if err != nil {
-			log.Printf("ER [%v] %v", c.IP, err)
+			parseErrors++
+			if parseErrors <= c.config().RFIDParseErrors {
+				c.log.Warn("skipping malformed RFID response", "err", err, "consecutive", parseErrors)
+				metrics.discarded.Inc("")
+				continue
+			}
+			c.log.Error("cannot parse RFID response", "err", err)
 			c.sendToKoha(Message{Action: "CONNECT", RFIDError: true, ErrorMessage: err.Error()})
-			c.quit <- true // TODO really?
+			c.shutdown()
 			break
 		}
+		parseErrors = 0
 		select {
 		case c.fromRFID <- resp:
-		case <-time.After(time.Second * 3):
+		case <-ctx.Done():
+			return
+		case <-time.After(c.config().stallTimeout()):
+			c.log.Error("client is stuck, not taking responses from RFID-unit")
+			c.shutdown()
 			return
 		}
 	}
 }
 
+// sendToRFID sends a command to the RFID-unit. One command is in flight at
+// a time, so that responses cannot be mistaken for the response to another
+// command: if the RFID-unit hasn't responded to the previous command, req
+// is queued, and sent when it has. While reconnecting to the RFID-unit,
+// commands are queued until reconnected.
 func (c *Client) sendToRFID(req RFIDReq) {
-	b := c.rfid.GenRequest(req)
 	c.rfidLock.Lock()
 	defer c.rfidLock.Unlock()
+	if c.rfidRedialing {
+		c.log.Warn("RFID command queued until reconnected", "cmd", req.Cmd)
+		c.rfidQueue = append(c.rfidQueue, req)
+		return
+	}
+	if c.rfidPending != nil {
+		c.log.Warn("RFID command queued until the pending command is answered", "cmd", req.Cmd, "pending", c.rfidPending.Cmd)
+		c.rfidQueue = append(c.rfidQueue, req)
+		return
+	}
+	c.writeRFID(req)
+}
+
+// writeRFID writes a command to the RFID-unit, and makes it the pending
+// command. c.rfidLock must be held.
+func (c *Client) writeRFID(req RFIDReq) {
+	b := c.rfid.GenRequest(req)
 	if c.rfidconn == nil {
-		log.Println("?? RFID conn gone TODO investigate")
+		c.log.Error("RFID connection gone TODO investigate")
 		return
 	}
+	c.hub.tracer.trace(c.IP, "->", b)
 	_, err := c.rfidconn.Write(b)
 	if err != nil {
-		log.Printf("ER [%v] %v", c.IP, err)
+		c.log.Error("RFID write failed", "err", err)
 		c.sendToKoha(Message{Action: "CONNECT", RFIDError: true, ErrorMessage: err.Error()})
-		c.quit <- true
+		c.shutdown()
 		return
 	}
-	log.Printf("-> [%v] %q", c.IP, string(b))
+	c.rfidPending = &req
+	c.sentAt = time.Now()
 }
 
-func barcodeFromTag(tag string) string {
-	var barcode string
-	id := strings.Split(tag, ":")
-	if len(id) == 3 && id[2] == "02030000" {
-		barcode = strings.TrimPrefix(id[0], "10")
-	} else {
-		barcode = id[0]
+// resumeRFID sends the commands queued while reconnecting to the RFID-unit.
+func (c *Client) resumeRFID() {
+	c.rfidLock.Lock()
+	defer c.rfidLock.Unlock()
+	c.rfidRedialing = false
+	if c.rfidPending == nil && len(c.rfidQueue) > 0 {
+		next := c.rfidQueue[0]
+		c.rfidQueue = c.rfidQueue[1:]
+		c.writeRFID(next)
+	}
+}
+
+// abandonRFID forgets the queued commands, and the pending one. With drain,
+// the response to the pending command is awaited, and discarded, before the
+// next command is sent; otherwise the next command is sent right away, even
+// if the RFID-unit never answers the pending command.
+func (c *Client) abandonRFID(drain bool) {
+	c.rfidLock.Lock()
+	defer c.rfidLock.Unlock()
+	if c.rfidPending == nil {
+		c.rfidQueue = nil
+		return
+	}
+	c.logger().Warn("abandoning RFID command", "cmd", c.rfidPending.Cmd, "queued", len(c.rfidQueue), "drain", drain)
+	c.rfidQueue = nil
+	if drain {
+		c.rfidDrain = true
+		return
+	}
+	c.rfidPending, c.rfidDrain = nil, false
+}
+
+// rfidResponse correlates a response from the RFID-unit with the pending
+// command, and sends the next queued command, if any. It reports whether
+// the response is expected: the response to the pending command, or a tag
+// read while scanning, when no command is pending. A tag read while a
+// command is pending is held, and replayed when scanning again. Other
+// responses, ex a late or duplicate response to a command already
+// answered, are discarded.
+func (c *Client) rfidResponse(resp RFIDResp) bool {
+	c.rfidLock.Lock()
+	defer c.rfidLock.Unlock()
+	if c.rfidPending == nil {
+		if resp.tagRead() {
+			return true
+		}
+		c.logger().Warn("discarding RFID response, no command is pending", "resp", fmt.Sprintf("%+v", resp))
+		metrics.discarded.Inc("")
+		return false
+	}
+	if resp.tagRead() && c.rfidPending.Cmd != cmdRereadTag {
+		c.logger().Info("holding tag read while a command is pending", "tag", resp.Tag, "pending", c.rfidPending.Cmd)
+		c.heldReads = append(c.heldReads, resp)
+		return false
+	}
+	metrics.rfidRTT.Observe(time.Since(c.sentAt))
+	abandoned := c.rfidDrain
+	c.rfidPending, c.rfidDrain = nil, false
+	c.sentAt = time.Time{}
+	if len(c.rfidQueue) > 0 {
+		next := c.rfidQueue[0]
+		c.rfidQueue = c.rfidQueue[1:]
+		c.writeRFID(next)
+	}
+	if abandoned {
+		c.logger().Warn("discarding response to abandoned RFID command", "resp", fmt.Sprintf("%+v", resp))
+		metrics.discarded.Inc("")
+		return false
+	}
+	return true
+}
+
+// cleanTag removes control characters from the tag read, and fails if it
+// cannot be sent to the SIP server.
+func (c *Client) cleanTag(resp RFIDResp) (RFIDResp, error) {
+	cfg := c.config()
+	tag, err := cleanTag(resp.Tag, sipDelimiter, cfg.sipDelimiter(), cfg.sipTerminator())
+	if err != nil {
+		return resp, err
+	}
+	resp.Tag = tag
+	resp.Barcode = strings.Split(tag, ":")[0]
+	return resp, nil
+}
+
+// writeData returns the data to write to the tags of the item with the
+// given barcode: the number of tags, owner and country given by item, with
+// the owner and country defaulting to the configured ones.
+func (c *Client) writeData(barcode string, item Item) tagData {
+	d := tagData{Usage: usageCirculating, Parts: item.NumTags, Part: 1,
+		Barcode: barcode, Country: item.Country, Owner: item.Owner}
+	if d.Country == "" {
+		d.Country = c.config().countryCode()
+	}
+	if d.Owner == "" {
+		d.Owner = c.config().ownerLibrary()
+	}
+	return d
+}
+
+// startWrite starts writing c.writing to the tags of the current item, by
+// preparing the RFID-unit for writing.
+func (c *Client) startWrite() {
+	c.state = RFIDPreWriteStep1
+	c.rfid.Reset()
+	c.sendToRFID(RFIDReq{Cmd: cmdSLPLBN, Data: []byte(c.writing.Owner)})
+}
+
+// writeNextTag writes the data blocks of the next tag of the item being
+// written, or tells Koha that all its tags are written.
+func (c *Client) writeNextTag() {
+	if len(c.writeIDs) == 0 {
+		c.current.Item.WriteFailed = false
+		c.current.Item.Status = "OK, preget"
+		c.writeDone()
+		return
+	}
+	c.writing.Part++
+	blocks, err := encodeTag(c.writing)
+	if err != nil {
+		c.writeFailed(fmt.Sprintf("Feil: %v", err))
+		return
+	}
+	blocks = append(blocks, make([]byte, (c.config().tagBlockCount()-tagBlocks)*tagBlockSize)...)
+	c.writeBlocks = blocks
+	c.state = RFIDWritingBlocks
+	c.sendToRFID(RFIDReq{Cmd: cmdWriteBlocks, Data: []byte(c.writeIDs[0]), Blocks: blocks})
+}
+
+// writeFailed tells Koha that writing the tags of the current item failed,
+// with the given status, if any.
+func (c *Client) writeFailed(status string) {
+	c.current.Item.WriteFailed = true
+	if status != "" {
+		c.current.Item.Status = status
+	}
+	c.writeDone()
+}
+
+// writeDone tells Koha the result of writing the tags of the current item,
+// and moves on to the next item of a WRITE-BATCH, if any.
+func (c *Client) writeDone() {
+	c.state = RFIDIdle
+	c.sendToKoha(c.current)
+	if c.batch != nil {
+		c.batchWritten()
+	}
+}
+
+// rejectInvalidTag rejects a tag read which cannot be sent to the SIP
+// server, in the states where it would be. It returns false if the tag is
+// not looked up in the current state, and is to be handled as usual.
+func (c *Client) rejectInvalidTag(tag string, err error) bool {
+	switch c.state {
+	case RFIDCheckin, RFIDWaitForCheckinReread:
+		c.graceTag = ""
+		c.rejectTag("CHECKIN", tag, err)
+		c.state = RFIDWaitForCheckinAlarmLeave
+	case RFIDCheckout:
+		c.rejectTag("CHECKOUT", tag, err)
+		c.state = RFIDWaitForCheckoutAlarmLeave
+	case RFIDExchange:
+		c.rejectTag("CHECKIN-CHECKOUT", tag, err)
+		c.state = RFIDWaitForExchangeAlarmLeave
+	case RFIDRenew:
+		c.rejectTag("RENEW", tag, err)
+		c.state = RFIDWaitForRenewAlarmLeave
+	case RFIDItemInfo:
+		c.logger().Warn("invalid tag", "tag", tag, "err", err)
+		c.sendToKoha(Message{Action: "ITEM-INFO", Item: Item{Tag: tag, TransactionFailed: true, Status: err.Error()}})
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDItemInfoWaitForAlarmLeave
+	case RFIDManualAlarm:
+		c.rejectTag(c.current.Action, tag, err)
+		c.state = RFIDWaitForManualAlarm
+	case RFIDInventory:
+		c.logger().Warn("invalid tag", "tag", tag, "err", err)
+		c.readInventoryTag(inventoryTag{tag: tag, complete: true, err: err})
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDInventoryWaitForAlarmLeave
+	default:
+		return false
+	}
+	return true
+}
+
+// unknownTag returns the message telling Koha that the tag read is not of
+// any item, ex a foreign tag, and must be removed and investigated.
+func unknownTag(barcode string, resp RFIDResp) Message {
+	return Message{
+		Action: "UNKNOWN-TAG",
+		Item: Item{
+			Unknown: true,
+			Barcode: barcode,
+			Tag:     resp.Tag,
+			Status:  "ukjent brikke, må fjernes og undersøkes",
+			RSSI:    resp.RSSI,
+		},
+	}
+}
+
+// itemSIPError leaves the alarm of an item whose SIP call failed as is, so
+// that the rest of the items on the RFID-unit are handled. Koha is told of
+// the error, with the item, when the RFID-unit responds, and the item is
+// not kept, so that it is handled again when read again.
+func (c *Client) itemSIPError(action, barcode, tag string, err error) {
+	c.logger().Error("SIP call failed", "action", action, "barcode", barcode, "err", err)
+	c.current = Message{
+		Action:       action,
+		SIPError:     true,
+		ErrorCode:    sipErrorCode(err),
+		ErrorMessage: err.Error(),
+		Item: Item{
+			Barcode:           barcode,
+			Tag:               tag,
+			TransactionFailed: true,
+		},
+	}
+	c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+}
+
+// rejectTag leaves the alarm of a tag with an invalid barcode as is. Koha
+// is told why when the RFID-unit responds, and the tag is not kept for retries.
+func (c *Client) rejectTag(action, tag string, err error) {
+	c.logger().Warn("invalid barcode", "tag", tag, "err", err)
+	c.current = Message{
+		Action: action,
+		Item: Item{
+			Tag:               tag,
+			TransactionFailed: true,
+			Status:            err.Error(),
+		},
 	}
-	return barcode
+	c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
 }
@@ -2,16 +2,22 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"app/fake"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -128,6 +134,54 @@ func (a *dummyUIAgent) run() {
 	}
 }
 
+// waitForState waits for the only client of the hub to be in the given
+// state, as reported by GET /clients, which is updated right after the
+// client has handled a message.
+func waitForState(t *testing.T, want RFIDState) {
+	var got []ClientStatus
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		hub.ServeClients(rec, httptest.NewRequest("GET", "/clients", nil))
+		got = nil
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 1 && got[0].State == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("GET /clients => %+v; want client in state %v", got, want)
+}
+
+// connectedClient returns the client connected to the hub, of which there
+// must be one.
+func connectedClient(t *testing.T) *Client {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.clients) != 1 {
+		t.Fatalf("hub has %d clients; want 1", len(hub.clients))
+	}
+	for c := range hub.clients {
+		return c
+	}
+	return nil
+}
+
+// waitForExit waits for the goroutines of c to exit.
+func waitForExit(t *testing.T, c *Client) {
+	exited := make(chan struct{})
+	go func() {
+		c.running.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client goroutines didn't exit; leaked")
+	}
+}
+
 func port(s string) string {
 	return s[strings.LastIndex(s, ":")+1:]
 }
@@ -156,7 +210,7 @@ func TestMissingRFIDUnit(t *testing.T) {
 	// <- end setup
 
 	msg := <-uiChan
-	want := Message{Action: "CONNECT", RFIDError: true,
+	want := Message{Action: "CONNECT", ErrorCode: CodeRFIDDisconnected, RFIDError: true,
 		ErrorMessage: fmt.Sprintf("dial tcp 127.0.0.1:%s: connect: connection refused", hub.config.RFIDPort)}
 	if !reflect.DeepEqual(msg, want) {
 		t.Errorf("Got %+v; want %+v", msg, want)
@@ -197,31 +251,53 @@ func TestRFIDUnitInitVersionFailure(t *testing.T) {
 	d.write([]byte("NOK\r"))
 
 	got := <-uiChan
-	want := Message{Action: "CONNECT", RFIDError: true, ErrorMessage: "RFID-unit responded with NOK"}
+	want := Message{Action: "CONNECT", ErrorCode: CodeRFIDNOK, RFIDError: true, ErrorMessage: "RFID-unit responded with NOK"}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("Got %+v; want %+v", got, want)
 		t.Fatal("UI didn't get notified of failed RFID connect")
 	}
 }
 
-func TestUnavailableSIPServer(t *testing.T) {
-	// Setup: ->
-
+// Verify that the initialization of an RFID-unit still booting is retried,
+// and that Koha is told so.
+func TestRFIDInitRetry(t *testing.T) {
 	uiChan := make(chan Message)
-	sipSrv := newSIPTestServer().Failing()
+	sipSrv := newSIPTestServer()
 	defer sipSrv.Close()
 
 	srv := httptest.NewServer(nil)
 	defer srv.Close()
 
-	d := newDummyRFIDReader()
-	defer d.Close()
+	// The RFID-unit refuses the first init, and accepts the second
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	inits := make(chan string, 2)
+	go func() {
+		for _, resp := range []string{"NOK\r", "OK\r"} {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			msg, err := bufio.NewReader(c).ReadString('\r')
+			if err != nil {
+				return
+			}
+			inits <- msg
+			c.Write([]byte(resp))
+		}
+	}()
 
 	hub = newHub(Config{
-		HTTPPort:    port(srv.URL),
-		SIPServer:   sipSrv.Addr(),
-		RFIDPort:    port(d.addr()),
-		RFIDTimeout: 1 * time.Second,
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		RFIDPort:          port(ln.Addr().String()),
+		RFIDTimeout:       1 * time.Second,
+		RFIDInitRetries:   2,
+		RFIDInitRetryWait: 10 * time.Millisecond,
 	})
 	defer hub.Close()
 
@@ -230,33 +306,139 @@ func TestUnavailableSIPServer(t *testing.T) {
 
 	// <- end setup
 
-	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
-		t.Fatal("RFID-unit didn't get version init command")
+	got := <-uiChan
+	want := Message{Action: "RETRYING", ErrorCode: CodeRFIDNOK, RFIDError: true, ErrorMessage: "RFID-unit responded with NOK"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v; want %+v", got, want)
 	}
-	d.write([]byte("OK\r"))
-	<-uiChan
-	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN"}`)); err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
+	got = <-uiChan
+	want = Message{Action: "CONNECT", Protocol: maxProtocolVersion, MinProtocol: minProtocolVersion, MaxProtocol: maxProtocolVersion}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v; want %+v", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		if msg := <-inits; msg != "VER2.00\r" {
+			t.Errorf("RFID-unit got %q on attempt %d; want version init command", msg, i+1)
+		}
 	}
+}
 
-	if msg := <-d.incoming; string(msg) != "BEG\r" {
-		t.Fatal("UI -> CHECKIN: RFID-unit didn't get instructed to start scanning")
+func TestRFIDInitFragmentedResponse(t *testing.T) {
+	tests := []struct {
+		parts   []string
+		version string
+	}{
+		{[]string{"O", "K", "\r"}, ""},
+		{[]string{"O", "K|RFID-U ", "2.03.18", "\r"}, "RFID-U 2.03.18"},
 	}
-	d.write([]byte("OK\r"))
-	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
+	for _, tt := range tests {
+		conn, unit := net.Pipe()
+
+		go func(parts []string) {
+			r := bufio.NewReader(unit)
+			if _, err := r.ReadBytes('\r'); err != nil {
+				return
+			}
+			// Deliver the version response split across several writes
+			for _, part := range parts {
+				unit.Write([]byte(part))
+			}
+			unit.Write([]byte("OKR\r"))
+		}(tt.parts)
+
+		c := &Client{log: logger, hub: &Hub{}, rfid: newRFIDManager()}
+		r, version, err := c.initRFIDConn(conn)
+		if err != nil {
+			t.Fatalf("initRFIDConn() => %v; want successful init", err)
+		}
+		if version != tt.version {
+			t.Errorf("initRFIDConn() version => %q; want %q", version, tt.version)
+		}
 
-	got := <-uiChan
-	got.ErrorMessage = "" // No way to know the os-assigned port number in error message
-	want := Message{Action: "CONNECT", SIPError: true}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get notified of SIP error")
+		// The following response is read as a separate frame
+		b, err := c.readRFIDFrame(r)
+		if err != nil || string(b) != "OKR\r" {
+			t.Errorf("readRFIDFrame() => %q, %v; want %q", b, err, "OKR\r")
+		}
+		putReader(r)
+		conn.Close()
+		unit.Close()
+	}
+}
+
+func TestRFIDCommandQueue(t *testing.T) {
+	conn, unit := net.Pipe()
+	defer conn.Close()
+	defer unit.Close()
+
+	cmds := make(chan string, 10)
+	go func() {
+		r := bufio.NewReader(unit)
+		for {
+			b, err := r.ReadBytes('\r')
+			if err != nil {
+				return
+			}
+			cmds <- string(b)
+		}
+	}()
+	next := func() string {
+		select {
+		case cmd := <-cmds:
+			return cmd
+		case <-time.After(100 * time.Millisecond):
+			return ""
+		}
+	}
+
+	c := &Client{log: logger, hub: &Hub{}, rfid: newRFIDManager(), rfidconn: conn}
+	discarded := metrics.discarded.Value("")
+
+	// A command issued before the previous is answered is queued.
+	c.sendToRFID(RFIDReq{Cmd: cmdAlarmOn})
+	c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+	if cmd := next(); cmd != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", cmd)
+	}
+	if cmd := next(); cmd != "" {
+		t.Fatalf("RFID-unit got %q before OK1 was answered; want nothing", cmd)
 	}
 
+	// A tag read doesn't answer the pending command; it is held until
+	// scanning again.
+	read := RFIDResp{OK: true, Tag: "1003010824124004:NO:02030000", Barcode: "1003010824124004"}
+	if c.rfidResponse(read) {
+		t.Error("tag read while OK1 is pending was accepted; want held")
+	}
+	if !reflect.DeepEqual(c.heldReads, []RFIDResp{read}) {
+		t.Errorf("held reads => %+v; want %+v", c.heldReads, []RFIDResp{read})
+	}
+	if cmd := next(); cmd != "" {
+		t.Fatalf("RFID-unit got %q after tag read; want nothing", cmd)
+	}
+
+	// The response sends the queued command.
+	if !c.rfidResponse(RFIDResp{OK: true}) {
+		t.Error("response to OK1 was discarded; want accepted")
+	}
+	if cmd := next(); cmd != "END\r" {
+		t.Fatalf("RFID-unit got %q; want END", cmd)
+	}
+	if !c.rfidResponse(RFIDResp{OK: true}) {
+		t.Error("response to END was discarded; want accepted")
+	}
+
+	// A late or duplicate response is discarded.
+	if c.rfidResponse(RFIDResp{OK: true}) {
+		t.Error("duplicate response was accepted; want discarded")
+	}
+	if n := metrics.discarded.Value(""); n != discarded+1 {
+		t.Errorf("discarded counter => %d; want %d", n, discarded+1)
+	}
 }
 
-func TestCheckins(t *testing.T) {
-	// Setup: ->
+func TestRFIDDuplicateResponse(t *testing.T) {
+	// setup ->
 
 	uiChan := make(chan Message)
 	sipSrv := newSIPTestServer()
@@ -281,142 +463,209 @@ func TestCheckins(t *testing.T) {
 
 	// <- end setup
 
-	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
-		t.Fatal("RFID-unit didn't get version init command")
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
 	}
+	<-d.incoming // BEG
+	// BEG is answered twice, ex by a late response to an earlier BEG.
+	d.write([]byte("OK\rOK\r"))
 
+	// The checkin proceeds as if BEG was answered once.
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	// A repeated tag read, while OK1 is pending, is held until OK1 is
+	// answered, and is then not checked in again.
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
 	d.write([]byte("OK\r"))
 
-	// Verify that UI get's CONNECT message
 	got := <-uiChan
-	want := Message{Action: "CONNECT"}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get notified of succesfull rfid connect")
+	if got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" || got.Item.AlarmOnFailed {
+		t.Errorf("Got %+v; want CHECKIN of 03010824124004 with alarm on", got)
 	}
-
-	// Send "CHECKIN" message from UI and verify that the UI gets notified of
-	// succesfull connect & RFID-unit that gets instructed to starts scanning for tags.
-	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
-	if err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Fatalf("RFID-unit got %q; want alarm left as is for the repeated read", msg)
 	}
+	d.write([]byte("OK\r"))
 
-	if msg := <-d.incoming; string(msg) != "BEG\r" {
-		t.Fatal("UI -> CHECKIN: RFID-unit didn't get instructed to start scanning")
+	// The client is still scanning, and handles the next item. An item read
+	// while its alarm is being turned on is handled after it.
+	sipSrv.Respond("101YNN20140226    161239AO|AB03011063175001|AQhutl|AJCat's cradle|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1 for the next item", msg)
 	}
-
-	// acknowledge BEG command
+	d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+	sipSrv.Respond("101YNN20140226    161239AO|AB03011174511003|AQhutl|AJKrutt-Kim|\r")
 	d.write([]byte("OK\r"))
-
-	// Simulate found book on RFID-unit. Verify that it get's checked in through
-	// SIP, the Alarm turned on, and that UI get's notified of the transaction
-	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CTfbol|AA2|CS927.8|\r")
-	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
-
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03011063175001" {
+		t.Errorf("Got %+v; want CHECKIN of 03011063175001", got)
+	}
 	if msg := <-d.incoming; string(msg) != "OK1\r" {
-		t.Errorf("Checkin: RFID reader didn't get instructed to turn on alarm")
+		t.Fatalf("RFID-unit got %q; want OK1 for the item read meanwhile", msg)
 	}
-	// simulate failed alarm command
-	d.write([]byte("NOK\r"))
-
-	got = <-uiChan
-	want = Message{Action: "CHECKIN",
-		Item: Item{
-			Label:         "Heavy metal in Baghdad",
-			Barcode:       "03010824124004",
-			Date:          "26/02/2014",
-			AlarmOnFailed: true,
-			Transfer:      "fbol",
-			Status:        "Feil: fikk ikke skrudd på alarm.",
-		}}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct message after checkin")
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03011174511003" {
+		t.Errorf("Got %+v; want CHECKIN of 03011174511003", got)
 	}
+}
 
-	// retry alarm on
-	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-ON"}`))
-	if err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
-	}
+func TestUnavailableSIPServer(t *testing.T) {
+	// Setup: ->
 
-	if msg := <-d.incoming; string(msg) != "ACT1003010824124004:NO:02030000\r" {
-		t.Fatal("UI -> RETRY-ALARM-ON didn't trigger the right RFID command")
-	}
-	d.write([]byte("OK\r"))
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer().Failing()
+	defer sipSrv.Close()
 
-	got = <-uiChan
-	want = Message{Action: "CHECKIN",
-		Item: Item{
-			Label:   "Heavy metal in Baghdad",
-			Barcode: "03010824124004",
-			Date:    "26/02/2014",
-		}}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct message after checkin retry alarm on")
-	}
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
 
-	// Simulate barcode not in our db
+	d := newDummyRFIDReader()
+	defer d.Close()
 
-	sipSrv.Respond("100NUY20140128    114702AO|AB1234|CV99|AFItem not checked out|\r")
-	d.write([]byte("RDT1234:NO:02030000|0\r"))
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
 
-	if msg := <-d.incoming; string(msg) != "OK \r" {
-		t.Errorf("Alarm was changed after unsuccessful checkin")
-	}
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
 
-	d.write([]byte("OK\r"))
+	// <- end setup
 
-	got = <-uiChan
-	want = Message{Action: "CHECKIN",
-		Item: Item{
-			Barcode:           "1234",
-			TransactionFailed: true,
-			Unknown:           true,
-			Status:            "eksemplaret finnes ikke i basen",
-		}}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
 	}
 
-	// Simulate book on RFID-unit, but with missing tags. Verify that UI gets
-	// notified with the books title, along with an error message
-	sipSrv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatal("UI -> CHECKIN: RFID-unit didn't get instructed to start scanning")
+	}
+	d.write([]byte("OK\r"))
 	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
 
+	// The error is of the item, whose alarm is left as is, and the session
+	// goes on.
 	if msg := <-d.incoming; string(msg) != "OK \r" {
-		t.Error("Alarm was changed after unsuccessful checkin")
+		t.Errorf("RFID-unit got %q after SIP error; want alarm left as is", msg)
 	}
 	d.write([]byte("OK\r"))
-
-	got = <-uiChan
-	want = Message{Action: "CHECKIN",
-		Item: Item{
-			Label:             "Heavy metal in Baghdad",
-			Barcode:           "03010824124004",
-			TransactionFailed: true,
-		}}
+	got := <-uiChan
+	got.ErrorMessage = "" // No way to know the os-assigned port number in error message
+	want := Message{Action: "CHECKIN", ErrorCode: CodeSIPUnavailable, SIPError: true,
+		Item: Item{Barcode: "03010824124004", Tag: "1003010824124004:NO:02030000", TransactionFailed: true}}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct message when item is missing tags")
+		t.Fatal("UI didn't get notified of SIP error")
 	}
-
-	// Verify that the RFID-unit gets END message when the corresponding
-	// websocket connection is closed.
-
-	// TODO I'm closing connection before, is this necessary?
-	// msg = <-d.incoming
-	// if string(msg) != "END\r" {
-	// 	t.Fatal("RFID-unit didn't get END message when UI connection was lost")
-	// }
-
 }
 
-func TestCheckouts(t *testing.T) {
+// Verify that a SIP call failing for one item of a batch checkin or
+// checkout is reported for that item, and that the rest of the batch is
+// checked in or out.
+func TestItemSIPError(t *testing.T) {
+	type read struct {
+		tag   string
+		resp  string // SIP response, or "" if the SIP call fails
+		alarm string // Alarm command sent to the RFID-unit
+		want  Message
+	}
+	for _, batch := range []struct {
+		action string
+		msg    string // Message from Koha starting the batch
+		reads  []read
+	}{
+		{"CHECKIN", `{"Action":"CHECKIN","Branch":"fmaj"}`, []read{
+			{"1003010824124004:NO:02030000", "101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r", "OK1\r",
+				Message{Action: "CHECKIN", Item: Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", Date: "26/02/2014"}}},
+			{"1003011063175001:NO:02030000", "", "OK \r",
+				Message{Action: "CHECKIN", SIPError: true, ErrorCode: CodeSIPUnavailable,
+					Item: Item{Barcode: "03011063175001", Tag: "1003011063175001:NO:02030000", TransactionFailed: true}}},
+			{"1003011174511003:NO:02030000", "101YNN20140226    161239AO|AB03011174511003|AQfmaj|AJKrutt-Kim|\r", "OK1\r",
+				Message{Action: "CHECKIN", Item: Item{Label: "Krutt-Kim", Barcode: "03011174511003", Date: "26/02/2014"}}},
+		}},
+		{"CHECKOUT", `{"Action":"CHECKOUT","Patron":"95","Branch":"fmaj"}`, []read{
+			{"1003010824124004:NO:02030000", "121NNY20140303    110236AOfmaj|AA95|AB03010824124004|AJHeavy metal in Baghdad|AH20140331    235900|\r", "OK0\r",
+				Message{Action: "CHECKOUT", Item: Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", Date: "31/03/2014"}}},
+			{"1003011063175001:NO:02030000", "", "OK \r",
+				Message{Action: "CHECKOUT", SIPError: true, ErrorCode: CodeSIPUnavailable,
+					Item: Item{Barcode: "03011063175001", Tag: "1003011063175001:NO:02030000", TransactionFailed: true}}},
+			{"1003011174511003:NO:02030000", "121NNY20140303    110236AOfmaj|AA95|AB03011174511003|AJKrutt-Kim|AH20140331    235900|\r", "OK0\r",
+				Message{Action: "CHECKOUT", Item: Item{Label: "Krutt-Kim", Barcode: "03011174511003", Date: "31/03/2014"}}},
+		}},
+	} {
+		t.Run(batch.action, func(t *testing.T) {
+			// Setup: ->
+
+			uiChan := make(chan Message)
+			sipSrv := newSIPTestServer()
+			defer sipSrv.Close()
+
+			srv := httptest.NewServer(nil)
+			defer srv.Close()
+
+			d := newDummyRFIDReader()
+			defer d.Close()
+
+			hub = newHub(Config{
+				HTTPPort:    port(srv.URL),
+				SIPServer:   sipSrv.Addr(),
+				RFIDPort:    port(d.addr()),
+				RFIDTimeout: 1 * time.Second,
+			})
+			defer hub.Close()
+
+			a := newDummyUIAgent(uiChan, port(srv.URL))
+			defer a.c.Close()
+
+			// <- end setup
+
+			<-d.incoming // VER2.00
+			d.write([]byte("OK\r"))
+			<-uiChan // CONNECT
+			sipSrv.Respond("24              00020140303    110236AOfmaj|AA95|AEPatron|BLY|\r")
+			if err := a.c.WriteMessage(websocket.TextMessage, []byte(batch.msg)); err != nil {
+				t.Fatal("UI failed to send message over websokcet conn")
+			}
+			<-d.incoming // BEG
+			d.write([]byte("OK\r"))
+
+			for _, tt := range batch.reads {
+				if tt.resp == "" {
+					sipSrv.FailNext(2) // The call is tried twice
+				} else {
+					sipSrv.Respond(tt.resp)
+				}
+				d.write([]byte("RDT" + tt.tag + "|0\r"))
+				if msg := <-d.incoming; string(msg) != tt.alarm {
+					t.Errorf("RFID-unit got %q for %s; want %q", msg, tt.tag, tt.alarm)
+				}
+				d.write([]byte("OK\r"))
+				got := <-uiChan
+				got.ErrorMessage = "" // No way to know the os-assigned port number in error message
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Got %+v; want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
 
-	// setup ->
+func TestRFIDResponseTimeout(t *testing.T) {
+	// Setup: ->
 
 	uiChan := make(chan Message)
 	sipSrv := newSIPTestServer()
@@ -429,11 +678,11 @@ func TestCheckouts(t *testing.T) {
 	defer d.Close()
 
 	hub = newHub(Config{
-		HTTPPort:       port(srv.URL),
-		SIPServer:      sipSrv.Addr(),
-		RFIDPort:       port(d.addr()),
-		LogSIPMessages: true,
-		RFIDTimeout:    1 * time.Second,
+		HTTPPort:            port(srv.URL),
+		SIPServer:           sipSrv.Addr(),
+		RFIDPort:            port(d.addr()),
+		RFIDTimeout:         1 * time.Second,
+		RFIDResponseTimeout: 50 * time.Millisecond,
 	})
 	defer hub.Close()
 
@@ -442,113 +691,4881 @@ func TestCheckouts(t *testing.T) {
 
 	// <- end setup
 
-	// TESTS /////////////////////////////////////////////////////////////////
-
 	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
 		t.Fatal("RFID-unit didn't get version init command")
 	}
 	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
 
-	got := <-uiChan
-	want := Message{Action: "CONNECT"}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get notified of succesfull rfid connect")
-	}
-
-	// Send "CHECKOUT" message from UI and verify that the UI gets notified of
-	// succesfull connect & RFID-unit that gets instructed to starts scanning for tags.
-	if err := a.c.WriteMessage(
-		websocket.TextMessage,
-		[]byte(`{"Action":"CHECKOUT", "Patron": "95", "Branch":"hutl"}`)); err != nil {
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN"}`)); err != nil {
 		t.Fatal("UI failed to send message over websokcet conn")
 	}
 
 	if msg := <-d.incoming; string(msg) != "BEG\r" {
-		t.Fatal("UI -> CHECKOUT: RFID-unit didn't get instructed to start scanning")
+		t.Fatal("UI -> CHECKIN: RFID-unit didn't get instructed to start scanning")
 	}
 
-	// acknowledge BEG command
-	d.write([]byte("OK\r"))
+	// Don't acknowledge BEG command, and verify that UI gets notified.
+	got := <-uiChan
+	want := Message{Action: "CONNECT", ErrorCode: CodeRFIDTimeout, RFIDError: true, ErrorMessage: "RFID-unit didn't respond in time"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get notified of RFID-unit not responding")
+	}
+}
+
+func TestRFIDReconnectFailure(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:              port(srv.URL),
+		SIPServer:             sipSrv.Addr(),
+		RFIDPort:              port(d.addr()),
+		RFIDTimeout:           1 * time.Second,
+		RFIDReconnectAttempts: 1,
+		RFIDReconnectWait:     10 * time.Millisecond,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	// Simulate RFID-unit going away for good.
+	d.Close()
+
+	got := <-uiChan
+	want := Message{Action: "RECONNECTING", ErrorCode: CodeRFIDDisconnected, RFIDError: true, ErrorMessage: "EOF"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get notified of RFID reconnect")
+	}
+
+	got = <-uiChan
+	want = Message{Action: "CONNECT", ErrorCode: CodeRFIDDisconnected, RFIDError: true, ErrorMessage: "EOF"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get notified of failed RFID reconnect")
+	}
+}
+
+// Verify that a command sent while reconnecting to the RFID-unit is queued,
+// and sent on the new connection when reconnected.
+func TestRFIDReconnectQueues(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	// The RFID-unit accepts the connection of the client, and the one it
+	// reconnects with.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+
+	hub = newHub(Config{
+		HTTPPort:              port(srv.URL),
+		SIPServer:             sipSrv.Addr(),
+		RFIDPort:              port("http://" + ln.Addr().String()),
+		RFIDTimeout:           1 * time.Second,
+		RFIDReconnectAttempts: 1,
+		RFIDReconnectWait:     10 * time.Millisecond,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	read := func(r *bufio.Reader) string {
+		msg, err := r.ReadString('\r')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	conn := <-conns
+	if msg := read(bufio.NewReader(conn)); msg != "VER2.00\r" {
+		t.Fatalf("RFID-unit got %q; want VER2.00", msg)
+	}
+	conn.Write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	// The connection is lost.
+	conn.Close()
+	if got := <-uiChan; got.Action != "RECONNECTING" {
+		t.Fatalf("Got %+v; want RECONNECTING", got)
+	}
+
+	// Scanning is started while the client is reconnecting.
+	conn = <-conns
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if msg := read(r); msg != "VER2.00\r" {
+		t.Fatalf("RFID-unit got %q on reconnect; want VER2.00", msg)
+	}
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	waitForState(t, RFIDCheckinWaitForBegOK)
+	conn.Write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CONNECT" || got.RFIDError {
+		t.Fatalf("Got %+v; want CONNECT", got)
+	}
+
+	if msg := read(r); msg != "BEG\r" {
+		t.Fatalf("RFID-unit got %q when reconnected; want BEG", msg)
+	}
+	conn.Write([]byte("OK\r"))
+	waitForState(t, RFIDCheckin)
+}
+
+// Verify that the waits between attempts to reconnect to the RFID-unit
+// double up to the max wait, with their second half jittered.
+func TestReconnectWait(t *testing.T) {
+	cfg := Config{RFIDReconnectWait: 100 * time.Millisecond, RFIDReconnectMaxWait: time.Second}
+	least := func(n int64) int64 { return 0 }
+	most := func(n int64) int64 { return n - 1 }
+	for _, tt := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{4, 400 * time.Millisecond, 800 * time.Millisecond},
+		{5, 500 * time.Millisecond, time.Second},
+		{50, 500 * time.Millisecond, time.Second},
+	} {
+		if got := reconnectWait(cfg, tt.attempt, least); got != tt.min {
+			t.Errorf("reconnectWait(%d) with least jitter => %v; want %v", tt.attempt, got, tt.min)
+		}
+		if got := reconnectWait(cfg, tt.attempt, most); got != tt.max {
+			t.Errorf("reconnectWait(%d) with most jitter => %v; want %v", tt.attempt, got, tt.max)
+		}
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 20; i++ {
+			got := reconnectWait(cfg, tt.attempt, rand.Int63n)
+			if got < tt.min || got > tt.max {
+				t.Errorf("reconnectWait(%d) => %v; want between %v and %v", tt.attempt, got, tt.min, tt.max)
+			}
+			seen[got] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("reconnectWait(%d) => %v 20 times; want jitter", tt.attempt, seen)
+		}
+	}
+
+	// Without a max wait, the wait keeps doubling, without overflowing.
+	cfg.RFIDReconnectMaxWait = 0
+	if got := reconnectWait(cfg, 8, most); got != 12800*time.Millisecond {
+		t.Errorf("reconnectWait(8) without max wait => %v; want 12.8s", got)
+	}
+	if got := reconnectWait(cfg, 100, least); got <= 0 {
+		t.Errorf("reconnectWait(100) without max wait => %v; want positive", got)
+	}
+}
+
+// Test that the client shuts down cleanly when both the RFID-unit and the UI
+// go away at the same time.
+func TestSimultaneousDisconnects(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	c := connectedClient(t)
+	go d.Close()
+	go a.c.Close()
+
+	// The client goroutines (Run, readFromRFID, ping, retransmit and the
+	// websocket handler) should all exit.
+	waitForExit(t, c)
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.clients) != 0 {
+		t.Errorf("hub has %d clients after disconnect; want 0", len(hub.clients))
+	}
+}
+
+// Test that all the goroutines of a client exit when its context is
+// cancelled, here through the context of the hub it is derived from.
+func TestClientContextCancelled(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	c := connectedClient(t)
+	hub.cancel()
+
+	// The client goroutines (Run, readFromRFID, ping, retransmit and the
+	// websocket handler) should all exit, though the UI and RFID-unit are
+	// still there.
+	waitForExit(t, c)
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.clients) != 0 {
+		t.Errorf("hub has %d clients after cancel; want 0", len(hub.clients))
+	}
+}
+
+func TestCheckins(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:       port(srv.URL),
+		SIPServer:      sipSrv.Addr(),
+		RFIDPort:       port(d.addr()),
+		RFIDTimeout:    1 * time.Second,
+		EndScanRetries: 1,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+
+	d.write([]byte("OK\r"))
+
+	// Verify that UI get's CONNECT message
+	got := <-uiChan
+	want := Message{Action: "CONNECT", Protocol: maxProtocolVersion, MinProtocol: minProtocolVersion, MaxProtocol: maxProtocolVersion}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get notified of succesfull rfid connect")
+	}
+
+	checkins := metrics.checkins.Value("fmaj")
+	sipCalls := metrics.sipLatency.Count()
+
+	// Send "CHECKIN" message from UI and verify that the UI gets notified of
+	// succesfull connect & RFID-unit that gets instructed to starts scanning for tags.
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatal("UI -> CHECKIN: RFID-unit didn't get instructed to start scanning")
+	}
+
+	// acknowledge BEG command
+	d.write([]byte("OK\r"))
+
+	// Simulate found book on RFID-unit. Verify that it get's checked in through
+	// SIP, the Alarm turned on, and that UI get's notified of the transaction
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CTfbol|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Errorf("Checkin: RFID reader didn't get instructed to turn on alarm")
+	}
+	// simulate failed alarm command
+	d.write([]byte("NOK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKIN", ErrorCode: CodeAlarmFailed,
+		Item: Item{
+			Label:         "Heavy metal in Baghdad",
+			Barcode:       "03010824124004",
+			Date:          "26/02/2014",
+			AlarmOnFailed: true,
+			Transfer:      "fbol",
+			Status:        "Feil: fikk ikke skrudd på alarm.",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct message after checkin")
+	}
+
+	if n := metrics.checkins.Value("fmaj"); n != checkins+1 {
+		t.Errorf("checkins counter => %d; want %d", n, checkins+1)
+	}
+	if n := metrics.sipLatency.Count(); n != sipCalls+1 {
+		t.Errorf("SIP latency observations => %d; want %d", n, sipCalls+1)
+	}
+
+	// retry alarm on
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-ON"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "ACT1003010824124004:NO:02030000\r" {
+		t.Fatal("UI -> RETRY-ALARM-ON didn't trigger the right RFID command")
+	}
+	d.write([]byte("OK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKIN",
+		Item: Item{
+			Label:   "Heavy metal in Baghdad",
+			Barcode: "03010824124004",
+			Date:    "26/02/2014",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct message after checkin retry alarm on")
+	}
+	waitForState(t, RFIDCheckin)
+
+	// Simulate barcode not in our db
+
+	sipSrv.Respond("100NUY20140128    114702AO|AB1234|CV99|AFItem not checked out|\r")
+	d.write([]byte("RDT1234:NO:02030000|0\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed after unsuccessful checkin")
+	}
+
+	d.write([]byte("OK\r"))
+
+	// Koha is told to have the tag removed, and that the checkin failed.
+	if got := <-uiChan; got.Action != "UNKNOWN-TAG" || got.Item.Tag != "1234:NO:02030000" {
+		t.Errorf("Got %+v; want UNKNOWN-TAG of 1234:NO:02030000", got)
+	}
+	got = <-uiChan
+	want = Message{Action: "CHECKIN", ErrorCode: CodeItemUnknown,
+		Item: Item{
+			Barcode:           "1234",
+			TransactionFailed: true,
+			Unknown:           true,
+			Status:            "eksemplaret finnes ikke i basen",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	// Simulate book on RFID-unit, but with missing tags. Verify that UI gets
+	// notified with the books title, along with an error message
+	sipSrv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Error("Alarm was changed after unsuccessful checkin")
+	}
+	d.write([]byte("OK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKIN", ErrorCode: CodePartsMissing,
+		Item: Item{
+			Label:             "Heavy metal in Baghdad",
+			Barcode:           "03010824124004",
+			TransactionFailed: true,
+			TagCountFailed:    true,
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct message when item is missing tags")
+	}
+
+	// Verify that END is resent when the RFID-unit fails to stop scanning,
+	// and that the UI is notified when it keeps failing.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatal("UI -> END: RFID-unit didn't get instructed to stop scanning")
+	}
+	d.write([]byte("NOK\r"))
+
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatal("END wasn't resent after RFID-unit failed to stop scanning")
+	}
+	d.write([]byte("NOK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "END", ErrorCode: CodeRFIDNOK, RFIDError: true, ErrorMessage: "RFID-unit failed to stop scanning"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get notified of failed END")
+	}
+
+	// Verify that the RFID-unit gets END message when the corresponding
+	// websocket connection is closed.
+
+	// TODO I'm closing connection before, is this necessary?
+	// msg = <-d.incoming
+	// if string(msg) != "END\r" {
+	// 	t.Fatal("RFID-unit didn't get END message when UI connection was lost")
+	// }
+
+}
+
+// Verify that the alarm of an item is retried on the data of its tag, even
+// when the RFID-unit reports its UID, as the alarm commands of the default
+// protocol cannot address a tag by UID.
+func TestRetryAlarmWithUID(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0||E004010046A847AD\r"))
+	<-d.incoming // OK1
+	d.write([]byte("NOK\r"))
+	if got := <-uiChan; !got.Item.AlarmOnFailed {
+		t.Fatalf("Got %+v; want alarm failed", got)
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-ON"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "ACT1003010824124004:NO:02030000\r" {
+		t.Errorf("RFID-unit got %q on RETRY-ALARM-ON; want alarm retried on the tag data", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Item.AlarmOnFailed || got.Item.Barcode != "03010824124004" {
+		t.Errorf("Got %+v; want alarm turned on", got)
+	}
+}
+
+func TestCheckinAlarmResponses(t *testing.T) {
+	tests := []struct {
+		desc      string
+		sipResp   string
+		tag       string
+		cmd       string // Alarm command expected by the RFID-unit
+		resp      string // Response of the RFID-unit
+		want      Item
+		failedOns int // Items kept for RETRY-ALARM-ON
+	}{
+		{"alarm on OK", "101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r",
+			"1003010824124004:NO:02030000", "OK1\r", "OK\r",
+			Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", Date: "26/02/2014"}, 0},
+		{"alarm on NOK", "101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r",
+			"1003010824124004:NO:02030000", "OK1\r", "NOK\r",
+			Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", Date: "26/02/2014",
+				AlarmOnFailed: true, Status: "Feil: fikk ikke skrudd på alarm."}, 1},
+		{"alarm leave OK", "100NUY20140128    114702AO|AB1234|CV99|AFItem not checked out|\r",
+			"1234:NO:02030000", "OK \r", "OK\r",
+			Item{Barcode: "1234", TransactionFailed: true, Unknown: true, Status: "eksemplaret finnes ikke i basen"}, 0},
+		// The alarm is left as is either way, so Koha is told the same.
+		{"alarm leave NOK", "100NUY20140128    114702AO|AB1234|CV99|AFItem not checked out|\r",
+			"1234:NO:02030000", "OK \r", "NOK\r",
+			Item{Barcode: "1234", TransactionFailed: true, Unknown: true, Status: "eksemplaret finnes ikke i basen"}, 0},
+	}
+
+	for _, tt := range tests {
+		uiChan := make(chan Message)
+		sipSrv := newSIPTestServer()
+		srv := httptest.NewServer(nil)
+		d := newDummyRFIDReader()
+		hub = newHub(Config{
+			HTTPPort:    port(srv.URL),
+			SIPServer:   sipSrv.Addr(),
+			RFIDPort:    port(d.addr()),
+			RFIDTimeout: 1 * time.Second,
+		})
+		a := newDummyUIAgent(uiChan, port(srv.URL))
+
+		<-d.incoming // VER2.00
+		d.write([]byte("OK\r"))
+		<-uiChan // CONNECT OK
+
+		a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+		<-d.incoming // BEG
+		d.write([]byte("OK\r"))
+
+		sipSrv.Respond(tt.sipResp)
+		d.write([]byte("RDT" + tt.tag + "|0\r"))
+		if msg := <-d.incoming; string(msg) != tt.cmd {
+			t.Errorf("%s: RFID-unit got %q; want %q", tt.desc, msg, tt.cmd)
+		}
+		d.write([]byte(tt.resp))
+
+		if tt.want.Unknown {
+			if got := <-uiChan; got.Action != "UNKNOWN-TAG" {
+				t.Errorf("%s: Got %+v; want UNKNOWN-TAG", tt.desc, got)
+			}
+		}
+		got := <-uiChan
+		if got.Action != "CHECKIN" || !reflect.DeepEqual(got.Item, tt.want) {
+			t.Errorf("%s: Got %+v; want CHECKIN of %+v", tt.desc, got, tt.want)
+		}
+
+		// Scanning continues, with failed items kept for retry.
+		var status []ClientStatus
+		for i := 0; i < 10; i++ {
+			rec := httptest.NewRecorder()
+			hub.ServeClients(rec, httptest.NewRequest("GET", "/clients", nil))
+			status = nil
+			json.Unmarshal(rec.Body.Bytes(), &status)
+			if len(status) == 1 && status[0].State == RFIDCheckin && status[0].FailedAlarmOn == tt.failedOns {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(status) != 1 || status[0].State != RFIDCheckin || status[0].FailedAlarmOn != tt.failedOns {
+			t.Errorf("%s: client status => %+v; want scanning with %d failed alarms", tt.desc, status, tt.failedOns)
+		}
+
+		a.c.Close()
+		hub.Close()
+		d.Close()
+		srv.Close()
+		sipSrv.Close()
+	}
+}
+
+func TestAlarmFailPolicy(t *testing.T) {
+	const (
+		tag         = "1003010824124004:NO:02030000"
+		checkinResp = "101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|AA2|\r"
+		checkinAnon = "101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r"
+		checkoutOK  = "121NNY20140226    161239AOfmaj|AA2|AB03010824124004|AJHeavy metal in Baghdad|AH20140331    235900|\r"
+	)
+	failed := Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", Date: "26/02/2014",
+		AlarmOnFailed: true, Status: "Feil: fikk ikke skrudd på alarm."}
+
+	tests := []struct {
+		desc       string
+		policy     string
+		sipResp    string
+		alarmResps []string // Responses to OK1 and the resent alarm commands
+		wantCode   ErrorCode
+		want       Item
+		failedOns  int    // Items kept for RETRY-ALARM-ON
+		sipRequest string // Prefix of the last SIP request
+	}{
+		{"notify", alarmFailNotify, checkinResp, []string{"NOK"}, CodeAlarmFailed, failed, 1, "09N"},
+		{"compensate", alarmFailCompensate, checkinResp, []string{"NOK"}, CodeCheckinReverted,
+			Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", Date: "26/02/2014",
+				AlarmOnFailed: true, TransactionFailed: true,
+				Status: "Feil: fikk ikke skrudd på alarm, innleveringen er angret."}, 0, "11YY"},
+		{"compensate without patron", alarmFailCompensate, checkinAnon, []string{"NOK"}, CodeAlarmFailed, failed, 1, "09N"},
+		{"block, alarm succeeds", alarmFailBlock, checkinResp, []string{"NOK", "NOK", "OK"}, "",
+			Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", Date: "26/02/2014"}, 0, "09N"},
+		{"block, alarm keeps failing", alarmFailBlock, checkinResp, []string{"NOK", "NOK", "NOK"}, CodeAlarmFailed, failed, 1, "09N"},
+	}
+
+	for _, tt := range tests {
+		uiChan := make(chan Message)
+		sipSrv := newSIPTestServer()
+		srv := httptest.NewServer(nil)
+		d := newDummyRFIDReader()
+		hub = newHub(Config{
+			HTTPPort:        port(srv.URL),
+			SIPServer:       sipSrv.Addr(),
+			RFIDPort:        port(d.addr()),
+			RFIDTimeout:     1 * time.Second,
+			AlarmFailPolicy: tt.policy,
+			AlarmRetries:    2,
+		})
+		a := newDummyUIAgent(uiChan, port(srv.URL))
+
+		<-d.incoming // VER2.00
+		d.write([]byte("OK\r"))
+		<-uiChan // CONNECT OK
+
+		a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+		<-d.incoming // BEG
+		d.write([]byte("OK\r"))
+
+		sipSrv.Respond(tt.sipResp)
+		d.write([]byte("RDT" + tag + "|0\r"))
+		if msg := <-d.incoming; string(msg) != "OK1\r" {
+			t.Errorf("%s: RFID-unit got %q; want OK1", tt.desc, msg)
+		}
+		sipSrv.Respond(checkoutOK)
+		for i, resp := range tt.alarmResps {
+			if i > 0 {
+				// The alarm is resent, with the block policy
+				if msg := <-d.incoming; string(msg) != "ACT"+tag+"\r" {
+					t.Errorf("%s: RFID-unit got %q; want alarm resent", tt.desc, msg)
+				}
+			}
+			d.write([]byte(resp + "\r"))
+		}
+
+		got := <-uiChan
+		if got.Action != "CHECKIN" || got.ErrorCode != tt.wantCode || !reflect.DeepEqual(got.Item, tt.want) {
+			t.Errorf("%s: Got %+v; want CHECKIN with code %q of %+v", tt.desc, got, tt.wantCode, tt.want)
+		}
+		if req := sipSrv.LastRequest(); !strings.HasPrefix(req, tt.sipRequest) {
+			t.Errorf("%s: last SIP request => %q; want %s...", tt.desc, req, tt.sipRequest)
+		}
+
+		var status []ClientStatus
+		for i := 0; i < 10; i++ {
+			rec := httptest.NewRecorder()
+			hub.ServeClients(rec, httptest.NewRequest("GET", "/clients", nil))
+			status = nil
+			json.Unmarshal(rec.Body.Bytes(), &status)
+			if len(status) == 1 && status[0].State == RFIDCheckin && status[0].FailedAlarmOn == tt.failedOns {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(status) != 1 || status[0].State != RFIDCheckin || status[0].FailedAlarmOn != tt.failedOns {
+			t.Errorf("%s: client status => %+v; want scanning with %d failed alarms", tt.desc, status, tt.failedOns)
+		}
+
+		a.c.Close()
+		hub.Close()
+		d.Close()
+		srv.Close()
+		sipSrv.Close()
+	}
+}
+
+func TestCheckinRereads(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" {
+		t.Fatalf("Got %+v; want CHECKIN of 03010824124004", got)
+	}
+
+	// The item is read twice more while it lies on the RFID-unit. Its alarm
+	// is left as is, and it is not checked in again.
+	for i := 0; i < 2; i++ {
+		d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+		if msg := <-d.incoming; string(msg) != "OK \r" {
+			t.Fatalf("RFID-unit got %q on reread; want alarm left as is", msg)
+		}
+		d.write([]byte("OK\r"))
+	}
+	if n := sipSrv.Requests(); n != 1 {
+		t.Errorf("SIP server got %d requests; want 1 checkin", n)
+	}
+
+	// Koha is only told of the next item.
+	sipSrv.Respond("101YNN20140226    161239AO|AB03011063175001|AQfmaj|AJCat's cradle|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03011063175001" {
+		t.Errorf("Got %+v; want CHECKIN of 03011063175001", got)
+	}
+
+	// A new session checks in the item again.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // END
+	d.write([]byte("OK\r"))
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Errorf("RFID-unit got %q in new session; want OK1", msg)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:       port(srv.URL),
+		SIPServer:      sipSrv.Addr(),
+		RFIDPort:       port(d.addr()),
+		RFIDTimeout:    1 * time.Second,
+		WSResumeWindow: time.Minute,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	connected := <-uiChan
+	if connected.Action != "CONNECT" || connected.Session == "" {
+		t.Fatalf("Got %+v; want CONNECT with session token", connected)
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKIN
+
+	// The websocket drops, and an item is checked in before Koha is back.
+	a.c.Close()
+	for {
+		hub.mu.Lock()
+		n := len(hub.suspended)
+		hub.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sipSrv.Respond("101YNN20140226    161239AO|AB03011063175001|AQfmaj|AJCat's cradle|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	// Koha reconnects with the token, and is sent the held message.
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws?session=%s", port(srv.URL), connected.Session), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = &dummyUIAgent{msg: uiChan, c: ws}
+	defer a.c.Close()
+	go a.run()
+
+	if got := <-uiChan; got.Action != "CONNECT" || got.Session != connected.Session {
+		t.Errorf("Got %+v; want CONNECT of the resumed session", got)
+	}
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03011063175001" {
+		t.Errorf("Got %+v; want CHECKIN of 03011063175001, held while disconnected", got)
+	}
+
+	// The session is the same: the first item is known to be checked in.
+	requests := sipSrv.Requests()
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Fatalf("RFID-unit got %q; want reread item ignored", msg)
+	}
+	d.write([]byte("OK\r"))
+	if n := sipSrv.Requests(); n != requests {
+		t.Errorf("SIP server got %d requests for the item read again; want none", n-requests)
+	}
+
+	// A session is only resumed once.
+	if c := hub.resume(connected.Session, "127.0.0.1", ""); c != nil {
+		t.Errorf("session resumed twice")
+	}
+}
+
+func TestDisconnectDuringSIPCall(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		SIPMaxConn:  1,
+		SIPTimeout:  time.Minute,
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The SIP server doesn't respond to the checkin, and Koha disconnects.
+	sipSrv.Silent()
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	for sipSrv.Requests() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	a.c.Close()
+
+	// The SIP call is cancelled, and its connection discarded.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := hub.settings().sipPool.stats()
+		if s.InUse == 0 && s.Evicted == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool stats => %+v; want the connection of the cancelled call evicted", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hub.mu.Lock()
+	n := len(hub.clients)
+	hub.mu.Unlock()
+	if n != 0 {
+		t.Errorf("hub has %d clients after disconnect; want none", n)
+	}
+}
+
+func TestCheckinMissingTagsGrace(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	clock := &fakeClock{now: time.Now()}
+	hub = newHub(Config{
+		HTTPPort:            port(srv.URL),
+		SIPServer:           sipSrv.Addr(),
+		RFIDPort:            port(d.addr()),
+		RFIDTimeout:         1 * time.Second,
+		RFIDResponseTimeout: 10 * time.Second,
+		DeadmanTimeout:      3 * time.Second,
+		MissingTagsGrace:    5 * time.Second,
+	})
+	hub.clock = clock
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.RespondWith(func(req []byte) []byte {
+		if strings.HasPrefix(string(req), "17") {
+			return []byte("1803020120140226    203140AB03011063175001|AO|AJCat's cradle|AQfhol|BGfhol|\r")
+		}
+		barcode := strings.SplitN(string(req), "|AB10", 2)[1][:14]
+		return []byte("101YNN20140226    161239AO|AB" + barcode + "|AQfmaj|\r")
+	})
+
+	// The set is incomplete while it is being placed on the RFID-unit.
+	// Nothing is awaited from the RFID-unit meanwhile, so neither the
+	// response timeout nor the deadman fires, and an item read meanwhile is
+	// handled after the set.
+	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
+	waitForState(t, RFIDCheckinGrace)
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	clock.Advance(4 * time.Second)
+	select {
+	case msg := <-d.incoming:
+		t.Fatalf("RFID-unit got %q during the grace period; want nothing", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The set is complete when read again after the grace period.
+	clock.Advance(time.Second)
+	if msg := <-d.incoming; string(msg) != "OKR\r" {
+		t.Fatalf("RFID-unit got %q; want item read again", msg)
+	}
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" || got.Item.TagCountFailed || got.ErrorCode != "" {
+		t.Errorf("Got %+v; want CHECKIN without missing tags", got)
+	}
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1 for the item read during the grace period", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03011063175001" {
+		t.Errorf("Got %+v; want CHECKIN of the item read during the grace period", got)
+	}
+
+	// A set completed during the grace period is handled at once.
+	d.write([]byte("RDT1003011174511003:NO:02030000|1\r"))
+	waitForState(t, RFIDCheckinGrace)
+	d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03011174511003" || got.Item.TagCountFailed {
+		t.Errorf("Got %+v; want CHECKIN without missing tags", got)
+	}
+
+	// A set still incomplete after the grace period is reported.
+	d.write([]byte("RDT1003011063175001:NO:02030000|1\r"))
+	waitForState(t, RFIDCheckinGrace)
+	clock.Advance(5 * time.Second)
+	if msg := <-d.incoming; string(msg) != "OKR\r" {
+		t.Fatalf("RFID-unit got %q; want item read again", msg)
+	}
+	d.write([]byte("RDT1003011063175001:NO:02030000|1\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Fatalf("RFID-unit got %q; want alarm left as is", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || !got.Item.TagCountFailed || got.ErrorCode != CodePartsMissing {
+		t.Errorf("Got %+v; want CHECKIN with missing tags", got)
+	}
+}
+
+func TestCheckinUnknownTag(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// A foreign tag, which the SIP-server knows nothing about. The alarm is
+	// left as is, and the UI is told to have the tag removed.
+	sipSrv.Respond("1801000120140226    203140ABE0040150ABCD1234|AO|\r")
+	d.write([]byte("RDTE0040150ABCD1234|1\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed for unknown tag: %q", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	want := Message{Action: "UNKNOWN-TAG", ErrorCode: CodeItemUnknown,
+		Item: Item{
+			Unknown: true,
+			Barcode: "E0040150ABCD1234",
+			Tag:     "E0040150ABCD1234",
+			Status:  "ukjent brikke, må fjernes og undersøkes",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+func TestCheckinBlockedItem(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The item was lost. It is checked in, but must be handled manually,
+	// so the alarm is left as is.
+	sipSrv.Respond("101YNY20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CV99|AFItem was lost, now found|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed for blocked item: %q", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	want := Message{Action: "CHECKIN", ErrorCode: CodeItemBlocked,
+		Item: Item{
+			Barcode:  "03010824124004",
+			Label:    "Heavy metal in Baghdad",
+			Transfer: "fhol",
+			Blocked:  true,
+			Status:   "Item was lost, now found",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+func TestCheckinInvalidBarcode(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:     port(srv.URL),
+		SIPServer:    sipSrv.Addr(),
+		RFIDPort:     port(d.addr()),
+		RFIDTimeout:  1 * time.Second,
+		BarcodeRules: map[string]BarcodeRules{"": {MinLength: 14, MaxLength: 14, CheckDigit: "mod10"}},
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The barcode fails validation, so SIP is not called, and the alarm is
+	// left as is.
+	d.write([]byte("RDT31234000012343|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed for invalid barcode: %q", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	want := Message{Action: "CHECKIN", ErrorCode: CodeTransactionFailed,
+		Item: Item{
+			Tag:               "31234000012343",
+			TransactionFailed: true,
+			Status:            `invalid barcode "31234000012343": wrong check digit`,
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+func TestCheckinMalformedTag(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:     port(srv.URL),
+		SIPServer:    sipSrv.Addr(),
+		RFIDPort:     port(d.addr()),
+		RFIDTimeout:  1 * time.Second,
+		SIPDelimiter: "^",
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// Control characters are removed from the tag before it is sent to SIP.
+	sipSrv.Respond("101YNN20140226    161239AO^AB03010824124004^AQfmaj^AJHeavy metal in Baghdad^\r")
+	d.write([]byte("RDT1003010824124004\x07:NO:\x0002030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKIN
+	if req := sipSrv.LastRequest(); !strings.Contains(req, "^AB1003010824124004:NO:02030000^") {
+		t.Errorf("SIP request => %q; want tag without control characters", req)
+	}
+
+	// A tag with the SIP delimiter is rejected, without calling SIP.
+	requests := sipSrv.Requests()
+	d.write([]byte("RDT10030108^6677001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed for malformed tag: %q", msg)
+	}
+	d.write([]byte("OK\r"))
+	got := <-uiChan
+	want := Message{Action: "CHECKIN", ErrorCode: CodeTransactionFailed,
+		Item: Item{
+			Tag:               "10030108^6677001:NO:02030000",
+			TransactionFailed: true,
+			Status:            `invalid tag "10030108^6677001:NO:02030000": contains '^'`,
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	if n := sipSrv.Requests(); n != requests {
+		t.Errorf("SIP server got %d requests for malformed tag; want none", n-requests)
+	}
+}
+
+// Verify that a tag which the RFID-unit detects, but cannot read, is not
+// taken for a missing tag: staff are told to reposition the item.
+func TestCheckinUnreadableTag(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// SIP is not called, and the alarm is left as is.
+	requests := sipSrv.Requests()
+	d.write([]byte("RDEE004010046A847AD\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed for unreadable tag: %q", msg)
+	}
+	d.write([]byte("OK\r"))
+	got := <-uiChan
+	want := Message{Action: "CHECKIN", ErrorCode: CodeTransactionFailed,
+		Item: Item{
+			Tag:               "E004010046A847AD",
+			TransactionFailed: true,
+			Status:            errTagUnreadable.Error(),
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	if n := sipSrv.Requests(); n != requests {
+		t.Errorf("SIP server got %d requests for unreadable tag; want none", n-requests)
+	}
+
+	// Repositioned, the item is read and checked in.
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Item.Label != "Heavy metal in Baghdad" || got.Item.TransactionFailed {
+		t.Errorf("Got %+v; want item checked in", got)
+	}
+}
+
+func TestCheckinReadSetInfo(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+		ReadSetInfo: true,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// Part 1 of a set of 3 is on the RFID-unit. The set size is read from
+	// the tag, and the alarm is left as is.
+	sipSrv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
+
+	if msg := <-d.incoming; string(msg) != "SET1003010824124004:NO:02030000\r" {
+		t.Fatalf("RFID-unit got %q; want set info command", msg)
+	}
+	d.write([]byte("SET1003010824124004:NO:02030000|1|3\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed for incomplete set: %q", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	want := Message{Action: "CHECKIN", ErrorCode: CodePartsMissing,
+		Item: Item{
+			Label:             "Heavy metal in Baghdad",
+			Barcode:           "03010824124004",
+			TransactionFailed: true,
+			TagCountFailed:    true,
+			NumTags:           3,
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+// Verify that the parts of a set are collected at checkout by the part
+// numbers read from their tags, and the set checked out when all are read.
+func TestCheckoutReadSetInfoParts(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:            port(srv.URL),
+		SIPServer:           sipSrv.Addr(),
+		RFIDPort:            port(d.addr()),
+		RFIDTimeout:         1 * time.Second,
+		ReadSetInfo:         true,
+		MissingPartsTimeout: time.Minute,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	sipSrv.Respond("24              00020140303    110236AOHUTL|AA95|AEPatron|BLY|\r")
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The tags carry the same data, and are told apart by their part
+	// numbers; a part read again is not counted twice.
+	sipSrv.Respond("1803020120140226    203140AB03011174511003|AO|AJKrutt-Kim|AQfhol|BGfhol|\r")
+	readPart := func(part string) {
+		d.write([]byte("RDT1003011174511003:NO:02030000|1\r"))
+		if msg := <-d.incoming; string(msg) != "SET1003011174511003:NO:02030000\r" {
+			t.Fatalf("RFID-unit got %q; want set info command", msg)
+		}
+		d.write([]byte("SET1003011174511003:NO:02030000|" + part + "|2\r"))
+	}
+	for _, part := range []string{"1", "1"} {
+		readPart(part)
+		if msg := <-d.incoming; string(msg) != "OK \r" {
+			t.Fatalf("RFID-unit got %q; want alarm left as is", msg)
+		}
+		d.write([]byte("OK\r"))
+	}
+	sipSrv.Respond("121NYY20140303    110236AOHUTL|AA95|AB03011174511003|AJKrutt-Kim|AH20140324    000000|\r")
+	readPart("2")
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Fatalf("RFID-unit got %q; want alarm off when all parts are read", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKOUT" || got.Item.Barcode != "03011174511003" || got.Item.TagCountFailed || got.Item.TransactionFailed {
+		t.Errorf("Got %+v; want CHECKOUT of the complete set", got)
+	}
+}
+
+func TestCheckinAFI(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:       port(srv.URL),
+		SIPServer:      sipSrv.Addr(),
+		RFIDPort:       port(d.addr()),
+		RFIDTimeout:    1 * time.Second,
+		UseAFI:         true,
+		Security:       SecurityPolicy{AFISecure: 0x07, AFIUnsecure: 0xC2},
+		BranchSecurity: map[string]SecurityPolicy{"fmaj": {AFISecure: 0x9A, AFIUnsecure: 0xC2}},
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	// Koha is told that the security of tags is read back.
+	if got := <-uiChan; got.Action != "CONNECT" || !got.SecurityRead {
+		t.Errorf("Got %+v; want CONNECT with security read back", got)
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The AFI is read, set to the branch's secure value, and read back
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CTfmaj|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+
+	if msg := <-d.incoming; string(msg) != "AFR1003010824124004:NO:02030000\r" {
+		t.Fatalf("Checkin: RFID reader didn't get instructed to read AFI, got %q", msg)
+	}
+	d.write([]byte("AFI1003010824124004:NO:02030000|C2\r"))
+	if msg := <-d.incoming; string(msg) != "AFS1003010824124004:NO:02030000|9A\r" {
+		t.Fatalf("Checkin: RFID reader didn't get instructed to set AFI, got %q", msg)
+	}
+	d.write([]byte("OK\r"))
+	if msg := <-d.incoming; string(msg) != "AFR1003010824124004:NO:02030000\r" {
+		t.Fatalf("Checkin: RFID reader didn't get instructed to read back AFI, got %q", msg)
+	}
+	d.write([]byte("AFI1003010824124004:NO:02030000|9A\r"))
+
+	got := <-uiChan
+	want := Message{Action: "CHECKIN",
+		Item: Item{
+			Label:          "Heavy metal in Baghdad",
+			Barcode:        "03010824124004",
+			Date:           "26/02/2014",
+			SecurityBefore: "UNSECURE",
+			SecurityAfter:  "SECURE",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	// The tag accepts the command, but the AFI read back is unchanged
+	sipSrv.Respond("101YNN20140226    161239AO|AB03011063175001|AQfhol|AJCat's cradle|CTfmaj|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+
+	<-d.incoming // AFR
+	d.write([]byte("AFI1003011063175001:NO:02030000|C2\r"))
+	if msg := <-d.incoming; string(msg) != "AFS1003011063175001:NO:02030000|9A\r" {
+		t.Fatalf("Checkin: RFID reader didn't get instructed to set AFI, got %q", msg)
+	}
+	d.write([]byte("OK\r"))
+	<-d.incoming // AFR
+	d.write([]byte("AFI1003011063175001:NO:02030000|C2\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKIN", ErrorCode: CodeAlarmFailed,
+		Item: Item{
+			Label:          "Cat's cradle",
+			Barcode:        "03011063175001",
+			Date:           "26/02/2014",
+			AlarmOnFailed:  true,
+			Status:         "Feil: fikk ikke skrudd på alarm.",
+			SecurityBefore: "UNSECURE",
+			SecurityAfter:  "UNSECURE",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	// The AFI cannot be read before it is set, but is set all the same;
+	// the AFI read back is neither secure nor unsecure
+	sipSrv.Respond("101YNN20140226    161239AO|AB03011143299001|AQfhol|AJ316 salmer og sanger|CTfmaj|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003011143299001:NO:02030000|0\r"))
+
+	<-d.incoming // AFR
+	d.write([]byte("NOK\r"))
+	if msg := <-d.incoming; string(msg) != "AFS1003011143299001:NO:02030000|9A\r" {
+		t.Fatalf("Checkin: RFID reader didn't get instructed to set AFI, got %q", msg)
+	}
+	d.write([]byte("OK\r"))
+	<-d.incoming // AFR
+	d.write([]byte("AFI1003011143299001:NO:02030000|07\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKIN", ErrorCode: CodeAlarmFailed,
+		Item: Item{
+			Label:         "316 salmer og sanger",
+			Barcode:       "03011143299001",
+			Date:          "26/02/2014",
+			AlarmOnFailed: true,
+			Status:        "Feil: fikk ikke skrudd på alarm.",
+			SecurityAfter: "07",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+func TestBranchSecurityPolicy(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:       port(srv.URL),
+		SIPServer:      sipSrv.Addr(),
+		RFIDPort:       port(d.addr()),
+		RFIDTimeout:    1 * time.Second,
+		BranchSecurity: map[string]SecurityPolicy{"fbol": {Disabled: true}},
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	want := Message{Action: "CHECKIN",
+		Item: Item{
+			Label:   "Heavy metal in Baghdad",
+			Barcode: "03010824124004",
+			Date:    "26/02/2014",
+		}}
+
+	// At a branch without security gates, the alarm is left as is
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fbol"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfbol|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Checkin at branch without security: alarm was changed, got %q", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // END
+	d.write([]byte("OK\r"))
+
+	// At other branches, the alarm is turned on
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fbol2"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfbol2|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Errorf("Checkin at branch with security: alarm wasn't turned on, got %q", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+func TestCheckinLeftUnsecured(t *testing.T) {
+	const (
+		returned = "101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r"
+		magnetic = "101YYN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|CK005|\r"
+		transit  = "101YNY20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|CTfroa|CY11|CV02|\r"
+	)
+	tests := []struct {
+		desc   string
+		policy SecurityPolicy
+		resp   string
+		want   string // Alarm command sent to the RFID-unit
+	}{
+		{"return", SecurityPolicy{}, returned, "OK1\r"},
+		{"return, transit unsecured", SecurityPolicy{TransitUnsecured: true}, returned, "OK1\r"},
+		{"transit", SecurityPolicy{}, transit, "OK1\r"},
+		{"transit, transit unsecured", SecurityPolicy{TransitUnsecured: true}, transit, "OK \r"},
+		{"transit, transit alarm leave", SecurityPolicy{TransitAlarm: transitAlarmLeave}, transit, "OK \r"},
+		{"transit, transit alarm on", SecurityPolicy{TransitAlarm: transitAlarmOn, TransitUnsecured: true}, transit, "OK1\r"},
+		{"return, transit alarm off", SecurityPolicy{TransitAlarm: transitAlarmOff}, returned, "OK1\r"},
+		{"magnetic", SecurityPolicy{}, magnetic, "OK1\r"},
+		{"magnetic, magnetic unsecured", SecurityPolicy{MagneticUnsecured: true}, magnetic, "OK \r"},
+		{"return, magnetic unsecured", SecurityPolicy{MagneticUnsecured: true}, returned, "OK1\r"},
+	}
+
+	for _, tt := range tests {
+		sipSrv := newSIPTestServer()
+		srv := httptest.NewServer(nil)
+		d := newDummyRFIDReader()
+		uiChan := make(chan Message)
+		hub = newHub(Config{
+			HTTPPort:    port(srv.URL),
+			SIPServer:   sipSrv.Addr(),
+			RFIDPort:    port(d.addr()),
+			RFIDTimeout: 1 * time.Second,
+			Security:    tt.policy,
+		})
+		a := newDummyUIAgent(uiChan, port(srv.URL))
+
+		<-d.incoming // VER2.00
+		d.write([]byte("OK\r"))
+		<-uiChan // CONNECT OK
+
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		<-d.incoming // BEG
+		d.write([]byte("OK\r"))
+
+		sipSrv.Respond(tt.resp)
+		d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+		if msg := <-d.incoming; string(msg) != tt.want {
+			t.Errorf("%s: RFID-unit got %q; want %q", tt.desc, msg, tt.want)
+		}
+		if tt.want == "OK \r" {
+			// An alarm left as is cannot fail to be turned on.
+			d.write([]byte("NOK\r"))
+		} else {
+			d.write([]byte("OK\r"))
+		}
+		if got := <-uiChan; got.Action != "CHECKIN" || got.Item.AlarmOnFailed || got.Item.InTransit != (tt.resp == transit) {
+			t.Errorf("%s: got %+v; want successful CHECKIN", tt.desc, got)
+		}
+		waitForState(t, RFIDCheckin)
+
+		// Nothing is kept for RETRY-ALARM-ON.
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CANCEL"}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		if got := <-uiChan; got.Action != "CANCEL" || len(got.Attention) != 0 {
+			t.Errorf("%s: got %+v; want CANCEL without items needing attention", tt.desc, got)
+		}
+
+		a.c.Close()
+		hub.Close()
+		d.Close()
+		srv.Close()
+		sipSrv.Close()
+	}
+}
+
+// Verify that the alarm of a magnetic item is left as is on checkout with
+// MagneticUnsecured, and that the checkout completes whatever the response.
+func TestCheckoutMagneticUnsecured(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+		Security:    SecurityPolicy{MagneticUnsecured: true},
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	sipSrv.Respond("24              00020140303    110236AOHUTL|AA95|AEPatron|BLY|\r")
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("121NYY20140303    110236AOHUTL|AA95|AB03011174511003|AJKrutt-Kim|AH20140324    000000|CK005|\r")
+	d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Fatalf("RFID-unit got %q; want alarm left as is", msg)
+	}
+	d.write([]byte("NOK\r"))
+	if got := <-uiChan; got.Action != "CHECKOUT" || got.Item.AlarmOffFailed || got.Item.TransactionFailed {
+		t.Errorf("Got %+v; want successful CHECKOUT", got)
+	}
+	waitForState(t, RFIDCheckout)
+
+	// Nothing is kept for RETRY-ALARM-OFF.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CANCEL"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if got := <-uiChan; got.Action != "CANCEL" || len(got.Attention) != 0 {
+		t.Errorf("Got %+v; want CANCEL without items needing attention", got)
+	}
+}
+
+// Verify that an item owned by another branch is unsecured for transit,
+// and routed to its home branch, while an item owned by the branch checking
+// it in is secured, with TransitAlarm off and TransitRouting.
+func TestCheckinTransitRouting(t *testing.T) {
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	uiChan := make(chan Message)
+	hub = newHub(Config{
+		HTTPPort:       port(srv.URL),
+		SIPServer:      sipSrv.Addr(),
+		RFIDPort:       port(d.addr()),
+		RFIDTimeout:    1 * time.Second,
+		TransitRouting: true,
+		Security:       SecurityPolicy{TransitAlarm: transitAlarmOff},
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// Owned by the branch checking it in
+	sipSrv.Respond("101YNN20140226    161239AOfmaj|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Errorf("Item of the branch: RFID-unit got %q; want alarm on", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.InTransit || got.Item.Transfer != "" {
+		t.Errorf("Item of the branch: got %+v; want CHECKIN not in transit", got)
+	}
+
+	// Owned by another branch, to be returned there
+	sipSrv.Respond("101YNY20140226    161239AOfmaj|AB03011063175001|AQfroa|AJCat's cradle|CV04|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Errorf("Item of another branch: RFID-unit got %q; want alarm off", msg)
+	}
+	d.write([]byte("OK\r"))
+	want := Item{Label: "Cat's cradle", Barcode: "03011063175001", Date: "26/02/2014", InTransit: true, Transfer: "froa"}
+	if got := <-uiChan; got.Action != "ROUTE" || !reflect.DeepEqual(got.Item, want) {
+		t.Errorf("Item of another branch: got %+v; want ROUTE of %+v", got, want)
+	}
+	if got := <-uiChan; got.Action != "CHECKIN" || !reflect.DeepEqual(got.Item, want) {
+		t.Errorf("Item of another branch: got %+v; want CHECKIN of %+v", got, want)
+	}
+
+	// The alarm cannot be turned off
+	sipSrv.Respond("101YNY20140226    161239AOfmaj|AB03011174511003|AQfroa|AJGrapes of wrath|CV04|\r")
+	d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+	<-d.incoming // OK0
+	d.write([]byte("NOK\r"))
+	<-uiChan // ROUTE
+	if got := <-uiChan; got.Action != "CHECKIN" || !got.Item.AlarmOffFailed || got.Item.Status != "Feil: fikk ikke skrudd av alarm." {
+		t.Errorf("Alarm failed: got %+v; want CHECKIN with AlarmOffFailed", got)
+	}
+}
+
+// Verify that the parts of a set read as incomplete are collected, and the
+// set checked in when all are read, or else reported with the number of
+// parts read, when MissingPartsTimeout has passed.
+func TestCheckinMissingParts(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	clock := &fakeClock{now: time.Now()}
+	hub = newHub(Config{
+		HTTPPort:            port(srv.URL),
+		SIPServer:           sipSrv.Addr(),
+		RFIDPort:            port(d.addr()),
+		RFIDTimeout:         1 * time.Second,
+		MissingPartsTimeout: 10 * time.Second,
+	})
+	hub.clock = clock
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The number of parts is given by the SIP server, and the parts are
+	// told apart by their UIDs. The alarm is left as is until both parts
+	// are read; a part read again is not counted twice.
+	sipSrv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|ZN2|\r")
+	for _, uid := range []string{"E004010000000001", "E004010000000001"} {
+		d.write([]byte("RDT1003010824124004:NO:02030000|1||" + uid + "\r"))
+		if msg := <-d.incoming; string(msg) != "OK \r" {
+			t.Fatalf("RFID-unit got %q; want alarm left as is", msg)
+		}
+		d.write([]byte("OK\r"))
+	}
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|1||E004010000000002\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want alarm on when all parts are read", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" || got.Item.TagCountFailed || got.Item.TransactionFailed {
+		t.Errorf("Got %+v; want CHECKIN of the complete set", got)
+	}
+
+	// One part of three is read, and the others not in time.
+	sipSrv.Respond("1803020120140226    203140AB03011063175001|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|ZN3|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|1||E004010000000003\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Fatalf("RFID-unit got %q; want alarm left as is", msg)
+	}
+	clock.Advance(10 * time.Second)
+	d.write([]byte("OK\r"))
+	got := <-uiChan
+	want := Message{Action: "CHECKIN", ErrorCode: CodePartsMissing,
+		Item: Item{
+			Label:             "Heavy metal in Baghdad",
+			Barcode:           "03011063175001",
+			TransactionFailed: true,
+			TagCountFailed:    true,
+			NumTags:           3,
+			PartsSeen:         1,
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+func TestCheckouts(t *testing.T) {
+
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:       port(srv.URL),
+		SIPServer:      sipSrv.Addr(),
+		RFIDPort:       port(d.addr()),
+		LogSIPMessages: true,
+		RFIDTimeout:    1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	// TESTS /////////////////////////////////////////////////////////////////
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	want := Message{Action: "CONNECT", Protocol: maxProtocolVersion, MinProtocol: minProtocolVersion, MaxProtocol: maxProtocolVersion}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get notified of succesfull rfid connect")
+	}
+
+	// Send "CHECKOUT" message from UI for a blocked patron, and verify that
+	// the UI gets notified and that the RFID-unit doesn't start scanning.
+	sipSrv.Respond("24Y             00020140303    110236AOHUTL|AA95|AEPatron|BLY|AFLåneren har for mange purringer|\r")
+	if err := a.c.WriteMessage(
+		websocket.TextMessage,
+		[]byte(`{"Action":"CHECKOUT", "Patron": "95", "Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	got = <-uiChan
+	want = Message{Action: "CHECKOUT", ErrorCode: CodePatronInvalid, PatronError: true, ErrorMessage: "Låneren har for mange purringer"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get notified of blocked patron")
+	}
+
+	// Send "CHECKOUT" message from UI and verify that the UI gets notified of
+	// succesfull connect & RFID-unit that gets instructed to starts scanning for tags.
+	sipSrv.Respond("24              00020140303    110236AOHUTL|AA95|AEPatron|BLY|\r")
+	if err := a.c.WriteMessage(
+		websocket.TextMessage,
+		[]byte(`{"Action":"CHECKOUT", "Patron": "95", "Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatal("UI -> CHECKOUT: RFID-unit didn't get instructed to start scanning")
+	}
+
+	// acknowledge BEG command
+	d.write([]byte("OK\r"))
+
+	// Simulate book on RFID-unit, but SIP show that book is already checked out.
+	// Verify that UI gets notified with the books title, along with an error message
+	sipSrv.Respond("120NUN20140303    102741AOHUTL|AA95|AB03011174511003|AJKrutt-Kim|AH|AFItem checked out to another patron|BLY|\r")
+	d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed after unsuccessful checkout")
+	}
+
+	d.write([]byte("OK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKOUT", ErrorCode: CodeTransactionFailed,
+		Item: Item{
+			Label:             "Krutt-Kim",
+			Barcode:           "03011174511003",
+			TransactionFailed: true,
+			Status:            "Item checked out to another patron",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct message when item is already checked out to another patron")
+	}
+
+	// Test successful checkout
+	sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Errorf("Alarm was not turned off after successful checkout")
+	}
+
+	// simulate failed alarm
+	d.write([]byte("NOK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKOUT", ErrorCode: CodeAlarmFailed,
+		Item: Item{
+			Label:          "Cat's cradle",
+			Barcode:        "03011063175001",
+			Date:           "31/03/2014",
+			AlarmOffFailed: true,
+			Status:         "Feil: fikk ikke skrudd av alarm.",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct message after succesfull checkout")
+	}
+
+	// retry alarm off
+	if err := a.c.WriteMessage(
+		websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-OFF"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "DAC1003011063175001:NO:02030000\r" {
+		t.Errorf("Got %q, Want DAC1003011063175001:NO:02030000", msg)
+		t.Fatal("UI -> RETRY-ALARM-ON didn't trigger the right RFID command")
+	}
+
+	// A second retry while the first is in progress should be rejected
+	if err := a.c.WriteMessage(
+		websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-OFF"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	got = <-uiChan
+	want = Message{Action: "RETRY-ALARM-OFF", ErrorCode: CodeRetryInProgress, UserError: true,
+		ErrorMessage: "Retry already in progress"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get notified of retry already in progress")
+	}
+
+	d.write([]byte("OK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKOUT",
+		Item: Item{
+			Label:   "Cat's cradle",
+			Barcode: "03011063175001",
+			Date:    "31/03/2014",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct message after succesfull checkout")
+	}
+	// The retry is done, and the session scans for items to check out.
+	waitForState(t, RFIDCheckout)
+
+	// Simulate book on RFID-unit, but with missing tags. Verify that the alarm
+	// is left untouched and that UI gets notified with the books title.
+	sipSrv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Error("Alarm was changed after checkout of item with missing tags")
+	}
+	d.write([]byte("OK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKOUT", ErrorCode: CodePartsMissing,
+		Item: Item{
+			Label:             "Heavy metal in Baghdad",
+			Barcode:           "03010824124004",
+			TransactionFailed: true,
+			TagCountFailed:    true,
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct message when item is missing tags")
+	}
+
+}
+
+// Test that rereading of items with missing tags doesn't trigger multiple SIP-calls
+func TestIncompleteSetAlarm(t *testing.T) {
+	tests := []struct {
+		action        string
+		checkinAlarm  string
+		checkoutAlarm string
+		wantCmd       string
+		rfidResp      string
+		alarmOnFail   bool
+		alarmOffFail  bool
+	}{
+		{"CHECKIN", "", "", "OK \r", "OK\r", false, false},
+		{"CHECKIN", incompleteAlarmOn, incompleteAlarmOff, "OK1\r", "OK\r", false, false},
+		{"CHECKIN", incompleteAlarmOff, incompleteAlarmOn, "OK0\r", "OK\r", false, false},
+		{"CHECKIN", incompleteAlarmOn, "", "OK1\r", "NOK\r", true, false},
+		{"CHECKOUT", incompleteAlarmOn, "", "OK \r", "OK\r", false, false},
+		{"CHECKOUT", "", incompleteAlarmOff, "OK0\r", "OK\r", false, false},
+		{"CHECKOUT", "", incompleteAlarmOn, "OK1\r", "OK\r", false, false},
+		{"CHECKOUT", "", incompleteAlarmOff, "OK0\r", "NOK\r", false, true},
+	}
+
+	for _, tt := range tests {
+		func() {
+			uiChan := make(chan Message)
+			sipSrv := newSIPTestServer()
+			defer sipSrv.Close()
+
+			srv := httptest.NewServer(nil)
+			defer srv.Close()
+
+			d := newDummyRFIDReader()
+			defer d.Close()
+
+			hub = newHub(Config{
+				HTTPPort:                port(srv.URL),
+				SIPServer:               sipSrv.Addr(),
+				RFIDPort:                port(d.addr()),
+				RFIDTimeout:             1 * time.Second,
+				CheckinIncompleteAlarm:  tt.checkinAlarm,
+				CheckoutIncompleteAlarm: tt.checkoutAlarm,
+			})
+			defer hub.Close()
+
+			a := newDummyUIAgent(uiChan, port(srv.URL))
+			defer a.c.Close()
+
+			<-d.incoming // VER2.00
+			d.write([]byte("OK\r"))
+			<-uiChan // CONNECT OK
+
+			msg := `{"Action":"CHECKIN","Branch":"fmaj"}`
+			if tt.action == "CHECKOUT" {
+				sipSrv.Respond("24              00020140303    110236AOHUTL|AA95|AEPatron|BLY|\r")
+				msg = `{"Action":"CHECKOUT","Patron":"95","Branch":"hutl"}`
+			}
+			if err := a.c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				t.Fatal("UI failed to send message over websokcet conn")
+			}
+			<-d.incoming // BEG
+			d.write([]byte("OK\r"))
+
+			sipSrv.Respond("1803020120140226    203140AB03011063175001|AO|AJCat's cradle|AQfhol|BGfhol|\r")
+			d.write([]byte("RDT1003011063175001:NO:02030000|1\r"))
+			if got := <-d.incoming; string(got) != tt.wantCmd {
+				t.Errorf("%s with %q/%q: RFID-unit got %q; want %q", tt.action, tt.checkinAlarm, tt.checkoutAlarm, got, tt.wantCmd)
+			}
+			d.write([]byte(tt.rfidResp))
+			got := <-uiChan
+			if got.Action != tt.action || !got.Item.TagCountFailed ||
+				got.Item.AlarmOnFailed != tt.alarmOnFail || got.Item.AlarmOffFailed != tt.alarmOffFail {
+				t.Errorf("%s with %q/%q, RFID-unit responding %q: got %+v", tt.action, tt.checkinAlarm, tt.checkoutAlarm, tt.rfidResp, got)
+			}
+		}()
+	}
+}
+
+func TestGhostReads(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	clock := &fakeClock{now: time.Now()}
+	hub = newHub(Config{
+		HTTPPort:        port(srv.URL),
+		SIPServer:       sipSrv.Addr(),
+		RFIDPort:        port(d.addr()),
+		RFIDTimeout:     1 * time.Second,
+		GhostReadWindow: time.Minute,
+	})
+	hub.clock = clock
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	// A patron checks in an item, and ends the session.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQhutl|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKIN
+	clock.Advance(time.Second)
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // END
+	d.write([]byte("OK\r"))
+	for !hub.idle() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The next patron checks out, while the item is still on the RFID-unit.
+	sipSrv.Respond("24              00020140303    110236AOHUTL|AA95|AEPatron|BLY|\r")
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	requests := sipSrv.Requests()
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Fatalf("RFID-unit got %q for item left from the previous session; want alarm left as is", msg)
+	}
+	d.write([]byte("OK\r"))
+	if n := sipSrv.Requests(); n != requests {
+		t.Errorf("SIP server got %d requests for item left from the previous session; want none", n-requests)
+	}
+
+	// Items of the patron are checked out as usual.
+	sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Fatalf("RFID-unit got %q; want alarm turned off", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKOUT" || got.Item.Barcode != "03011063175001" {
+		t.Errorf("Got %+v; want CHECKOUT of 03011063175001 only", got)
+	}
+
+	// The item left on the RFID-unit is checked out as usual when read
+	// again after GhostReadWindow.
+	clock.Advance(time.Minute)
+	sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03010824124004|AJHeavy metal in Baghdad|AH20140331    235900|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Fatalf("RFID-unit got %q for item read after GhostReadWindow; want alarm turned off", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKOUT" || got.Item.Barcode != "03010824124004" {
+		t.Errorf("Got %+v; want CHECKOUT of 03010824124004", got)
+	}
+}
+
+func TestCheckoutNoBlock(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	// In offline mode the patron is not checked, and scanning starts at once.
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"hutl","NoBlock":true}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatalf("RFID-unit got %q; want BEG without patron check", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	// The checkout has the no block flag, and the alarm is turned off.
+	sipSrv.Respond("121NNY20140303    110236AOhutl|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Errorf("RFID-unit got %q; want alarm turned off", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	want := Message{Action: "CHECKOUT",
+		Item: Item{Label: "Cat's cradle", Barcode: "03011063175001", Date: "31/03/2014"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	req := sipSrv.LastRequest()
+	today := time.Now().Format("20060102")
+	if !strings.HasPrefix(req, "11YY"+today) || !strings.Contains(req, "AA95|") {
+		t.Errorf("SIP checkout request => %q; want no block flag and transaction date %s", req, today)
+	}
+}
+
+// Verify that the alarm of an item is turned off after its SIP checkout,
+// or before it with CheckoutAlarmOrder before, in which case it is turned
+// on again if the checkout is denied.
+func TestCheckoutAlarmOrder(t *testing.T) {
+	for _, order := range []string{checkoutAlarmAfter, checkoutAlarmBefore} {
+		t.Run(order, func(t *testing.T) {
+			// setup ->
+
+			uiChan := make(chan Message)
+			sipSrv := newSIPTestServer()
+			defer sipSrv.Close()
+
+			srv := httptest.NewServer(nil)
+			defer srv.Close()
+
+			d := newDummyRFIDReader()
+			defer d.Close()
+
+			hub = newHub(Config{
+				HTTPPort:           port(srv.URL),
+				SIPServer:          sipSrv.Addr(),
+				RFIDPort:           port(d.addr()),
+				RFIDTimeout:        1 * time.Second,
+				CheckoutAlarmOrder: order,
+			})
+			defer hub.Close()
+
+			a := newDummyUIAgent(uiChan, port(srv.URL))
+			defer a.c.Close()
+
+			// <- end setup
+
+			<-d.incoming // VER2.00
+			d.write([]byte("OK\r"))
+			<-uiChan // CONNECT OK
+
+			if err := a.c.WriteMessage(websocket.TextMessage,
+				[]byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"hutl","NoBlock":true}`)); err != nil {
+				t.Fatal("UI failed to send message over websokcet conn")
+			}
+			<-d.incoming // BEG
+			d.write([]byte("OK\r"))
+
+			// Checked out: the alarm is turned off, after or before SIP
+			requests := sipSrv.Requests()
+			sipSrv.Respond("121NNY20140303    110236AOhutl|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
+			d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+			if msg := <-d.incoming; string(msg) != "OK0\r" {
+				t.Fatalf("RFID-unit got %q; want alarm turned off", msg)
+			}
+			if got, want := sipSrv.Requests()-requests, map[string]int{checkoutAlarmAfter: 1, checkoutAlarmBefore: 0}[order]; got != want {
+				t.Errorf("SIP server got %d requests before alarm was turned off; want %d", got, want)
+			}
+			d.write([]byte("OK\r"))
+			got := <-uiChan
+			want := Message{Action: "CHECKOUT",
+				Item: Item{Label: "Cat's cradle", Barcode: "03011063175001", Date: "31/03/2014"}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Got %+v; want %+v", got, want)
+			}
+
+			// Denied: the alarm is left as is, or turned on again
+			sipSrv.Respond("120NUN20140303    102741AOhutl|AA95|AB03011174511003|AJKrutt-Kim|AH|AFItem checked out to another patron|BLY|\r")
+			d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+			wantCmds := map[string][]string{
+				checkoutAlarmAfter:  {"OK \r"},
+				checkoutAlarmBefore: {"OK0\r", "OK1\r"},
+			}[order]
+			for _, want := range wantCmds {
+				if msg := <-d.incoming; string(msg) != want {
+					t.Fatalf("RFID-unit got %q on denied checkout; want %q", msg, want)
+				}
+				d.write([]byte("OK\r"))
+			}
+			got = <-uiChan
+			want = Message{Action: "CHECKOUT", ErrorCode: CodeTransactionFailed,
+				Item: Item{
+					Label:             "Krutt-Kim",
+					Barcode:           "03011174511003",
+					TransactionFailed: true,
+					Status:            "Item checked out to another patron",
+				}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Got %+v; want %+v", got, want)
+			}
+			if order == checkoutAlarmAfter {
+				return
+			}
+
+			// Denied, and the alarm cannot be turned on again
+			d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+			<-d.incoming // OK0
+			d.write([]byte("OK\r"))
+			<-d.incoming // OK1
+			d.write([]byte("NOK\r"))
+			if got := <-uiChan; !got.Item.AlarmOnFailed || !got.Item.TransactionFailed {
+				t.Errorf("Got %+v; want denied checkout with alarm failed", got)
+			}
+		})
+	}
+}
+
+// Verify that on CHECKIN-CHECKOUT, an item is checked in and out again,
+// and its alarm changed once: turned off if checked out again, or on if
+// it cannot be.
+func TestCheckinCheckout(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:        port(srv.URL),
+		SIPServer:       sipSrv.Addr(),
+		RFIDPort:        port(d.addr()),
+		RFIDTimeout:     1 * time.Second,
+		CheckinCheckout: true,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	var (
+		mu       sync.Mutex
+		requests []string // Commands of the SIP requests
+	)
+	sipSrv.RespondWith(func(req []byte) []byte {
+		mu.Lock()
+		requests = append(requests, string(req[:2]))
+		mu.Unlock()
+		if string(req[:2]) == "23" {
+			return []byte("24              00020140303    110236AOhutl|AA95|AEPatron|BLY|\r")
+		}
+		barcode := "03011063175001"
+		for _, b := range []string{"03011174511003", "03010824124004"} {
+			if strings.Contains(string(req), b) {
+				barcode = b
+			}
+		}
+		switch {
+		case string(req[:2]) == "09":
+			return []byte("101YNN20140226    161239AO|AB" + barcode + "|AQhutl|AJCat's cradle|\r")
+		case barcode == "03011174511003":
+			return []byte("120NUN20140303    102741AOhutl|AA95|AB" + barcode + "|AJKrutt-Kim|AH|AFItem is reserved for another patron|\r")
+		}
+		return []byte("121NNY20140303    110236AOhutl|AA95|AB" + barcode + "|AJCat's cradle|AH20140331    235900|\r")
+	})
+	sipCommands := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		s := strings.Join(requests, ",")
+		requests = nil
+		return s
+	}
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"CHECKIN-CHECKOUT","Patron":"95","Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatalf("RFID-unit got %q; want BEG", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	// Checked in and out again: the alarm is only turned off
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Errorf("RFID-unit got %q; want alarm turned off", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	want := Message{Action: "CHECKIN-CHECKOUT",
+		Item: Item{Label: "Cat's cradle", Barcode: "03011063175001", Date: "31/03/2014"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	if got, want := sipCommands(), "23,09,11"; got != want {
+		t.Errorf("SIP requests => %s; want patron status, checkin and checkout", got)
+	}
+
+	// Read again while lying on the RFID-unit: neither checked in nor
+	// out again
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("RFID-unit got %q; want alarm left as is", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	// Returned, but reserved for another patron: the alarm is only turned on
+	d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Errorf("RFID-unit got %q; want alarm turned on", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKIN-CHECKOUT", ErrorCode: CodeTransactionFailed,
+		Item: Item{Label: "Cat's cradle", Barcode: "03011174511003", Date: "26/02/2014", TransactionFailed: true,
+			Status: "Item is reserved for another patron"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	if got, want := sipCommands(), "09,11"; got != want {
+		t.Errorf("SIP requests => %s; want checkin and checkout", got)
+	}
+
+	// The checkin fails: the error is of the item, whose alarm is left as
+	// is, and the session goes on
+	sipSrv.FailNext(2) // The call is tried twice
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("RFID-unit got %q after SIP error; want alarm left as is", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got = <-uiChan
+	got.ErrorMessage = "" // No way to know the os-assigned port number in error message
+	want = Message{Action: "CHECKIN-CHECKOUT", SIPError: true, ErrorCode: CodeSIPUnavailable,
+		Item: Item{Barcode: "03010824124004", Tag: "1003010824124004:NO:02030000", TransactionFailed: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	sipCommands()
+
+	// Read again, it is checked in and out again
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Errorf("RFID-unit got %q; want alarm turned off", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "CHECKIN-CHECKOUT",
+		Item: Item{Label: "Cat's cradle", Barcode: "03010824124004", Date: "31/03/2014"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	if got, want := sipCommands(), "09,11"; got != want {
+		t.Errorf("SIP requests => %s; want checkin and checkout", got)
+	}
+}
+
+func TestBarcodesSession(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	<-d.incoming
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("1803020120140226    203140AB03010824124004|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
+	<-d.incoming
+	d.write([]byte("OK\r"))
+
+	<-uiChan
+	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
+	<-d.incoming
+	d.write([]byte("OK\r"))
+
+	if got := <-uiChan; got.SIPError {
+		t.Fatalf("Rereading of failed tags triggered multiple SIP-calls")
+	}
+}
+
+func TestWriteLogic(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	sipSrv.Respond("1803020120140226    203140AB03010824124004|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	// The SIP call fails: Koha is told, and the client stays connected
+	sipSrv.FailNext(2) // The call is tried twice
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"ITEM-INFO", "Item": {"Barcode": "03010824124004"}}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if got := <-uiChan; got.Action != "ITEM-INFO" || !got.SIPError {
+		t.Errorf("Got %+v; want ITEM-INFO with SIP error", got)
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"ITEM-INFO", "Item": {"Barcode": "03010824124004"}}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "TGC\r" {
+		t.Fatal("item-info didn't trigger RFID TagCount")
+	}
+
+	d.write([]byte("OK|2\r"))
+
+	got := <-uiChan
+	want := Message{Action: "ITEM-INFO",
+		Item: Item{
+			Label:      "Heavy metal in Baghdad",
+			Barcode:    "03010824124004",
+			HomeBranch: "fhol",
+			NumTags:    2,
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct item info ")
+	}
+
+	// 1. failed write
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"WRITE", "Item": {"Barcode": "03010824124004", "NumTags": 2}}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "SLPLBN|02030000\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("NOK\r"))
+
+	got = <-uiChan
+	want = Message{Action: "WRITE", ErrorCode: CodeWriteFailed,
+		Item: Item{
+			Label:       "Heavy metal in Baghdad",
+			Barcode:     "03010824124004",
+			HomeBranch:  "fhol",
+			WriteFailed: true,
+			NumTags:     2,
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct message of failed write ")
+	}
+
+	// 2. succesfull write
+
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"WRITE", "Item": {"Barcode": "03010824124004", "NumTags": 2}}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "SLPLBN|02030000\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("OK\r"))
+
+	if msg := <-d.incoming; string(msg) != "SLPLBC|NO\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("OK\r"))
+
+	if msg := <-d.incoming; string(msg) != "SLPDTM|DS24\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("OK\r"))
+
+	if msg := <-d.incoming; string(msg) != "SLPSSB|0\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("OK\r"))
+
+	if msg := <-d.incoming; string(msg) != "SLPCRD|1\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("OK\r"))
+
+	if msg := <-d.incoming; string(msg) != "SLPWTM|5000\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("OK\r"))
+
+	if msg := <-d.incoming; string(msg) != "SLPRSS|1\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("OK\r"))
+
+	if msg := <-d.incoming; string(msg) != "TGC\r" {
+		t.Fatal("WRITE command didn't initialize the reader properly")
+	}
+
+	d.write([]byte("OK|2\r"))
+
+	if msg := <-d.incoming; string(msg) != "WRT03010824124004|2|0\r" {
+		t.Fatal("Reader didn't get the right Write command")
+	}
+
+	d.write([]byte("OK|E004010046A847AD|E004010046A847AD\r"))
+
+	if msg := <-d.incoming; string(msg) != "OKR\r" {
+		t.Fatal("Reader didn't get instructed to read back the written tag")
+	}
+
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+
+	got = <-uiChan
+	want = Message{Action: "WRITE",
+		Item: Item{
+			Label:      "Heavy metal in Baghdad",
+			Barcode:    "03010824124004",
+			HomeBranch: "fhol",
+			NumTags:    2,
+			Status:     "OK, preget",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct item info after WRITE command ")
+	}
+
+}
+
+// Test that scanning items for lookup doesn't perform any transaction.
+func TestItemInfoLookup(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"ITEM-INFO"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatal("UI -> ITEM-INFO: RFID-unit didn't get instructed to start scanning")
+	}
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("1804000120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AH20140331    235900|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+
+	got := <-uiChan
+	want := Message{Action: "ITEM-INFO",
+		Item: Item{
+			Label:   "Heavy metal in Baghdad",
+			Barcode: "03010824124004",
+			Date:    "31/03/2014",
+		}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+		t.Fatal("UI didn't get the correct item info")
+	}
+
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Error("Alarm was changed after item lookup")
+	}
+	d.write([]byte("OK\r"))
+}
+
+func TestUserErrors(t *testing.T) {
+
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer().Failing()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"BLA", "this is not well formed json }`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	got := <-uiChan
+	want := Message{Action: "CONNECT", ErrorCode: CodeInvalidRequest, UserError: true,
+		ErrorMessage: "unexpected end of JSON input"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	// Attempt CHECKOUT without sending the patron barcode
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"CHECKOUT"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	got = <-uiChan
+	want = Message{Action: "CHECKOUT", ErrorCode: CodeInvalidRequest, UserError: true,
+		ErrorMessage: "Patron not supplied"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	// CHECKIN-CHECKOUT is not enabled
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"CHECKIN-CHECKOUT","Patron":"95"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	got = <-uiChan
+	want = Message{Action: "CHECKIN-CHECKOUT", ErrorCode: CodeInvalidRequest, UserError: true,
+		ErrorMessage: "CHECKIN-CHECKOUT is not enabled"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+}
+
+func TestMaxMessageSize(t *testing.T) {
+
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:         port(srv.URL),
+		SIPServer:        sipSrv.Addr(),
+		RFIDPort:         port(d.addr()),
+		RFIDTimeout:      1 * time.Second,
+		WSMaxMessageSize: 2 * defaultMaxMessageSize,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	// A message larger than the default limit, but within the configured one
+	branch := strings.Repeat("x", 4*defaultMaxMessageSize/3)
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"CHECKOUT","Branch":"`+branch+`"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	got := <-uiChan
+	want := Message{Action: "CHECKOUT", ErrorCode: CodeInvalidRequest, UserError: true,
+		ErrorMessage: "Patron not supplied"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	// A message larger than the configured limit closes the connection
+	branch = strings.Repeat("x", 4*defaultMaxMessageSize)
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"CHECKOUT","Branch":"`+branch+`"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	if _, ok := <-d.incoming; ok {
+		t.Error("Connection was not closed after a message larger than the limit")
+	}
+}
+
+func TestClientsEndpoint(t *testing.T) {
+
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK|RFID-U 2.03.18\r"))
+	if got, want := <-uiChan, (Message{Action: "CONNECT", RFIDVersion: "RFID-U 2.03.18",
+		Protocol: maxProtocolVersion, MinProtocol: minProtocolVersion, MaxProtocol: maxProtocolVersion}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v; want %+v", got, want)
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CTfbol|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("NOK\r"))
+	<-uiChan // CHECKIN, alarm on failed
+
+	want := []ClientStatus{{
+		IP:            "127.0.0.1",
+		Branch:        "fmaj",
+		State:         RFIDCheckin,
+		Barcode:       "03010824124004",
+		FailedAlarmOn: 1,
+		RFIDVersion:   "RFID-U 2.03.18",
+	}}
+	var got []ClientStatus
+	// The status is updated right after the message to Koha is sent
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		hub.ServeClients(rec, httptest.NewRequest("GET", "/clients", nil))
+		got = nil
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("GET /clients => %+v; want %+v", got, want)
+}
+
+func TestHubShutdown(t *testing.T) {
+
+	// setup ->
+
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+
+	var got Message
+	if err := ws.ReadJSON(&got); err != nil || got.Action != "CONNECT" {
+		t.Fatalf("UI didn't get CONNECT: %+v, %v", got, err)
+	}
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	shutdown := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- hub.Shutdown(ctx)
+	}()
+
+	if err := ws.ReadJSON(&got); err != nil || got.Action != "CLOSE" {
+		t.Fatalf("UI didn't get CLOSE: %+v, %v", got, err)
+	}
+
+	// New clients are refused while shutting down
+	if _, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL)), nil); err == nil {
+		t.Error("Hub accepted a new client while shutting down")
+	}
+
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatalf("Shutdown: RFID-unit didn't get instructed to stop scanning, got %q", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Hub.Shutdown() => %v; want nil", err)
+	}
+
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("UI connection closed with %v; want normal close", err)
+	}
+}
+
+// Verify that when Koha closes the websocket during a transaction, ex when
+// the page is left, the RFID-unit is told to stop scanning before its
+// connection is closed.
+func TestEndScanOnClose(t *testing.T) {
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKIN
+
+	// The page is left mid-session
+	if err := a.c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Errorf("RFID-unit got %q; want END when the websocket closed", msg)
+	}
+	if _, ok := <-d.incoming; ok {
+		t.Error("RFID connection was not closed after END")
+	}
+}
+
+// Verify that if a second websocket connection is opened from the same IP,
+// the first connection is closed.
+func TestDuplicateClientEvict(t *testing.T) {
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	var got Message
+	if err := ws.ReadJSON(&got); err != nil || got.Action != "CONNECT" {
+		t.Fatalf("UI didn't get CONNECT: %+v, %v", got, err)
+	}
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// The first connection is closed, and its RFID connection released
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Error("First connection from the same IP was not closed")
+	}
+	if _, ok := <-d.incoming; ok {
+		t.Error("RFID connection of the first client was not closed")
+	}
+	// The dummy RFID-unit accepts only one connection, so the new client
+	// fails to connect to it, but it is not refused by the hub.
+	if got := <-uiChan; got.Action != "CONNECT" || got.UserError || !got.RFIDError {
+		t.Errorf("Got %+v; want CONNECT failing on the RFID-unit, not refused", got)
+	}
+}
+
+// Verify that with the reject policy, a second websocket connection from the
+// same IP is refused, and the first connection kept.
+func TestDuplicateClientReject(t *testing.T) {
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:         port(srv.URL),
+		SIPServer:        sipSrv.Addr(),
+		RFIDPort:         port(d.addr()),
+		RFIDTimeout:      1 * time.Second,
+		DuplicateClients: duplicateReject,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	var got Message
+	want := Message{Action: "CONNECT", ErrorCode: CodeRFIDInUse, UserError: true,
+		ErrorMessage: "RFID-unit is already in use by another connection"}
+	if err := ws.ReadJSON(&got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, %v; want %+v", got, err, want)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Refused connection closed with %v; want policy violation", err)
+	}
+
+	// The first client still works
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Errorf("First client: RFID-unit didn't get instructed to start scanning, got %q", msg)
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	cfg := Config{
+		HTTPPort:    port(srv.URL),
+		RFIDTimeout: 1 * time.Second,
+	}
+	if err := simulate(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	hub = newHub(cfg)
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	if got, want := <-uiChan, (Message{Action: "CONNECT", RFIDVersion: fake.Version,
+		Protocol: maxProtocolVersion, MinProtocol: minProtocolVersion, MaxProtocol: maxProtocolVersion}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v; want %+v", got, want)
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	// All the test items are on the fake RFID-unit, and are checked in one by one.
+	want := []Item{
+		{Barcode: "03010824124004", Label: "Heavy metal in Baghdad", Transfer: "fhol"},
+		{Barcode: "03011063175001", Label: "Cat's cradle"},
+		{Barcode: "03011143299001", Label: "316 salmer og sanger", Transfer: "fmaj", InTransit: true, Borrowernr: "95"},
+	}
+	for _, w := range want {
+		got := <-uiChan
+		if got.Action != "CHECKIN" || got.Item.Date == "" {
+			t.Fatalf("Got %+v; want successful CHECKIN", got)
+		}
+		got.Item.Date = ""
+		if !reflect.DeepEqual(got.Item, w) {
+			t.Errorf("Got %+v; want %+v", got.Item, w)
+		}
+	}
+}
+
+func TestRFIDSelfTest(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	cfg := Config{
+		HTTPPort:    port(srv.URL),
+		RFIDTimeout: 1 * time.Second,
+	}
+	if err := simulate(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	hub = newHub(cfg)
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-uiChan // CONNECT
+
+	// The items on the fake RFID-unit are read while scanning, and are
+	// discarded.
+	tag := fake.Tag("03010824124004")
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"TEST","Branch":"hutl","Item":{"Tag":"`+tag+`"}}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	want := Message{Action: "TEST", RFIDVersion: fake.Version, Item: Item{Tag: tag},
+		TestReport: []TestStep{{"VERSION", true}, {"BEGIN-SCAN", true}, {"END-SCAN", true}, {"ALARM-OFF", true}, {"ALARM-ON", true}}}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v; want %+v", got, want)
+	}
+
+	// A test tag which Koha says is unsecured is left so.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"TEST","Branch":"hutl","Item":{"Tag":"`+tag+`","SecurityBefore":"UNSECURE"}}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	wantReport := []TestStep{{"VERSION", true}, {"BEGIN-SCAN", true}, {"END-SCAN", true}, {"ALARM-ON", true}, {"ALARM-OFF", true}}
+	if got := <-uiChan; !reflect.DeepEqual(got.TestReport, wantReport) {
+		t.Fatalf("Got report %+v; want %+v", got.TestReport, wantReport)
+	}
+
+	// The RFID-unit is left ready for transactions.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" || got.Item.TransactionFailed {
+		t.Errorf("Got %+v; want successful CHECKIN after TEST", got)
+	}
+}
+
+// Verify that with Config.UseAFI, the security of the test tag is read
+// first, and restored after the alarm was toggled.
+func TestRFIDSelfTestRestoresAFI(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	cfg := Config{
+		HTTPPort:    port(srv.URL),
+		RFIDTimeout: 1 * time.Second,
+		UseAFI:      true,
+		Security:    SecurityPolicy{AFISecure: 0x07, AFIUnsecure: 0xC2},
+	}
+	if err := simulate(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	hub = newHub(cfg)
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-uiChan // CONNECT
+
+	tag := fake.Tag("03010824124004")
+	tests := []struct {
+		action   string // Leaving the test tag with the security
+		security string
+		report   []TestStep
+	}{
+		{"SENSITIZE", "SECURE", []TestStep{{"VERSION", true}, {"BEGIN-SCAN", true}, {"END-SCAN", true},
+			{"READ-AFI", true}, {"ALARM-OFF", true}, {"ALARM-ON", true}}},
+		{"DEACTIVATE", "UNSECURE", []TestStep{{"VERSION", true}, {"BEGIN-SCAN", true}, {"END-SCAN", true},
+			{"READ-AFI", true}, {"ALARM-ON", true}, {"ALARM-OFF", true}}},
+	}
+	for _, test := range tests {
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"`+test.action+`","Branch":"hutl"}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		if got := <-uiChan; got.Action != test.action || got.Item.SecurityAfter != test.security {
+			t.Fatalf("Got %+v; want %s leaving the tag %s", got, test.action, test.security)
+		}
+
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"TEST","Branch":"hutl","Item":{"Tag":"`+tag+`"}}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		want := Message{Action: "TEST", RFIDVersion: fake.Version,
+			Item:       Item{Tag: tag, SecurityBefore: test.security, SecurityAfter: test.security},
+			TestReport: test.report}
+		if got := <-uiChan; !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %+v; want %+v", got, want)
+		}
+	}
+}
+
+func TestRFIDSelfTestFailure(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	// Without a test tag, the alarm is not tested.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"TEST"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // VER2.00
+	d.write([]byte("OK|RFID-U 2.03.18\r"))
+	<-d.incoming // BEG
+	d.write([]byte("NOK\r"))
+
+	// Scanning is stopped even though it failed to start.
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatalf("RFID-unit got %q; want END", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	want := []TestStep{{"VERSION", true}, {"BEGIN-SCAN", false}, {"END-SCAN", true}}
+	if got.Action != "TEST" || got.RFIDVersion != "RFID-U 2.03.18" || !reflect.DeepEqual(got.TestReport, want) ||
+		got.ErrorCode != CodeRFIDNOK || got.ErrorMessage == "" {
+		t.Errorf("Got %+v; want TEST report %+v with error", got, want)
+	}
+
+	// Only an idle RFID-unit can be tested.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"TEST"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if got := <-uiChan; got.Action != "TEST" || !got.UserError || got.ErrorCode != CodeInvalidRequest {
+		t.Errorf("Got %+v; want TEST refused during checkin", got)
+	}
+}
+
+// fakeClock is a clock where time only passes when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	armed  *sync.Cond // Signalled when a timer is armed, if waited for
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	at     time.Time
+	active bool
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1), at: f.now.Add(d), active: true}
+	f.timers = append(f.timers, t)
+	f.signalArmed()
+	return t
+}
+
+// waitArmed blocks until n timers are armed, ex until a goroutine has
+// armed its timer, or armed it again after it fired, so that advancing the
+// clock fires it.
+func (f *fakeClock) waitArmed(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.armed == nil {
+		f.armed = sync.NewCond(&f.mu)
+	}
+	for {
+		active := 0
+		for _, t := range f.timers {
+			if t.active {
+				active++
+			}
+		}
+		if active >= n {
+			return
+		}
+		f.armed.Wait()
+	}
+}
+
+func (f *fakeClock) signalArmed() {
+	if f.armed != nil {
+		f.armed.Broadcast()
+	}
+}
+
+// Advance moves the time forward by d, and fires the timers which expire.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for _, t := range f.timers {
+		if t.active && !t.at.After(f.now) {
+			t.active = false
+			t.c <- f.now
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.at = t.clock.now.Add(d)
+	t.active = true
+	if d <= 0 {
+		// Fires at once, as a time.Timer does.
+		t.active = false
+		select {
+		case t.c <- t.clock.now:
+		default:
+		}
+	}
+	t.clock.signalArmed()
+	return wasActive
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	clock := &fakeClock{now: time.Now()}
+	hub = newHub(Config{
+		HTTPPort:           port(srv.URL),
+		SIPServer:          sipSrv.Addr(),
+		RFIDPort:           port(d.addr()),
+		RFIDTimeout:        1 * time.Second,
+		SessionIdleTimeout: time.Minute,
+	})
+	hub.clock = clock
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	checkin := func(barcode string) {
+		sipSrv.Respond("101YNN20140226    161239AO|AB" + barcode + "|AQfhol|AJHeavy metal in Baghdad|\r")
+		d.write([]byte("RDT10" + barcode + ":NO:02030000|0\r"))
+		if msg := <-d.incoming; string(msg) != "OK1\r" {
+			t.Fatalf("RFID-unit got %q; want OK1", msg)
+		}
+		d.write([]byte("OK\r"))
+		if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != barcode {
+			t.Fatalf("Got %+v; want CHECKIN of %s", got, barcode)
+		}
+	}
+	checkin("03010824124004")
+
+	// Activity within the timeout keeps the session going. Were the session
+	// ended, the RFID-unit would get END instead.
+	clock.Advance(59 * time.Second)
+	checkin("03011063175001")
+
+	// The timeout runs from the last response of the RFID-unit, however
+	// long it took to handle.
+	clock.Advance(time.Minute)
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatalf("RFID-unit got %q after session timed out; want END", msg)
+	}
+	if got, want := <-uiChan, (Message{Action: "TIMEOUT"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	d.write([]byte("OK\r"))
+
+	// The session is ended, so the checked in item is forgotten, and
+	// checked in again in the next session.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	checkin("03010824124004")
+}
+
+// Verify that RENEW renews the item read on the RFID-unit for the patron,
+// leaves its alarm as it is, and reports the new due date.
+func TestRenew(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+		// The barcodes of the tags differ from the tags, by which items
+		// are identified to the SIP server.
+		BarcodeRules: map[string]BarcodeRules{"02030000": {Strip: "^10", TrimPrefix: "0301", MinLength: 10}},
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RENEW","Branch":"fmaj","Patron":"95"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatalf("RFID-unit got %q; want BEG", msg)
+	}
+	d.write([]byte("OK\r"))
+	waitForState(t, RFIDRenew)
+
+	sipSrv.Respond("301YNN20140303    110236AOfmaj|AA95|AB03011063175001|AJCat's cradle|AH20140428    235900|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Fatalf("RFID-unit got %q; want alarm left as is", msg)
+	}
+	if req := sipSrv.LastRequest(); !strings.HasPrefix(req, "29") || !strings.Contains(req, "|AA95|") || !strings.Contains(req, "|AB1003011063175001:NO:02030000|") {
+		t.Errorf("SIP server got %q; want renewal of 1003011063175001:NO:02030000 for patron 95", req)
+	}
+	d.write([]byte("OK\r"))
+
+	got := <-uiChan
+	if got.Action != "RENEW" || got.Item.Barcode != "03011063175001" || got.Item.TransactionFailed ||
+		got.Item.Label != "Cat's cradle" || got.Item.Date != "28/04/2014" {
+		t.Errorf("Got %+v; want RENEW of 03011063175001 due 28/04/2014", got)
+	}
+	waitForState(t, RFIDRenew)
+}
+
+// Verify that Koha is told of a SIP call being retried, without an error
+// flag, as the transaction may still succeed.
+func TestCheckinSIPRetrying(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:     port(srv.URL),
+		SIPServer:    sipSrv.Addr(),
+		RFIDPort:     port(d.addr()),
+		RFIDTimeout:  1 * time.Second,
+		SIPRetries:   1,
+		SIPRetryWait: time.Millisecond,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	sipSrv.FailNext(1)
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	got := <-uiChan
+	if got.Action != "RETRYING" || got.SIPError || got.ErrorCode != CodeSIPUnavailable {
+		t.Errorf("Got %+v; want RETRYING without SIPError", got)
+	}
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want alarm on", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" || got.SIPError {
+		t.Errorf("Got %+v; want item checked in after retry", got)
+	}
+}
+
+func TestDeadmanTimeout(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	clock := &fakeClock{now: time.Now()}
+	hub = newHub(Config{
+		HTTPPort:       port(srv.URL),
+		SIPServer:      sipSrv.Addr(),
+		RFIDPort:       port(d.addr()),
+		RFIDTimeout:    1 * time.Second,
+		DeadmanTimeout: time.Minute,
+	})
+	hub.clock = clock
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	// The RFID-unit never responds to BEG, and there is no response
+	// timeout, so the client waits for it until the deadman fires.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG, not answered
+
+	var msg []byte
+	for i := 0; i < 50 && msg == nil; i++ {
+		clock.Advance(30 * time.Second)
+		select {
+		case msg = <-d.incoming:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if string(msg) != "END\r" {
+		t.Fatalf("RFID-unit got %q when client was stuck; want END", msg)
+	}
+	want := Message{Action: "CANCEL", ErrorCode: CodeClientReset, ErrorMessage: "client stuck for 1m0s, and reset"}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+	d.write([]byte("OK\r"))
+	waitForState(t, RFIDIdle)
+
+	// The client has recovered, and starts a new session.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatalf("RFID-unit got %q after client was reset; want BEG", msg)
+	}
+	d.write([]byte("OK\r"))
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want alarm on", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" {
+		t.Errorf("Got %+v; want item checked in after client was reset", got)
+	}
+
+	// A scanning client waits for the next item, and is never reset.
+	clock.Advance(2 * time.Minute)
+	select {
+	case msg := <-d.incoming:
+		t.Fatalf("RFID-unit got %q while scanning; want nothing", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMaxSessionItems(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:        port(srv.URL),
+		SIPServer:       sipSrv.Addr(),
+		RFIDPort:        port(d.addr()),
+		RFIDTimeout:     1 * time.Second,
+		MaxSessionItems: 2,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// Unknown items are not kept, and don't count.
+	sipSrv.Respond("100NUY20140128    114702AO|AB1234|CV99|AFItem not checked out|\r")
+	d.write([]byte("RDT1234:NO:02030000|0\r"))
+	<-d.incoming // OK
+	d.write([]byte("OK\r"))
+	<-uiChan // UNKNOWN-TAG
+	<-uiChan // CHECKIN, unknown
+
+	for _, tag := range []string{"1003010824124004", "1003011063175001"} {
+		sipSrv.Respond("101YNN20140226    161239AO|AB" + tag[2:] + "|AQfmaj|AJHeavy metal in Baghdad|\r")
+		d.write([]byte("RDT" + tag + ":NO:02030000|0\r"))
+		if msg := <-d.incoming; string(msg) != "OK1\r" {
+			t.Fatalf("RFID-unit got %q; want OK1", msg)
+		}
+		d.write([]byte("OK\r"))
+		if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != tag[2:] {
+			t.Fatalf("Got %+v; want CHECKIN of %s", got, tag[2:])
+		}
+	}
+
+	// The second item fills the session, which is ended.
+	got := <-uiChan
+	if got.Action != "SESSION-FULL" || got.ErrorMessage == "" {
+		t.Errorf("Got %+v; want SESSION-FULL", got)
+	}
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatalf("RFID-unit got %q; want END", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	var status []ClientStatus
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		hub.ServeClients(rec, httptest.NewRequest("GET", "/clients", nil))
+		status = nil
+		json.Unmarshal(rec.Body.Bytes(), &status)
+		if len(status) == 1 && status[0].State == RFIDIdle {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(status) != 1 || status[0].State != RFIDIdle {
+		t.Errorf("client status after SESSION-FULL: %+v; want idle", status)
+	}
+
+	// Koha starts a new session.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Errorf("RFID-unit got %q; want BEG of new session", msg)
+	}
+}
 
-	// Simulate book on RFID-unit, but SIP show that book is already checked out.
-	// Verify that UI gets notified with the books title, along with an error message
-	sipSrv.Respond("120NUN20140303    102741AOHUTL|AA95|AB03011174511003|AJKrutt-Kim|AH|AFItem checked out to another patron|BLY|\r")
-	d.write([]byte("RDT1003011174511003:NO:02030000|0\r"))
+func TestCancel(t *testing.T) {
+	const checkinResp = "101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|AA2|CS927.8|\r"
 
-	if msg := <-d.incoming; string(msg) != "OK \r" {
-		t.Errorf("Alarm was changed after unsuccessful checkout")
+	tests := []struct {
+		desc      string
+		setup     func(d *dummyRFID, a *dummyUIAgent, sipSrv *SIPTestServer, uiChan chan Message)
+		attention []string
+		late      string // Late response to the command pending at CANCEL
+	}{
+		{"idle", func(d *dummyRFID, a *dummyUIAgent, sipSrv *SIPTestServer, uiChan chan Message) {}, nil, ""},
+		{"scanning for checkin", func(d *dummyRFID, a *dummyUIAgent, sipSrv *SIPTestServer, uiChan chan Message) {
+			a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+			<-d.incoming // BEG
+			d.write([]byte("OK\r"))
+		}, nil, ""},
+		{"turning alarm on", func(d *dummyRFID, a *dummyUIAgent, sipSrv *SIPTestServer, uiChan chan Message) {
+			a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+			<-d.incoming // BEG
+			d.write([]byte("OK\r"))
+			sipSrv.Respond(checkinResp)
+			d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+			<-d.incoming // OK1, not answered
+		}, []string{"03010824124004"}, "OK\r"},
+		{"alarm on failed", func(d *dummyRFID, a *dummyUIAgent, sipSrv *SIPTestServer, uiChan chan Message) {
+			a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+			<-d.incoming // BEG
+			d.write([]byte("OK\r"))
+			sipSrv.Respond(checkinResp)
+			d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+			<-d.incoming // OK1
+			d.write([]byte("NOK\r"))
+			<-uiChan // CHECKIN, alarm on failed
+		}, []string{"03010824124004"}, ""},
+		{"turning alarm off", func(d *dummyRFID, a *dummyUIAgent, sipSrv *SIPTestServer, uiChan chan Message) {
+			sipSrv.Respond("24              00020140303    110236AOHUTL|AA95|AEPatron|BLY|\r")
+			a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT","Branch":"hutl","Patron":"95"}`))
+			<-d.incoming // BEG
+			d.write([]byte("OK\r"))
+			sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
+			d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+			<-d.incoming // OK0, not answered
+		}, []string{"03011063175001"}, "NOK\r"},
+		{"writing", func(d *dummyRFID, a *dummyUIAgent, sipSrv *SIPTestServer, uiChan chan Message) {
+			sipSrv.Respond("1803020120140226    203140AB03010824124004|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+			a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"ITEM-INFO","Item":{"Barcode":"03010824124004"}}`))
+			<-d.incoming // TGC
+			d.write([]byte("OK|1\r"))
+			<-uiChan // ITEM-INFO
+			a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"WRITE","Item":{"NumTags":1}}`))
+			for {
+				msg := string(<-d.incoming)
+				if strings.HasPrefix(msg, "WRT") {
+					break // not answered
+				}
+				if msg == "TGC\r" {
+					d.write([]byte("OK|1\r"))
+				} else {
+					d.write([]byte("OK\r"))
+				}
+			}
+		}, []string{"03010824124004"}, "OK|E004010046A847AD\r"},
+	}
+
+	for _, test := range tests {
+		uiChan := make(chan Message)
+		sipSrv := newSIPTestServer()
+		srv := httptest.NewServer(nil)
+		d := newDummyRFIDReader()
+		hub = newHub(Config{
+			HTTPPort:    port(srv.URL),
+			SIPServer:   sipSrv.Addr(),
+			RFIDPort:    port(d.addr()),
+			RFIDTimeout: 1 * time.Second,
+		})
+		a := newDummyUIAgent(uiChan, port(srv.URL))
+
+		<-d.incoming // VER2.00
+		d.write([]byte("OK\r"))
+		<-uiChan // CONNECT OK
+
+		test.setup(d, a, sipSrv, uiChan)
+
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CANCEL"}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		got := <-uiChan
+		want := Message{Action: "CANCEL", Attention: test.attention}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Got %+v; want %+v", test.desc, got, want)
+		}
+		// END is sent when the pending command is answered, and its
+		// response is not taken as the response to END.
+		d.write([]byte(test.late))
+		if msg := <-d.incoming; string(msg) != "END\r" {
+			t.Errorf("%s: RFID-unit got %q after CANCEL; want END", test.desc, msg)
+		}
+		waitForState(t, RFIDWaitForEndOK)
+		d.write([]byte("OK\r"))
+
+		var status []ClientStatus
+		for i := 0; i < 10; i++ {
+			rec := httptest.NewRecorder()
+			hub.ServeClients(rec, httptest.NewRequest("GET", "/clients", nil))
+			status = nil
+			json.Unmarshal(rec.Body.Bytes(), &status)
+			if len(status) == 1 && status[0].State == RFIDIdle && status[0].Barcode == "" && status[0].FailedAlarmOn == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(status) != 1 || status[0].State != RFIDIdle || status[0].Barcode != "" || status[0].FailedAlarmOn != 0 {
+			t.Errorf("%s: client status after CANCEL: %+v; want idle", test.desc, status)
+		}
+
+		a.c.Close()
+		hub.Close()
+		d.Close()
+		srv.Close()
+		sipSrv.Close()
+	}
+}
+
+func TestCheckinMode(t *testing.T) {
+	for _, mode := range []string{checkinBatch, checkinSingle} {
+		t.Run(mode, func(t *testing.T) {
+			// setup ->
+
+			uiChan := make(chan Message)
+			sipSrv := newSIPTestServer()
+			defer sipSrv.Close()
+
+			srv := httptest.NewServer(nil)
+			defer srv.Close()
+
+			d := newDummyRFIDReader()
+			defer d.Close()
+
+			hub = newHub(Config{
+				HTTPPort:    port(srv.URL),
+				SIPServer:   sipSrv.Addr(),
+				RFIDPort:    port(d.addr()),
+				RFIDTimeout: 1 * time.Second,
+				CheckinMode: mode,
+			})
+			defer hub.Close()
+
+			a := newDummyUIAgent(uiChan, port(srv.URL))
+			defer a.c.Close()
+			// <- end setup
+
+			<-d.incoming // VER2.00
+			d.write([]byte("OK\r"))
+			<-uiChan // CONNECT OK
+
+			items := []struct{ barcode, sip string }{
+				{"03010824124004", "101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|\r"},
+				{"03011063175001", "101YNN20140226    161239AO|AB03011063175001|AQhutl|AJCat's cradle|\r"},
+			}
+			for i, item := range items {
+				if i == 0 || mode == checkinSingle {
+					// In single mode, Koha starts a new checkin for each item.
+					if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+						t.Fatal("UI failed to send message over websokcet conn")
+					}
+					if msg := <-d.incoming; string(msg) != "BEG\r" {
+						t.Fatalf("item %d: RFID-unit got %q; want BEG", i, msg)
+					}
+					d.write([]byte("OK\r"))
+				}
+				sipSrv.Respond(item.sip)
+				d.write([]byte("RDT10" + item.barcode + ":NO:02030000|0\r"))
+				if msg := <-d.incoming; string(msg) != "OK1\r" {
+					t.Fatalf("item %d: RFID-unit got %q; want OK1", i, msg)
+				}
+				d.write([]byte("OK\r"))
+				if mode == checkinSingle {
+					// Scanning is stopped after each item, before Koha gets
+					// the result.
+					if msg := <-d.incoming; string(msg) != "END\r" {
+						t.Fatalf("item %d: RFID-unit got %q; want END", i, msg)
+					}
+					d.write([]byte("OK\r"))
+				}
+				if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != item.barcode {
+					t.Errorf("item %d: got %+v; want CHECKIN of %s", i, got, item.barcode)
+				}
+			}
+
+			if mode == checkinBatch {
+				// Scanning continues until Koha ends it.
+				if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+					t.Fatal("UI failed to send message over websokcet conn")
+				}
+				if msg := <-d.incoming; string(msg) != "END\r" {
+					t.Fatalf("RFID-unit got %q; want END", msg)
+				}
+				d.write([]byte("OK\r"))
+			}
+
+			// Either way, the session ends with the items cleared.
+			var status []ClientStatus
+			for i := 0; i < 100; i++ {
+				rec := httptest.NewRecorder()
+				hub.ServeClients(rec, httptest.NewRequest("GET", "/clients", nil))
+				status = nil
+				json.Unmarshal(rec.Body.Bytes(), &status)
+				if len(status) == 1 && status[0].State == RFIDIdle {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(status) != 1 || status[0].State != RFIDIdle || status[0].Barcode != "" || status[0].FailedAlarmOn != 0 {
+				t.Errorf("status => %+v; want idle client without items", status)
+			}
+		})
 	}
+}
+
+// Verify that Koha is told which items need attention, when it ends a
+// single mode checkin kept scanning for items to retry.
+func TestCheckinSingleEnd(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+		CheckinMode: checkinSingle,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
 
+	<-d.incoming // VER2.00
 	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
 
-	got = <-uiChan
-	want = Message{Action: "CHECKOUT",
-		Item: Item{
-			Label:             "Krutt-Kim",
-			Barcode:           "03011174511003",
-			TransactionFailed: true,
-			Status:            "Item checked out to another patron",
-		}}
-	if !reflect.DeepEqual(got, want) {
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The alarm fails, so scanning continues for a retry.
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	d.write([]byte("NOK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || !got.Item.AlarmOnFailed {
+		t.Errorf("Got %+v; want CHECKIN with alarm failed", got)
+	}
+	waitForState(t, RFIDCheckin)
+
+	// Koha ends the checkin instead of retrying.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatalf("RFID-unit got %q; want END", msg)
+	}
+	d.write([]byte("OK\r"))
+	want := Message{Action: "END", Attention: []string{"03010824124004"}}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
 		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct message when item is already checked out to another patron")
 	}
+}
 
-	// Test successful checkout
-	sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
-	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+func TestCheckinItemEvents(t *testing.T) {
+	// setup ->
 
-	if msg := <-d.incoming; string(msg) != "OK0\r" {
-		t.Errorf("Alarm was not turned off after successful checkout")
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+		ItemEvents:  true,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
 	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
 
-	// simulate failed alarm
-	d.write([]byte("NOK\r"))
+	// The SIP-server gives the barcode in another form than the tag.
+	sipSrv.Respond("101YNN20140226    161239AO|AB3010824124004|AQfhol|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
 
-	got = <-uiChan
-	want = Message{Action: "CHECKOUT",
+	// The UI gets the item before the alarm is turned on.
+	got := <-uiChan
+	want := Message{Action: "ITEM",
 		Item: Item{
-			Label:          "Cat's cradle",
-			Barcode:        "03011063175001",
-			Date:           "31/03/2014",
-			AlarmOffFailed: true,
-			Status:         "Feil: fikk ikke skrudd av alarm.",
+			Label:    "Heavy metal in Baghdad",
+			Barcode:  "03010824124004",
+			Date:     "26/02/2014",
+			Transfer: "fhol",
 		}}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct message after succesfull checkout")
 	}
 
-	// retry alarm off
-	if err := a.c.WriteMessage(
-		websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-OFF"}`)); err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
 	}
+	d.write([]byte("OK\r"))
 
-	if msg := <-d.incoming; string(msg) != "DAC1003011063175001:NO:02030000\r" {
-		t.Errorf("Got %q, Want DAC1003011063175001:NO:02030000", msg)
-		t.Fatal("UI -> RETRY-ALARM-ON didn't trigger the right RFID command")
+	// The final result has the same barcode.
+	got = <-uiChan
+	want.Action = "CHECKIN"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
 	}
 
-	d.write([]byte("OK\r"))
-
+	// Items with missing tags are sent too.
+	sipSrv.Respond("1803020120140226    203140AB03011063175001|AO|AJCat's cradle|AQhutl|BGhutl|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|1\r"))
 	got = <-uiChan
-	want = Message{Action: "CHECKOUT",
+	want = Message{Action: "ITEM", ErrorCode: CodePartsMissing,
 		Item: Item{
-			Label:   "Cat's cradle",
-			Barcode: "03011063175001",
-			Date:    "31/03/2014",
+			Label:             "Cat's cradle",
+			Barcode:           "03011063175001",
+			TransactionFailed: true,
+			TagCountFailed:    true,
 		}}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct message after succesfull checkout")
 	}
+	<-d.incoming // OK
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKIN
+}
+
+// readKoha reads the next message to Koha from ws, or fails the test if
+// none arrives within a second.
+func readKoha(t *testing.T, ws *websocket.Conn) Message {
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var msg Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("no message to Koha: %v", err)
+	}
+	return msg
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	const writers, msgs = 8, 50
+
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(srv.URL, "http://"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	conn := <-conns
+	defer conn.Close()
+
+	// Messages to Koha and pings are written from different goroutines.
+	c := &Client{log: logger, hub: &Hub{config: Config{WSAckTimeout: time.Minute}}, conn: conn}
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < msgs; j++ {
+				if err := c.sendToKoha(Message{Action: "CHECKIN", Item: Item{Barcode: fmt.Sprintf("%d-%d", i, j)}}); err != nil {
+					t.Error(err)
+				}
+				if err := c.write(websocket.PingMessage, nil); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	// Every message is received as a well-formed frame.
+	ids := make(map[uint64]bool)
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for len(ids) < writers*msgs {
+		_, b, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("after %d messages: %v", len(ids), err)
+		}
+		var msg Message
+		if err := json.Unmarshal(b, &msg); err != nil || msg.Action != "CHECKIN" || msg.ID == 0 {
+			t.Fatalf("got %q, %v; want CHECKIN message with ID", b, err)
+		}
+		ids[msg.ID] = true
+	}
+	wg.Wait()
+}
+
+// Verify that Koha is pinged while the connection is idle, that the
+// connection is kept open as long as Koha answers with a pong, and that it
+// is closed when Koha stops answering.
+func TestPing(t *testing.T) {
+	// setup ->
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+		WSPongWait:  200 * time.Millisecond,
+	})
+	defer hub.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// <- end setup
+
+	var answer int32 = 1
+	pings := make(chan struct{}, 10)
+	ws.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		if atomic.LoadInt32(&answer) == 0 {
+			return nil
+		}
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+
+	// Pinged for well beyond the pong wait, without being disconnected.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pings:
+		case <-closed:
+			t.Fatalf("connection closed after %d pings answered", i)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d pings; want 3", i)
+		}
+	}
+
+	atomic.StoreInt32(&answer, 0)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection still open after Koha stopped answering pings")
+	}
+}
+
+func TestStalledClient(t *testing.T) {
+	cfg := Config{ClientQueueSize: 1, ClientStallTimeout: 50 * time.Millisecond}
+
+	// Koha: the reader gives up on a client which doesn't take messages,
+	// and closes the connection.
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(srv.URL, "http://"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	c := &Client{log: logger, hub: &Hub{config: cfg}, conn: <-conns,
+		fromKoha: make(chan Message, cfg.ClientQueueSize)}
+	c.ctx, c.stop = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	c.running.Add(1)
+	go func() {
+		c.readFromKoha(c.ctx)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader of messages from Koha blocked on stuck client")
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Error("connection to Koha not closed after client got stuck")
+	}
+	if !c.closing() {
+		t.Error("stuck client not shut down")
+	}
+
+	// RFID-unit: the reader gives up, and shuts down the client.
+	rfidConn, unit := net.Pipe()
+	defer unit.Close()
+	c = &Client{log: logger, hub: &Hub{config: cfg}, rfid: newRFIDManager(), rfidconn: rfidConn,
+		fromRFID: make(chan RFIDResp, cfg.ClientQueueSize)}
+	c.ctx, c.stop = context.WithCancel(context.Background())
+	done = make(chan struct{})
+	c.running.Add(1)
+	go func() {
+		c.readFromRFID(c.ctx, getReader(rfidConn))
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := unit.Write([]byte("OK\r")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader of RFID responses blocked on stuck client")
+	}
+	if !c.closing() {
+		t.Error("stuck client not shut down")
+	}
+}
+
+func TestAckRetransmit(t *testing.T) {
+	// setup ->
+
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:     port(srv.URL),
+		SIPServer:    sipSrv.Addr(),
+		RFIDPort:     port(d.addr()),
+		RFIDTimeout:  1 * time.Second,
+		WSAckTimeout: 50 * time.Millisecond,
+		WSAckRetries: 3,
+	})
+	defer hub.Close()
+
+	// A fake Koha, acknowledging messages itself.
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+
+	// CONNECT is dropped, and retransmitted with the same ID.
+	got := readKoha(t, ws)
+	if got.Action != "CONNECT" || got.ID != 1 {
+		t.Fatalf("got %+v; want CONNECT with ID 1", got)
+	}
+	got = readKoha(t, ws)
+	if got.Action != "CONNECT" || got.ID != 1 {
+		t.Fatalf("got %+v; want retransmitted CONNECT with ID 1", got)
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"Action":"ACK","ID":1}`))
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+
+	got = readKoha(t, ws)
+	if got.Action != "CHECKIN" || got.ID != 2 || got.Item.Barcode != "03010824124004" {
+		t.Fatalf("got %+v; want CHECKIN of 03010824124004 with ID 2", got)
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"Action":"ACK","ID":2}`))
+
+	// Acknowledged messages are not retransmitted.
+	ws.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var msg Message
+	if err := ws.ReadJSON(&msg); err == nil {
+		t.Errorf("got %+v after ACK; want no more messages", msg)
+	}
+}
+
+func TestAckGiveUp(t *testing.T) {
+	// setup ->
+
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:     port(srv.URL),
+		SIPServer:    sipSrv.Addr(),
+		RFIDPort:     port(d.addr()),
+		RFIDTimeout:  1 * time.Second,
+		WSAckTimeout: 20 * time.Millisecond,
+		WSAckRetries: 2,
+	})
+	defer hub.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
 
+	// Koha never acknowledges CONNECT; after the retransmits, the hub
+	// closes the connection.
+	for i := 0; i < 3; i++ {
+		if got := readKoha(t, ws); got.Action != "CONNECT" || got.ID != 1 {
+			t.Fatalf("got %+v; want CONNECT with ID 1", got)
+		}
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("got message; want connection closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection not closed after retransmits")
+	}
 }
 
-// Test that rereading of items with missing tags doesn't trigger multiple SIP-calls
-func TestBarcodesSession(t *testing.T) {
+func TestKohaRateLimit(t *testing.T) {
 	// setup ->
 
 	uiChan := make(chan Message)
@@ -566,43 +5583,79 @@ func TestBarcodesSession(t *testing.T) {
 		SIPServer:   sipSrv.Addr(),
 		RFIDPort:    port(d.addr()),
 		RFIDTimeout: 1 * time.Second,
+		WSRateLimit: 1,
+		WSRateBurst: 3,
 	})
 	defer hub.Close()
 
 	a := newDummyUIAgent(uiChan, port(srv.URL))
 	defer a.c.Close()
-
 	// <- end setup
 
-	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
-		t.Fatal("RFID-unit didn't get version init command")
-	}
+	<-d.incoming // VER2.00
 	d.write([]byte("OK\r"))
 	<-uiChan // CONNECT OK
 
-	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN"}`)); err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
-	}
-
-	<-d.incoming
-	d.write([]byte("OK\r"))
+	throttled := metrics.throttled.Value("")
 
-	sipSrv.Respond("1803020120140226    203140AB03010824124004|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
-	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
-	<-d.incoming
-	d.write([]byte("OK\r"))
+	// A burst of messages, each answered with an error, as no patron is
+	// given. Only the burst allowed by the rate limit gets through, and
+	// Koha is told that the others are dropped.
+	for i := 0; i < 10; i++ {
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT","Branch":"fmaj"}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+	}
+	var handled, dropped int
+	for i := 0; i < 10; i++ {
+		select {
+		case got := <-uiChan:
+			switch {
+			case got.Action != "CHECKOUT" || !got.UserError:
+				t.Errorf("got %+v; want user error", got)
+			case got.ErrorCode == CodeThrottled:
+				dropped++
+			default:
+				handled++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d responses; want 10", i)
+		}
+	}
+	if handled != 3 || dropped != 7 {
+		t.Errorf("got %d messages handled, %d dropped; want 3 handled, 7 dropped", handled, dropped)
+	}
+	if n := metrics.throttled.Value(""); n != throttled+7 {
+		t.Errorf("throttled counter => %d; want %d", n, throttled+7)
+	}
 
-	<-uiChan
-	d.write([]byte("RDT1003010824124004:NO:02030000|1\r"))
-	<-d.incoming
-	d.write([]byte("OK\r"))
+	// Pausing and resuming a session are never throttled, though nothing
+	// is to be paused.
+	for _, action := range []string{"PAUSE", "RESUME"} {
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"`+action+`"}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		if got := <-uiChan; got.Action != action || got.ErrorCode == CodeThrottled {
+			t.Errorf("got %+v; want %s handled", got, action)
+		}
+	}
 
-	if got := <-uiChan; got.SIPError {
-		t.Fatalf("Rereading of failed tags triggered multiple SIP-calls")
+	// Nor is ending it.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	select {
+	case msg := <-d.incoming:
+		if string(msg) != "END\r" {
+			t.Errorf("RFID-unit got %q; want END", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("END was throttled")
 	}
 }
 
-func TestWriteLogic(t *testing.T) {
+// Test writing tags with the data blocks encoded by the hub.
+func TestWriteTagBlocks(t *testing.T) {
 	// setup ->
 
 	uiChan := make(chan Message)
@@ -616,10 +5669,12 @@ func TestWriteLogic(t *testing.T) {
 	defer d.Close()
 
 	hub = newHub(Config{
-		HTTPPort:    port(srv.URL),
-		SIPServer:   sipSrv.Addr(),
-		RFIDPort:    port(d.addr()),
-		RFIDTimeout: 1 * time.Second,
+		HTTPPort:           port(srv.URL),
+		SIPServer:          sipSrv.Addr(),
+		RFIDPort:           port(d.addr()),
+		RFIDTimeout:        1 * time.Second,
+		WriteTagBlocks:     true,
+		WriteTagBlockCount: 10,
 	})
 	defer hub.Close()
 
@@ -628,144 +5683,353 @@ func TestWriteLogic(t *testing.T) {
 
 	// <- end setup
 
-	sipSrv.Respond("1803020120140226    203140AB03010824124004|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
-
-	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
-		t.Fatal("RFID-unit didn't get version init command")
-	}
+	<-d.incoming // VER2.00
 	d.write([]byte("OK\r"))
 	<-uiChan // CONNECT OK
 
-	if err := a.c.WriteMessage(websocket.TextMessage,
-		[]byte(`{"Action":"ITEM-INFO", "Item": {"Barcode": "03010824124004"}}`)); err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
+	// The basic block, in 9 blocks, followed by a block of zeros
+	blocks := func(part int) string {
+		b, err := encodeTag(tagData{Usage: usageCirculating, Parts: 2, Part: part,
+			Barcode: "03010824124004", Country: "SE", Owner: "02030001"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%X00000000", b)
 	}
 
-	if msg := <-d.incoming; string(msg) != "TGC\r" {
-		t.Fatal("item-info didn't trigger RFID TagCount")
+	// write initializes the RFID-unit with the owner of the item, and reads
+	// the ids of the tags on it
+	write := func() {
+		if err := a.c.WriteMessage(websocket.TextMessage,
+			[]byte(`{"Action":"WRITE", "Item": {"Barcode": "03010824124004", "NumTags": 2, "Owner": "02030001", "Country": "SE"}}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		for _, want := range []string{"SLPLBN|02030001\r", "SLPLBC|SE\r", "SLPDTM|DS24\r", "SLPSSB|0\r", "SLPCRD|1\r", "SLPWTM|5000\r", "SLPRSS|1\r"} {
+			if msg := <-d.incoming; string(msg) != want {
+				t.Fatalf("RFID-unit got %q; want %q", msg, want)
+			}
+			d.write([]byte("OK\r"))
+		}
+		if msg := <-d.incoming; string(msg) != "TGC\r" {
+			t.Fatalf("RFID-unit got %q; want TGC", msg)
+		}
+		d.write([]byte("OK|2\r"))
+		if msg := <-d.incoming; string(msg) != "UID\r" {
+			t.Fatalf("RFID-unit got %q; want UID", msg)
+		}
+		d.write([]byte("OK|E004010046A847AD|E004010046A847AE\r"))
 	}
 
-	d.write([]byte("OK|2\r"))
+	// 1. Both tags are written, and read back
+	write()
+	for i, id := range []string{"E004010046A847AD", "E004010046A847AE"} {
+		if msg, want := string(<-d.incoming), "WBL"+id+"|"+blocks(i+1)+"\r"; msg != want {
+			t.Fatalf("RFID-unit got %q; want %q", msg, want)
+		}
+		d.write([]byte("OK\r"))
+		if msg, want := string(<-d.incoming), "RBL"+id+"|10\r"; msg != want {
+			t.Fatalf("RFID-unit got %q; want %q", msg, want)
+		}
+		d.write([]byte("BLK" + id + "|" + blocks(i+1) + "\r"))
+	}
 
 	got := <-uiChan
-	want := Message{Action: "ITEM-INFO",
-		Item: Item{
-			Label:   "Heavy metal in Baghdad",
-			Barcode: "03010824124004",
-			NumTags: 2,
-		}}
+	want := Message{Action: "WRITE", Item: Item{Barcode: "03010824124004", NumTags: 2, Status: "OK, preget"}}
 	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct item info ")
-	}
-
-	// 1. failed write
-	if err := a.c.WriteMessage(websocket.TextMessage,
-		[]byte(`{"Action":"WRITE", "Item": {"Barcode": "03010824124004", "NumTags": 2}}`)); err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
-	}
-
-	if msg := <-d.incoming; string(msg) != "SLPLBN|02030000\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
+		t.Fatalf("Got %+v; want %+v", got, want)
 	}
 
-	d.write([]byte("NOK\r"))
+	// 2. A block of the second tag is read back wrong
+	write()
+	<-d.incoming // WBL
+	d.write([]byte("OK\r"))
+	<-d.incoming // RBL
+	d.write([]byte("BLKE004010046A847AD|" + blocks(1) + "\r"))
+	<-d.incoming // WBL
+	d.write([]byte("OK\r"))
+	<-d.incoming // RBL
+	bad := blocks(2)
+	bad = bad[:8*2] + "FF" + bad[8*2+2:] // first byte of block 2
+	d.write([]byte("BLKE004010046A847AE|" + bad + "\r"))
 
 	got = <-uiChan
-	want = Message{Action: "WRITE",
-		Item: Item{
-			Label:       "Heavy metal in Baghdad",
-			Barcode:     "03010824124004",
-			WriteFailed: true,
-			NumTags:     2,
-		}}
+	want = Message{Action: "WRITE", ErrorCode: CodeWriteFailed, Item: Item{Barcode: "03010824124004", NumTags: 2,
+		WriteFailed: true, Status: "Feil: blokk 2 av brikke 2 av 2 ble ikke preget riktig."}}
 	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct message of failed write ")
+		t.Fatalf("Got %+v; want %+v", got, want)
 	}
 
-	// 2. succesfull write
-
+	// 3. An item which cannot be written to tags is refused
 	if err := a.c.WriteMessage(websocket.TextMessage,
-		[]byte(`{"Action":"WRITE", "Item": {"Barcode": "03010824124004", "NumTags": 2}}`)); err != nil {
+		[]byte(`{"Action":"WRITE", "Item": {"Barcode": "03010824124004", "NumTags": 2, "Country": "NOR"}}`)); err != nil {
 		t.Fatal("UI failed to send message over websokcet conn")
 	}
-
-	if msg := <-d.incoming; string(msg) != "SLPLBN|02030000\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
+	if got := <-uiChan; !got.UserError || !strings.Contains(got.ErrorMessage, "country code") {
+		t.Errorf("Got %+v; want user error about the country code", got)
 	}
+}
 
-	d.write([]byte("OK\r"))
+// Test that INVENTORY lists the items on the RFID-unit, without touching
+// their alarm.
+func TestInventory(t *testing.T) {
+	// setup ->
 
-	if msg := <-d.incoming; string(msg) != "SLPLBC|NO\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
-	}
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
 
-	d.write([]byte("OK\r"))
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
 
-	if msg := <-d.incoming; string(msg) != "SLPDTM|DS24\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
-	}
+	d := newDummyRFIDReader()
+	defer d.Close()
 
-	d.write([]byte("OK\r"))
+	hub = newHub(Config{
+		HTTPPort:        port(srv.URL),
+		SIPServer:       sipSrv.Addr(),
+		SIPMaxConn:      2,
+		RFIDPort:        port(d.addr()),
+		RFIDTimeout:     1 * time.Second,
+		InventoryWindow: 50 * time.Millisecond,
+	})
+	defer hub.Close()
 
-	if msg := <-d.incoming; string(msg) != "SLPSSB|0\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
-	}
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
 
-	d.write([]byte("OK\r"))
+	// <- end setup
 
-	if msg := <-d.incoming; string(msg) != "SLPCRD|1\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
+	titles := map[string]string{
+		"03010824124004": "Heavy metal in Baghdad",
+		"03011063175001": "Cat's cradle",
 	}
+	sipSrv.RespondWith(func(req []byte) []byte {
+		barcode := strings.SplitN(strings.SplitN(string(req), "AB", 2)[1], "|", 2)[0]
+		return []byte("1803020120140226    203140AB" + barcode + "|AJ" + titles[barcode] + "|AQfhol|BGfhol|\r")
+	})
 
+	<-d.incoming // VER2.00
 	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
 
-	if msg := <-d.incoming; string(msg) != "SLPWTM|5000\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"INVENTORY","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Fatalf("RFID-unit got %q; want BEG", msg)
 	}
-
 	d.write([]byte("OK\r"))
 
-	if msg := <-d.incoming; string(msg) != "SLPRSS|1\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
+	// The alarm of each item is left as is. An item read twice is listed
+	// once.
+	for _, tag := range []string{
+		"1003010824124004:NO:02030000|0",
+		"1003011063175001:NO:02030000|1", // Incomplete set
+		"1003019999999001:NO:02030000|0", // Unknown to the SIP server
+		"1003010824124004:NO:02030000|0",
+	} {
+		d.write([]byte("RDT" + tag + "\r"))
+		if msg := <-d.incoming; string(msg) != "OK \r" {
+			t.Fatalf("RFID-unit got %q after reading %s; want alarm left as is", msg, tag)
+		}
+		d.write([]byte("OK\r"))
 	}
 
+	// Scanning stops when the window has passed
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatalf("RFID-unit got %q; want END", msg)
+	}
 	d.write([]byte("OK\r"))
 
-	if msg := <-d.incoming; string(msg) != "TGC\r" {
-		t.Fatal("WRITE command didn't initialize the reader properly")
+	got := <-uiChan
+	want := Message{Action: "INVENTORY", Manifest: []Item{
+		{Barcode: "03010824124004", Label: "Heavy metal in Baghdad", HomeBranch: "fhol"},
+		{Barcode: "03011063175001", Label: "Cat's cradle", HomeBranch: "fhol", TagCountFailed: true},
+		{Barcode: "03019999999001", Unknown: true, Status: "eksemplaret finnes ikke i basen", HomeBranch: "fhol"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
 	}
+}
 
-	d.write([]byte("OK|2\r"))
+func TestInventoryCalls(t *testing.T) {
+	// An INVENTORY leaves connections of the pool to other clients.
+	for maxConn, want := range map[int]int{1: 1, 2: 1, 3: 1, 5: 2, 10: 5} {
+		if got := inventoryCalls(maxConn); got != want {
+			t.Errorf("inventoryCalls(%d) => %d; want %d", maxConn, got, want)
+		}
+	}
+}
 
-	if msg := <-d.incoming; string(msg) != "WRT03010824124004|2|0\r" {
-		t.Fatal("Reader didn't get the right Write command")
+// optionsConn records the TCP options set on a connection.
+type optionsConn struct {
+	*net.TCPConn
+	mu        sync.Mutex
+	noDelay   []bool
+	keepAlive []bool
+	period    time.Duration
+}
+
+func (c *optionsConn) SetNoDelay(b bool) error {
+	c.mu.Lock()
+	c.noDelay = append(c.noDelay, b)
+	c.mu.Unlock()
+	return c.TCPConn.SetNoDelay(b)
+}
+
+func (c *optionsConn) SetKeepAlive(b bool) error {
+	c.mu.Lock()
+	c.keepAlive = append(c.keepAlive, b)
+	c.mu.Unlock()
+	return c.TCPConn.SetKeepAlive(b)
+}
+
+func (c *optionsConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.mu.Lock()
+	c.period = d
+	c.mu.Unlock()
+	return c.TCPConn.SetKeepAlivePeriod(d)
+}
+
+func TestRFIDConnOptions(t *testing.T) {
+	for _, tt := range []struct {
+		nagle     bool
+		interval  time.Duration
+		noDelay   []bool
+		keepAlive []bool
+		period    time.Duration
+	}{
+		{false, 30 * time.Second, []bool{true}, []bool{true}, 30 * time.Second},
+		{true, 0, []bool{false}, []bool{false}, 0},
+	} {
+		// setup ->
+
+		uiChan := make(chan Message)
+		sipSrv := newSIPTestServer()
+		defer sipSrv.Close()
+
+		srv := httptest.NewServer(nil)
+		defer srv.Close()
+
+		d := newDummyRFIDReader()
+		defer d.Close()
+
+		hub = newHub(Config{
+			HTTPPort:      port(srv.URL),
+			SIPServer:     sipSrv.Addr(),
+			RFIDPort:      port(d.addr()),
+			RFIDTimeout:   1 * time.Second,
+			RFIDNagle:     tt.nagle,
+			RFIDKeepAlive: tt.interval,
+		})
+		var conn *optionsConn
+		dialed := make(chan struct{})
+		hub.dial = func(network, address string) (net.Conn, error) {
+			c, err := net.Dial(network, address)
+			if err != nil {
+				return nil, err
+			}
+			conn = &optionsConn{TCPConn: c.(*net.TCPConn)}
+			close(dialed)
+			return conn, nil
+		}
+
+		a := newDummyUIAgent(uiChan, port(srv.URL))
+
+		// <- end setup
+
+		<-d.incoming // VER2.00
+		d.write([]byte("OK\r"))
+		if msg := <-uiChan; msg.Action != "CONNECT" || msg.RFIDError {
+			t.Fatalf("Got %+v; want CONNECT", msg)
+		}
+		<-dialed
+
+		conn.mu.Lock()
+		if !reflect.DeepEqual(conn.noDelay, tt.noDelay) || !reflect.DeepEqual(conn.keepAlive, tt.keepAlive) || conn.period != tt.period {
+			t.Errorf("Nagle %v, keepalive %v: set no delay %v, keepalive %v every %v; want %v, %v every %v",
+				tt.nagle, tt.interval, conn.noDelay, conn.keepAlive, conn.period, tt.noDelay, tt.keepAlive, tt.period)
+		}
+		conn.mu.Unlock()
+
+		a.c.Close()
+		hub.Close()
 	}
+}
 
-	d.write([]byte("OK|E004010046A847AD|E004010046A847AD\r"))
+// Test that frames which are not responses are skipped, as are a few
+// malformed responses, but not a corrupt stream.
+func TestRFIDUnknownFrames(t *testing.T) {
+	// setup ->
 
-	got = <-uiChan
-	want = Message{Action: "WRITE",
-		Item: Item{
-			Label:   "Heavy metal in Baghdad",
-			Barcode: "03010824124004",
-			NumTags: 2,
-			Status:  "OK, preget",
-		}}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
-		t.Fatal("UI didn't get the correct item info after WRITE command ")
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:        port(srv.URL),
+		SIPServer:       sipSrv.Addr(),
+		RFIDPort:        port(d.addr()),
+		RFIDTimeout:     1 * time.Second,
+		RFIDParseErrors: 2,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
 	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
 
-}
+	// An unsolicited status notification, and as many malformed responses
+	// as tolerated, don't stop the checkin.
+	d.write([]byte("STA|READY\r"))
+	d.write([]byte("OKI\r"))
+	d.write([]byte("STA|READY\r"))
+	d.write([]byte("OKI\r"))
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" {
+		t.Fatalf("Got %+v; want checkin of 03010824124004", got)
+	}
 
-func TestUserErrors(t *testing.T) {
+	// The count of malformed responses was reset by the tag read, but a
+	// corrupt stream gives up the connection.
+	d.write([]byte("\x01\xfe\r"))
+	d.write([]byte("OKI\r"))
+	d.write([]byte("RDT\x00\x00\r"))
+	got := <-uiChan
+	if got.Action != "CONNECT" || !got.RFIDError || !strings.Contains(got.ErrorMessage, "cannot parse RFID response") {
+		t.Errorf("Got %+v; want CONNECT with RFID error", got)
+	}
+}
 
+// Verify that a WRITE-BATCH writes the tags of its items one at a time, and
+// moves on when the tag of an item is read back with another barcode,
+// keeping the item as pending.
+func TestWriteBatch(t *testing.T) {
 	// setup ->
 
 	uiChan := make(chan Message)
-	sipSrv := newSIPTestServer().Failing()
+	sipSrv := newSIPTestServer()
 	defer sipSrv.Close()
 
 	srv := httptest.NewServer(nil)
@@ -784,82 +6048,83 @@ func TestUserErrors(t *testing.T) {
 
 	a := newDummyUIAgent(uiChan, port(srv.URL))
 	defer a.c.Close()
+
 	// <- end setup
 
-	if msg := <-d.incoming; string(msg) != "VER2.00\r" {
-		t.Fatal("RFID-unit didn't get version init command")
-	}
+	<-d.incoming // VER2.00
 	d.write([]byte("OK\r"))
 	<-uiChan // CONNECT OK
 
-	if err := a.c.WriteMessage(websocket.TextMessage,
-		[]byte(`{"Action":"BLA", "this is not well formed json }`)); err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
+	barcodes := []string{"03010824124004", "03011063175001", "03011174511003"}
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"WRITE-BATCH", "Batch": [
+		{"Barcode": "03010824124004", "NumTags": 1},
+		{"Barcode": "03011063175001", "NumTags": 1},
+		{"Barcode": "03011174511003", "NumTags": 1}]}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
 	}
-
-	got := <-uiChan
-	want := Message{Action: "CONNECT", UserError: true,
-		ErrorMessage: "unexpected end of JSON input"}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Got %+v; want %+v", got, want)
+	want := Message{Action: "WRITE-BATCH", Item: Item{Barcode: barcodes[0], NumTags: 1}, Pending: barcodes}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v; want %+v", got, want)
 	}
 
-	// Attempt CHECKOUT without sending the patron barcode
-	if err := a.c.WriteMessage(websocket.TextMessage,
-		[]byte(`{"Action":"CHECKOUT"}`)); err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
+	// write writes the tag placed on the RFID-unit, which is read back with
+	// the given barcode.
+	write := func(barcode, readBack string) Message {
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"WRITE-NEXT"}`)); err != nil {
+			t.Fatal("UI failed to send message over websocket conn")
+		}
+		for _, want := range []string{"SLPLBN|02030000\r", "SLPLBC|NO\r", "SLPDTM|DS24\r", "SLPSSB|0\r", "SLPCRD|1\r", "SLPWTM|5000\r", "SLPRSS|1\r", "TGC\r"} {
+			if msg := <-d.incoming; string(msg) != want {
+				t.Fatalf("RFID-unit got %q; want %q", msg, want)
+			}
+			if want == "TGC\r" {
+				d.write([]byte("OK|1\r"))
+			} else {
+				d.write([]byte("OK\r"))
+			}
+		}
+		if msg, want := <-d.incoming, "WRT"+barcode+"|1|0\r"; string(msg) != want {
+			t.Fatalf("RFID-unit got %q; want %q", msg, want)
+		}
+		d.write([]byte("OK|E004010046A847AD\r"))
+		<-d.incoming // OKR
+		d.write([]byte("RDT10" + readBack + ":NO:02030000|0\r"))
+		return <-uiChan
 	}
 
-	got = <-uiChan
-	want = Message{Action: "CHECKOUT", UserError: true,
-		ErrorMessage: "Patron not supplied"}
-	if !reflect.DeepEqual(got, want) {
+	// 1. written
+	if got := write(barcodes[0], barcodes[0]); got.Action != "WRITE" || got.Item.WriteFailed || got.Item.Status != "OK, preget" {
+		t.Errorf("Got %+v; want WRITE of %s", got, barcodes[0])
+	}
+	want = Message{Action: "WRITE-BATCH", Item: Item{Barcode: barcodes[1], NumTags: 1},
+		Written: barcodes[:1], Pending: barcodes[1:]}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
 		t.Errorf("Got %+v; want %+v", got, want)
 	}
 
-}
-
-func TestBarcodeFromTag(t *testing.T) {
-	var tests = []struct {
-		in  string
-		out string
-	}{
-		{"1003011596802008:NO:02030000", "03011596802008"}, // only deichman tags should strip 10
-		{"1003011596802008:NO:02030001", "1003011596802008"},
-		{"10123456789012", "10123456789012"},
+	// 2. read back with the barcode of the previous item
+	if got := write(barcodes[1], barcodes[0]); got.Action != "WRITE" || !got.Item.WriteFailed || got.ErrorCode != CodeWriteFailed {
+		t.Errorf("Got %+v; want failed WRITE of %s", got, barcodes[1])
 	}
-	for _, tt := range tests {
-		r := barcodeFromTag(tt.in)
-		if !reflect.DeepEqual(r, tt.out) {
-			t.Errorf("BarcodeFromTag(%s) got: %s\t want %s\n", tt.in, r, tt.out)
-		}
+	want = Message{Action: "WRITE-BATCH", Item: Item{Barcode: barcodes[2], NumTags: 1},
+		Written: barcodes[:1], Pending: barcodes[1:]}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
 	}
-}
-
-/*
-// Verify that if a second websocket connection is opened from the same IP,
-// the first connection is closed.
-func TestDuplicateClientConnections(t *testing.T) {
-	sipPool, _ = pool.NewChannelPool(1, 1, FailingSIPResponse())
 
-	ws, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:8888/ws", nil)
-	if err != nil {
-		t.Fatal("Cannot get ws connection to 127.0.0.1:8888/ws")
+	// 3. written, ending the batch
+	if got := write(barcodes[2], barcodes[2]); got.Action != "WRITE" || got.Item.WriteFailed {
+		t.Errorf("Got %+v; want WRITE of %s", got, barcodes[2])
 	}
-
-	_, _, err = websocket.DefaultDialer.Dial("ws://127.0.0.1:8888/ws", nil)
-	if err != nil {
-		t.Fatal("Cannot get ws connection to 127.0.0.1:8888/ws")
+	want = Message{Action: "WRITE-BATCH", Written: []string{barcodes[0], barcodes[2]}, Pending: barcodes[1:2]}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
 	}
 
-	time.Sleep(100 * time.Millisecond)
-
-	// Try writing to the first connection; it should be closed:
-	err = ws.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CONNECT"}`))
-	if err == nil {
-		t.Error("Two ws connections from the same IP should not be allowed")
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"WRITE-NEXT"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	if got := <-uiChan; got.Action != "WRITE-NEXT" || !got.UserError {
+		t.Errorf("Got %+v; want WRITE-NEXT user error, the batch being done", got)
 	}
-	time.Sleep(100 * time.Millisecond)
-
 }
-*/
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+)
+
+// duration is a time.Duration given as a string in config files, ex "90s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string, ex \"10s\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// configFile is the JSON representation of Config. The durations are
+// shadowed, so that they can be given as strings instead of nanoseconds.
+type configFile struct {
+	*configFields
+	SIPIdleTimeout         *duration
+	SIPHealthCheckInterval *duration
+	SIPKeepAlive           *duration
+	SIPTimeout             *duration
+	SIPRetryWait           *duration
+	SIPBreakerCooldown     *duration
+	RFIDTimeout            *duration
+	RFIDResponseTimeout    *duration
+	RFIDReconnectWait      *duration
+	MissingPartsTimeout    *duration
+	RFIDReconnectMaxWait   *duration
+	RFIDReconnectMaxTime   *duration
+	RFIDInitRetryWait      *duration
+	RFIDKeepAlive          *duration
+	SessionIdleTimeout     *duration
+	DeadmanTimeout         *duration
+	MissingTagsGrace       *duration
+	GhostReadWindow        *duration
+	InventoryWindow        *duration
+	WSWriteWait            *duration
+	WSPongWait             *duration
+	WSAckTimeout           *duration
+	WSResumeWindow         *duration
+	ClientStallTimeout     *duration
+	ShutdownTimeout        *duration
+}
+
+// configFields has the fields of Config, but not its methods.
+type configFields Config
+
+func (f configFile) apply(cfg *Config) {
+	for _, d := range []struct {
+		from *duration
+		to   *time.Duration
+	}{
+		{f.SIPIdleTimeout, &cfg.SIPIdleTimeout},
+		{f.SIPHealthCheckInterval, &cfg.SIPHealthCheckInterval},
+		{f.SIPKeepAlive, &cfg.SIPKeepAlive},
+		{f.SIPTimeout, &cfg.SIPTimeout},
+		{f.SIPRetryWait, &cfg.SIPRetryWait},
+		{f.SIPBreakerCooldown, &cfg.SIPBreakerCooldown},
+		{f.RFIDTimeout, &cfg.RFIDTimeout},
+		{f.RFIDResponseTimeout, &cfg.RFIDResponseTimeout},
+		{f.RFIDReconnectWait, &cfg.RFIDReconnectWait},
+		{f.MissingPartsTimeout, &cfg.MissingPartsTimeout},
+		{f.RFIDReconnectMaxWait, &cfg.RFIDReconnectMaxWait},
+		{f.RFIDReconnectMaxTime, &cfg.RFIDReconnectMaxTime},
+		{f.RFIDInitRetryWait, &cfg.RFIDInitRetryWait},
+		{f.RFIDKeepAlive, &cfg.RFIDKeepAlive},
+		{f.SessionIdleTimeout, &cfg.SessionIdleTimeout},
+		{f.DeadmanTimeout, &cfg.DeadmanTimeout},
+		{f.MissingTagsGrace, &cfg.MissingTagsGrace},
+		{f.GhostReadWindow, &cfg.GhostReadWindow},
+		{f.InventoryWindow, &cfg.InventoryWindow},
+		{f.WSWriteWait, &cfg.WSWriteWait},
+		{f.WSPongWait, &cfg.WSPongWait},
+		{f.WSAckTimeout, &cfg.WSAckTimeout},
+		{f.WSResumeWindow, &cfg.WSResumeWindow},
+		{f.ClientStallTimeout, &cfg.ClientStallTimeout},
+		{f.ShutdownTimeout, &cfg.ShutdownTimeout},
+	} {
+		if d.from != nil {
+			*d.to = time.Duration(*d.from)
+		}
+	}
+}
+
+// LoadConfig reads a Config from the JSON file at path. The keys are the
+// names of the Config fields, and durations are given as strings:
+//
+//	{"SIPServer": "sip_proxy:9999", "SIPMaxConn": 10, "RFIDTimeout": "10m"}
+//
+// Fields missing from the file are set to their defaults, and fields given
+// in the environment, see applyEnv, override those of the file.
+func LoadConfig(path string) (Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := defaultConfig
+	f := configFile{configFields: (*configFields)(&cfg)}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return Config{}, fmt.Errorf("cannot parse config file %s: %v", path, err)
+	}
+	f.apply(&cfg)
+	cfg.applyEnv()
+	if err := cfg.validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	warnClamped(logger, cfg.clampDurations())
+	return cfg, nil
+}
+
+// applyEnv sets the ports and the SIP server and credentials from the
+// environment variables TCP_PORT, HTTP_PORT, SIP_SERVER, SIP_USER and
+// SIP_PASS, where set.
+func (c *Config) applyEnv() {
+	// TODO move these to command line flags
+	for _, e := range []struct {
+		name  string
+		field *string
+	}{
+		{"TCP_PORT", &c.RFIDPort},
+		{"HTTP_PORT", &c.HTTPPort},
+		{"SIP_SERVER", &c.SIPServer},
+		{"SIP_USER", &c.SIPUser},
+		{"SIP_PASS", &c.SIPPass},
+	} {
+		if v := os.Getenv(e.name); v != "" {
+			*e.field = v
+		}
+	}
+}
+
+// validate checks that the required fields are set, and that the
+// numbers and durations are within range.
+func (c Config) validate() error {
+	if c.RFIDPort == "" {
+		return errors.New("RFID port is required")
+	}
+	if c.HTTPPort == "" {
+		return errors.New("HTTP port is required")
+	}
+	host, port, err := net.SplitHostPort(c.SIPServer)
+	if err != nil && c.SIPServer != "" {
+		return fmt.Errorf("SIP server must be given as host:port: %v", err)
+	}
+	if host == "" {
+		return errors.New("SIP host is required")
+	}
+	if port == "" {
+		return errors.New("SIP port is required")
+	}
+	if c.SIPUser == "" || c.SIPPass == "" {
+		return errors.New("SIP user and password are required")
+	}
+	for branch, e := range c.BranchSIP {
+		if _, _, err := net.SplitHostPort(e.Server); err != nil && e.Server != "" {
+			return fmt.Errorf("SIP server of branch %s must be given as host:port: %v", branch, err)
+		}
+	}
+	if c.SIPMaxConn < 1 {
+		return errors.New("SIP max connections must be at least 1")
+	}
+	if c.SIPMinConn < 0 || c.SIPMinConn > c.SIPMaxConn {
+		return fmt.Errorf("SIP min connections must be between 0 and %d", c.SIPMaxConn)
+	}
+	if c.RFIDReconnectAttempts < 0 || c.RFIDInitRetries < 0 || c.EndScanRetries < 0 || c.SIPRetries < 0 || c.WSAckRetries < 0 || c.AlarmRetries < 0 {
+		return errors.New("number of retries cannot be negative")
+	}
+	for _, d := range []time.Duration{
+		c.SIPIdleTimeout, c.SIPHealthCheckInterval, c.SIPKeepAlive, c.SIPTimeout, c.SIPRetryWait, c.SIPBreakerCooldown, c.RFIDTimeout,
+		c.RFIDResponseTimeout, c.RFIDReconnectWait, c.MissingPartsTimeout, c.RFIDReconnectMaxWait, c.RFIDReconnectMaxTime, c.RFIDInitRetryWait, c.RFIDKeepAlive, c.SessionIdleTimeout, c.DeadmanTimeout,
+		c.MissingTagsGrace, c.GhostReadWindow, c.InventoryWindow, c.WSWriteWait, c.WSPongWait, c.WSAckTimeout, c.WSResumeWindow, c.ShutdownTimeout, c.ClientStallTimeout,
+	} {
+		if d < 0 {
+			return fmt.Errorf("timeout cannot be negative: %v", d)
+		}
+	}
+	if c.MissingTagsGrace > 0 && c.RFIDResponseTimeout > 0 && c.MissingTagsGrace >= c.RFIDResponseTimeout {
+		return fmt.Errorf("missing tags grace must be shorter than the RFID response timeout of %v", c.RFIDResponseTimeout)
+	}
+	if c.RFIDParseErrors < 0 {
+		return errors.New("RFID parse errors cannot be negative")
+	}
+	if c.SIPBreakerThreshold < 0 {
+		return errors.New("SIP breaker threshold cannot be negative")
+	}
+	if c.SIPMaxCalls < 0 {
+		return errors.New("SIP max calls cannot be negative")
+	}
+	if c.ClientQueueSize < 0 {
+		return errors.New("client queue size cannot be negative")
+	}
+	if c.MaxSessionItems < 0 {
+		return errors.New("max session items cannot be negative")
+	}
+	if c.WSRateLimit < 0 || c.WSRateBurst < 0 {
+		return errors.New("websocket rate limit cannot be negative")
+	}
+	switch c.DuplicateClients {
+	case "", duplicateEvict, duplicateReject:
+	default:
+		return fmt.Errorf("duplicate clients policy must be %q or %q, not %q",
+			duplicateEvict, duplicateReject, c.DuplicateClients)
+	}
+	switch c.CheckinMode {
+	case "", checkinBatch, checkinSingle:
+	default:
+		return fmt.Errorf("checkin mode must be %q or %q, not %q", checkinBatch, checkinSingle, c.CheckinMode)
+	}
+	switch c.AlarmFailPolicy {
+	case "", alarmFailNotify, alarmFailCompensate, alarmFailBlock:
+	default:
+		return fmt.Errorf("alarm fail policy must be %q, %q or %q, not %q",
+			alarmFailNotify, alarmFailCompensate, alarmFailBlock, c.AlarmFailPolicy)
+	}
+	switch c.CheckoutAlarmOrder {
+	case "", checkoutAlarmAfter, checkoutAlarmBefore:
+	default:
+		return fmt.Errorf("checkout alarm order must be %q or %q, not %q",
+			checkoutAlarmAfter, checkoutAlarmBefore, c.CheckoutAlarmOrder)
+	}
+	for _, a := range []string{c.CheckinIncompleteAlarm, c.CheckoutIncompleteAlarm} {
+		switch a {
+		case "", incompleteAlarmLeave, incompleteAlarmOn, incompleteAlarmOff:
+		default:
+			return fmt.Errorf("incomplete set alarm must be %q, %q or %q, not %q",
+				incompleteAlarmLeave, incompleteAlarmOn, incompleteAlarmOff, a)
+		}
+	}
+	for branch, p := range c.BranchSecurity {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("branch %q: %v", branch, err)
+		}
+	}
+	if err := c.Security.validate(); err != nil {
+		return err
+	}
+	switch c.JournalSync {
+	case "", journalSyncAlways, journalSyncNever:
+	default:
+		return fmt.Errorf("journal sync policy must be %q or %q, not %q",
+			journalSyncAlways, journalSyncNever, c.JournalSync)
+	}
+	if err := c.validateSIPFraming(); err != nil {
+		return err
+	}
+	if err := validateSIPFields(c.SIPFields); err != nil {
+		return err
+	}
+	if err := validRFIDVendor(c.RFIDVendor); err != nil {
+		return err
+	}
+	if _, err := encodeTag(tagData{Usage: usageCirculating, Parts: 1, Part: 1, Barcode: "0",
+		Country: c.CountryCode, Owner: c.OwnerLibrary}); err != nil {
+		return fmt.Errorf("cannot write institution to tags: %v", err)
+	}
+	if c.WriteTagBlockCount != 0 && c.WriteTagBlockCount < tagBlocks {
+		return fmt.Errorf("tag block count must be at least %d, to hold the basic block", tagBlocks)
+	}
+	for lib, r := range c.BarcodeRules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("library number %q: %v", lib, err)
+		}
+	}
+	if err := validateScreenMessages(c.ScreenMessages); err != nil {
+		return err
+	}
+	for branch, msgs := range c.BranchScreenMessages {
+		if err := validateScreenMessages(msgs); err != nil {
+			return fmt.Errorf("branch %q: %v", branch, err)
+		}
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Shortest durations which work, for the durations clamped by
+// clampDurations.
+const (
+	minWriteWait       = 100 * time.Millisecond
+	minPongWait        = time.Second
+	minResponseTimeout = 100 * time.Millisecond
+	minKeepAlive       = time.Second // TCP keepalives are in whole seconds
+)
+
+// A clamped is a configured duration adjusted by clampDurations.
+type clamped struct {
+	name     string
+	from, to time.Duration
+	reason   string
+}
+
+// clampDurations adjusts the durations which are too short to work, or
+// which contradict another duration, to the shortest safe values, and
+// returns what was adjusted. Durations of 0, which give the default or
+// disable what they time, are left alone. The durations must have been
+// validated.
+func (c *Config) clampDurations() []clamped {
+	var res []clamped
+	clamp := func(name string, d *time.Duration, min time.Duration, reason string) {
+		if *d > 0 && *d < min {
+			res = append(res, clamped{name: name, from: *d, to: min, reason: reason})
+			*d = min
+		}
+	}
+	clamp("WSWriteWait", &c.WSWriteWait, minWriteWait, "too short to write a message")
+	// Koha is pinged at 9/10 of the pong wait, and the ping must be
+	// written, and the pong read, before it has passed.
+	minPong := minPongWait
+	if w := 2 * c.writeWait(); w > minPong {
+		minPong = w
+	}
+	if p := c.pongWait(); p > 0 && p < minPong {
+		c.WSPongWait = p // May be RFIDTimeout
+		clamp("WSPongWait", &c.WSPongWait, minPong, "too short to ping and get the pong")
+	}
+	clamp("WSAckTimeout", &c.WSAckTimeout, c.writeWait(), "shorter than the time to write the message")
+	clamp("RFIDResponseTimeout", &c.RFIDResponseTimeout, minResponseTimeout, "too short for the RFID-unit to respond")
+	clamp("SIPTimeout", &c.SIPTimeout, minResponseTimeout, "too short for the SIP server to respond")
+	clamp("RFIDKeepAlive", &c.RFIDKeepAlive, minKeepAlive, "shorter than a second")
+	clamp("SIPKeepAlive", &c.SIPKeepAlive, minKeepAlive, "shorter than a second")
+	clamp("RFIDReconnectMaxWait", &c.RFIDReconnectMaxWait, c.RFIDReconnectWait, "shorter than the first wait")
+	clamp("RFIDReconnectMaxTime", &c.RFIDReconnectMaxTime, c.RFIDReconnectWait, "no attempt would be made")
+	return res
+}
+
+// warnClamped logs the durations adjusted by clampDurations.
+func warnClamped(l *Logger, adjusted []clamped) {
+	for _, a := range adjusted {
+		l.Warn("configured duration adjusted", "setting", a.name, "from", a.from, "to", a.to, "reason", a.reason)
+	}
+}
+
+// validateSIPFraming checks that the SIP field delimiter and message
+// terminator are single characters which cannot be confused with field
+// identifiers or data of fixed-length fields, and differ from each other.
+func (c Config) validateSIPFraming() error {
+	for _, f := range []struct{ name, s string }{{"delimiter", c.SIPDelimiter}, {"terminator", c.SIPTerminator}} {
+		if f.s == "" {
+			continue
+		}
+		if len(f.s) != 1 {
+			return fmt.Errorf("SIP %s must be a single character: %q", f.name, f.s)
+		}
+		if c := f.s[0]; c == ' ' || '0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' {
+			return fmt.Errorf("SIP %s cannot be a letter, digit or space: %q", f.name, f.s)
+		}
+	}
+	if c.sipDelimiter() == c.sipTerminator() {
+		return fmt.Errorf("SIP delimiter and terminator must differ: %q", c.sipDelimiter())
+	}
+	return nil
+}
+
+// sipDelimiter returns the field delimiter of SIP messages.
+func (c Config) sipDelimiter() byte {
+	if c.SIPDelimiter == "" {
+		return sipDelimiter
+	}
+	return c.SIPDelimiter[0]
+}
+
+// sipTerminator returns the terminator of SIP messages.
+func (c Config) sipTerminator() byte {
+	if c.SIPTerminator == "" {
+		return sipTerminator
+	}
+	return c.SIPTerminator[0]
+}
+
+// ownerLibrary returns the library number of the institution.
+func (c Config) ownerLibrary() string {
+	if c.OwnerLibrary == "" {
+		return defaultOwnerLibrary
+	}
+	return c.OwnerLibrary
+}
+
+// countryCode returns the country code of the institution.
+func (c Config) countryCode() string {
+	if c.CountryCode == "" {
+		return defaultCountryCode
+	}
+	return c.CountryCode
+}
+
+// barcodeRules returns the barcode rules, keyed by library number.
+func (c Config) barcodeRules() map[string]BarcodeRules {
+	if c.BarcodeRules == nil {
+		return defaultBarcodeRules
+	}
+	return c.BarcodeRules
+}
+
+// SecurityPolicy is how the security of items is handled at a branch.
+type SecurityPolicy struct {
+	Disabled    bool // The branch has no security gates, so the alarm is left as is
+	AFISecure   byte // AFI of items not checked out, ex 0x07
+	AFIUnsecure byte // AFI of checked out items, ex 0xC2
+
+	// Alarm command for items checked in to be sent in transit to another
+	// branch: "on" (default), "leave" or "off". TransitUnsecured is the
+	// same as "leave", for configs predating TransitAlarm.
+	TransitAlarm     string
+	TransitUnsecured bool
+
+	// Items the SIP server reports as magnetic media, ex video tapes, are
+	// secured otherwise, ex in locked cases, and their alarm is left as is.
+	MagneticUnsecured bool
+}
+
+// transitAlarm returns the alarm command for items in transit.
+func (p SecurityPolicy) transitAlarm() string {
+	switch {
+	case p.TransitAlarm != "":
+		return p.TransitAlarm
+	case p.TransitUnsecured:
+		return transitAlarmLeave
+	}
+	return transitAlarmOn
+}
+
+// securityState returns the security of a tag with the given AFI: SECURE,
+// UNSECURE, or the AFI in hex if it is neither.
+func (p SecurityPolicy) securityState(afi byte) string {
+	switch afi {
+	case p.AFISecure:
+		return "SECURE"
+	case p.AFIUnsecure:
+		return "UNSECURE"
+	}
+	return fmt.Sprintf("%02X", afi)
+}
+
+func (p SecurityPolicy) validate() error {
+	switch p.TransitAlarm {
+	case "", transitAlarmOn, transitAlarmLeave, transitAlarmOff:
+	default:
+		return fmt.Errorf("transit alarm must be %q, %q or %q, not %q",
+			transitAlarmOn, transitAlarmLeave, transitAlarmOff, p.TransitAlarm)
+	}
+	return nil
+}
+
+// SIPEndpoint is the SIP server and account used by a branch. Fields left
+// empty are taken from SIPServer, SIPUser, SIPPass and SIPDept.
+type SIPEndpoint struct {
+	Server string
+	User   string
+	Pass   string
+	Dept   string
+}
+
+// branchSIP returns the config of the SIP connections of the given branch.
+func (c Config) branchSIP(branch string) Config {
+	e, ok := c.BranchSIP[branch]
+	if !ok {
+		return c
+	}
+	for _, f := range []struct {
+		from string
+		to   *string
+	}{
+		{e.Server, &c.SIPServer},
+		{e.User, &c.SIPUser},
+		{e.Pass, &c.SIPPass},
+		{e.Dept, &c.SIPDept},
+	} {
+		if f.from != "" {
+			*f.to = f.from
+		}
+	}
+	return c
+}
+
+// security returns the security policy of the given branch: the fields
+// set in its BranchSecurity over those of Security. A bool can only be
+// turned on for a branch, as false is not set.
+func (c Config) security(branch string) SecurityPolicy {
+	p, ok := c.BranchSecurity[branch]
+	if !ok {
+		return c.Security
+	}
+	merged := c.Security
+	if p.AFISecure != 0 {
+		merged.AFISecure = p.AFISecure
+	}
+	if p.AFIUnsecure != 0 {
+		merged.AFIUnsecure = p.AFIUnsecure
+	}
+	if p.TransitAlarm != "" || p.TransitUnsecured {
+		merged.TransitAlarm = p.transitAlarm()
+	}
+	merged.Disabled = merged.Disabled || p.Disabled
+	merged.MagneticUnsecured = merged.MagneticUnsecured || p.MagneticUnsecured
+	return merged
+}
+
+// sipKeepAlive returns the keepalive interval of SIP connections, as
+// expected by net.Dialer, where a negative interval disables keepalives.
+func (c Config) sipKeepAlive() time.Duration {
+	if c.SIPKeepAlive <= 0 {
+		return -1
+	}
+	return c.SIPKeepAlive
+}
+
+// inventoryWindow returns the time to collect tags for an INVENTORY.
+func (c Config) inventoryWindow() time.Duration {
+	if c.InventoryWindow <= 0 {
+		return defaultInventoryWindow
+	}
+	return c.InventoryWindow
+}
+
+// writeWait returns the time allowed to write a message to Koha.
+func (c Config) writeWait() time.Duration {
+	if c.WSWriteWait <= 0 {
+		return defaultWriteWait
+	}
+	return c.WSWriteWait
+}
+
+// pongWait returns the time to wait for a pong from Koha. If it is 0 or
+// less, Koha is not pinged, and the connection is never closed for being idle.
+func (c Config) pongWait() time.Duration {
+	if c.WSPongWait <= 0 {
+		return c.RFIDTimeout
+	}
+	return c.WSPongWait
+}
+
+// rateBurst returns the number of messages from Koha allowed in a burst
+// above the rate limit, which is at least 1.
+func (c Config) rateBurst() int {
+	if c.WSRateBurst < 1 {
+		return 1
+	}
+	return c.WSRateBurst
+}
+
+// tagBlockCount returns the number of data blocks written to tags with
+// WriteTagBlocks.
+func (c Config) tagBlockCount() int {
+	if c.WriteTagBlockCount == 0 {
+		return tagBlocks
+	}
+	return c.WriteTagBlockCount
+}
+
+// stallTimeout returns the time to wait for a client to take a message
+// from Koha or the RFID-unit, before it is considered stuck.
+func (c Config) stallTimeout() time.Duration {
+	if c.ClientStallTimeout <= 0 {
+		return defaultStallTimeout
+	}
+	return c.ClientStallTimeout
+}
+
+// maxMessageSize returns the maximum size in bytes of a message from Koha.
+func (c Config) maxMessageSize() int64 {
+	if c.WSMaxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+	return c.WSMaxMessageSize
+}
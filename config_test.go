@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "mcccl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"RFIDPort": "6006",
+		"SIPServer": "sip.example.org:6001",
+		"SIPUser": "rfid",
+		"SIPPass": "secret",
+		"SIPDept": "hutl",
+		"SIPMinConn": 2,
+		"SIPMaxConn": 10,
+		"SIPIdleTimeout": "90s",
+		"SIPKeepAlive": "45s",
+		"RFIDTimeout": "10m",
+		"LogLevel": "debug",
+		"UseAFI": true,
+		"BranchSecurity": {"fmaj": {"AFISecure": 154, "AFIUnsecure": 194}, "fbol": {"Disabled": true}}
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultConfig
+	want.RFIDPort = "6006"
+	want.SIPServer = "sip.example.org:6001"
+	want.SIPUser = "rfid"
+	want.SIPPass = "secret"
+	want.SIPDept = "hutl"
+	want.SIPMinConn = 2
+	want.SIPMaxConn = 10
+	want.SIPIdleTimeout = 90 * time.Second
+	want.SIPKeepAlive = 45 * time.Second
+	want.RFIDTimeout = 10 * time.Minute
+	want.LogLevel = "debug"
+	want.UseAFI = true
+	want.BranchSecurity = map[string]SecurityPolicy{
+		"fmaj": {AFISecure: 0x9A, AFIUnsecure: 0xC2},
+		"fbol": {Disabled: true},
+	}
+
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("LoadConfig() =>\n%+v\nwant:\n%+v", cfg, want)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := writeConfigFile(t, `{"SIPUser": "rfid"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultConfig
+	want.SIPUser = "rfid"
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("LoadConfig() =>\n%+v\nwant:\n%+v", cfg, want)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	path := writeConfigFile(t, `{"SIPServer": "sip.example.org:6001", "SIPUser": "rfid", "SIPPass": "secret"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	os.Setenv("SIP_USER", "koha")
+	defer os.Unsetenv("SIP_USER")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SIPServer != "sip.example.org:6001" || cfg.SIPUser != "koha" || cfg.SIPPass != "secret" {
+		t.Errorf("LoadConfig() with SIP_USER set => SIP %s %s %s; want user from environment",
+			cfg.SIPServer, cfg.SIPUser, cfg.SIPPass)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{`{"SIPServer": ""}`, "SIP host is required"},
+		{`{"SIPServer": ":6001"}`, "SIP host is required"},
+		{`{"SIPServer": "sip.example.org"}`, "SIP server must be given as host:port"},
+		{`{"BranchSIP": {"fmaj": {"Server": "sip.example.org"}}}`, "SIP server of branch fmaj must be given as host:port"},
+		{`{"SIPMaxConn": 0}`, "SIP max connections must be at least 1"},
+		{`{"SIPMinConn": 6}`, "SIP min connections must be between 0 and 5"},
+		{`{"RFIDTimeout": 10}`, "duration must be a string"},
+		{`{"RFIDTimeout": "ten minutes"}`, "invalid duration"},
+		{`{"LogLevel": "verbose"}`, "unknown log level"},
+		{`{"RFIDVendor": "acme"}`, "unknown RFID vendor"},
+		{`{"JournalSync": "sometimes"}`, "journal sync policy"},
+		{`{"AlarmFailPolicy": "ignore"}`, "alarm fail policy"},
+		{`{"CheckinIncompleteAlarm": "deactivate"}`, "incomplete set alarm"},
+		{`{"CheckoutAlarmOrder": "during"}`, "checkout alarm order"},
+		{`{"BranchSecurity": {"fmaj": {"TransitAlarm": "secure"}}}`, "transit alarm"},
+		{`{"SIPFields": {"Shelf": "AQ"}}`, "unknown item attribute"},
+		{`{"SIPFields": {"HomeBranch": "AQ|"}}`, "two letters or digits"},
+		{`{"AlarmRetries": -1}`, "retries cannot be negative"},
+		{`{"MissingTagsGrace": "10s", "RFIDResponseTimeout": "10s"}`, "missing tags grace must be shorter"},
+		{`{"RFIDParseErrors": -1}`, "RFID parse errors cannot be negative"},
+		{`{"SIPBreakerThreshold": -1}`, "SIP breaker threshold cannot be negative"},
+		{`{"SIPMaxCalls": -1}`, "SIP max calls cannot be negative"},
+		{`{"SIPBreakerCooldown": "-30s"}`, "cannot be negative"},
+		{`{"MaxSessionItems": -1}`, "max session items cannot be negative"},
+		{`{"ClientQueueSize": -1}`, "client queue size cannot be negative"},
+		{`{"WSResumeWindow": "-1s"}`, "cannot be negative"},
+		{`{"GhostReadWindow": "-1m"}`, "cannot be negative"},
+		{`{"InventoryWindow": "-3s"}`, "cannot be negative"},
+		{`{"RFIDKeepAlive": "-30s"}`, "cannot be negative"},
+		{`{"RFIDInitRetries": -1}`, "retries cannot be negative"},
+		{`{"WriteTagBlockCount": 8}`, "tag block count must be at least 9"},
+		{`{"RFIDInitRetryWait": "-2s"}`, "cannot be negative"},
+		{`{"SIPDelimiter": "||"}`, "single character"},
+		{`{"SIPDelimiter": "A"}`, "cannot be a letter"},
+		{`{"SIPTerminator": "|"}`, "must differ"},
+		{`{"CheckinMode": "continuous"}`, "checkin mode"},
+		{`{"WSRateLimit": -1}`, "rate limit cannot be negative"},
+		{`{"BarcodeRules": {"": {"CheckDigit": "mod97"}}}`, "unknown barcode check digit"},
+		{`{"ScreenMessages": {"item-lost": "Lost"}}`, "unknown screen message condition"},
+		{`{"BranchScreenMessages": {"fmaj": {"item-lost": "Lost"}}}`, "unknown screen message condition"},
+		{`{"CountryCode": "NOR"}`, "country code \"NOR\": wrong length"},
+		{`{"OwnerLibrary": "NO-0203 0000"}`, "owner library"},
+		{`{"SIPUser": `, "cannot parse config file"},
+	}
+
+	for _, test := range tests {
+		path := writeConfigFile(t, test.content)
+		_, err := LoadConfig(path)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("LoadConfig(%s) => %v; want error containing %q", test.content, err, test.want)
+		}
+	}
+
+	if _, err := LoadConfig("/nonexisting/config.json"); err == nil {
+		t.Error("LoadConfig(/nonexisting/config.json) => nil error; want error")
+	}
+}
+
+func TestClampDurations(t *testing.T) {
+	tests := []struct {
+		desc string
+		cfg  Config
+		want Config
+		n    int // Durations adjusted
+	}{
+		{"defaults", defaultConfig, defaultConfig, 0},
+		{"disabled", Config{}, Config{}, 0},
+		{"write wait",
+			Config{WSWriteWait: time.Millisecond, WSPongWait: time.Minute},
+			Config{WSWriteWait: minWriteWait, WSPongWait: time.Minute}, 1},
+		{"pong wait shorter than ping write",
+			Config{WSWriteWait: 5 * time.Second, WSPongWait: 3 * time.Second},
+			Config{WSWriteWait: 5 * time.Second, WSPongWait: 10 * time.Second}, 1},
+		{"pong wait of RFID timeout",
+			Config{RFIDTimeout: 500 * time.Millisecond, WSWriteWait: 200 * time.Millisecond},
+			Config{RFIDTimeout: 500 * time.Millisecond, WSWriteWait: 200 * time.Millisecond, WSPongWait: time.Second}, 1},
+		{"ack timeout shorter than write wait",
+			Config{WSAckTimeout: time.Second, WSPongWait: time.Minute},
+			Config{WSAckTimeout: defaultWriteWait, WSPongWait: time.Minute}, 1},
+		{"response timeouts and keepalives",
+			Config{RFIDResponseTimeout: time.Millisecond, SIPTimeout: 10 * time.Millisecond, RFIDKeepAlive: 500 * time.Millisecond, SIPKeepAlive: 30 * time.Second},
+			Config{RFIDResponseTimeout: minResponseTimeout, SIPTimeout: minResponseTimeout, RFIDKeepAlive: time.Second, SIPKeepAlive: 30 * time.Second}, 3},
+		{"reconnect",
+			Config{RFIDReconnectWait: 2 * time.Second, RFIDReconnectMaxWait: time.Second, RFIDReconnectMaxTime: time.Second},
+			Config{RFIDReconnectWait: 2 * time.Second, RFIDReconnectMaxWait: 2 * time.Second, RFIDReconnectMaxTime: 2 * time.Second}, 2},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		adjusted := cfg.clampDurations()
+		if !reflect.DeepEqual(cfg, tt.want) {
+			t.Errorf("%s: clampDurations() gave %+v; want %+v", tt.desc, cfg, tt.want)
+		}
+		if len(adjusted) != tt.n {
+			t.Errorf("%s: clampDurations() => %+v; want %d durations adjusted", tt.desc, adjusted, tt.n)
+		}
+	}
+
+	// LoadConfig clamps, and warns of it
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	path := writeConfigFile(t, `{"SIPServer": "sip.example.org:6001", "WSWriteWait": "1ms"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.WSWriteWait != minWriteWait || !strings.Contains(buf.String(), "setting=WSWriteWait") {
+		t.Errorf("LoadConfig gave WSWriteWait %v, and logged %q; want %v, and a warning", cfg.WSWriteWait, buf.String(), minWriteWait)
+	}
+}
+
+func TestConfigWebsocketDefaults(t *testing.T) {
+	cfg := Config{RFIDTimeout: time.Minute}
+	if got := cfg.writeWait(); got != defaultWriteWait {
+		t.Errorf("writeWait() => %v; want %v", got, defaultWriteWait)
+	}
+	if got := cfg.pongWait(); got != time.Minute {
+		t.Errorf("pongWait() => %v; want %v", got, time.Minute)
+	}
+	if got := cfg.maxMessageSize(); got != defaultMaxMessageSize {
+		t.Errorf("maxMessageSize() => %v; want %v", got, defaultMaxMessageSize)
+	}
+
+	cfg = Config{WSWriteWait: time.Second, WSPongWait: 30 * time.Second, WSMaxMessageSize: 4096}
+	if cfg.writeWait() != time.Second || cfg.pongWait() != 30*time.Second || cfg.maxMessageSize() != 4096 {
+		t.Errorf("configured websocket settings not used: %v %v %v",
+			cfg.writeWait(), cfg.pongWait(), cfg.maxMessageSize())
+	}
+}
+
+func TestBranchSecurityMerged(t *testing.T) {
+	cfg := Config{
+		Security: SecurityPolicy{AFISecure: 0x07, AFIUnsecure: 0xC2, TransitAlarm: transitAlarmOff, MagneticUnsecured: true},
+		BranchSecurity: map[string]SecurityPolicy{
+			"fmaj": {AFISecure: 0x9A},
+			"fbol": {Disabled: true, TransitUnsecured: true},
+		},
+	}
+	tests := []struct {
+		branch string
+		want   SecurityPolicy
+	}{
+		{"hutl", cfg.Security},
+		{"fmaj", SecurityPolicy{AFISecure: 0x9A, AFIUnsecure: 0xC2, TransitAlarm: transitAlarmOff, MagneticUnsecured: true}},
+		{"fbol", SecurityPolicy{Disabled: true, AFISecure: 0x07, AFIUnsecure: 0xC2, TransitAlarm: transitAlarmLeave, MagneticUnsecured: true}},
+	}
+	for _, tt := range tests {
+		if got := cfg.security(tt.branch); got != tt.want {
+			t.Errorf("security(%q) => %+v; want %+v", tt.branch, got, tt.want)
+		}
+	}
+}
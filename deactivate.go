@@ -0,0 +1,82 @@
+package main
+
+// DEACTIVATE turns the alarm of an item off without checking it out, ex for
+// display copies, and SENSITIZE turns it on again, without any SIP
+// transaction. Scanning is started, and the alarm of the first item read is
+// changed; with Config.UseAFI, the AFI is read back to verify it. Without
+// it, the RFID-unit cannot read back the alarm, and its OK is trusted, as
+// CONNECT tells Koha. Koha is told the result, with the security of the tag
+// before and after if read, when scanning has been stopped again.
+
+// manualAlarmCmd returns the alarm command of a DEACTIVATE or SENSITIZE
+// while scanning.
+func manualAlarmCmd(action string) RFIDCommand {
+	if action == "SENSITIZE" {
+		return cmdAlarmOn
+	}
+	return cmdAlarmOff
+}
+
+// startManualAlarm starts scanning for the item to DEACTIVATE or SENSITIZE.
+func (c *Client) startManualAlarm(msg Message) {
+	if c.state != RFIDIdle {
+		c.sendToKoha(Message{Action: msg.Action, UserError: true, ErrorCode: CodeInvalidRequest,
+			ErrorMessage: "alarm can only be changed manually when idle"})
+		return
+	}
+	c.current = Message{Action: msg.Action}
+	c.branch = msg.Branch
+	c.state = RFIDManualAlarmWaitForBegOK
+	c.rfid.Reset()
+	c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
+}
+
+// manualAlarmScanning handles the response to starting the scan.
+func (c *Client) manualAlarmScanning(resp RFIDResp) {
+	if !resp.OK {
+		c.logger().Error("RFID failed to start scanning")
+		c.sendToKoha(Message{Action: c.current.Action, RFIDError: true, ErrorCode: CodeRFIDNOK})
+		c.current = Message{}
+		c.state = RFIDIdle
+		return
+	}
+	c.state = RFIDManualAlarm
+}
+
+// manualAlarmRead changes the alarm of the item read.
+func (c *Client) manualAlarmRead(resp RFIDResp) {
+	barcode, err := c.hub.barcodes.normalize(resp.Tag)
+	if err != nil {
+		c.rejectTag(c.current.Action, resp.Tag, err)
+		c.state = RFIDWaitForManualAlarm
+		return
+	}
+	c.current.Item = Item{Barcode: barcode, Tag: resp.Tag, RSSI: resp.RSSI, TagCountFailed: !resp.OK}
+	c.setAlarm(manualAlarmCmd(c.current.Action), resp.Tag)
+	c.state = RFIDWaitForManualAlarm
+}
+
+// manualAlarmDone records whether the alarm was changed, as verified by
+// checkAFI with Config.UseAFI, or else as the RFID-unit responded, and stops
+// scanning; Koha is told the result when it has stopped.
+func (c *Client) manualAlarmDone(resp RFIDResp) {
+	item := &c.current.Item
+	switch {
+	case item.TransactionFailed:
+		// The tag was rejected, and its alarm left as is.
+	case !resp.OK && c.current.Action == "SENSITIZE":
+		item.AlarmOnFailed = true
+		item.Status = "Feil: fikk ikke skrudd på alarm."
+	case !resp.OK:
+		item.AlarmOffFailed = true
+		item.Status = "Feil: fikk ikke skrudd av alarm."
+	default:
+		c.logger().Info("alarm changed manually", "action", c.current.Action, "barcode", item.Barcode)
+	}
+	result := c.current
+	c.endResult = &result
+	c.current = Message{}
+	c.state = RFIDWaitForEndOK
+	c.endRetries = 0
+	c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+}
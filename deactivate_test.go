@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"app/fake"
+)
+
+// Verify that the alarm of an item on the fake RFID-unit is turned off and
+// on again without SIP, with the AFI read back.
+func TestDeactivateSensitize(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	cfg := Config{
+		HTTPPort:    port(srv.URL),
+		RFIDTimeout: 1 * time.Second,
+		UseAFI:      true,
+		Security:    SecurityPolicy{AFISecure: 0x07, AFIUnsecure: 0xC2},
+	}
+	if err := simulate(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	hub = newHub(cfg)
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-uiChan // CONNECT
+
+	// The first item on the RFID-unit is the one changed.
+	tag := fake.Tag("03010824124004")
+	tests := []struct {
+		action        string
+		before, after string
+	}{
+		{"DEACTIVATE", "SECURE", "UNSECURE"},
+		{"SENSITIZE", "UNSECURE", "SECURE"},
+	}
+	for _, test := range tests {
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"`+test.action+`","Branch":"hutl"}`)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		want := Message{Action: test.action, Item: Item{Barcode: "03010824124004", Tag: tag,
+			SecurityBefore: test.before, SecurityAfter: test.after}}
+		if got := <-uiChan; !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %+v; want %+v", got, want)
+		}
+	}
+
+	// The RFID-unit is left ready for transactions.
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if got := <-uiChan; got.Action != "CHECKIN" || got.Item.Barcode != "03010824124004" || got.Item.TransactionFailed {
+		t.Errorf("Got %+v; want successful CHECKIN after SENSITIZE", got)
+	}
+}
+
+// Verify that a failure to change the alarm is reported, and that the alarm
+// cannot be changed manually during a transaction.
+func TestDeactivateFailed(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"DEACTIVATE","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Fatalf("RFID-unit got %q; want alarm off", msg)
+	}
+
+	// Busy changing the alarm
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"SENSITIZE","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if got := <-uiChan; got.Action != "SENSITIZE" || !got.UserError || got.ErrorCode != CodeInvalidRequest {
+		t.Errorf("Got %+v; want SENSITIZE refused while busy", got)
+	}
+
+	d.write([]byte("NOK\r"))
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Fatalf("RFID-unit got %q; want END", msg)
+	}
+	d.write([]byte("OK\r"))
+	want := Message{Action: "DEACTIVATE", ErrorCode: CodeAlarmFailed, Item: Item{Barcode: "03010824124004", Tag: "1003010824124004:NO:02030000",
+		AlarmOffFailed: true, Status: "Feil: fikk ikke skrudd av alarm."}}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
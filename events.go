@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of an Event.
+type EventType string
+
+// Types of events.
+const (
+	EventCheckinComplete  EventType = "checkin-complete"  // An item was checked in, and its alarm changed
+	EventCheckoutComplete EventType = "checkout-complete" // An item was checked out, and its alarm changed
+	EventError            EventType = "error"             // Koha was sent an error
+)
+
+// An Event is emitted by the hub on a transaction, for integrators to
+// trigger external systems, ex to print a routing slip.
+type Event struct {
+	Type         EventType
+	Time         time.Time
+	IP           string // IP of the client
+	Branch       string
+	Patron       string    // Patron the item was checked out to, on checkout-complete
+	Item         Item      // Item of the transaction, on checkin-complete and checkout-complete
+	Action       string    // Action of the message with the error, on error
+	ErrorCode    ErrorCode // on error
+	ErrorMessage string    // on error
+}
+
+// An EventHandler handles the events emitted by the hub.
+type EventHandler interface {
+	HandleEvent(Event)
+}
+
+// EventHandlerFunc is a function handling events.
+type EventHandlerFunc func(Event)
+
+// HandleEvent calls f(e).
+func (f EventHandlerFunc) HandleEvent(e Event) { f(e) }
+
+// eventQueueSize is the number of events queued for a handler which is
+// busy, before further events are dropped.
+const eventQueueSize = 100
+
+// eventBus dispatches events to the registered handlers. Each handler gets
+// the events in order, in a goroutine of its own, so that a slow handler
+// doesn't stall the clients or the other handlers. The zero eventBus has
+// no handlers.
+type eventBus struct {
+	mu     sync.Mutex
+	queues []chan Event
+	closed bool
+}
+
+// register adds a handler of the events emitted from now on.
+func (b *eventBus) register(h EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	q := make(chan Event, eventQueueSize)
+	b.queues = append(b.queues, q)
+	go func() {
+		for e := range q {
+			h.HandleEvent(e)
+		}
+	}()
+}
+
+// emit queues e for every handler, without waiting for them. The event is
+// dropped for a handler whose queue is full.
+func (b *eventBus) emit(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.queues {
+		select {
+		case q <- e:
+		default:
+			metrics.eventsDropped.Inc("")
+			logger.Warn("event handler is busy, dropping event", "type", e.Type, "ip", e.IP)
+		}
+	}
+}
+
+// close stops dispatching events. The events queued are still handled.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, q := range b.queues {
+		close(q)
+	}
+	b.queues = nil
+}
+
+// RegisterEventHandler registers h to handle the events of transactions.
+func (h *Hub) RegisterEventHandler(eh EventHandler) {
+	h.events.register(eh)
+}
+
+// emit emits an event of the client's transactions. It may be called from
+// any goroutine of the client.
+func (c *Client) emit(e Event) {
+	e.Time = time.Now()
+	e.IP = c.IP
+	e.Branch = c.Status().Branch
+	c.hub.events.emit(e)
+}
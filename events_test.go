@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Verify that a busy handler neither stalls the emitter nor the other
+// handlers, but gets its events dropped when its queue is full.
+func TestEventBusBusyHandler(t *testing.T) {
+	var b eventBus
+	defer b.close()
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	defer close(unblock)
+	b.register(EventHandlerFunc(func(Event) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-unblock
+	}))
+	received := make(chan Event, eventQueueSize+2)
+	b.register(EventHandlerFunc(func(e Event) { received <- e }))
+
+	dropped := metrics.eventsDropped.Value("")
+	b.emit(Event{Type: EventError})
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < eventQueueSize+1; i++ {
+			b.emit(Event{Type: EventCheckinComplete})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("emit blocked on busy handler")
+	}
+	if n := metrics.eventsDropped.Value("") - dropped; n != 1 {
+		t.Errorf("dropped %d events; want 1", n)
+	}
+	for i := 0; i < eventQueueSize+2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("handler got %d events; want %d", i, eventQueueSize+2)
+		}
+	}
+}
+
+func TestTransactionEvents(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	events := make(chan Event, 10)
+	hub.RegisterEventHandler(EventHandlerFunc(func(e Event) { events <- e }))
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT
+
+	// An item is checked in
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CTfmaj|AA2|CS927.8|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKIN
+
+	// A blocked patron is refused
+	sipSrv.Respond("24Y             00020140303    110236AOHUTL|AA95|AEPatron|BLY|AFLåneren har for mange purringer|\r")
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	<-uiChan // CHECKOUT patron error
+
+	// An item is checked out
+	sipSrv.Respond("24              00020140303    110236AOHUTL|AA95|AEPatron|BLY|\r")
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	<-d.incoming // OK0
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKOUT
+
+	for _, want := range []Event{
+		{Type: EventCheckinComplete, Branch: "fmaj",
+			Item: Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", Date: "26/02/2014"}},
+		{Type: EventError, Branch: "fmaj", Action: "CHECKOUT", ErrorCode: CodePatronInvalid,
+			ErrorMessage: "Låneren har for mange purringer"},
+		{Type: EventCheckoutComplete, Branch: "fmaj", Patron: "95",
+			Item: Item{Label: "Cat's cradle", Barcode: "03011063175001", Date: "31/03/2014"}},
+	} {
+		var got Event
+		select {
+		case got = <-events:
+		case <-time.After(time.Second):
+			t.Fatalf("handler didn't get %s event", want.Type)
+		}
+		if got.Time.IsZero() || got.IP == "" {
+			t.Errorf("%s event without time or client IP: %+v", got.Type, got)
+		}
+		got.Time, got.IP = time.Time{}, ""
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %+v; want %+v", got, want)
+		}
+	}
+}
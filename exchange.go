@@ -0,0 +1,194 @@
+package main
+
+import "time"
+
+// A CHECKIN-CHECKOUT exchanges the items of a patron returning and
+// borrowing them again at once: each item read is checked in, and checked
+// out again to the patron. The alarm is changed once, for the net result of
+// the two, so that an item borrowed again is not secured only to be
+// unsecured: it is turned off if the item is checked out, or on if it is
+// returned but cannot be checked out, ex because it is reserved for
+// another patron.
+
+// exchange checks in and out again the item of a tag read in a
+// CHECKIN-CHECKOUT, and changes its alarm for the net result.
+func (c *Client) exchange(resp RFIDResp) {
+	barcode, err := c.hub.barcodes.normalize(resp.Tag)
+	if err != nil {
+		c.rejectTag("CHECKIN-CHECKOUT", resp.Tag, err)
+		c.state = RFIDWaitForExchangeAlarmLeave
+		return
+	}
+	if c.ghostRead(resp.Tag) || (resp.OK && c.exchanged(barcode)) {
+		c.logger().Debug("ignoring item read again", "barcode", barcode)
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDWaitForExchangeRereadLeave
+		return
+	}
+	if !resp.OK {
+		// Missing tags: the item is neither checked in nor out, until the
+		// set is read complete.
+		if barcode != c.current.Item.Barcode {
+			c.current, err = DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgItemStatus(resp.Tag), c.config().localized(c.branch, itemStatusParse), c.IP)
+			if err != nil {
+				c.itemSIPError("CHECKIN-CHECKOUT", barcode, resp.Tag, err)
+				c.state = RFIDWaitForExchangeAlarmLeave
+				return
+			}
+		}
+		c.current.Action = "CHECKIN-CHECKOUT"
+		c.current.Item.TagCountFailed = true
+		c.current.Item.RSSI = resp.RSSI
+		c.alarmIncompleteSet(barcode, resp.Tag, RFIDWaitForExchangeAlarmLeave)
+		return
+	}
+
+	checkin, err := DoSIPCallWithRetry(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgCheckin(c.branch, resp.Tag), c.config().localized(c.branch, checkinParse), c.IP, c.sipRetrying)
+	if err != nil {
+		c.itemSIPError("CHECKIN-CHECKOUT", barcode, resp.Tag, err)
+		c.state = RFIDWaitForExchangeAlarmLeave
+		return
+	}
+	if checkin.Item.Unknown || checkin.Item.Blocked {
+		if checkin.Item.Blocked {
+			c.logger().Warn("item must be handled manually", "barcode", barcode, "reason", checkin.Item.Status)
+		}
+		c.current = checkin
+		c.current.Action = "CHECKIN-CHECKOUT"
+		c.current.Item.RSSI = resp.RSSI
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDWaitForExchangeAlarmLeave
+		return
+	}
+	// An item which is not on loan fails to be checked in, but may still be
+	// checked out.
+	returned := !checkin.Item.TransactionFailed
+	if returned {
+		metrics.checkins.Inc(c.branch)
+		c.journal("CHECKIN", barcode, resp.Tag, stepSIP)
+	}
+
+	req := sipFormMsgCheckoutAt(c.branch, c.patron, resp.Tag, c.noBlock, time.Now())
+	checkout, err := DoSIPCallWithRetry(c.ctx, *c.config(), c.sipPoolFor(c.branch), req, c.config().localized(c.branch, checkoutParse), c.IP, c.sipRetrying)
+	switch {
+	case err == nil && !checkout.Item.Unknown && !checkout.Item.TransactionFailed:
+		metrics.checkouts.Inc(c.branch)
+		if returned {
+			c.journal("CHECKIN", barcode, "", stepDone)
+			c.emit(Event{Type: EventCheckinComplete, Item: checkin.Item})
+		}
+		c.journal("CHECKOUT", barcode, resp.Tag, stepSIP)
+		c.current = checkout
+		c.current.Action = "CHECKIN-CHECKOUT"
+		c.current.Item.RSSI = resp.RSSI
+		c.items[barcode] = c.current
+		c.failedAlarmOff[barcode] = failedTag{tag: resp.Tag, uid: resp.TagID} // Store tag for potential retry
+		if c.alarmLeft(false) {
+			delete(c.failedAlarmOff, barcode)
+			c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+			c.state = RFIDWaitForExchangeAlarmKept
+			break
+		}
+		c.setAlarm(cmdAlarmOff, resp.Tag)
+		c.state = RFIDWaitForExchangeAlarm
+	case returned:
+		// Returned, but not borrowed again: the item is secured as on
+		// checkin, and Koha is told why it wasn't checked out.
+		c.current = checkin
+		c.current.Action = "CHECKIN-CHECKOUT"
+		c.current.Item.RSSI = resp.RSSI
+		c.current.Item.TransactionFailed = true
+		if err != nil {
+			c.logger().Error("SIP call failed", "err", err)
+			c.current.SIPError = true
+			c.current.ErrorCode = sipErrorCode(err)
+			c.current.ErrorMessage = err.Error()
+		} else {
+			c.current.Item.Status = checkout.Item.Status
+		}
+		if c.branch == c.current.Item.Transfer {
+			c.current.Item.Transfer = ""
+			c.current.Item.InTransit = false
+		}
+		c.items[barcode] = c.current
+		c.failedAlarmOn[barcode] = failedTag{tag: resp.Tag, uid: resp.TagID} // Store tag for potential retry
+		if c.alarmLeft(true) {
+			delete(c.failedAlarmOn, barcode)
+			c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+			c.state = RFIDWaitForExchangeAlarmKept
+			break
+		}
+		c.setAlarm(cmdAlarmOn, resp.Tag)
+		c.state = RFIDWaitForExchangeAlarm
+	case err != nil:
+		c.itemSIPError("CHECKIN-CHECKOUT", barcode, resp.Tag, err)
+		c.state = RFIDWaitForExchangeAlarmLeave
+	default:
+		// Neither checked in nor out; the alarm is left as is.
+		c.current = checkout
+		c.current.Action = "CHECKIN-CHECKOUT"
+		c.current.Item.RSSI = resp.RSSI
+		c.sendToRFID(RFIDReq{Cmd: cmdAlarmLeave})
+		c.state = RFIDWaitForExchangeAlarmLeave
+	}
+}
+
+// exchangeDone tells Koha the result of the CHECKIN-CHECKOUT of the current
+// item, when its alarm has been changed.
+func (c *Client) exchangeDone(resp RFIDResp) {
+	c.state = RFIDExchange
+	action := c.exchangeAction()
+	barcode := c.current.Item.Barcode
+	switch {
+	case !resp.OK && action == "CHECKIN":
+		c.current.Item.AlarmOnFailed = true
+		c.current.Item.Status = "Feil: fikk ikke skrudd på alarm."
+	case !resp.OK:
+		c.current.Item.AlarmOffFailed = true
+		c.current.Item.Status = "Feil: fikk ikke skrudd av alarm."
+	case action == "CHECKIN":
+		// The status tells why the item wasn't checked out.
+		delete(c.failedAlarmOn, barcode)
+		c.current.Item.AlarmOnFailed = false
+	default:
+		delete(c.failedAlarmOff, barcode)
+		c.current.Item.AlarmOffFailed = false
+		c.current.Item.Status = ""
+	}
+	c.sendToKoha(c.current)
+	c.journalResult(action)
+	if action == "CHECKIN" {
+		c.emit(Event{Type: EventCheckinComplete, Item: c.current.Item})
+	} else {
+		c.emit(Event{Type: EventCheckoutComplete, Patron: c.patron, Item: c.current.Item})
+	}
+}
+
+// exchangeAction returns the net transaction of the current item of a
+// CHECKIN-CHECKOUT, whose alarm is being changed: CHECKOUT, or CHECKIN if
+// it could not be checked out.
+func (c *Client) exchangeAction() string {
+	if c.current.Item.TransactionFailed {
+		return "CHECKIN"
+	}
+	return "CHECKOUT"
+}
+
+// exchanged reports whether the item with the given barcode has been
+// checked in and out again, or else returned, with its alarm changed, in
+// the current CHECKIN-CHECKOUT.
+func (c *Client) exchanged(barcode string) bool {
+	item, ok := c.items[barcode]
+	_, alarmOnFailed := c.failedAlarmOn[barcode]
+	_, alarmOffFailed := c.failedAlarmOff[barcode]
+	return ok && item.Action == "CHECKIN-CHECKOUT" && !item.Item.TagCountFailed && !alarmOnFailed && !alarmOffFailed
+}
+
+// scanState returns the state to scan in when the alarms of failed items
+// have been retried: scan, or RFIDExchange if they were exchanged.
+func (c *Client) scanState(scan RFIDState) RFIDState {
+	if c.current.Action == "CHECKIN-CHECKOUT" {
+		return RFIDExchange
+	}
+	return scan
+}
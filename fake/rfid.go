@@ -0,0 +1,175 @@
+// Package fake provides in-process fakes of an RFID-unit and a SIP server,
+// for running the hub without real hardware, and for tests.
+package fake
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Version is the firmware version reported by the fake RFID-unit.
+const Version = "fake 1.0"
+
+// Tag returns the RFID tag id of an item with the given barcode, as read
+// by the RFID-unit. Ex: 03010824124004 => 1003010824124004:NO:02030000
+func Tag(barcode string) string {
+	return "10" + barcode + ":NO:02030000"
+}
+
+// RFIDUnit is a fake RFID-unit. When a scan is started, it reads its tags
+// one at a time; the next tag is read when the alarm of the previous tag
+// has been set.
+type RFIDUnit struct {
+	l    net.Listener
+	mu   sync.Mutex
+	tags []string
+}
+
+// NewRFIDUnit starts a fake RFID-unit listening on a random port on
+// localhost, with tags for the given barcodes.
+func NewRFIDUnit(barcodes ...string) (*RFIDUnit, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	u := &RFIDUnit{l: l}
+	u.SetItems(barcodes...)
+	go u.run()
+	return u, nil
+}
+
+// SetItems replaces the items on the RFID-unit. Scans already started
+// are not affected.
+func (u *RFIDUnit) SetItems(barcodes ...string) {
+	tags := make([]string, len(barcodes))
+	for i, b := range barcodes {
+		tags[i] = Tag(b)
+	}
+	u.mu.Lock()
+	u.tags = tags
+	u.mu.Unlock()
+}
+
+// Port returns the port the RFID-unit is listening on.
+func (u *RFIDUnit) Port() string {
+	_, port, _ := net.SplitHostPort(u.l.Addr().String())
+	return port
+}
+
+// Close stops the RFID-unit from accepting connections.
+func (u *RFIDUnit) Close() error { return u.l.Close() }
+
+func (u *RFIDUnit) run() {
+	for {
+		conn, err := u.l.Accept()
+		if err != nil {
+			return
+		}
+		go u.handle(conn)
+	}
+}
+
+// rfidConn is the state of a connection to the RFID-unit.
+type rfidConn struct {
+	w    *bufio.Writer
+	tags []string          // Tags not yet read in the current scan
+	afi  map[string]string // AFI of tags, keyed by tag id
+}
+
+func (u *RFIDUnit) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	c := rfidConn{w: bufio.NewWriter(conn), afi: make(map[string]string)}
+	for {
+		b, err := r.ReadString('\r')
+		if err != nil {
+			return
+		}
+		c.respond(strings.TrimSuffix(b, "\r"), u)
+		if c.w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (c *rfidConn) respond(req string, u *RFIDUnit) {
+	switch {
+	case req == "BEG":
+		u.mu.Lock()
+		c.tags = append([]string(nil), u.tags...)
+		u.mu.Unlock()
+		c.write("OK")
+		c.readNext()
+	case req == "END":
+		c.tags = nil
+		c.write("OK")
+	case req == "OK1", req == "OK0", req == "OK ":
+		// Alarm set; the next tag is read.
+		c.write("OK")
+		c.readNext()
+	case req == "TGC":
+		c.write("OK|1")
+	case req == "OKR":
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if len(u.tags) == 0 {
+			c.write("NOK")
+			return
+		}
+		c.write("RDT" + u.tags[0] + "|0")
+	case strings.HasPrefix(req, "WRT"):
+		// Ex: WRT03010824124004|2|0 => OK|<id>|<id>
+		parts := strings.Split(req[3:], "|")
+		n := 1
+		if len(parts) == 3 {
+			fmt.Sscan(parts[1], &n)
+		}
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("E0040100%08X", i+1)
+		}
+		c.write("OK|" + strings.Join(ids, "|"))
+	case strings.HasPrefix(req, "AFS"):
+		// Ex: AFS1003010824124004:NO:02030000|07
+		if i := strings.LastIndex(req, "|"); i > 3 {
+			c.afi[req[3:i]] = req[i+1:]
+		}
+		c.write("OK")
+	case strings.HasPrefix(req, "AFR"):
+		// The AFI is read back after it is set; the next tag is read.
+		tag := req[3:]
+		afi, ok := c.afi[tag]
+		if !ok {
+			afi = "07"
+		}
+		c.write("AFI" + tag + "|" + afi)
+		c.readNext()
+	case strings.HasPrefix(req, "SET"):
+		// The fake items are all single part.
+		c.write(req + "|1|1")
+	case strings.HasPrefix(req, "VER"):
+		c.write("OK|" + Version)
+	case strings.HasPrefix(req, "SLP"),
+		strings.HasPrefix(req, "ACT"), strings.HasPrefix(req, "DAC"):
+		c.write("OK")
+	default:
+		c.write("NOK")
+	}
+}
+
+// readNext reads the next tag of the scan, if any.
+func (c *rfidConn) readNext() {
+	if len(c.tags) == 0 {
+		return
+	}
+	c.write("RDT" + c.tags[0] + "|0")
+	c.tags = c.tags[1:]
+}
+
+func (c *rfidConn) write(resp string) {
+	c.w.WriteString(resp)
+	c.w.WriteByte('\r')
+}
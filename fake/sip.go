@@ -0,0 +1,193 @@
+package fake
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Item is an item known by the fake SIP server.
+type Item struct {
+	Barcode string
+	Title   string
+	Branch  string // Home branch
+	Hold    bool   // On hold for Patron, at the branch HoldBranch
+}
+
+// Test patrons. Patron can borrow items, BlockedPatron is denied to.
+// Other patrons are unknown.
+const (
+	Patron        = "95"
+	BlockedPatron = "96"
+	HoldBranch    = "fmaj"
+)
+
+// Items are the items known by the fake SIP server, keyed by barcode.
+var Items = map[string]Item{
+	"03010824124004": {Barcode: "03010824124004", Title: "Heavy metal in Baghdad", Branch: "fhol"},
+	"03011063175001": {Barcode: "03011063175001", Title: "Cat's cradle", Branch: "hutl"},
+	"03011143299001": {Barcode: "03011143299001", Title: "316 salmer og sanger", Branch: "hutl", Hold: true},
+}
+
+// Barcodes returns the sorted barcodes of Items.
+func Barcodes() []string {
+	barcodes := make([]string, 0, len(Items))
+	for b := range Items {
+		barcodes = append(barcodes, b)
+	}
+	sort.Strings(barcodes)
+	return barcodes
+}
+
+const sipDateLayout = "20060102    150405"
+
+// Length of the fixed fields of the SIP requests, following the message code.
+var sipFixedLen = map[string]int{
+	"09": 37, // no block, transaction date, return date
+	"11": 38, // SC renewal policy, no block, transaction date, nb due date
+	"17": 18, // transaction date
+	"23": 21, // language, transaction date
+	"29": 38, // third party allowed, no block, transaction date, nb due date
+	"93": 2,  // UID algorithm, PWD algorithm
+	"99": 8,  // status code, max print width, protocol version
+}
+
+// SIPServer is a fake SIP server, which answers requests with canned
+// responses for the test patrons and Items. Error detection is not supported.
+type SIPServer struct {
+	l net.Listener
+}
+
+// NewSIPServer starts a fake SIP server listening on a random port on localhost.
+func NewSIPServer() (*SIPServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &SIPServer{l: l}
+	go s.run()
+	return s, nil
+}
+
+// Addr returns the address of the SIP server, as host:port.
+func (s *SIPServer) Addr() string { return s.l.Addr().String() }
+
+// Close stops the SIP server from accepting connections.
+func (s *SIPServer) Close() error { return s.l.Close() }
+
+func (s *SIPServer) run() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *SIPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		req, err := r.ReadString('\r')
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte(sipRespond(strings.TrimRight(req, "\r\n")) + "\r")); err != nil {
+			return
+		}
+	}
+}
+
+// sipField returns the value of the variable field with the given code in
+// the SIP request req.
+func sipField(req, code string) string {
+	n, ok := sipFixedLen[req[:2]]
+	if !ok || len(req) < 2+n {
+		return ""
+	}
+	for _, f := range strings.Split(req[2+n:], "|") {
+		if strings.HasPrefix(f, code) {
+			return f[len(code):]
+		}
+	}
+	return ""
+}
+
+// sipItem returns the barcode of the item identifier field in the SIP
+// request, which may be given as the tag id of the item, and the item
+// with the barcode.
+func sipItem(req string) (Item, string, bool) {
+	barcode := sipField(req, "AB")
+	if t := strings.Split(barcode, ":"); len(t) == 3 && t[2] == "02030000" {
+		barcode = strings.TrimPrefix(t[0], "10")
+	}
+	item, ok := Items[barcode]
+	return item, barcode, ok
+}
+
+func sipRespond(req string) string {
+	if len(req) < 2 {
+		return "96"
+	}
+	now := time.Now().Format(sipDateLayout)
+	due := time.Now().AddDate(0, 0, 28).Format(sipDateLayout)
+	patron := sipField(req, "AA")
+	inst := "AO" + sipField(req, "AO") + "|"
+
+	switch req[:2] {
+	case "93": // Login
+		return "941"
+	case "99": // SC status
+		return "98YYYYNN600003" + now + "2.00AO|BXYYYYYYYYYYYYYYYY|"
+	case "23": // Patron status
+		switch patron {
+		case Patron:
+			return "24              000" + now + inst + "AA" + patron + "|AETest Patron|BLY|"
+		case BlockedPatron:
+			return "24Y             000" + now + inst + "AA" + patron + "|AEBlocked Patron|BLY|AFLåneren er sperret|"
+		default:
+			return "24YYYY          000" + now + inst + "AA" + patron + "|AE|BLN|"
+		}
+	case "09": // Checkin
+		item, id, ok := sipItem(req)
+		if !ok {
+			return "100NUY" + now + inst + "AB" + id + "|CV99|AFItem not checked out|"
+		}
+		if item.Hold {
+			return "101YNY" + now + inst + "AB" + id + "|AQ" + item.Branch + "|AJ" + item.Title +
+				"|CT" + HoldBranch + "|CV02|CY" + Patron + "|"
+		}
+		return "101YNN" + now + inst + "AB" + id + "|AQ" + item.Branch + "|AJ" + item.Title + "|"
+	case "11": // Checkout
+		item, id, ok := sipItem(req)
+		switch {
+		case patron != Patron:
+			return "120NUN" + now + inst + "AA" + patron + "|AB" + id + "|AJ" + item.Title + "|AH|AFPatron cannot borrow|"
+		case !ok:
+			return "120NUN" + now + inst + "AA" + patron + "|AB" + id + "|AJ|AH|AFInvalid item|"
+		case item.Hold:
+			return "120NUN" + now + inst + "AA" + patron + "|AB" + id + "|AJ" + item.Title + "|AH|AFItem is on hold for another patron|"
+		}
+		return "121NNY" + now + inst + "AA" + patron + "|AB" + id + "|AJ" + item.Title + "|AH" + due + "|"
+	case "29": // Renew
+		item, id, ok := sipItem(req)
+		if !ok || item.Hold || patron != Patron {
+			return "300NUN" + now + inst + "AA" + patron + "|AB" + id + "|AJ" + item.Title + "|AH|AFRenewal not allowed|"
+		}
+		return "301YNY" + now + inst + "AA" + patron + "|AB" + id + "|AJ" + item.Title + "|AH" + due + "|"
+	case "17": // Item information
+		item, id, ok := sipItem(req)
+		if !ok {
+			return "18010001" + now + "AB" + id + "|AJ|"
+		}
+		status := "03" // Available
+		if item.Hold {
+			status = "08" // Waiting on hold shelf
+		}
+		return "18" + status + "0201" + now + "AB" + id + "|AJ" + item.Title + "|AQ" + item.Branch + "|BG" + item.Branch + "|"
+	}
+	return "96" // Request SC resend
+}
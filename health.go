@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// rfidHealthTimeout is the time to wait for the RFID-unit checked by
+// /healthz to accept a connection.
+const rfidHealthTimeout = 5 * time.Second
+
+// subsystemHealth is the health of a subsystem, as reported by /healthz.
+type subsystemHealth struct {
+	OK            bool
+	Error         string `json:",omitempty"` // Error of this check
+	LastError     string `json:",omitempty"` // Last error of any check, also when healthy again
+	LastErrorTime string `json:",omitempty"`
+}
+
+// healthReport is the response of /healthz.
+type healthReport struct {
+	OK   bool
+	SIP  subsystemHealth
+	RFID *subsystemHealth `json:",omitempty"` // Only if Config.HealthRFIDAddr is set
+}
+
+// health keeps the last errors of the subsystems checked by /healthz.
+type health struct {
+	sip  subsystemHealth
+	rfid subsystemHealth
+}
+
+// update sets the result of a check of s.
+func (s *subsystemHealth) update(err error) {
+	s.OK = err == nil
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+		s.LastError = s.Error
+		s.LastErrorTime = time.Now().Format(time.RFC3339)
+	}
+}
+
+// checkHealth checks that the SIP server can be reached through the pool,
+// and, if configured, that the RFID-unit at HealthRFIDAddr accepts
+// connections.
+func (h *Hub) checkHealth() healthReport {
+	s := h.settings()
+	sipErr := s.sipPool.probe(checkSIPConn(s.config))
+	var rfidErr error
+	if s.config.HealthRFIDAddr != "" {
+		var conn net.Conn
+		conn, rfidErr = net.DialTimeout("tcp", s.config.HealthRFIDAddr, rfidHealthTimeout)
+		if rfidErr == nil {
+			conn.Close()
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.health.sip.update(sipErr)
+	report := healthReport{OK: sipErr == nil, SIP: h.health.sip}
+	if s.config.HealthRFIDAddr != "" {
+		h.health.rfid.update(rfidErr)
+		rfid := h.health.rfid
+		report.RFID = &rfid
+		report.OK = report.OK && rfidErr == nil
+	}
+	return report
+}
+
+// ServeHealth responds with the health of the SIP server and RFID-unit, with
+// status 200 if they are reachable, and 503 if not.
+func (h *Hub) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	report := h.checkHealth()
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		args := []interface{}{"sip", report.SIP.Error}
+		if report.RFID != nil {
+			args = append(args, "rfid", report.RFID.Error)
+		}
+		h.log.Warn("health check failed", args...)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		h.log.Error("cannot encode health report", "err", err)
+	}
+}
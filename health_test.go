@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getHealth(t *testing.T, h *Hub) (int, healthReport) {
+	rec := httptest.NewRecorder()
+	h.ServeHealth(rec, httptest.NewRequest("GET", "/healthz", nil))
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestHealthOK(t *testing.T) {
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+	sipSrv.Respond("98YYYNYN01000320170101    1200002.00AOfmaj|BXYYYYYYYYYYYYYYYY|\r")
+
+	rfid, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfid.Close()
+
+	h := newHub(Config{SIPServer: sipSrv.Addr(), SIPMaxConn: 1, SIPTimeout: time.Second,
+		HealthRFIDAddr: rfid.Addr().String()})
+	defer h.Close()
+
+	code, report := getHealth(t, h)
+	if code != http.StatusOK || !report.OK || !report.SIP.OK || report.RFID == nil || !report.RFID.OK {
+		t.Fatalf("GET /healthz => %d %+v; want 200 and all OK", code, report)
+	}
+
+	// The SIP connection is kept in the pool, and reused by the next check.
+	getHealth(t, h)
+	if s := h.settings().sipPool.stats(); s.Created != 1 || s.Idle != 1 {
+		t.Errorf("pool stats after two checks => %+v; want 1 connection created and idle", s)
+	}
+}
+
+func TestHealthSIPDown(t *testing.T) {
+	// An address nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	h := newHub(Config{SIPServer: addr, SIPMaxConn: 1, SIPTimeout: time.Second})
+	defer h.Close()
+
+	code, report := getHealth(t, h)
+	if code != http.StatusServiceUnavailable || report.OK || report.SIP.OK {
+		t.Fatalf("GET /healthz => %d %+v; want 503 with SIP not OK", code, report)
+	}
+	if report.SIP.Error == "" || report.SIP.LastError != report.SIP.Error || report.SIP.LastErrorTime == "" {
+		t.Errorf("SIP health => %+v; want error and last error", report.SIP)
+	}
+	if report.RFID != nil {
+		t.Errorf("RFID health => %+v; want none, when no RFID-unit is configured", report.RFID)
+	}
+
+	// The last error is kept when the SIP server is back.
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+	sipSrv.Respond("98YYYNYN01000320170101    1200002.00AOfmaj|BXYYYYYYYYYYYYYYYY|\r")
+	cfg := Config{SIPServer: sipSrv.Addr(), SIPTimeout: time.Second}
+	h.current.Store(&settings{config: cfg, sipPool: newPool(0, 1, 0, initSIPConn(cfg))})
+
+	code, healthy := getHealth(t, h)
+	if code != http.StatusOK || !healthy.SIP.OK || healthy.SIP.Error != "" || healthy.SIP.LastError != report.SIP.Error {
+		t.Errorf("GET /healthz => %d %+v; want 200 with the last error", code, healthy)
+	}
+}
@@ -1,43 +1,257 @@
 package main
 
-import "sync"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies for clients connecting from the same IP as a connected client.
+const (
+	duplicateEvict  = "evict"
+	duplicateReject = "reject"
+)
+
+// Checkin modes: in batch mode, scanning continues after each item, until
+// Koha sends END. In single mode, scanning stops after each item, and Koha
+// must send CHECKIN for the next.
+const (
+	checkinBatch  = "batch"
+	checkinSingle = "single"
+)
+
+// Policies for items whose alarm cannot be turned on after they have been
+// checked in. With notify, Koha is told, and staff can retry the alarm.
+// With compensate, the checkin is reverted by checking the item out again.
+// With block, the result is held back while the alarm is resent.
+const (
+	alarmFailNotify     = "notify"
+	alarmFailCompensate = "compensate"
+	alarmFailBlock      = "block"
+)
+
+// Orders of the alarm and the SIP checkout, at checkout. With after, the
+// alarm is turned off when the SIP server has checked out the item. With
+// before, it is turned off first, and the item checked out when the
+// RFID-unit has responded; it is turned on again if the checkout is denied.
+const (
+	checkoutAlarmAfter  = "after"
+	checkoutAlarmBefore = "before"
+)
+
+// Alarm commands for sets read as incomplete. With leave, the alarm is not
+// changed, whatever state it is in; with on and off, it is turned on or off.
+const (
+	incompleteAlarmLeave = "leave"
+	incompleteAlarmOn    = "on"
+	incompleteAlarmOff   = "off"
+)
+
+// Alarm commands for items checked in to be sent in transit to another
+// branch. With on, they are secured as other items; with leave, the alarm
+// is not changed; with off, they are unsecured for the transport, and are
+// secured when checked in at their destination.
+const (
+	transitAlarmOn    = "on"
+	transitAlarmLeave = "leave"
+	transitAlarmOff   = "off"
+)
 
 // Hub maintains the set of connected clients, to make sure we only have one per IP.
 type Hub struct {
-	mu          sync.Mutex         // Protects the following:
-	clients     map[*Client]bool   // Connected clients
-	clientsByIP map[string]*Client // Connected clients keyed by IP-address
-	config      Config
-	sipPool     *pool
+	mu           sync.Mutex         // Protects the following:
+	clients      map[*Client]bool   // Connected clients
+	clientsByIP  map[string]*Client // Connected clients keyed by IP-address
+	shuttingDown bool               // No new clients are accepted
+	config       Config             // Config the hub was started with
+	current      atomic.Value       // *settings of new transactions, replaced by Reload
+	log          *Logger
+	clock        clock
+	barcodes     barcodeNormalizer
+	journal      *journal           // Journal of transactions, nil if disabled
+	recovered    []journalRecord    // Transactions in-flight at the last crash
+	health       health             // Results of the checks of /healthz
+	suspended    map[string]*Client // Clients whose websocket has dropped, keyed by session token
+	tracer       *rfidTracer        // Traces the raw traffic with the RFID-units
+	dial         dialFunc           // Connects to the RFID-units
+	events       eventBus           // Dispatches the events of transactions to the handlers registered
+	ctx          context.Context    // Parent of the contexts of the clients, done when the hub is closed
+	cancel       context.CancelFunc // Cancels ctx
 }
 
+// dialFunc connects to an address, like net.Dial. It is replaced in tests,
+// to inspect the connections made.
+type dialFunc func(network, address string) (net.Conn, error)
+
 func newHub(cfg Config) *Hub {
-	return &Hub{
+	h := &Hub{
 		clients:     make(map[*Client]bool),
 		clientsByIP: make(map[string]*Client),
 		config:      cfg,
-		sipPool:     newPool(cfg.SIPMaxConn, initSIPConn(cfg)),
+		log:         logger,
+		clock:       realClock{},
+		barcodes:    newBarcodeNormalizer(cfg.barcodeRules()),
+		tracer:      newRFIDTracer(cfg.RFIDTrace, os.Stderr),
+		dial:        net.Dial,
 	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	h.current.Store(newSettings(cfg))
+	return h
+}
+
+// sipPoolFor returns the pool of SIP connections of the given branch, or
+// the default pool if the branch has no SIP server of its own.
+func (h *Hub) sipPoolFor(branch string) *pool {
+	return h.settings().sipPoolFor(branch)
 }
 
 func (h *Hub) Close() {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	// Shuts down all clients, connected or suspended.
+	h.cancel()
+	h.settings().close()
+	for token, c := range h.suspended {
+		c.expiry.Stop()
+		c.closeRFID()
+		delete(h.suspended, token)
+	}
+	if err := h.journal.Close(); err != nil {
+		h.log.Error("cannot close journal", "err", err)
+	}
+	h.events.close()
+}
+
+// Shutdown shuts down the hub gracefully. New clients are refused, and every
+// client is told to CLOSE and to stop scanning as soon as no RFID command is
+// pending. When all clients are idle, or ctx is done, all connections are
+// closed. It returns ctx.Err() if the clients didn't become idle in time.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.shuttingDown = true
 	for c := range h.clients {
-		c.quit <- true
+		c.requestClose()
 	}
+	h.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !h.idle() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			h.log.Warn("shutdown before all clients were idle", "err", ctx.Err())
+			h.Close()
+			return ctx.Err()
+		}
+	}
+	h.Close()
+	return nil
 }
 
-func (h *Hub) Connect(c *Client) {
+// idle reports whether all connected clients are idle.
+func (h *Hub) idle() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if !c.closing() && c.Status().State != RFIDIdle {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Hub) isShuttingDown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.shuttingDown
+}
+
+// Connect registers a client. The RFID-unit accepts only one connection, so
+// if there is already a client from the same IP, either the old client is
+// disconnected, or the new client is refused, depending on the configured
+// policy. It returns false if the client is refused.
+func (h *Hub) Connect(c *Client) bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	if old, ok := h.clientsByIP[c.IP]; ok {
-		// There is already a connection from the same IP, disconnect it.
+		if h.settings().config.DuplicateClients == duplicateReject {
+			h.log.Warn("refused client, RFID-unit already in use", "ip", c.IP)
+			return false
+		}
 		delete(h.clients, old)
-		old.quit <- true
+		old.shutdown()
+		// Close the RFID connection right away, so that it is available
+		// to the new client.
+		old.closeRFID()
 	}
 	h.clients[c] = true
 	h.clientsByIP[c.IP] = c
+	return true
+}
+
+// suspend keeps c, whose websocket has dropped, for Config.WSResumeWindow,
+// so that Koha can resume its session. It returns false if the session
+// cannot be resumed, and c is to be torn down.
+func (h *Hub) suspend(c *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.session == "" || h.shuttingDown || !h.clients[c] || c.closing() {
+		return false
+	}
+	if h.suspended == nil {
+		h.suspended = make(map[string]*Client)
+	}
+	h.suspended[c.session] = c
+	c.expiry = time.AfterFunc(c.config().WSResumeWindow, func() { h.expire(c) })
+	return true
+}
+
+// expire tears down c, if Koha hasn't resumed its session.
+func (h *Hub) expire(c *Client) {
+	h.mu.Lock()
+	if h.suspended[c.session] != c {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.suspended, c.session)
+	h.mu.Unlock()
+	c.log.Info("session not resumed in time, disconnecting")
+	c.teardown()
+}
+
+// resume returns the suspended client of the session with the given
+// token, or nil if there is none from ip, speaking the given format. A
+// client which has shut down meanwhile cannot be resumed, and is left to
+// expire.
+func (h *Hub) resume(token, ip, format string) *Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.suspended[token]
+	if !ok || c.IP != ip || c.format != format || c.closing() {
+		return nil
+	}
+	delete(h.suspended, token)
+	c.expiry.Stop()
+	return c
+}
+
+// newSessionToken returns a random token with which Koha can resume a
+// session.
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
 }
 
 func (h *Hub) Disconnect(c *Client) {
@@ -45,7 +259,33 @@ func (h *Hub) Disconnect(c *Client) {
 	defer h.mu.Unlock()
 	if _, ok := h.clients[c]; ok {
 		delete(h.clients, c)
-		c.quit <- true
+		c.shutdown()
 		delete(h.clientsByIP, c.IP)
 	}
 }
+
+// ServeClients responds with a JSON list of the status of every connected
+// client, sorted by IP. It requires WSAuthToken, if configured.
+func (h *Hub) ServeClients(w http.ResponseWriter, r *http.Request) {
+	if !h.settings().config.checkToken(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	h.mu.Lock()
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	statuses := make([]ClientStatus, 0, len(clients))
+	for _, c := range clients {
+		statuses = append(statuses, c.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].IP < statuses[j].IP })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		h.log.Error("cannot encode clients", "err", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultInventoryWindow is the time to collect tags for an INVENTORY, if
+// not configured.
+const defaultInventoryWindow = 3 * time.Second
+
+// inventoryTag is a tag read by an INVENTORY.
+type inventoryTag struct {
+	tag      string
+	complete bool  // All tags of the set were on the RFID-unit
+	err      error // Why the tag cannot be looked up, if invalid
+	rssi     *int  // Signal strength of the tag, if reported
+}
+
+// readInventoryTag records a tag read by an INVENTORY, unless it has been
+// read before.
+func (c *Client) readInventoryTag(t inventoryTag) {
+	for i, read := range c.inventory {
+		if read.tag == t.tag {
+			// The rest of an incomplete set may have been placed on the
+			// RFID-unit since the tag was first read.
+			c.inventory[i].complete = read.complete || t.complete
+			if t.rssi != nil {
+				c.inventory[i].rssi = t.rssi
+			}
+			return
+		}
+	}
+	c.inventory = append(c.inventory, t)
+}
+
+// inventoryCalls returns the number of item status calls an INVENTORY may
+// have in flight, with a SIP pool of maxConn connections: half of them, so
+// that the checkins of other clients sharing the pool are not starved.
+func inventoryCalls(maxConn int) int {
+	if n := maxConn / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// inventoryManifest looks up the items of the tags read by an INVENTORY,
+// with up to inventoryCalls item status calls to the SIP server at a time,
+// and returns the manifest to send to Koha. Tags which are not of any item
+// are listed with Item.Tag.
+func (c *Client) inventoryManifest() Message {
+	res := Message{Action: "INVENTORY", Manifest: make([]Item, len(c.inventory))}
+	sem := make(chan struct{}, inventoryCalls(c.config().SIPMaxConn))
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex // Protects sipErr
+		sipErr error
+	)
+	for i, t := range c.inventory {
+		barcode, err := c.hub.barcodes.normalize(t.tag)
+		if t.err != nil {
+			err = t.err
+		}
+		if err != nil {
+			res.Manifest[i] = Item{Tag: t.tag, Unknown: true, Status: err.Error(), RSSI: t.rssi}
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, barcode string, complete bool, rssi *int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			info, err := DoSIPCallContext(c.ctx, *c.config(), c.sipPoolFor(c.branch), sipFormMsgItemStatus(barcode), c.config().localized(c.branch, itemInfoParse), c.IP)
+			if err != nil {
+				mu.Lock()
+				sipErr = err
+				mu.Unlock()
+				info = Message{Item: Item{Barcode: barcode}}
+			}
+			info.Item.TagCountFailed = !complete
+			info.Item.RSSI = rssi
+			res.Manifest[i] = info.Item
+		}(i, barcode, t.complete, t.rssi)
+	}
+	wg.Wait()
+	if sipErr != nil {
+		c.logger().Error("SIP call failed", "action", "INVENTORY", "err", sipErr)
+		res.SIPError = true
+		res.ErrorCode = sipErrorCode(sipErr)
+		res.ErrorMessage = sipErr.Error()
+	}
+	return res
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Layout of the basic block of library tags, in the fixed-length encoding
+// of ISO 28560-3 (data model DS24 of the RFID-unit). Tags are written and
+// read in blocks of tagBlockSize bytes, the last one padded with zeros.
+const (
+	tagBlockSize  = 4
+	tagDataLength = 34                                                // Bytes of the basic block
+	tagBlocks     = (tagDataLength + tagBlockSize - 1) / tagBlockSize // Blocks holding the basic block
+
+	tagVersion = 1 // Version of the data model, in the high nibble of the first byte
+
+	tagOffsetParts   = 1
+	tagOffsetPart    = 2
+	tagOffsetBarcode = 3 // Primary item identifier, padded with zeros
+	tagOffsetCRC     = 19
+	tagOffsetCountry = 21
+	tagOffsetOwner   = 23 // ISIL of the owner library, without the country prefix, padded with zeros
+
+	tagMaxBarcode = tagOffsetCRC - tagOffsetBarcode
+	tagMaxOwner   = tagDataLength - tagOffsetOwner
+)
+
+// Institution of the tags written, if not configured: Deichman, Oslo.
+const (
+	defaultOwnerLibrary = "02030000"
+	defaultCountryCode  = "NO"
+)
+
+// usageCirculating is the type of usage of circulating items, in the low
+// nibble of the first byte.
+const usageCirculating = 1
+
+// tagData is the data of a library item, as encoded in the basic block of
+// its tags.
+type tagData struct {
+	Usage   byte   // Type of usage, ex usageCirculating
+	Parts   int    // Number of parts in the set
+	Part    int    // Part number of the tag, from 1
+	Barcode string // Primary item identifier
+	Country string // ISO 3166-1 country code of the owner library, ex NO
+	Owner   string // Library number of the owner library, ex 02030000
+}
+
+// encodeTag encodes d in the basic block of a tag.
+func encodeTag(d tagData) ([]byte, error) {
+	if d.Usage > 0x0F {
+		return nil, fmt.Errorf("type of usage out of range: %d", d.Usage)
+	}
+	if d.Parts < 1 || d.Parts > 255 {
+		return nil, fmt.Errorf("number of parts out of range: %d", d.Parts)
+	}
+	if d.Part < 1 || d.Part > d.Parts {
+		return nil, fmt.Errorf("part number out of range: %d of %d", d.Part, d.Parts)
+	}
+	for _, f := range []struct {
+		name, s  string
+		min, max int
+	}{
+		{"barcode", d.Barcode, 1, tagMaxBarcode},
+		{"country code", d.Country, 0, 2},
+		{"owner library", d.Owner, 0, tagMaxOwner},
+	} {
+		if len(f.s) < f.min || len(f.s) > f.max {
+			return nil, fmt.Errorf("%s %q: wrong length", f.name, f.s)
+		}
+		for i := 0; i < len(f.s); i++ {
+			if f.s[i] <= ' ' || f.s[i] > '~' {
+				return nil, fmt.Errorf("%s %q: not printable ASCII", f.name, f.s)
+			}
+		}
+	}
+	if d.Country != "" && len(d.Country) != 2 {
+		return nil, fmt.Errorf("country code %q: wrong length", d.Country)
+	}
+
+	b := make([]byte, tagBlocks*tagBlockSize)
+	b[0] = tagVersion<<4 | d.Usage
+	b[tagOffsetParts] = byte(d.Parts)
+	b[tagOffsetPart] = byte(d.Part)
+	copy(b[tagOffsetBarcode:], d.Barcode)
+	copy(b[tagOffsetCountry:], d.Country)
+	copy(b[tagOffsetOwner:], d.Owner)
+	crc := tagCRC(b[:tagDataLength])
+	b[tagOffsetCRC] = byte(crc)
+	b[tagOffsetCRC+1] = byte(crc >> 8)
+	return b, nil
+}
+
+// decodeTag decodes the basic block b of a tag.
+func decodeTag(b []byte) (tagData, error) {
+	if len(b) < tagDataLength {
+		return tagData{}, fmt.Errorf("tag data too short: %d bytes", len(b))
+	}
+	b = b[:tagDataLength]
+	if v := b[0] >> 4; v != tagVersion {
+		return tagData{}, fmt.Errorf("unsupported data model version: %d", v)
+	}
+	if crc := uint16(b[tagOffsetCRC]) | uint16(b[tagOffsetCRC+1])<<8; crc != tagCRC(b) {
+		return tagData{}, errors.New("wrong CRC")
+	}
+	d := tagData{
+		Usage:   b[0] & 0x0F,
+		Parts:   int(b[tagOffsetParts]),
+		Part:    int(b[tagOffsetPart]),
+		Barcode: strings.TrimRight(string(b[tagOffsetBarcode:tagOffsetCRC]), "\x00"),
+		Country: strings.TrimRight(string(b[tagOffsetCountry:tagOffsetOwner]), "\x00"),
+		Owner:   strings.TrimRight(string(b[tagOffsetOwner:]), "\x00"),
+	}
+	if d.Part < 1 || d.Part > d.Parts {
+		return tagData{}, fmt.Errorf("part number out of range: %d of %d", d.Part, d.Parts)
+	}
+	return d, nil
+}
+
+// tagCRC returns the CRC-16/CCITT (polynomial 0x1021, initial value 0xFFFF)
+// of the basic block b, skipping the CRC itself.
+func tagCRC(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for i, c := range b {
+		if i == tagOffsetCRC || i == tagOffsetCRC+1 {
+			continue
+		}
+		crc ^= uint16(c) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// badBlock returns the number of the first block of want which differs in
+// got, or -1 if they are equal.
+func badBlock(want, got []byte) int {
+	for n := 0; n < len(want)/tagBlockSize; n++ {
+		i := n * tagBlockSize
+		if len(got) < i+tagBlockSize || string(want[i:i+tagBlockSize]) != string(got[i:i+tagBlockSize]) {
+			return n
+		}
+	}
+	return -1
+}
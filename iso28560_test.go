@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeTag(t *testing.T) {
+	d := tagData{Usage: usageCirculating, Parts: 2, Part: 1, Barcode: "03010824124004", Country: "NO", Owner: "02030000"}
+	b, err := encodeTag(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != tagBlocks*tagBlockSize {
+		t.Fatalf("encodeTag(%+v) => %d bytes; want %d", d, len(b), tagBlocks*tagBlockSize)
+	}
+
+	// The fields at their offsets in the basic block, padded with zeros
+	for _, f := range []struct {
+		name string
+		from int
+		want []byte
+	}{
+		{"version and type of usage", 0, []byte{0x11}},
+		{"parts in set", 1, []byte{2}},
+		{"part number", 2, []byte{1}},
+		{"primary item identifier", 3, []byte("03010824124004\x00\x00")},
+		{"country", 21, []byte("NO")},
+		{"ISIL", 23, []byte("02030000\x00\x00\x00")},
+		{"padding", 34, []byte{0, 0}},
+	} {
+		if got := b[f.from : f.from+len(f.want)]; !bytes.Equal(got, f.want) {
+			t.Errorf("%s => % X; want % X", f.name, got, f.want)
+		}
+	}
+	if crc := uint16(b[19]) | uint16(b[20])<<8; crc != tagCRC(b[:34]) {
+		t.Errorf("CRC => %04X; want %04X", crc, tagCRC(b[:34]))
+	}
+
+	got, err := decodeTag(b)
+	if err != nil || got != d {
+		t.Errorf("decodeTag(encodeTag(%+v)) => %+v, %v; want it back", d, got, err)
+	}
+
+	// An ISIL fills the rest of the basic block.
+	d.Owner = "02030000123"
+	if b, err = encodeTag(d); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decodeTag(b); err != nil || got != d {
+		t.Errorf("decodeTag(encodeTag(%+v)) => %+v, %v; want it back", d, got, err)
+	}
+	d.Owner = "02030000"
+
+	for _, tt := range []struct {
+		d   tagData
+		err string
+	}{
+		{tagData{Parts: 1, Part: 1}, "barcode"},
+		{tagData{Parts: 1, Part: 1, Barcode: "03010824124004001"}, "barcode"},
+		{tagData{Parts: 1, Part: 1, Barcode: "0301 0824"}, "not printable"},
+		{tagData{Parts: 1, Part: 1, Barcode: "03010824124004", Country: "NOR"}, "country code"},
+		{tagData{Parts: 1, Part: 1, Barcode: "03010824124004", Country: "N"}, "country code"},
+		{tagData{Parts: 1, Part: 1, Barcode: "03010824124004", Owner: "020300001234"}, "owner library"},
+		{tagData{Parts: 2, Part: 3, Barcode: "03010824124004"}, "part number"},
+		{tagData{Parts: 256, Part: 1, Barcode: "03010824124004"}, "number of parts"},
+		{tagData{Usage: 0x10, Parts: 1, Part: 1, Barcode: "03010824124004"}, "type of usage"},
+	} {
+		if _, err := encodeTag(tt.d); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("encodeTag(%+v) => %v; want error containing %q", tt.d, err, tt.err)
+		}
+	}
+}
+
+func TestDecodeTag(t *testing.T) {
+	b, err := encodeTag(tagData{Usage: usageCirculating, Parts: 1, Part: 1, Barcode: "1234", Country: "SE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeTag(b)
+	want := tagData{Usage: usageCirculating, Parts: 1, Part: 1, Barcode: "1234", Country: "SE"}
+	if err != nil || got != want {
+		t.Errorf("decodeTag(% X) => %+v, %v; want %+v", b, got, err, want)
+	}
+
+	corrupt := func(i int, c byte) []byte {
+		bad := append([]byte(nil), b...)
+		bad[i] = c
+		return bad
+	}
+	for _, tt := range []struct {
+		desc string
+		b    []byte
+		err  string
+	}{
+		{"short", b[:tagBlockSize*(tagBlocks-1)], "too short"},
+		{"version", corrupt(0, 0x21), "unsupported data model version"},
+		{"barcode", corrupt(4, '9'), "wrong CRC"},
+		{"CRC", corrupt(19, b[19]^0xFF), "wrong CRC"},
+	} {
+		if got, err := decodeTag(tt.b); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: decodeTag(% X) => %+v, %v; want error containing %q", tt.desc, tt.b, got, err, tt.err)
+		}
+	}
+
+	// Standard check value of CRC-16/CCITT with initial value 0xFFFF
+	if crc := tagCRC([]byte("123456789")); crc != 0x29B1 {
+		t.Errorf("tagCRC(123456789) => %04X; want 29B1", crc)
+	}
+}
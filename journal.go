@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policies for syncing the journal to disk.
+const (
+	journalSyncAlways = "always" // fsync after every record
+	journalSyncNever  = "never"  // leave it to the operating system
+)
+
+// Steps of a transaction, as recorded in the journal.
+const (
+	stepDesecure  = "desecure"  // The alarm is being turned off, before the SIP checkout
+	stepSIP       = "sip"       // The SIP transaction completed; the alarm is being changed
+	stepDone      = "done"      // The result was sent to Koha
+	stepAlarmFail = "alarm"     // The result was sent to Koha, but the alarm of the item could not be changed
+	stepCancelled = "cancelled" // The transaction was cancelled by Koha
+	stepRecovered = "recovered" // The transaction was in-flight at a crash, and has been reported
+)
+
+// journalRecord records that a transaction has completed a step.
+type journalRecord struct {
+	Time    time.Time
+	IP      string
+	Branch  string
+	Action  string // CHECKIN or CHECKOUT
+	Barcode string
+	Tag     string `json:",omitempty"`
+	Step    string
+}
+
+func (r journalRecord) key() string {
+	return r.IP + "\x00" + r.Action + "\x00" + r.Barcode
+}
+
+// journal is an append-only file of journalRecords, one JSON object per
+// line, from which the transactions in-flight at a crash are recovered.
+// A nil journal records nothing.
+type journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	sync bool
+}
+
+// openJournal opens the journal at path, creating it if needed, and
+// returns the transactions that were in-flight when it was last closed,
+// ordered by time. They are marked as recovered, so that they are only
+// reported once.
+func openJournal(path, syncPolicy string) (*journal, []journalRecord, error) {
+	inFlight, err := readJournal(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Terminate a record partially written at a crash, so that it doesn't
+	// corrupt the next record.
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+	j := &journal{f: f, sync: syncPolicy != journalSyncNever}
+	for _, r := range inFlight {
+		r.Time = time.Now()
+		r.Step = stepRecovered
+		if err := j.record(r); err != nil {
+			j.Close()
+			return nil, nil, err
+		}
+	}
+	return j, inFlight, nil
+}
+
+// readJournal returns the transactions of the journal at path which have
+// not been done, failed to change the alarm, been cancelled or recovered. Lines which cannot be parsed, ex
+// one partially written at a crash, are skipped.
+func readJournal(path string) ([]journalRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pending := make(map[string]journalRecord)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var r journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			logger.Warn("skipping invalid journal record", "path", path, "line", n, "err", err)
+			continue
+		}
+		switch r.Step {
+		case stepDone, stepAlarmFail, stepCancelled, stepRecovered:
+			delete(pending, r.key())
+		default:
+			pending[r.key()] = r
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read journal %s: %v", path, err)
+	}
+
+	inFlight := make([]journalRecord, 0, len(pending))
+	for _, r := range pending {
+		inFlight = append(inFlight, r)
+	}
+	sort.Slice(inFlight, func(i, j int) bool { return inFlight[i].Time.Before(inFlight[j].Time) })
+	return inFlight, nil
+}
+
+// record appends r to the journal, and syncs it to disk unless the sync
+// policy is "never".
+func (j *journal) record(r journalRecord) error {
+	if j == nil {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if j.sync {
+		return j.f.Sync()
+	}
+	return nil
+}
+
+// Close closes the journal file.
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
+
+// openJournal opens the transaction journal, if configured, and logs the
+// transactions that were in-flight when the hub last crashed. It must be
+// called before clients connect.
+func (h *Hub) openJournal() error {
+	if h.config.JournalPath == "" {
+		return nil
+	}
+	j, recovered, err := openJournal(h.config.JournalPath, h.config.JournalSync)
+	if err != nil {
+		return fmt.Errorf("cannot open journal: %v", err)
+	}
+	for _, r := range recovered {
+		h.log.Warn("transaction in-flight at crash, needs to be reconciled", "ip", r.IP, "branch", r.Branch,
+			"action", r.Action, "barcode", r.Barcode, "step", r.Step, "time", r.Time.Format(time.RFC3339))
+	}
+	h.mu.Lock()
+	h.journal = j
+	h.recovered = recovered
+	h.mu.Unlock()
+	return nil
+}
+
+// ServeRecovery responds with a JSON list of the transactions which were
+// in-flight when the hub last crashed, so that staff can reconcile them.
+// It requires WSAuthToken, if configured.
+func (h *Hub) ServeRecovery(w http.ResponseWriter, r *http.Request) {
+	if !h.settings().config.checkToken(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	h.mu.Lock()
+	recovered := h.recovered
+	h.mu.Unlock()
+	if recovered == nil {
+		recovered = []journalRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recovered); err != nil {
+		h.log.Error("cannot encode recovery report", "err", err)
+	}
+}
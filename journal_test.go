@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcccl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	j, recovered, err := openJournal(path, journalSyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 0 {
+		t.Errorf("new journal recovered %v; want none", recovered)
+	}
+	now := time.Now()
+	for _, r := range []journalRecord{
+		{Time: now, IP: "1", Action: "CHECKIN", Barcode: "a", Step: stepSIP},
+		{Time: now, IP: "1", Action: "CHECKIN", Barcode: "a", Step: stepDone},
+		{Time: now.Add(time.Second), IP: "1", Action: "CHECKOUT", Barcode: "b", Step: stepSIP},
+		{Time: now, IP: "2", Action: "CHECKIN", Barcode: "c", Step: stepSIP},
+		{Time: now, IP: "3", Action: "CHECKIN", Barcode: "d", Step: stepSIP},
+		{Time: now, IP: "3", Action: "CHECKIN", Barcode: "d", Step: stepCancelled},
+	} {
+		if err := j.record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	// A record partially written at the crash is skipped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Time":"2017-01-01T`)
+	f.Close()
+
+	j, recovered, err = openJournal(path, journalSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if len(recovered) != 2 || recovered[0].Barcode != "c" || recovered[1].Barcode != "b" {
+		t.Fatalf("recovered %+v; want transactions of c and b", recovered)
+	}
+
+	// Recovered transactions are only reported once.
+	j, recovered, err = openJournal(path, journalSyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if len(recovered) != 0 {
+		t.Errorf("recovered %+v again; want none", recovered)
+	}
+}
+
+func TestJournalCrashMidTransaction(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	dir, err := ioutil.TempDir("", "mcccl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+		JournalPath: filepath.Join(dir, "journal"),
+	}
+	hub = newHub(cfg)
+	if err := hub.openJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The first item completes its checkin.
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKIN
+
+	// The hub crashes after the second item is checked in through SIP, but
+	// before the RFID-unit has turned on its alarm.
+	sipSrv.Respond("101YNN20140226    161239AO|AB03011063175001|AQhutl|AJCat's cradle|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want OK1", msg)
+	}
+	hub.Close()
+
+	// On restart, the in-flight transaction is reported.
+	h := newHub(cfg)
+	defer h.Close()
+	if err := h.openJournal(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeRecovery(rec, httptest.NewRequest("GET", "/recovery", nil))
+	var got []journalRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("recovery report => %+v; want 1 transaction", got)
+	}
+	r := got[0]
+	if r.IP != "127.0.0.1" || r.Branch != "fmaj" || r.Action != "CHECKIN" || r.Barcode != "03011063175001" ||
+		r.Tag != "1003011063175001:NO:02030000" || r.Step != stepSIP {
+		t.Errorf("recovered %+v; want checkin of 03011063175001 after SIP step", r)
+	}
+}
+
+// Verify that with CheckoutAlarmOrder before, an item whose alarm is being
+// turned off is recovered at a crash, although it has not been checked out.
+func TestJournalCrashDesecured(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	dir, err := ioutil.TempDir("", "mcccl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		HTTPPort:           port(srv.URL),
+		SIPServer:          sipSrv.Addr(),
+		RFIDPort:           port(d.addr()),
+		RFIDTimeout:        1 * time.Second,
+		JournalPath:        filepath.Join(dir, "journal"),
+		CheckoutAlarmOrder: checkoutAlarmBefore,
+	}
+	hub = newHub(cfg)
+	if err := hub.openJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"hutl","NoBlock":true}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The hub crashes while the alarm is being turned off, before the SIP
+	// checkout.
+	requests := sipSrv.Requests()
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Fatalf("RFID-unit got %q; want OK0", msg)
+	}
+	hub.Close()
+	if n := sipSrv.Requests() - requests; n != 0 {
+		t.Fatalf("SIP server got %d requests; want none before the alarm is off", n)
+	}
+
+	h := newHub(cfg)
+	defer h.Close()
+	if err := h.openJournal(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeRecovery(rec, httptest.NewRequest("GET", "/recovery", nil))
+	var got []journalRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Action != "CHECKOUT" || got[0].Barcode != "03011063175001" || got[0].Step != stepDesecure {
+		t.Errorf("recovery report => %+v; want checkout of 03011063175001 being desecured", got)
+	}
+}
+
+// Verify that a transaction is journaled under the barcode of the tag, even
+// if SIP gives another, and that an alarm failure is recorded as such.
+func TestJournalAlarmFailed(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	dir, err := ioutil.TempDir("", "mcccl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+		JournalPath: path,
+	})
+	if err := hub.openJournal(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// The SIP server drops the leading zero of the barcode.
+	sipSrv.Respond("101YNN20140226    161239AO|AB3010824124004|AQfhol|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("NOK\r"))
+	if got := <-uiChan; !got.Item.AlarmOnFailed {
+		t.Fatalf("Got %+v; want alarm on failed", got)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r journalRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Barcode != "03010824124004" {
+			t.Errorf("journaled %+v; want barcode of tag", r)
+		}
+		steps = append(steps, r.Step)
+	}
+	if want := []string{stepSIP, stepAlarmFail}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("journaled steps %v; want %v", steps, want)
+	}
+	if inFlight, err := readJournal(path); err != nil || len(inFlight) != 0 {
+		t.Errorf("readJournal() => %+v, %v; want no transactions in-flight", inFlight, err)
+	}
+}
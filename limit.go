@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errSIPBusy is returned instead of calling the SIP server when too many
+// SIP calls are in flight, and none completes in time.
+var errSIPBusy = errors.New("too many SIP calls in progress, gave up waiting")
+
+// callLimit bounds the number of SIP calls in flight across all clients and
+// SIP servers, so that many RFID-units checking in at once don't overwhelm
+// the ILS. Calls over the limit queue for a slot. A nil callLimit lets all
+// calls through.
+type callLimit chan struct{}
+
+// newCallLimit returns a callLimit of n calls, or nil if n is 0.
+func newCallLimit(n int) callLimit {
+	if n <= 0 {
+		return nil
+	}
+	return make(callLimit, n)
+}
+
+// acquire waits for a slot for a call, for up to wait, if > 0, or until ctx
+// is done. A slot acquired must be released.
+func (l callLimit) acquire(ctx context.Context, wait time.Duration) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	default:
+	}
+	var timeout <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return errSIPBusy
+	}
+}
+
+// release releases a slot acquired by acquire.
+func (l callLimit) release() {
+	if l == nil {
+		return
+	}
+	<-l
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCallLimit(t *testing.T) {
+	l := newCallLimit(1)
+	ctx := context.Background()
+	if err := l.acquire(ctx, time.Second); err != nil {
+		t.Fatalf("acquire() with a free slot => %v; want nil", err)
+	}
+
+	// The limit is reached: callers give up after the wait, or when their
+	// context is done
+	if err := l.acquire(ctx, 10*time.Millisecond); err != errSIPBusy {
+		t.Errorf("acquire() over the limit => %v; want %v", err, errSIPBusy)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.acquire(cancelled, time.Second); err != context.Canceled {
+		t.Errorf("acquire() over the limit, cancelled => %v; want %v", err, context.Canceled)
+	}
+
+	// A caller queuing gets the slot when it is released
+	acquired := make(chan error)
+	go func() { acquired <- l.acquire(ctx, time.Second) }()
+	time.Sleep(10 * time.Millisecond)
+	l.release()
+	if err := <-acquired; err != nil {
+		t.Errorf("acquire() queuing for a released slot => %v; want nil", err)
+	}
+
+	// A nil callLimit doesn't limit
+	if l := newCallLimit(0); l != nil || l.acquire(ctx, 0) != nil || l.acquire(ctx, 0) != nil {
+		t.Errorf("newCallLimit(0) => %v; want nil limit letting calls through", l)
+	}
+}
+
+func TestSIPMaxCalls(t *testing.T) {
+	srv := newSIPTestServer().Delay(20 * time.Millisecond)
+	defer srv.Close()
+	srv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+
+	// Each pool has room for more calls than the limit
+	cfg := Config{SIPServer: srv.Addr(), SIPMaxConn: 5, SIPMaxCalls: 2, SIPTimeout: 2 * time.Second,
+		BranchSIP: map[string]SIPEndpoint{"fmaj": {Server: srv.Addr()}}}
+	h := newHub(cfg)
+	defer h.Close()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 8)
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Calls to both SIP servers count against the same limit
+			p := h.settings().sipPool
+			if i%2 == 1 {
+				p = h.sipPoolFor("fmaj")
+			}
+			_, err := DoSIPCall(cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP")
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("DoSIPCall queuing for the limit => %v; want nil", err)
+		}
+	}
+	if n := srv.MaxInFlight(); n != 2 {
+		t.Errorf("SIP calls in flight at a time => %d; want the limit of 2", n)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+)
+
+type logLevel int
+
+// Possible log levels
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = [...]string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l logLevel) String() string { return levelNames[l] }
+
+// parseLogLevel parses a log level name, as given in Config.LogLevel.
+// An empty name gives the Info level.
+func parseLogLevel(s string) (logLevel, error) {
+	if s == "" {
+		return levelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level: %q", s)
+}
+
+// Logger writes log lines at or above its level, using the standard log
+// package. Each line consists of the level, a message, and key-value fields:
+//
+//	ERROR SIP call failed ip=10.172.2.100 branch=hutl state=3 err="connection refused"
+type Logger struct {
+	level  logLevel
+	fields []interface{} // Key-value pairs added to every line
+}
+
+func newLogger(level logLevel) *Logger {
+	return &Logger{level: level}
+}
+
+// With returns a Logger which adds the given key-value pairs to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{level: l.level, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.output(levelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.output(levelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.output(levelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.output(levelError, msg, kv) }
+
+func (l *Logger) output(level logLevel, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	writeFields(&b, l.fields)
+	writeFields(&b, kv)
+	log.Print(b.String())
+}
+
+func writeFields(b *bytes.Buffer, kv []interface{}) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(b, " %v=%s", kv[i], v)
+	}
+}
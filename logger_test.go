@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	l := newLogger(levelInfo).With("ip", "10.172.2.100")
+	l.Debug("not logged")
+	l.Info("-> RFID", "msg", "BEG\r")
+	l.With("branch", "hutl").Error("SIP call failed", "err", "connection refused", "state", RFIDCheckin)
+
+	want := `INFO -> RFID ip=10.172.2.100 msg="BEG\r"
+ERROR SIP call failed ip=10.172.2.100 branch=hutl err="connection refused" state=Checkin
+`
+	if buf.String() != want {
+		t.Errorf("got log output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		in    string
+		level logLevel
+		ok    bool
+	}{
+		{"", levelInfo, true},
+		{"debug", levelDebug, true},
+		{"WARN", levelWarn, true},
+		{"Error", levelError, true},
+		{"verbose", levelInfo, false},
+	}
+	for _, tt := range tests {
+		level, err := parseLogLevel(tt.in)
+		if level != tt.level || (err == nil) != tt.ok {
+			t.Errorf("parseLogLevel(%q) => %v, %v; want %v, ok=%v", tt.in, level, err, tt.level, tt.ok)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -9,9 +10,13 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"app/fake"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -26,12 +31,340 @@ type Config struct {
 	SIPDept    string
 	SIPMaxConn int
 
+	// SIP servers and credentials of branches which differ, keyed by
+	// branch code. Each has its own pool of connections.
+	BranchSIP map[string]SIPEndpoint
+
+	// Minimum number of SIP connections kept open in the pool. Pooled
+	// connections idle for longer than SIPIdleTimeout are closed. Idle
+	// connections are checked with a SC status message every
+	// SIPHealthCheckInterval, if > 0.
+	SIPMinConn             int
+	SIPIdleTimeout         time.Duration
+	SIPHealthCheckInterval time.Duration
+
+	// Interval between TCP keepalive probes on SIP connections, so that
+	// idle connections are not silently dropped by firewalls. 0 disables
+	// keepalives.
+	SIPKeepAlive time.Duration
+
+	// Time to wait for the SIP server to respond, 0 to wait forever
+	SIPTimeout time.Duration
+
+	// Maximum number of SIP calls in flight at a time, across all clients
+	// and SIP servers, 0 for no limit. Calls over it queue for up to
+	// SIPTimeout, and then fail.
+	SIPMaxCalls int
+
+	// Number of times to retry checkins and checkouts failing with a
+	// transient SIP error, and the time to wait before the first retry.
+	// The wait is doubled for each retry.
+	SIPRetries   int
+	SIPRetryWait time.Duration
+
+	// Number of consecutive failed SIP calls after which calls to the SIP
+	// server fail fast for SIPBreakerCooldown, instead of waiting for a
+	// server which is down. Then a single call probes whether it is back.
+	// 0 disables it.
+	SIPBreakerThreshold int
+	SIPBreakerCooldown  time.Duration
+
+	// Host of the RFID-units, if not the IP of the client
+	RFIDHost string
+
+	// Vendor of the RFID-units, selecting the protocol spoken with them.
+	// Empty for the default vendor.
+	RFIDVendor string
+
 	RFIDTimeout time.Duration
 
+	// Use Nagle's algorithm on connections to the RFID-units, batching
+	// small writes. Off by default, as it delays the commands, which are
+	// small frames each waiting for a response.
+	RFIDNagle bool
+
+	// Interval between TCP keepalive probes on connections to the
+	// RFID-units, so that a unit which is gone is noticed while idle.
+	// 0 disables keepalives.
+	RFIDKeepAlive time.Duration
+
+	// Time to wait for the RFID-unit to respond to a command, 0 to wait forever
+	RFIDResponseTimeout time.Duration
+
+	// Number of attempts to reconnect to a lost RFID-unit, and the time to
+	// wait before the first attempt. The wait doubles with each attempt, up
+	// to RFIDReconnectMaxWait, and is jittered, so that units rebooting at
+	// once are not reconnected to in step. Attempts stop when the next wait
+	// would pass RFIDReconnectMaxTime since the connection was lost. A zero
+	// max wait or time is no limit.
+	RFIDReconnectAttempts int
+	RFIDReconnectWait     time.Duration
+	RFIDReconnectMaxWait  time.Duration
+	RFIDReconnectMaxTime  time.Duration
+
+	// Number of times to retry the initialization of the RFID-unit when a
+	// client connects, and the time to wait between the attempts, so that
+	// a unit still booting, ex powered on with the computer, is waited for.
+	RFIDInitRetries   int
+	RFIDInitRetryWait time.Duration
+
+	// Number of consecutive malformed responses from the RFID-unit which
+	// are skipped, before the connection is given up. Frames which are not
+	// responses, ex status notifications, are always skipped.
+	RFIDParseErrors int
+
+	// Number of times to resend END if the RFID-unit fails to stop scanning
+	EndScanRetries int
+
+	// Time to collect the parts of an item read as an incomplete set, at
+	// checkin and checkout, before its missing parts are reported with the
+	// number read, in Item.PartsSeen, of those expected. Its alarm is
+	// changed once, when all parts are read. The number of parts is given
+	// by the SIP server, see defaultSIPFields, or read from the tags with
+	// ReadSetInfo, and the parts are told apart by their part numbers read
+	// with ReadSetInfo, or else by their UIDs, which the RFID-unit must then
+	// report. 0 to report missing parts at once.
+	MissingPartsTimeout time.Duration
+
+	// Time a transaction session may be idle, without messages from Koha or
+	// the RFID-unit, before it is ended and Koha is told so. 0 to never end it.
+	SessionIdleTimeout time.Duration
+
+	// Longest time a client may wait in one state for a response from the
+	// RFID-unit, ex one which never comes when RFIDResponseTimeout is 0,
+	// before it is reset: scanning is stopped, the transaction forgotten,
+	// and Koha told with CANCEL. A safety net for clients wedged in a way
+	// the other timeouts miss. Scanning and paused clients are never reset,
+	// as the RFID-unit is silent until an item is placed on it. 0 to never
+	// reset clients.
+	DeadmanTimeout time.Duration
+
+	// Maximum number of items in a checkin or checkout session. When
+	// reached, the session is ended, and Koha is told with SESSION-FULL to
+	// start a new one. 0 for no limit.
+	MaxSessionItems int
+
+	// Time to wait before reading an item again, when the RFID-unit reports
+	// it as an incomplete set at checkin, as the rest of the set may still
+	// be being placed on it. Only if it is still incomplete, the missing
+	// tags are reported. 0 to report them at once. The RFID-unit gets no
+	// response to its read meanwhile, so it must be shorter than
+	// RFIDResponseTimeout. Other items read meanwhile are handled after it.
+	MissingTagsGrace time.Duration
+
+	// Time within which a tag read in a session is ignored when read again
+	// at checkin or checkout in the next session, as it is probably still
+	// lying on the RFID-unit after the previous patron. 0 to not ignore it.
+	GhostReadWindow time.Duration
+
+	// Time to collect tags on the RFID-unit for an INVENTORY, before the
+	// manifest of the items read is sent to Koha. Default 3s.
+	InventoryWindow time.Duration
+
+	// Set the security of items by writing the AFI of their tags, instead
+	// of with the alarm commands of the RFID-unit. The AFI is read back to
+	// verify that it was set, and the security of the tag before and after
+	// is reported. The RFID-unit cannot read back the alarm set by its
+	// alarm commands, so without UseAFI their OK is trusted, and the
+	// security is not reported; CONNECT tells Koha which, in SecurityRead.
+	UseAFI bool
+
+	// Rules for normalizing and validating the barcodes of tags, keyed by
+	// the library number of the tag, or "" for tags of other libraries. If
+	// not given, the "10" prefix is stripped from barcodes of tags with
+	// library number 02030000.
+	BarcodeRules map[string]BarcodeRules
+
+	// Read the number of parts of items from their tags, when the RFID-unit
+	// reports a set as incomplete, and tell Koha in Item.NumTags. The part
+	// number of each tag read is used to collect the parts of the set with
+	// MissingPartsTimeout. Not all RFID-units support it.
+	ReadSetInfo bool
+
+	// Library number and ISO 3166-1 country code of the institution, with
+	// which tags are written, unless Koha gives them in the WRITE message.
+	// Default 02030000 and NO.
+	OwnerLibrary string
+	CountryCode  string
+
+	// Encode the ISO 28560 data blocks of tags written with WRITE, and
+	// write them tag by tag, reading back and validating each block,
+	// instead of leaving the encoding to the RFID-unit. Not all RFID-units
+	// support it.
+	WriteTagBlocks bool
+
+	// Number of data blocks written to tags with WriteTagBlocks, and read
+	// back: the blocks of the basic block, followed by blocks of zeros, ex
+	// to clear the rest of the user memory of the tags. 0 for the blocks of
+	// the basic block only.
+	WriteTagBlockCount int
+
+	// Checkin mode: "batch" (default) keeps scanning after each item, and
+	// "single" stops scanning after each item, ending the session, before
+	// the result of the item is sent. If the alarm of the item failed,
+	// scanning continues, so that it can be retried; if Koha sends END
+	// instead, it is told which items need attention.
+	CheckinMode string
+
+	// Check out all items in offline mode, with the SIP no block flag, for
+	// branches whose SIP server cannot reach the ILS, and reconciles the
+	// checkouts later. Patrons are not checked. Koha can also ask for it
+	// per checkout, with Message.NoBlock.
+	NoBlockCheckout bool
+
+	// Allow CHECKIN-CHECKOUT, where items are checked in and out again to
+	// the patron in one scan, for patrons returning and borrowing at once.
+	CheckinCheckout bool
+
+	// What to do when the alarm of an item cannot be turned on after it has
+	// been checked in, leaving an item returned in the ILS which doesn't
+	// set off the gates. "notify" (default) tells Koha, with ErrorCode
+	// ALARM_FAILED, and keeps the item for RETRY-ALARM-ON. "compensate"
+	// checks the item out again to the patron it was checked out to, with
+	// no block, and tells Koha with ErrorCode CHECKIN_REVERTED; if it
+	// cannot, it notifies. "block" holds back the result, and resends the
+	// alarm command up to AlarmRetries times before it notifies.
+	AlarmFailPolicy string
+	AlarmRetries    int
+
+	// When to turn off the alarm of an item at checkout. "after" (default)
+	// turns it off when the SIP server has checked out the item. "before"
+	// turns it off first, and checks out the item when the RFID-unit has
+	// responded, so it is not any faster; the alarm is turned on again if
+	// the checkout is denied or fails. The desecure is journaled before it
+	// is sent, so that an item left without alarm is recovered. With
+	// "before", the alarm of magnetic items is turned off even with
+	// Security.MagneticUnsecured, as the media type is not known yet.
+	CheckoutAlarmOrder string
+
+	// Alarm command sent for a set read as incomplete, at checkin and at
+	// checkout. "leave" (default) leaves the alarm as is; RFID-units differ
+	// in whether this keeps or deactivates it, so "on" and "off" change it
+	// explicitly. With UseAFI, the AFI set is read back, as for other items.
+	CheckinIncompleteAlarm  string
+	CheckoutIncompleteAlarm string
+
+	// Send an ITEM message for each item during checkin, as soon as its SIP
+	// status is known, before its alarm is changed.
+	ItemEvents bool
+
+	// Send a ROUTE message for each item checked in to be sent in transit,
+	// with the branch to send it to as Item.Transfer, when its alarm has
+	// been changed as by SecurityPolicy.TransitAlarm.
+	TransitRouting bool
+
+	// Path of the transaction journal, from which transactions in-flight
+	// at a crash are reported on startup. Empty to disable the journal.
+	// JournalSync is "always" (default) to fsync every record, or "never".
+	JournalPath string
+	JournalSync string
+
+	// Screen messages shown instead of the AF screen messages of the SIP
+	// server, keyed by the condition detected in the SIP response, ex
+	// "item-unknown" or "patron-blocked" (see screen.go), and screen
+	// messages of branches which differ, keyed by branch code. In the
+	// messages, {message} is replaced by the AF screen message, {barcode}
+	// by the barcode and {title} by the title of the item. Conditions
+	// without a message show the AF screen message.
+	ScreenMessages       map[string]string
+	BranchScreenMessages map[string]map[string]string
+
+	// Security policy, and the fields of the security policies of branches
+	// which differ from it, keyed by branch code.
+	Security       SecurityPolicy
+	BranchSecurity map[string]SecurityPolicy
+
 	WSProxy bool
 
+	// Origins allowed to connect to the websocket, ex "https://koha.example.org".
+	// If none are given, any origin is allowed.
+	WSAllowedOrigins []string
+
+	// Token required to connect to the websocket, given as a bearer token
+	// in the Authorization header, or in the token query parameter. If
+	// empty, no token is required.
+	WSAuthToken string
+
+	// Don't check origin or token, for local development.
+	WSNoAuth bool
+
+	// What to do when a client connects from the same IP as a connected
+	// client: "evict" (default) disconnects the old client, and "reject"
+	// refuses the new client.
+	DuplicateClients string
+
+	// Time to wait for clients to finish their transactions when shutting down
+	ShutdownTimeout time.Duration
+
+	// Address of an RFID-unit, as host:port, which /healthz checks that
+	// accepts connections. If empty, only the SIP server is checked.
+	HealthRFIDAddr string
+
+	// Port to serve Prometheus metrics on. If empty, metrics are
+	// served on HTTPPort.
+	MetricsPort string
+
+	// Time allowed to write a message to Koha, time to wait for a pong
+	// from Koha before the connection is closed, and maximum size in bytes
+	// of a message from Koha. Zero values give the defaults; the pong wait
+	// defaults to RFIDTimeout.
+	WSWriteWait      time.Duration
+	WSPongWait       time.Duration
+	WSMaxMessageSize int64
+
+	// Maximum rate of messages from Koha per second, and the number of
+	// messages allowed in a burst above it. Messages exceeding the rate are
+	// dropped, and Koha is told so, except END, CANCEL, PAUSE, RESUME and
+	// RETRY-ALARM-ON/OFF. 0 for no limit.
+	WSRateLimit float64
+	WSRateBurst int
+
+	// Time to wait for Koha to acknowledge a message, before it is
+	// retransmitted, and the number of retransmits before the connection
+	// is closed. 0 to not use acks, for UIs which don't send them.
+	WSAckTimeout time.Duration
+	WSAckRetries int
+
+	// Time a client is kept after its websocket drops, ex at a wifi blip,
+	// so that Koha can reconnect with the Session token given on CONNECT,
+	// as /ws?session=<token>, and resume the session. 0 disables resuming.
+	WSResumeWindow time.Duration
+
+	// Number of messages from Koha, and of responses from the RFID-unit,
+	// queued while a client is busy, ex with a slow SIP call. A message
+	// which cannot be queued within ClientStallTimeout means that the
+	// client is stuck, and it is closed. A zero timeout gives the default.
+	ClientQueueSize    int
+	ClientStallTimeout time.Duration
+
+	// Add sequence number and checksum to SIP requests, and validate them
+	// in SIP responses. Not all SIP servers support this.
+	SIPErrorDetection bool
+
+	// Field delimiter and message terminator of SIP messages, for SIP
+	// servers not using the standard "|" and "\r". A single character
+	// each, which cannot be a letter, digit or space.
+	SIPDelimiter  string
+	SIPTerminator string
+
+	// SIP field codes of Item attributes, for SIP servers which give them
+	// in other fields than Koha, ex {"HomeBranch": "AQ"}. Attributes not
+	// given are read from the fields of Koha, see defaultSIPFields.
+	SIPFields map[string]string
+
+	// Use an in-process fake RFID-unit and SIP server, for testing
+	// without real hardware. See package fake for the test items.
+	Simulate bool
+
+	LogLevel       string // DEBUG, INFO, WARN or ERROR
 	LogSIPMessages bool
 	LogRFID        bool
+
+	// Trace the raw traffic with the RFID-units of all clients, to
+	// RFIDTraceFile, or stderr if not given. Clients can also be traced
+	// one at a time, with POST /trace?ip=<ip>&on=true.
+	RFIDTrace     bool
+	RFIDTraceFile string
 }
 
 type rfidMsg struct {
@@ -43,55 +376,196 @@ type rfidMsg struct {
 
 // global variables
 var (
-	config = Config{
-		RFIDPort:       "6005",
-		HTTPPort:       "8899",
-		SIPServer:      "sip_proxy:9999",
-		SIPUser:        "autouser",
-		SIPPass:        "autopass",
-		SIPMaxConn:     5,
-		LogSIPMessages: true,
-		RFIDTimeout:    15 * time.Minute,
-		WSProxy:        true,
+	// defaultConfig holds the settings used when not given by
+	// environment variables, flags or a config file.
+	defaultConfig = Config{
+		RFIDPort:                "6005",
+		HTTPPort:                "8899",
+		SIPServer:               "sip_proxy:9999",
+		SIPUser:                 "autouser",
+		SIPPass:                 "autopass",
+		SIPMaxConn:              5,
+		SIPIdleTimeout:          5 * time.Minute,
+		SIPHealthCheckInterval:  time.Minute,
+		SIPKeepAlive:            30 * time.Second,
+		SIPTimeout:              10 * time.Second,
+		SIPRetries:              2,
+		SIPRetryWait:            200 * time.Millisecond,
+		SIPBreakerThreshold:     5,
+		SIPBreakerCooldown:      30 * time.Second,
+		LogSIPMessages:          true,
+		RFIDTimeout:             15 * time.Minute,
+		RFIDResponseTimeout:     10 * time.Second,
+		RFIDReconnectAttempts:   5,
+		RFIDReconnectWait:       time.Second,
+		RFIDReconnectMaxWait:    30 * time.Second,
+		RFIDReconnectMaxTime:    2 * time.Minute,
+		RFIDInitRetries:         3,
+		RFIDInitRetryWait:       2 * time.Second,
+		RFIDKeepAlive:           30 * time.Second,
+		EndScanRetries:          3,
+		RFIDParseErrors:         3,
+		SessionIdleTimeout:      5 * time.Minute,
+		DeadmanTimeout:          15 * time.Minute,
+		InventoryWindow:         defaultInventoryWindow,
+		OwnerLibrary:            defaultOwnerLibrary,
+		CountryCode:             defaultCountryCode,
+		CheckinMode:             checkinBatch,
+		AlarmFailPolicy:         alarmFailNotify,
+		CheckinIncompleteAlarm:  incompleteAlarmLeave,
+		CheckoutIncompleteAlarm: incompleteAlarmLeave,
+		AlarmRetries:            3,
+		CheckoutAlarmOrder:      checkoutAlarmAfter,
+		JournalSync:             journalSyncAlways,
+		Security:                SecurityPolicy{AFISecure: 0x07, AFIUnsecure: 0xC2},
+		WSProxy:                 true,
+		WSWriteWait:             defaultWriteWait,
+		WSMaxMessageSize:        defaultMaxMessageSize,
+		ClientQueueSize:         8,
+		ClientStallTimeout:      defaultStallTimeout,
+		WSAckRetries:            3,
+		WSRateLimit:             10,
+		WSRateBurst:             20,
+		ShutdownTimeout:         10 * time.Second,
+		DuplicateClients:        duplicateEvict,
 	}
 
+	config = defaultConfig
+
 	hub *Hub
 
+	logger = newLogger(levelInfo)
+
+	metrics = newMetrics()
+
 	logToRFID chan rfidMsg
 )
 
 func init() {
-	// TODO move these to command line flags
-	if os.Getenv("TCP_PORT") != "" {
-		config.RFIDPort = os.Getenv("TCP_PORT")
-	}
-	if os.Getenv("HTTP_PORT") != "" {
-		config.HTTPPort = os.Getenv("HTTP_PORT")
-	}
-	if os.Getenv("SIP_SERVER") != "" {
-		config.SIPServer = os.Getenv("SIP_SERVER")
-	}
-	if os.Getenv("SIP_USER") != "" {
-		config.SIPUser = os.Getenv("SIP_USER")
-	}
-	if os.Getenv("SIP_PASS") != "" {
-		config.SIPPass = os.Getenv("SIP_PASS")
-	}
+	config.applyEnv()
 
 	// TODO move somewhere else
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
+	http.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeClients(w, r)
+	})
+	http.HandleFunc("/recovery", func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeRecovery(w, r)
+	})
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeHealth(w, r)
+	})
+	http.HandleFunc("/trace", func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeTrace(w, r)
+	})
 }
 
 func main() {
 	flag.DurationVar(&config.RFIDTimeout, "rfid-timeout", 15*time.Minute, "RFID-timeout in Koha UI")
+	flag.DurationVar(&config.RFIDResponseTimeout, "rfid-response-timeout", 10*time.Second, "Time to wait for RFID-unit to respond to a command")
+	flag.StringVar(&config.RFIDVendor, "rfid-vendor", "", "Vendor of the RFID-units, selecting their protocol (default \"default\")")
+	flag.IntVar(&config.RFIDReconnectAttempts, "rfid-reconnect-attempts", 5, "Number of attempts to reconnect to a lost RFID-unit")
+	flag.IntVar(&config.RFIDInitRetries, "rfid-init-retries", 3, "Number of times to retry the initialization of an RFID-unit when a client connects")
+	flag.DurationVar(&config.RFIDInitRetryWait, "rfid-init-retry-wait", 2*time.Second, "Time to wait between attempts to initialize an RFID-unit")
+	flag.BoolVar(&config.RFIDNagle, "rfid-nagle", false, "Use Nagle's algorithm on connections to RFID-units")
+	flag.DurationVar(&config.RFIDKeepAlive, "rfid-keepalive", 30*time.Second, "Interval between TCP keepalive probes on connections to RFID-units, 0 to disable")
+	flag.DurationVar(&config.RFIDReconnectWait, "rfid-reconnect-wait", time.Second, "Time to wait before first attempt to reconnect to RFID-unit")
+	flag.DurationVar(&config.RFIDReconnectMaxWait, "rfid-reconnect-max-wait", 30*time.Second, "Max time to wait between attempts to reconnect to RFID-unit, 0 for no limit")
+	flag.DurationVar(&config.RFIDReconnectMaxTime, "rfid-reconnect-max-time", 2*time.Minute, "Max time to try to reconnect to RFID-unit, 0 for no limit")
 	flag.IntVar(&config.SIPMaxConn, "sip-maxconn", 5, "Max size of SIP connection pool")
+	flag.IntVar(&config.SIPMinConn, "sip-minconn", 0, "Min number of connections kept open in SIP connection pool")
+	flag.DurationVar(&config.SIPIdleTimeout, "sip-idle-timeout", 5*time.Minute, "Close pooled SIP connections idle for longer than this")
+	flag.DurationVar(&config.SIPHealthCheckInterval, "sip-health-check", time.Minute, "Interval between health checks of pooled SIP connections")
+	flag.DurationVar(&config.SIPKeepAlive, "sip-keepalive", 30*time.Second, "Interval between TCP keepalive probes on SIP connections, 0 to disable")
+	flag.DurationVar(&config.SIPTimeout, "sip-timeout", 10*time.Second, "Time to wait for SIP server to respond")
+	flag.IntVar(&config.SIPMaxCalls, "sip-max-calls", 0, "Max number of SIP calls in flight across all clients, 0 for no limit")
+	flag.IntVar(&config.SIPRetries, "sip-retries", 2, "Number of times to retry checkins and checkouts on transient SIP errors")
+	flag.DurationVar(&config.SIPRetryWait, "sip-retry-wait", 200*time.Millisecond, "Time to wait before first retry of a SIP call")
+	flag.IntVar(&config.SIPBreakerThreshold, "sip-breaker-threshold", 5, "Fail SIP calls fast after this many consecutive failures, 0 to never")
+	flag.DurationVar(&config.SIPBreakerCooldown, "sip-breaker-cooldown", 30*time.Second, "Time to fail SIP calls fast before probing the SIP server again")
+	flag.IntVar(&config.RFIDParseErrors, "rfid-parse-errors", 3, "Number of consecutive malformed responses from an RFID-unit to skip before giving up the connection")
+	flag.IntVar(&config.EndScanRetries, "end-retries", 3, "Number of times to resend END if RFID-unit fails to stop scanning")
+	flag.DurationVar(&config.InventoryWindow, "inventory-window", defaultInventoryWindow, "Time to collect tags on the RFID-unit for an INVENTORY")
+	flag.DurationVar(&config.GhostReadWindow, "ghost-read-window", 0, "Ignore tags read again in the next session within this time of their last read, 0 to not ignore them")
+	flag.DurationVar(&config.MissingPartsTimeout, "missing-parts-timeout", 0, "Time to collect the parts of an incomplete set at checkin and checkout, 0 to report missing parts at once")
+	flag.DurationVar(&config.MissingTagsGrace, "missing-tags-grace", 0, "Time to wait before reading an incomplete set again at checkin, 0 to report missing tags at once")
+	flag.DurationVar(&config.SessionIdleTimeout, "session-idle-timeout", 5*time.Minute, "End transaction sessions idle for longer than this, 0 to never end them")
+	flag.DurationVar(&config.DeadmanTimeout, "deadman-timeout", 15*time.Minute, "Reset clients stuck waiting for a response from the RFID-unit for longer than this, 0 to never reset them")
+	flag.IntVar(&config.MaxSessionItems, "max-session-items", 0, "End sessions with this many items, 0 for no limit")
+	flag.BoolVar(&config.ReadSetInfo, "read-set-info", false, "Read the number of parts of incomplete sets from their tags")
+	flag.StringVar(&config.OwnerLibrary, "owner-library", defaultOwnerLibrary, "Library number of the institution, written to tags")
+	flag.StringVar(&config.CountryCode, "country-code", defaultCountryCode, "Country code of the institution, written to tags")
+	flag.BoolVar(&config.WriteTagBlocks, "write-tag-blocks", false, "Encode and write the ISO 28560 data blocks of tags, instead of leaving it to the RFID-unit")
+	flag.IntVar(&config.WriteTagBlockCount, "write-tag-block-count", 0, "Number of data blocks written to tags with -write-tag-blocks, 0 for those of the basic block only")
+	flag.StringVar(&config.CheckinMode, "checkin-mode", checkinBatch, "Keep scanning after each checked in item (batch), or stop (single)")
+	flag.BoolVar(&config.NoBlockCheckout, "no-block-checkout", false, "Check out in offline mode, with the SIP no block flag, without checking patrons")
+	flag.BoolVar(&config.CheckinCheckout, "checkin-checkout", false, "Allow checking items in and out again to a patron in one scan (CHECKIN-CHECKOUT)")
+	flag.StringVar(&config.AlarmFailPolicy, "alarm-fail-policy", alarmFailNotify, "When the alarm of a checked in item fails: notify, compensate or block")
+	flag.StringVar(&config.CheckinIncompleteAlarm, "checkin-incomplete-alarm", incompleteAlarmLeave, "Alarm command for sets read as incomplete at checkin: leave, on or off")
+	flag.StringVar(&config.CheckoutIncompleteAlarm, "checkout-incomplete-alarm", incompleteAlarmLeave, "Alarm command for sets read as incomplete at checkout: leave, on or off")
+	flag.IntVar(&config.AlarmRetries, "alarm-retries", 3, "Number of times to resend the alarm of a checked in item, with alarm-fail-policy block")
+	flag.StringVar(&config.CheckoutAlarmOrder, "checkout-alarm-order", checkoutAlarmAfter, "Turn off the alarm of items after or before their SIP checkout")
+	flag.BoolVar(&config.TransitRouting, "transit-routing", false, "Send ROUTE messages with the destination of items checked in to be sent in transit")
+	flag.BoolVar(&config.ItemEvents, "item-events", false, "Send ITEM messages during checkin, before the alarm of items is changed")
+	flag.StringVar(&config.JournalPath, "journal", "", "Path of transaction journal for crash recovery (default none)")
+	flag.StringVar(&config.JournalSync, "journal-sync", journalSyncAlways, "Sync journal to disk after every record (always) or never")
+	flag.BoolVar(&config.UseAFI, "use-afi", false, "Set security of items with the AFI of tags instead of alarm commands")
+	flag.BoolVar(&config.SIPErrorDetection, "sip-error-detection", false, "Use SIP sequence numbers and checksums")
+	flag.StringVar(&config.SIPDelimiter, "sip-delimiter", "|", "Field delimiter of SIP messages")
+	flag.StringVar(&config.SIPTerminator, "sip-terminator", "\r", "Terminator of SIP messages")
+	flag.DurationVar(&config.WSWriteWait, "ws-write-wait", defaultWriteWait, "Time allowed to write a message to Koha")
+	flag.DurationVar(&config.WSPongWait, "ws-pong-wait", 0, "Time to wait for pong from Koha (default rfid-timeout)")
+	flag.Int64Var(&config.WSMaxMessageSize, "ws-max-message-size", defaultMaxMessageSize, "Max size in bytes of a message from Koha")
+	flag.Float64Var(&config.WSRateLimit, "ws-rate-limit", 10, "Max messages per second from Koha, 0 for no limit")
+	flag.IntVar(&config.WSRateBurst, "ws-rate-burst", 20, "Number of messages from Koha allowed in a burst above the rate limit")
+	flag.DurationVar(&config.WSAckTimeout, "ws-ack-timeout", 0, "Time to wait for Koha to acknowledge a message before retransmitting it, 0 to not use acks")
+	flag.IntVar(&config.WSAckRetries, "ws-ack-retries", 3, "Number of retransmits of an unacknowledged message before closing the connection")
+	flag.DurationVar(&config.WSResumeWindow, "ws-resume-window", 0, "Time to keep a session after the websocket drops, for Koha to resume it, 0 to not resume sessions")
+	flag.IntVar(&config.ClientQueueSize, "client-queue-size", 8, "Number of messages from Koha and the RFID-unit queued while a client is busy")
+	flag.DurationVar(&config.ClientStallTimeout, "client-stall-timeout", defaultStallTimeout, "Time to wait for a busy client to take a message before closing it as stuck")
+	flag.StringVar(&config.DuplicateClients, "duplicate-clients", duplicateEvict, "On connect from an IP already connected: evict old client or reject new client")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "Time to wait for clients to finish transactions on SIGTERM")
+	flag.StringVar(&config.HealthRFIDAddr, "health-rfid-addr", "", "Address of an RFID-unit to check in /healthz (default none)")
+	flag.StringVar(&config.MetricsPort, "metrics-port", "", "Port to serve Prometheus metrics on (default http port)")
 	flag.BoolVar(&config.WSProxy, "ws-proxy", true, "WS goes through proxy, find client IP in request header")
+	flag.BoolVar(&config.Simulate, "simulate", false, "Use fake RFID-unit and SIP server with test items, for testing without hardware")
+	flag.Var((*stringList)(&config.WSAllowedOrigins), "ws-allowed-origins", "Comma separated origins allowed to connect to the websocket (default any)")
+	flag.StringVar(&config.WSAuthToken, "ws-auth-token", "", "Token required to connect to the websocket")
+	flag.BoolVar(&config.WSNoAuth, "ws-no-auth", false, "Don't check origin or token of websocket connections, for local development")
 	rfidEndpoint := flag.String("rfid-endpoint", "http://rfidscanner.deichman.no/hub/in", "RDID scanner endpoint")
 
+	flag.StringVar(&config.LogLevel, "log-level", "INFO", "Log level: DEBUG, INFO, WARN or ERROR")
+	flag.BoolVar(&config.RFIDTrace, "rfid-trace", false, "Trace the raw traffic with the RFID-units of all clients")
+	flag.StringVar(&config.RFIDTraceFile, "rfid-trace-file", "", "File to write RFID traces to (default stderr)")
+	configPath := flag.String("config", "", "JSON config file; flags given on the command line take precedence")
+
 	flag.Parse()
 
+	if *configPath != "" {
+		cfg, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config = cfg
+		// Parse again, so that flags given explicitly override the config file.
+		flag.Parse()
+	}
+
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := config.validate(); err != nil {
+		log.Fatal(err)
+	}
+	logger = newLogger(level)
+	warnClamped(logger, config.clampDurations())
+	if len(config.WSAllowedOrigins) == 0 && !config.WSNoAuth {
+		logger.Warn("origins of websocket connections are not checked, set WSAllowedOrigins to the origin of Koha")
+	}
+
 	if *rfidEndpoint != "" {
 		config.LogRFID = true
 		logToRFID = make(chan rfidMsg, 100)
@@ -113,15 +587,77 @@ func main() {
 	}
 
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
+
+	if config.MetricsPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			log.Fatal(http.ListenAndServe(":"+config.MetricsPort, mux))
+		}()
+	} else {
+		http.Handle("/metrics", metrics)
+	}
+
+	if config.Simulate {
+		if err := simulate(&config); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	hub = newHub(config)
-	defer hub.Close()
+	if err := hub.openJournal(); err != nil {
+		log.Fatal(err)
+	}
+	if err := hub.openTrace(); err != nil {
+		log.Fatal(err)
+	}
 
-	log.Fatal(http.ListenAndServe(":"+config.HTTPPort, nil))
+	srv := &http.Server{Addr: ":" + config.HTTPPort}
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		logger.Info("shutting down", "timeout", config.ShutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+		hub.Shutdown(ctx)
+		close(done)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// simulate starts a fake RFID-unit with the test items and a fake SIP
+// server, and configures cfg to use them.
+func simulate(cfg *Config) error {
+	sipSrv, err := fake.NewSIPServer()
+	if err != nil {
+		return err
+	}
+	unit, err := fake.NewRFIDUnit(fake.Barcodes()...)
+	if err != nil {
+		sipSrv.Close()
+		return err
+	}
+	cfg.SIPServer = sipSrv.Addr()
+	cfg.SIPErrorDetection = false
+	cfg.SIPDelimiter, cfg.SIPTerminator = "", ""
+	cfg.RFIDHost = "127.0.0.1"
+	cfg.RFIDPort = unit.Port()
+	logger.Warn("simulation mode, using fake RFID-unit and SIP server",
+		"rfid", net.JoinHostPort(cfg.RFIDHost, cfg.RFIDPort), "sip", cfg.SIPServer)
+	return nil
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// The origin is checked by serveWs, with the settings of the hub.
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -131,41 +667,98 @@ var xForwardedRepl = strings.NewReplacer("10.173.251.150", "", ",", "", " ", "")
 
 // serveWs handles websocket requests from the peer.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if hub.isShuttingDown() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s := hub.settings()
+	if err := s.config.authorize(r); err != nil {
+		logger.Warn("websocket connection refused", "err", err, "origin", r.Header.Get("Origin"))
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	rfid := newRFIDProtocol(s.config.RFIDVendor)
+	format := negotiateFormat(r)
+	var header http.Header
+	if format != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {format}}
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
-		log.Println(err)
+		logger.Error("websocket upgrade failed", "err", err)
 		return
 	}
 	var ip string
-	if hub.config.WSProxy {
+	if s.config.WSProxy {
 		ip = xForwardedRepl.Replace(r.Header.Get("X-Forwarded-For"))
 
 	} else {
 		ip, _, err = net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
-			log.Printf("ERR cannot get remote IP address: %v", err)
+			logger.Error("cannot get remote IP address", "err", err)
+			return
+		}
+	}
+	if token := r.URL.Query().Get("session"); token != "" {
+		if client := hub.resume(token, ip, format); client != nil {
+			client.log.Info("websocket reconnected, session resumed")
+			client.attach(conn)
+			client.running.Add(1)
+			client.readFromKoha(client.ctx)
 			return
 		}
+		logger.Warn("cannot resume session, starting a new one", "ip", ip)
 	}
+	protocol, protoErr := negotiateProtocol(r.URL.Query().Get("protocol"))
 	client := &Client{
 		IP:             ip,
 		hub:            hub,
+		log:            hub.log.With("ip", ip),
 		conn:           conn,
-		fromKoha:       make(chan Message),
-		fromRFID:       make(chan RFIDResp),
-		quit:           make(chan bool, 5),
-		rfid:           newRFIDManager(),
+		fromKoha:       make(chan Message, s.config.ClientQueueSize),
+		fromRFID:       make(chan RFIDResp, s.config.ClientQueueSize),
+		closeReq:       make(chan struct{}, 1),
+		reconnected:    make(chan struct{}, 1),
+		rfid:           rfid,
 		items:          make(map[string]Message),
-		failedAlarmOn:  make(map[string]string),
-		failedAlarmOff: make(map[string]string),
+		failedAlarmOn:  make(map[string]failedTag),
+		failedAlarmOff: make(map[string]failedTag),
+		protocol:       protocol,
+		format:         format,
+	}
+	client.ctx, client.stop = context.WithCancel(hub.ctx)
+	client.pinned.Store(s)
+	if s.config.WSResumeWindow > 0 {
+		client.session = newSessionToken()
+	}
+	if protoErr != nil {
+		client.log.Warn("websocket connection refused", "err", protoErr)
+		client.sendToKoha(Message{Action: "CONNECT", UserError: true, ErrorCode: CodeProtocolVersion, ErrorMessage: protoErr.Error(),
+			MinProtocol: minProtocolVersion, MaxProtocol: maxProtocolVersion})
+		client.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, ""))
+		conn.Close()
+		client.stop()
+		return
+	}
+	// Added to before the client is visible to the hub, so that waiting
+	// for it to exit cannot race with its start.
+	client.running.Add(3)
+	if !hub.Connect(client) {
+		client.running.Add(-3)
+		client.sendToKoha(Message{Action: "CONNECT", UserError: true, ErrorCode: CodeRFIDInUse,
+			ErrorMessage: "RFID-unit is already in use by another connection"})
+		client.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+		conn.Close()
+		client.stop()
+		return
 	}
-	hub.Connect(client)
-	rfid, ok := client.initRFID(hub.config.RFIDPort)
+	reader, ok := client.initRFID(client.ctx, s.config.RFIDPort)
 	if !ok {
+		client.running.Add(-3)
 		hub.Disconnect(client)
 		return
 	}
-	go client.readFromRFID(rfid)
-	go client.Run(hub.config)
-	client.readFromKoha()
+	go client.readFromRFID(client.ctx, reader)
+	go client.Run(*client.config())
+	client.readFromKoha(client.ctx)
 }
@@ -2,14 +2,58 @@ package main
 
 // Message is a message to or from Koha's user interface.
 type Message struct {
-	Action       string // CHECKIN/CHECKOUT/CONNECT/ITEM-INFO/RETRY-ALARM-ON/RETRY-ALARM-OFF/WRITE/END
-	Patron       string // Patron username/barcode
-	Branch       string // branch where transaction is taking place
-	RFIDError    bool   // true if RFID-reader is unavailable
-	SIPError     bool   // true if SIP-server is unavailable
-	UserError    bool   // true if user is not using the API correctly
-	ErrorMessage string // textual description of the error
-	Item         Item   // current item in focus (checked in, out etc.)
+	ID           uint64     `json:",omitempty"` // ID of a message to Koha, when acks are enabled; Koha acknowledges it with an ACK of the same ID
+	Action       string     // CHECKIN/CHECKOUT/CHECKIN-CHECKOUT/RENEW/CONNECT/ITEM-INFO/INVENTORY/RETRY-ALARM-ON/RETRY-ALARM-OFF/WRITE/END/RECONNECTING/RETRYING/CLOSE/TIMEOUT/SESSION-FULL/UNKNOWN-TAG/CANCEL/ITEM/ROUTE/ACK/TEST/PATRON-INFO/WRITE-BATCH/WRITE-NEXT/PAUSE/RESUME/DEACTIVATE/SENSITIZE
+	Patron       string     // Patron username/barcode
+	PIN          string     `json:",omitempty"` // Patron PIN, if the patron must be authenticated with PIN
+	NoBlock      bool       `json:",omitempty"` // on CHECKOUT, check out in offline mode, with the SIP no block flag; the patron is not checked
+	Branch       string     // branch where transaction is taking place
+	RFIDError    bool       // true if RFID-reader is unavailable
+	SIPError     bool       // true if SIP-server is unavailable
+	UserError    bool       // true if user is not using the API correctly
+	PatronError  bool       `json:",omitempty"` // true if patron is invalid, blocked, or PIN is wrong
+	ErrorCode    ErrorCode  `json:",omitempty"` // code of the error, if any; set from the error flags by sendToKoha, if not given
+	ErrorMessage string     // textual description of the error
+	RFIDVersion  string     `json:",omitempty"` // firmware version of the RFID-unit, on successful CONNECT
+	Session      string     `json:",omitempty"` // token to resume the session with if the websocket drops, on successful CONNECT
+	Protocol     int        `json:",omitempty"` // version of the protocol negotiated with Koha, on successful CONNECT
+	MinProtocol  int        `json:",omitempty"` // oldest version of the protocol supported by the bridge, on CONNECT
+	MaxProtocol  int        `json:",omitempty"` // newest version of the protocol supported by the bridge, on CONNECT
+	SecurityRead bool       `json:",omitempty"` // true if the security of tags is read back, and given in Item.SecurityBefore/After, on CONNECT; only with Config.UseAFI
+	Attention    []string   `json:",omitempty"` // barcodes of items which may need manual attention, on CANCEL, and END of a single mode checkin
+	TestReport   []TestStep `json:",omitempty"` // results of the steps of a TEST of the RFID-unit
+	Manifest     []Item     `json:",omitempty"` // items read by an INVENTORY, in the order read
+	Batch        []Item     `json:",omitempty"` // items to write the tags of, one at a time, on WRITE-BATCH
+	Written      []string   `json:",omitempty"` // barcodes of the items of a WRITE-BATCH whose tags have been written
+	Pending      []string   `json:",omitempty"` // barcodes of the items of a WRITE-BATCH which still need tags
+	PatronInfo   *Patron    `json:",omitempty"` // account of the patron, on PATRON-INFO
+	Item         Item       // current item in focus (checked in, out etc.)
+
+	condition    string // condition of a SIP response, for which the screen message can be localized
+	checkedOutTo string // patron the item was checked out to, from a checkin response
+}
+
+// TestStep is the result of a step of a TEST of the RFID-unit.
+type TestStep struct {
+	Step string // VERSION, BEGIN-SCAN, END-SCAN, READ-AFI, ALARM-OFF or ALARM-ON
+	OK   bool
+}
+
+// Patron is the account of a patron, as given by the SIP server, for staff
+// to review before a checkout.
+type Patron struct {
+	Name                 string
+	HoldCount            int      // holds ready for pickup
+	OverdueCount         int      // items overdue
+	ChargedCount         int      // items checked out
+	FineCount            int      // fines and fees outstanding
+	RecallCount          int      // items recalled
+	UnavailableHoldCount int      // holds not yet ready for pickup
+	FeeAmount            string   // outstanding amount of fines and fees, ex 25.00
+	Currency             string   // ISO 4217 currency code of FeeAmount, ex NOK
+	HoldItems            []string // items of holds ready for pickup, as given by the SIP server
+	OverdueItems         []string // items overdue, if given by the SIP server
+	FineItems            []string // fines and fees, if given by the SIP server
 }
 
 type Item struct {
@@ -17,17 +61,94 @@ type Item struct {
 	Borrowernr string
 	Label      string
 	Barcode    string
+	Tag        string `json:",omitempty"` // RFID tag id, of tags not belonging to any item
 	Date       string // Format: 10/03/2013
+	SIPTxID    string `json:",omitempty"` // Transaction id (BK) given by the SIP server, if any, to correlate with the ILS logs
 	Status     string // An error explanation or an error message passed on from SIP-server
 	Transfer   string // Branchcode, or empty string if item belongs to the issuing branch
+	SortBin    string `json:",omitempty"` // Sort bin the item should be put in, if given by the SIP server on checkin
+	HomeBranch string `json:",omitempty"` // Branchcode of the owner of the item given by the SIP server, on ITEM-INFO and INVENTORY
 	Hold       bool   // true if item is reserved for the current branch
-	NumTags    int
+	InTransit  bool   `json:",omitempty"` // true if item must be sent to the Transfer branch, for a reservation there or to be returned home
+	NumTags    int    // Number of tags of the item: of its parts, or to WRITE
+	PartsSeen  int    `json:",omitempty"` // Number of parts read of an incomplete set, when reported after Config.MissingPartsTimeout
+	MediaType  string `json:",omitempty"` // SIP media type (CK), ex 001 for book, 005 for video tape, 006 for CD
+	Magnetic   bool   `json:",omitempty"` // true if the SIP server reports the item as magnetic media
+	RSSI       *int   `json:",omitempty"` // Signal strength of the tag, in dBm, if the RFID-unit reports it; a weak one may be damaged
+	Owner      string `json:",omitempty"` // Library number of the owner of the item, on WRITE; default Config.OwnerLibrary
+	Country    string `json:",omitempty"` // Country code of the owner of the item, on WRITE; default Config.CountryCode
+
+	// Security of the tag, read back before and after its alarm was
+	// changed, with Config.UseAFI: SECURE, UNSECURE, or the AFI in hex if
+	// neither. Empty if not read, ex with the alarm commands, which the
+	// RFID-unit cannot read back.
+	SecurityBefore string `json:",omitempty"`
+	SecurityAfter  string `json:",omitempty"`
 
 	// Possible errors
 	Unknown           bool // true if SIP server cant give any information on a given barcode
 	TransactionFailed bool // true if the transaction failed
+	Blocked           bool `json:",omitempty"` // true if the item must be handled manually, ex lost or claimed returned; the alarm is left as is
 	AlarmOnFailed     bool // true if it failed to turn on alarm
 	AlarmOffFailed    bool // true if it failed to turn off alarm
 	WriteFailed       bool // true if write to tag failed
 	TagCountFailed    bool // true if mismatch between expected number of tags and found tags
 }
+
+// ErrorCode identifies the error of a Message, so that Koha can show a
+// localized message, and decide whether to offer a retry. ErrorMessage has
+// the details.
+type ErrorCode string
+
+// Possible ErrorCodes
+const (
+	CodeSIPTimeout        ErrorCode = "SIP_TIMEOUT"        // SIP server didn't respond in time
+	CodeSIPUnavailable    ErrorCode = "SIP_UNAVAILABLE"    // SIP server cannot be reached, or failed
+	CodeRFIDNOK           ErrorCode = "RFID_NOK"           // RFID-unit refused a command
+	CodeRFIDTimeout       ErrorCode = "RFID_TIMEOUT"       // RFID-unit didn't respond in time
+	CodeRFIDDisconnected  ErrorCode = "RFID_DISCONNECTED"  // Connection to the RFID-unit failed or was lost
+	CodeRFIDInUse         ErrorCode = "RFID_IN_USE"        // RFID-unit is used by another connection
+	CodeProtocolVersion   ErrorCode = "PROTOCOL_VERSION"   // Protocol version of Koha is not supported, or lacks the action
+	CodeInvalidRequest    ErrorCode = "INVALID_REQUEST"    // Message from Koha is invalid, ex missing patron
+	CodeRetryInProgress   ErrorCode = "RETRY_IN_PROGRESS"  // A retry of alarms is already in progress
+	CodePatronInvalid     ErrorCode = "PATRON_INVALID"     // Patron is invalid, blocked, or PIN is wrong
+	CodeItemUnknown       ErrorCode = "ITEM_UNKNOWN"       // Item or tag is not known by the SIP server
+	CodeItemBlocked       ErrorCode = "ITEM_BLOCKED"       // Item must be handled manually
+	CodePartsMissing      ErrorCode = "PARTS_MISSING"      // Not all parts of the item are on the RFID-unit
+	CodeAlarmFailed       ErrorCode = "ALARM_FAILED"       // Alarm of the item could not be changed
+	CodeCheckinReverted   ErrorCode = "CHECKIN_REVERTED"   // Checkin was reverted, as the alarm of the item could not be turned on
+	CodeWriteFailed       ErrorCode = "WRITE_FAILED"       // Writing the tags of the item failed
+	CodeTransactionFailed ErrorCode = "TRANSACTION_FAILED" // SIP server refused the transaction
+	CodeClientReset       ErrorCode = "CLIENT_RESET"       // Client was stuck, and was reset; the transaction is cancelled
+	CodeThrottled         ErrorCode = "THROTTLED"          // Too many messages from Koha; the message was dropped
+)
+
+// errorCode returns the ErrorCode of m, or if none is given, the code of
+// its error flags. It returns "" if m is not an error.
+func (m Message) errorCode() ErrorCode {
+	switch {
+	case m.ErrorCode != "":
+		return m.ErrorCode
+	case m.PatronError:
+		return CodePatronInvalid
+	case m.SIPError:
+		return CodeSIPUnavailable
+	case m.RFIDError:
+		return CodeRFIDDisconnected
+	case m.UserError:
+		return CodeInvalidRequest
+	case m.Item.Unknown:
+		return CodeItemUnknown
+	case m.Item.Blocked:
+		return CodeItemBlocked
+	case m.Item.TagCountFailed:
+		return CodePartsMissing
+	case m.Item.AlarmOnFailed, m.Item.AlarmOffFailed:
+		return CodeAlarmFailed
+	case m.Item.WriteFailed:
+		return CodeWriteFailed
+	case m.Item.TransactionFailed:
+		return CodeTransactionFailed
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		msg  Message
+		want ErrorCode
+	}{
+		{Message{Action: "CHECKIN"}, ""},
+		{Message{Action: "CONNECT", RFIDError: true, ErrorCode: CodeRFIDTimeout}, CodeRFIDTimeout},
+		{Message{Action: "CONNECT", RFIDError: true}, CodeRFIDDisconnected},
+		{Message{Action: "CHECKOUT", SIPError: true}, CodeSIPUnavailable},
+		{Message{Action: "CHECKOUT", PatronError: true}, CodePatronInvalid},
+		{Message{Action: "CHECKOUT", UserError: true}, CodeInvalidRequest},
+		{Message{Action: "CHECKIN", Item: Item{Unknown: true, TransactionFailed: true}}, CodeItemUnknown},
+		{Message{Action: "CHECKIN", Item: Item{Blocked: true}}, CodeItemBlocked},
+		{Message{Action: "CHECKIN", Item: Item{TagCountFailed: true, TransactionFailed: true}}, CodePartsMissing},
+		{Message{Action: "CHECKIN", Item: Item{AlarmOnFailed: true}}, CodeAlarmFailed},
+		{Message{Action: "CHECKOUT", Item: Item{AlarmOffFailed: true}}, CodeAlarmFailed},
+		{Message{Action: "WRITE", Item: Item{WriteFailed: true}}, CodeWriteFailed},
+		{Message{Action: "CHECKOUT", Item: Item{TransactionFailed: true}}, CodeTransactionFailed},
+	}
+	for _, tt := range tests {
+		if got := tt.msg.errorCode(); got != tt.want {
+			t.Errorf("%+v.errorCode() => %q; want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+// Verify that the fields of a message which are not given, and not used by
+// every action, are left out.
+func TestMessageOmitEmpty(t *testing.T) {
+	b, err := json.Marshal(Message{Action: "CHECKIN", Item: Item{Barcode: "03010824124004"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"ID", "PIN", "Session", "TestReport", "Manifest", "Batch", "Written", "Pending", "PatronInfo", "SecurityBefore"} {
+		if strings.Contains(string(b), `"`+field+`"`) {
+			t.Errorf("json.Marshal(CHECKIN) => %s; want %s left out", b, field)
+		}
+	}
+}
+
+// timeoutErr is a net.Error which timed out.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+var _ net.Error = timeoutErr{}
+
+func TestSIPAndRFIDErrorCodes(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want ErrorCode
+	}{
+		{errSIPTimeout, CodeSIPTimeout},
+		{timeoutErr{}, CodeSIPTimeout},
+		{io.EOF, CodeSIPUnavailable},
+		{errSIPLoginFailed, CodeSIPUnavailable},
+	} {
+		if got := sipErrorCode(tt.err); got != tt.want {
+			t.Errorf("sipErrorCode(%v) => %q; want %q", tt.err, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		err  error
+		want ErrorCode
+	}{
+		{errRFIDNOK, CodeRFIDNOK},
+		{timeoutErr{}, CodeRFIDTimeout},
+		{io.EOF, CodeRFIDDisconnected},
+		{errors.New("connection refused"), CodeRFIDDisconnected},
+	} {
+		if got := rfidErrorCode(tt.err); got != tt.want {
+			t.Errorf("rfidErrorCode(%v) => %q; want %q", tt.err, got, tt.want)
+		}
+	}
+}
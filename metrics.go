@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics holds the counters and histograms exposed to Prometheus.
+type Metrics struct {
+	checkins           *counter
+	checkouts          *counter
+	sipErrors          *counter
+	rfidErrors         *counter
+	reconnects         *counter
+	throttled          *counter
+	discarded          *counter
+	breakerTransitions *counter
+	eventsDropped      *counter
+	sipLatency         *histogram
+	rfidRTT            *histogram
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		checkins:           newCounter("rfidhub_checkins_total", "Number of items checked in.", "branch"),
+		checkouts:          newCounter("rfidhub_checkouts_total", "Number of items checked out.", "branch"),
+		sipErrors:          newCounter("rfidhub_sip_errors_total", "Number of failed SIP calls.", ""),
+		rfidErrors:         newCounter("rfidhub_rfid_errors_total", "Number of RFID errors reported to Koha.", ""),
+		reconnects:         newCounter("rfidhub_rfid_reconnects_total", "Number of reconnects to lost RFID-units.", ""),
+		throttled:          newCounter("rfidhub_throttled_messages_total", "Number of messages from Koha dropped by the rate limit.", ""),
+		discarded:          newCounter("rfidhub_rfid_discarded_responses_total", "Number of unexpected responses from RFID-units discarded.", ""),
+		breakerTransitions: newCounter("rfidhub_sip_breaker_transitions_total", "Number of times SIP circuit breakers changed to a state.", "state"),
+		eventsDropped:      newCounter("rfidhub_events_dropped_total", "Number of events dropped for busy event handlers.", ""),
+		sipLatency:         newHistogram("rfidhub_sip_call_seconds", "Duration of SIP calls, including retry."),
+		rfidRTT:            newHistogram("rfidhub_rfid_roundtrip_seconds", "Time from a command is sent to the RFID-unit until it responds."),
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	m.checkins.write(&b)
+	m.checkouts.write(&b)
+	m.sipErrors.write(&b)
+	m.rfidErrors.write(&b)
+	m.reconnects.write(&b)
+	m.throttled.write(&b)
+	m.discarded.write(&b)
+	m.breakerTransitions.write(&b)
+	m.eventsDropped.write(&b)
+	m.sipLatency.write(&b)
+	m.rfidRTT.write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+// counter is a counter, optionally partitioned by the value of one label.
+type counter struct {
+	name, help string
+	label      string // Label name, or "" if not partitioned
+	mu         sync.Mutex
+	values     map[string]uint64 // Keyed by label value
+}
+
+func newCounter(name, help, label string) *counter {
+	return &counter{name: name, help: help, label: label, values: make(map[string]uint64)}
+}
+
+// Inc increments the counter for the given label value. The
+// value is ignored if the counter is not partitioned.
+func (c *counter) Inc(labelValue string) {
+	if c.label == "" {
+		labelValue = ""
+	}
+	c.mu.Lock()
+	c.values[labelValue]++
+	c.mu.Unlock()
+}
+
+// Value returns the count for the given label value.
+func (c *counter) Value(labelValue string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *counter) write(b *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(b, "%s %d\n", c.name, c.values[""])
+		return
+	}
+	labelValues := make([]string, 0, len(c.values))
+	for v := range c.values {
+		labelValues = append(labelValues, v)
+	}
+	sort.Strings(labelValues)
+	for _, v := range labelValues {
+		fmt.Fprintf(b, "%s{%s=%q} %d\n", c.name, c.label, v, c.values[v])
+	}
+}
+
+// Upper bounds in seconds of the histogram buckets.
+var histogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observed durations in buckets.
+type histogram struct {
+	name, help string
+	mu         sync.Mutex
+	counts     []uint64 // Per bucket, not cumulative
+	count      uint64
+	sum        float64
+}
+
+func newHistogram(name, help string) *histogram {
+	return &histogram{name: name, help: help, counts: make([]uint64, len(histogramBuckets))}
+}
+
+// Observe adds a duration to the histogram.
+func (h *histogram) Observe(d time.Duration) {
+	s := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range histogramBuckets {
+		if s <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += s
+}
+
+// Count returns the number of observed durations.
+func (h *histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *histogram) write(b *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, le := range histogramBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{le=\"%g\"} %d\n", h.name, le, cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(b, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(b, "%s_count %d\n", h.name, h.count)
+}
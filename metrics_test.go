@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	m := newMetrics()
+	m.checkins.Inc("hutl")
+	m.checkins.Inc("hutl")
+	m.checkins.Inc("fmaj")
+	m.sipErrors.Inc("ignored")
+	m.sipLatency.Observe(20 * time.Millisecond)
+	m.sipLatency.Observe(3 * time.Second)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE rfidhub_checkins_total counter\n",
+		`rfidhub_checkins_total{branch="fmaj"} 1` + "\n",
+		`rfidhub_checkins_total{branch="hutl"} 2` + "\n",
+		"rfidhub_sip_errors_total 1\n",
+		"rfidhub_rfid_reconnects_total 0\n",
+		"# TYPE rfidhub_sip_call_seconds histogram\n",
+		`rfidhub_sip_call_seconds_bucket{le="0.01"} 0` + "\n",
+		`rfidhub_sip_call_seconds_bucket{le="0.025"} 1` + "\n",
+		`rfidhub_sip_call_seconds_bucket{le="5"} 2` + "\n",
+		`rfidhub_sip_call_seconds_bucket{le="+Inf"} 2` + "\n",
+		"rfidhub_sip_call_seconds_sum 3.02\n",
+		"rfidhub_sip_call_seconds_count 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q; got:\n%s", want, body)
+		}
+	}
+}
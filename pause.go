@@ -0,0 +1,73 @@
+package main
+
+// A PAUSE stops the RFID-unit from scanning in the middle of a session, ex
+// for staff to inspect an item stuck on it, without ending the session: the
+// items handled, and the ones which failed to get their alarm changed, are
+// kept, so that a RETRY-ALARM-ON/OFF still works. RESUME starts scanning
+// again in the same session. A session can only be paused while scanning,
+// not while an item is being handled; a paused session still ends when it
+// has been idle for Config.SessionIdleTimeout.
+
+// pausable reports whether a session scanning in the given state can be
+// paused.
+func (s RFIDState) pausable() bool {
+	switch s {
+	case RFIDCheckin, RFIDCheckout, RFIDExchange, RFIDRenew:
+		return true
+	}
+	return false
+}
+
+// pause stops scanning, keeping the session.
+func (c *Client) pause() {
+	if !c.state.pausable() {
+		c.sendToKoha(Message{Action: "PAUSE", UserError: true,
+			ErrorMessage: "can only pause a session while scanning"})
+		return
+	}
+	c.paused = c.state
+	c.state = RFIDWaitForPauseOK
+	c.sendToRFID(RFIDReq{Cmd: cmdEndScan})
+}
+
+// pauseDone tells Koha that the session is paused, when the RFID-unit has
+// stopped scanning. If it didn't, it may still be scanning, and the session
+// goes on.
+func (c *Client) pauseDone(resp RFIDResp) {
+	if !resp.OK {
+		c.logger().Error("RFID failed to stop scanning")
+		c.state = c.paused
+		c.sendToKoha(Message{Action: "PAUSE", RFIDError: true, ErrorCode: CodeRFIDNOK,
+			ErrorMessage: "RFID-unit failed to stop scanning"})
+		return
+	}
+	c.logger().Info("session paused", "items", len(c.items))
+	c.state = RFIDPaused
+	c.sendToKoha(Message{Action: "PAUSE"})
+}
+
+// resume starts scanning again in the paused session.
+func (c *Client) resume() {
+	if c.state != RFIDPaused {
+		c.sendToKoha(Message{Action: "RESUME", UserError: true, ErrorMessage: "no session is paused"})
+		return
+	}
+	c.state = RFIDWaitForResumeOK
+	c.rfid.Reset()
+	c.sendToRFID(RFIDReq{Cmd: cmdBeginScan})
+}
+
+// resumeDone tells Koha that the session is resumed, when the RFID-unit has
+// started scanning. If it didn't, the session stays paused.
+func (c *Client) resumeDone(resp RFIDResp) {
+	if !resp.OK {
+		c.logger().Error("RFID failed to start scanning")
+		c.state = RFIDPaused
+		c.sendToKoha(Message{Action: "RESUME", RFIDError: true, ErrorCode: CodeRFIDNOK,
+			ErrorMessage: "RFID-unit failed to start scanning"})
+		return
+	}
+	c.logger().Info("session resumed")
+	c.state = c.paused
+	c.sendToKoha(Message{Action: "RESUME"})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Verify that a checkin session paused and resumed mid-batch keeps its
+// items: an item checked in before the pause isn't checked in again, and
+// an item whose alarm failed can still be retried.
+func TestPauseResume(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT
+
+	send := func(msg string) {
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal("UI failed to send message over websocket conn")
+		}
+	}
+
+	send(`{"Action":"CHECKIN","Branch":"fmaj"}`)
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+
+	// One item is checked in, the alarm of another fails
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("OK\r"))
+	<-uiChan // CHECKIN
+	sipSrv.Respond("101YNN20140226    161239AO|AB03011063175001|AQfmaj|AJCat's cradle|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	<-d.incoming // OK1
+	d.write([]byte("NOK\r"))
+	if got := <-uiChan; !got.Item.AlarmOnFailed {
+		t.Fatalf("Got %+v; want CHECKIN with AlarmOnFailed", got)
+	}
+
+	send(`{"Action":"PAUSE"}`)
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Errorf("RFID-unit got %q on PAUSE; want END", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "PAUSE" || got.ErrorCode != "" {
+		t.Errorf("Got %+v; want PAUSE", got)
+	}
+	send(`{"Action":"PAUSE"}`)
+	if got := <-uiChan; got.Action != "PAUSE" || !got.UserError {
+		t.Errorf("Got %+v; want PAUSE user error, the session being paused", got)
+	}
+
+	send(`{"Action":"RESUME"}`)
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Errorf("RFID-unit got %q on RESUME; want BEG", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Action != "RESUME" || got.ErrorCode != "" {
+		t.Errorf("Got %+v; want RESUME", got)
+	}
+
+	// The item checked in before the pause is not checked in again
+	d.write([]byte("RDT1003010824124004:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Errorf("RFID-unit got %q for item read again; want alarm left", msg)
+	}
+	d.write([]byte("OK\r"))
+
+	// The item whose alarm failed before the pause is retried
+	send(`{"Action":"RETRY-ALARM-ON"}`)
+	if msg := <-d.incoming; !strings.HasPrefix(string(msg), "ACT1003011063175001") {
+		t.Errorf("RFID-unit got %q on RETRY-ALARM-ON; want alarm on of 03011063175001", msg)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Item.Barcode != "03011063175001" || got.Item.AlarmOnFailed {
+		t.Errorf("Got %+v; want alarm on of 03011063175001", got)
+	}
+
+	send(`{"Action":"RESUME"}`)
+	if got := <-uiChan; got.Action != "RESUME" || !got.UserError {
+		t.Errorf("Got %+v; want RESUME user error, no session being paused", got)
+	}
+}
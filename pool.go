@@ -1,54 +1,160 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"io"
 	"net"
 	"sync"
+	"time"
 )
 
+// readers is a pool of buffered readers, reused between SIP calls and
+// RFID connections to avoid allocating a new buffer for each.
+var readers = sync.Pool{
+	New: func() interface{} { return bufio.NewReader(nil) },
+}
+
+// getReader returns a buffered reader from the pool, reading from r.
+func getReader(r io.Reader) *bufio.Reader {
+	br := readers.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+// putReader returns a buffered reader to the pool. Any buffered data is
+// discarded, so it must only be called when the reader is done.
+func putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readers.Put(br)
+}
+
 type connFactory func() (net.Conn, error)
 
+// connCheck checks if a connection is healthy.
+type connCheck func(net.Conn) error
+
+// idleConn is a connection waiting in the pool.
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// poolStats are statistics of a pool.
+type poolStats struct {
+	InUse   int // Connections currently borrowed
+	Idle    int // Connections waiting in the pool
+	Created int // Connections created in total
+	Evicted int // Connections closed because they failed or were idle too long
+}
+
 // pool is a SIP-connection pool.
 type pool struct {
-	factory connFactory
-	conns   chan net.Conn
-	mu      sync.Mutex
-	failing map[net.Conn]bool
+	factory     connFactory
+	closeOnce   sync.Once
+	minN        int           // Minimum number of connections kept open by the health check
+	idleTimeout time.Duration // Connections idle for longer are closed, if > 0
+	conns       chan idleConn // Idle connections
+	open        chan struct{} // Semaphore limiting the number of open connections
+	done        chan struct{} // Closed when pool is closed
+	breaker     *breaker      // Fails SIP calls fast while the server is down, nil if disabled
+	calls       callLimit     // Bounds the SIP calls in flight, shared by all pools, nil if unlimited
+	clock       clock         // Times the idle connections and the health checks
+	mu          sync.Mutex    // Protects the following:
+	failing     map[net.Conn]bool
+	created     int
+	evicted     int
 }
 
-func newPool(maxN int, fn connFactory) *pool {
+func newPool(minN, maxN int, idleTimeout time.Duration, fn connFactory) *pool {
+	if maxN < 1 {
+		maxN = 1
+	}
+	if minN > maxN {
+		minN = maxN
+	}
 	p := pool{
-		conns:   make(chan net.Conn, maxN),
-		failing: make(map[net.Conn]bool),
-		factory: fn,
+		minN:        minN,
+		idleTimeout: idleTimeout,
+		conns:       make(chan idleConn, maxN),
+		open:        make(chan struct{}, maxN),
+		done:        make(chan struct{}),
+		failing:     make(map[net.Conn]bool),
+		factory:     fn,
+		clock:       realClock{},
 	}
 
 	return &p
 }
 
+// get borrows a connection from the pool, creating a new one if none is idle.
+// If the maximum number of connections is open, it waits until one is returned.
 func (p *pool) get() (net.Conn, error) {
-	select {
-	case conn := <-p.conns:
-		return conn, nil
-	default:
-		return p.factory()
+	return p.getContext(context.Background())
+}
+
+// getContext is like get, but gives up waiting for a connection when ctx is
+// done, and returns ctx.Err().
+func (p *pool) getContext(ctx context.Context) (net.Conn, error) {
+	for {
+		var ic idleConn
+		select {
+		case ic = <-p.conns:
+		default:
+			select {
+			case ic = <-p.conns:
+			case p.open <- struct{}{}:
+				return p.create()
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if p.stale(ic) {
+			p.evict(ic.conn)
+			continue
+		}
+		return ic.conn, nil
 	}
 }
 
+// create creates a new connection. The caller must have reserved a slot in p.open.
+func (p *pool) create() (net.Conn, error) {
+	conn, err := p.factory()
+	if err != nil {
+		<-p.open
+		return nil, err
+	}
+	p.mu.Lock()
+	p.created++
+	p.mu.Unlock()
+	return conn, nil
+}
+
 func (p *pool) put(conn net.Conn) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	failing := p.failing[conn]
+	delete(p.failing, conn)
+	p.mu.Unlock()
+
+	if failing {
+		p.evict(conn)
+		return
+	}
 
-	if p.failing[conn] {
-		delete(p.failing, conn)
-		conn.Close()
+	select {
+	case <-p.done:
+		// The pool is closed, or drained after a reload of the config.
+		p.evict(conn)
 		return
+	default:
 	}
 
 	select {
-	case p.conns <- conn:
+	case p.conns <- idleConn{conn: conn, since: p.clock.Now()}:
 	default:
-		// pool is full
-		conn.Close()
+		// pool is full; should not happen as long as
+		// connections are only put back after get.
+		p.evict(conn)
 	}
 }
 
@@ -57,3 +163,110 @@ func (p *pool) isFailing(conn net.Conn) {
 	p.failing[conn] = true
 	p.mu.Unlock()
 }
+
+// evict closes the connection and frees its slot in the pool.
+func (p *pool) evict(conn net.Conn) {
+	conn.Close()
+	<-p.open
+	p.mu.Lock()
+	p.evicted++
+	p.mu.Unlock()
+}
+
+func (p *pool) stale(ic idleConn) bool {
+	return p.idleTimeout > 0 && p.clock.Now().Sub(ic.since) > p.idleTimeout
+}
+
+func (p *pool) stats() poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := len(p.conns)
+	return poolStats{
+		InUse:   len(p.open) - idle,
+		Idle:    idle,
+		Created: p.created,
+		Evicted: p.evicted,
+	}
+}
+
+// checkHealth checks the idle connections at every interval, evicting the
+// ones that are stale or fail the check, and then opens new connections
+// until there are at least minN. It runs until the pool is closed.
+func (p *pool) checkHealth(interval time.Duration, check connCheck) {
+	t := p.clock.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+		case <-p.done:
+			return
+		}
+
+		for i, n := 0, len(p.conns); i < n; i++ {
+			var ic idleConn
+			select {
+			case ic = <-p.conns:
+			default:
+				continue
+			}
+			if p.stale(ic) || check(ic.conn) != nil {
+				p.evict(ic.conn)
+				continue
+			}
+			p.conns <- ic
+		}
+
+		for len(p.open) < p.minN {
+			select {
+			case p.open <- struct{}{}:
+			case <-p.done:
+				return
+			}
+			conn, err := p.create()
+			if err != nil {
+				break
+			}
+			p.put(conn)
+		}
+		t.Reset(interval)
+	}
+}
+
+// probe checks an idle connection, or a new one if none is idle, and
+// returns it to the pool if it passes the check. A connection failing the
+// check is evicted. If all connections are in use, the pool is considered
+// healthy without checking.
+func (p *pool) probe(check connCheck) error {
+	var conn net.Conn
+	select {
+	case ic := <-p.conns:
+		conn = ic.conn
+	case p.open <- struct{}{}:
+		var err error
+		if conn, err = p.create(); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if err := check(conn); err != nil {
+		p.evict(conn)
+		return err
+	}
+	p.put(conn)
+	return nil
+}
+
+// close stops the health check and closes all idle connections.
+// It is safe to call more than once.
+func (p *pool) close() {
+	p.closeOnce.Do(func() { close(p.done) })
+	for {
+		select {
+		case ic := <-p.conns:
+			p.evict(ic.conn)
+		default:
+			return
+		}
+	}
+}
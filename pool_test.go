@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pipeFactory() (net.Conn, error) {
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestPoolBounded(t *testing.T) {
+	p := newPool(0, 1, 0, pipeFactory)
+	defer p.close()
+
+	c1, err := p.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan net.Conn)
+	go func() {
+		c, _ := p.get()
+		got <- c
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("pool.get() returned a connection when all connections are in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.put(c1)
+	if c2 := <-got; c2 != c1 {
+		t.Errorf("pool.get() => %v; want returned connection %v", c2, c1)
+	}
+
+	if want := (poolStats{InUse: 1, Created: 1}); p.stats() != want {
+		t.Errorf("pool.stats() => %+v; want %+v", p.stats(), want)
+	}
+}
+
+func TestPoolEvictsStale(t *testing.T) {
+	p := newPool(0, 2, time.Minute, pipeFactory)
+	defer p.close()
+	clock := &fakeClock{now: time.Now()}
+	p.clock = clock
+
+	c1, _ := p.get()
+	p.put(c1)
+	clock.Advance(2 * time.Minute)
+
+	c2, _ := p.get()
+	if c2 == c1 {
+		t.Error("pool.get() returned a connection idle for longer than the idle timeout")
+	}
+
+	if want := (poolStats{InUse: 1, Created: 2, Evicted: 1}); p.stats() != want {
+		t.Errorf("pool.stats() => %+v; want %+v", p.stats(), want)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	p := newPool(1, 2, 0, pipeFactory)
+	defer p.close()
+
+	clock := &fakeClock{now: time.Now()}
+	p.clock = clock
+
+	c1, _ := p.get()
+	p.put(c1)
+
+	checked := make(chan net.Conn)
+	failing := func(conn net.Conn) error {
+		checked <- conn
+		return errors.New("no response")
+	}
+	go p.checkHealth(time.Minute, failing)
+
+	clock.waitArmed(1)
+	clock.Advance(time.Minute)
+	if conn := <-checked; conn != c1 {
+		t.Errorf("health check got %v; want the idle connection", conn)
+	}
+
+	// The failing connection is evicted, and a new one opened to keep
+	// minimum, which is checked at the next interval.
+	clock.waitArmed(1)
+	if s := p.stats(); s.Evicted != 1 || s.Created != 2 || s.Idle != 1 {
+		t.Errorf("pool.stats() => %+v; want 1 evicted, 2 created and 1 idle", s)
+	}
+	clock.Advance(time.Minute)
+	if conn := <-checked; conn == c1 {
+		t.Error("health check got the connection which failed the previous check")
+	}
+}
+
+func TestReaderPool(t *testing.T) {
+	r := getReader(strings.NewReader("OK\rOKR\r"))
+	if b, _ := r.ReadBytes('\r'); string(b) != "OK\r" {
+		t.Errorf("ReadBytes() => %q; want %q", b, "OK\r")
+	}
+	putReader(r)
+
+	// A reused reader must not return data buffered from its previous source
+	r = getReader(strings.NewReader("BEG\r"))
+	defer putReader(r)
+	if b, _ := r.ReadBytes('\r'); string(b) != "BEG\r" {
+		t.Errorf("ReadBytes() => %q; want %q", b, "BEG\r")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Versions of the protocol between Koha's user interface and the bridge
+// supported by the bridge. Koha gives the version it speaks in the protocol
+// parameter of the websocket URL, ex /ws?protocol=2; without it, Koha is
+// taken to speak the newest version. The version negotiated, and the range
+// supported, are given on CONNECT.
+//
+// Version 1 is the original protocol. Version 2 adds CANCEL, RENEW, TEST and
+// INVENTORY, version 3 CHECKIN-CHECKOUT, version 4 PATRON-INFO, version 5
+// WRITE-BATCH and WRITE-NEXT, version 6 PAUSE and RESUME, and version 7
+// DEACTIVATE and SENSITIZE.
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 7
+)
+
+// actionProtocol is the protocol version in which an action from Koha was
+// added, for actions added after version 1.
+var actionProtocol = map[string]int{
+	"CANCEL":           2,
+	"RENEW":            2,
+	"TEST":             2,
+	"INVENTORY":        2,
+	"CHECKIN-CHECKOUT": 3,
+	"PATRON-INFO":      4,
+	"WRITE-BATCH":      5,
+	"WRITE-NEXT":       5,
+	"PAUSE":            6,
+	"RESUME":           6,
+	"DEACTIVATE":       7,
+	"SENSITIZE":        7,
+}
+
+// protocolError is returned by negotiateProtocol for a version of the
+// protocol which the bridge doesn't support.
+type protocolError struct {
+	version string
+}
+
+func (e protocolError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %q, want %d to %d", e.version, minProtocolVersion, maxProtocolVersion)
+}
+
+// negotiateProtocol returns the version of the protocol to speak with Koha,
+// given the version Koha speaks. A Koha newer than the bridge speaks the
+// newest version of the bridge.
+func negotiateProtocol(version string) (int, error) {
+	if version == "" {
+		return maxProtocolVersion, nil
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil || v < minProtocolVersion {
+		return 0, protocolError{version: version}
+	}
+	if v > maxProtocolVersion {
+		// Koha is newer than the bridge, and is expected to fall back to
+		// the version given on CONNECT.
+		return maxProtocolVersion, nil
+	}
+	return v, nil
+}
+
+// supports reports whether action is part of the protocol version
+// negotiated with Koha.
+func (c *Client) supports(action string) bool {
+	return actionProtocol[action] <= c.protocol
+}
+
+// connected returns the CONNECT message telling Koha that the RFID-unit, of
+// firmware version, is ready, and whether the security of tags is read back.
+func (c *Client) connected(version string) Message {
+	return Message{Action: "CONNECT", RFIDVersion: version, Session: c.session,
+		Protocol: c.protocol, MinProtocol: minProtocolVersion, MaxProtocol: maxProtocolVersion,
+		SecurityRead: c.config().UseAFI}
+}
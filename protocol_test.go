@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		want    int
+		err     bool
+	}{
+		{"", maxProtocolVersion, false},
+		{"1", 1, false},
+		{"2", 2, false},
+		{"99", maxProtocolVersion, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"v2", 0, true},
+	} {
+		got, err := negotiateProtocol(tt.version)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("negotiateProtocol(%q) => %d, %v; want %d, error %v", tt.version, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// Verify that Koha speaking a version of the protocol which the bridge
+// doesn't support is refused on CONNECT, and that Koha speaking an older
+// version is not allowed actions added after it.
+func TestProtocolHandshake(t *testing.T) {
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+
+	// Incompatible: refused without connecting to the RFID-unit
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws?protocol=0", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	var got Message
+	want := Message{Action: "CONNECT", UserError: true, ErrorCode: CodeProtocolVersion,
+		ErrorMessage: `unsupported protocol version "0", want 1 to 7`, MinProtocol: 1, MaxProtocol: 7}
+	if err := ws.ReadJSON(&got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, %v; want %+v", got, err, want)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Errorf("Refused connection closed with %v; want protocol error", err)
+	}
+	select {
+	case msg := <-d.incoming:
+		t.Fatalf("RFID-unit got %q from refused connection; want nothing", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Compatible: version 1 is negotiated
+	ws, _, err = websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%s/ws?protocol=1", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	got = Message{}
+	want = Message{Action: "CONNECT", Protocol: 1, MinProtocol: 1, MaxProtocol: 7}
+	if err := ws.ReadJSON(&got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v, %v; want %+v", got, err, want)
+	}
+
+	// RENEW was added in version 2
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RENEW","Patron":"95"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	got = Message{}
+	want = Message{Action: "RENEW", UserError: true, ErrorCode: CodeProtocolVersion,
+		ErrorMessage: "RENEW is not supported by protocol version 1"}
+	if err := ws.ReadJSON(&got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, %v; want %+v", got, err, want)
+	}
+
+	// CHECKIN is part of version 1
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	if msg := <-d.incoming; string(msg) != "BEG\r" {
+		t.Errorf("RFID-unit didn't get instructed to start scanning, got %q", msg)
+	}
+}
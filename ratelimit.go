@@ -0,0 +1,46 @@
+package main
+
+import "time"
+
+// unlimitedActions are the actions from Koha which are not rate limited, as
+// they end, pause or resume a transaction, or retry its alarms, and must not
+// be lost.
+var unlimitedActions = map[string]bool{
+	"END":             true,
+	"CANCEL":          true,
+	"PAUSE":           true,
+	"RESUME":          true,
+	"RETRY-ALARM-ON":  true,
+	"RETRY-ALARM-OFF": true,
+}
+
+// tokenBucket is a token bucket rate limiter. It holds up to burst tokens,
+// and is refilled with rate tokens per second. It is not safe for
+// concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket.
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// allow reports whether a token is available at now, and takes it if so.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
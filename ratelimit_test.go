@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, 3, start)
+
+	// A full bucket allows a burst.
+	for i := 0; i < 3; i++ {
+		if !b.allow(start) {
+			t.Fatalf("message %d of burst not allowed", i+1)
+		}
+	}
+	if b.allow(start) {
+		t.Error("message exceeding burst allowed")
+	}
+
+	// Tokens are refilled at the rate, up to the burst.
+	if !b.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("message not allowed after refill")
+	}
+	if b.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("message allowed before refill")
+	}
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.allow(later) {
+			t.Fatalf("message %d not allowed after long pause", i+1)
+		}
+	}
+	if b.allow(later) {
+		t.Error("bucket refilled beyond burst")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+// settings are the Config and SIP connection pools of transactions. The
+// hub's settings are replaced as a whole by Reload; a client keeps the
+// settings it has until it is idle, or between the items of a session, so
+// that a transaction in progress finishes on the settings it started with.
+type settings struct {
+	config      Config
+	sipPool     *pool
+	branchPools map[string]*pool // SIP pools of branches with their own SIP server
+}
+
+// newSettings returns the settings of cfg, with new SIP connection pools.
+func newSettings(cfg Config) *settings {
+	s := &settings{
+		config:  cfg,
+		sipPool: newPool(cfg.SIPMinConn, cfg.SIPMaxConn, cfg.SIPIdleTimeout, initSIPConn(cfg)),
+	}
+	s.sipPool.breaker = newBreaker(cfg.SIPServer, cfg.SIPBreakerThreshold, cfg.SIPBreakerCooldown)
+	calls := newCallLimit(cfg.SIPMaxCalls)
+	s.sipPool.calls = calls
+	if cfg.SIPHealthCheckInterval > 0 {
+		go s.sipPool.checkHealth(cfg.SIPHealthCheckInterval, checkSIPConn(cfg))
+	}
+	for branch := range cfg.BranchSIP {
+		if s.branchPools == nil {
+			s.branchPools = make(map[string]*pool)
+		}
+		bcfg := cfg.branchSIP(branch)
+		p := newPool(cfg.SIPMinConn, cfg.SIPMaxConn, cfg.SIPIdleTimeout, initSIPConn(bcfg))
+		p.breaker = newBreaker(bcfg.SIPServer, cfg.SIPBreakerThreshold, cfg.SIPBreakerCooldown)
+		p.calls = calls
+		if cfg.SIPHealthCheckInterval > 0 {
+			go p.checkHealth(cfg.SIPHealthCheckInterval, checkSIPConn(bcfg))
+		}
+		s.branchPools[branch] = p
+	}
+	return s
+}
+
+// sipPoolFor returns the pool of SIP connections of the given branch, or
+// the default pool if the branch has no SIP server of its own.
+func (s *settings) sipPoolFor(branch string) *pool {
+	if p, ok := s.branchPools[branch]; ok {
+		return p
+	}
+	return s.sipPool
+}
+
+// close drains the SIP connection pools: idle connections are closed, and
+// connections in use are closed when they are put back. Clients which
+// still have the settings can make SIP calls, without pooling.
+func (s *settings) close() {
+	if s.sipPool != nil {
+		s.sipPool.close()
+	}
+	for _, p := range s.branchPools {
+		p.close()
+	}
+}
+
+// settings returns the settings of new transactions. A hub which wasn't
+// made by newHub has the settings of its config, without SIP connections.
+func (h *Hub) settings() *settings {
+	if s, ok := h.current.Load().(*settings); ok {
+		return s
+	}
+	return &settings{config: h.config}
+}
+
+// Reload replaces the settings of new transactions with those of cfg, with
+// new SIP connection pools, and drains the old pools. Clients take the new
+// settings when they are idle, or between items; transactions in progress
+// finish on the old ones. The settings of websocket connections, ex the
+// auth token and the RFID-unit, take effect for new connections. Settings
+// which only take effect when the hub is started, ex the HTTP port, the
+// journal and the barcode rules, are not changed.
+func (h *Hub) Reload(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	warnClamped(h.log, cfg.clampDurations())
+	s := newSettings(cfg)
+	h.mu.Lock()
+	old, _ := h.current.Load().(*settings)
+	h.current.Store(s)
+	h.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	h.log.Info("config reloaded")
+	return nil
+}
+
+// config returns the Config of the client's transactions. It may be called
+// from any goroutine of the client.
+func (c *Client) config() *Config {
+	return &c.settings().config
+}
+
+// sipPoolFor returns the pool of SIP connections of the given branch, of
+// the client's settings.
+func (c *Client) sipPoolFor(branch string) *pool {
+	return c.settings().sipPoolFor(branch)
+}
+
+// settings returns the client's settings: those it was given when
+// connecting, or last took from the hub.
+func (c *Client) settings() *settings {
+	if s, ok := c.pinned.Load().(*settings); ok {
+		return s
+	}
+	return c.hub.settings()
+}
+
+// reloadSettings takes the hub's settings, if they have been reloaded. It
+// must only be called from Run, when idle or between items, so that a
+// session left open doesn't keep using drained SIP pools.
+func (c *Client) reloadSettings() {
+	s := c.hub.settings()
+	old, _ := c.pinned.Load().(*settings)
+	c.pinned.Store(s)
+	if old != nil && old != s {
+		c.log.Info("client took reloaded config")
+	}
+}
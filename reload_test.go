@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Verify that a reload of the config mid-session doesn't abort the
+// transaction in progress, which finishes on the old SIP server, and that
+// the next item, and the next session, use the new one.
+func TestReload(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan Message)
+	oldSIP := newSIPTestServer()
+	defer oldSIP.Close()
+	newSIP := newSIPTestServer()
+	defer newSIP.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	cfg := Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   oldSIP.Addr(),
+		SIPUser:     "autouser",
+		SIPPass:     "autopass",
+		SIPMaxConn:  1,
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	}
+	hub = newHub(cfg)
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT
+
+	checkin := func(tag string) Message {
+		t.Helper()
+		d.write([]byte("RDT" + tag + "|0\r"))
+		if msg := <-d.incoming; string(msg) != "OK1\r" {
+			t.Fatalf("RFID-unit got %q after reading %s; want alarm on", msg, tag)
+		}
+		d.write([]byte("OK\r"))
+		return <-uiChan
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	oldSIP.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad|\r")
+	newSIP.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad (new)|\r")
+	if got := checkin("1003010824124004:NO:02030000"); got.Item.Label != "Heavy metal in Baghdad" {
+		t.Fatalf("checkin before reload => %+v; want item from old SIP server", got)
+	}
+
+	// Reloaded mid-transaction: the item is checked in on the old SIP
+	// server, and the alarm turned on
+	old := hub.settings()
+	reloaded := cfg
+	reloaded.SIPServer = newSIP.Addr()
+	oldSIP.Respond("101YNN20140226    161239AO|AB03011063175001|AQfmaj|AJCat's cradle|\r")
+	d.write([]byte("RDT1003011063175001:NO:02030000|0\r"))
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want alarm on", msg)
+	}
+	if err := hub.Reload(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	d.write([]byte("OK\r"))
+	if got := <-uiChan; got.Item.Label != "Cat's cradle" || got.ErrorCode != "" {
+		t.Errorf("checkin in progress at reload => %+v; want item from old SIP server", got)
+	}
+	// The old pool is drained: its connections are closed when put back
+	if s := old.sipPool.stats(); s.Idle != 0 || s.InUse != 0 {
+		t.Errorf("old pool stats => %+v; want no connections kept", s)
+	}
+
+	// The next item of the session uses the new SIP server
+	newSIP.Respond("101YNN20140226    161239AO|AB03011143299001|AQfmaj|AJ316 salmer og sanger (new)|\r")
+	if got := checkin("1003011143299001:NO:02030000"); got.Item.Label != "316 salmer og sanger (new)" {
+		t.Errorf("checkin of next item after reload => %+v; want item from new SIP server", got)
+	}
+	newSIP.Respond("101YNN20140226    161239AO|AB03010824124004|AQfmaj|AJHeavy metal in Baghdad (new)|\r")
+
+	// The next session uses the new SIP server
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	<-d.incoming // END
+	d.write([]byte("OK\r"))
+	for !hub.idle() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websocket conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	if got := checkin("1003010824124004:NO:02030000"); got.Item.Label != "Heavy metal in Baghdad (new)" {
+		t.Errorf("checkin in session after reload => %+v; want item from new SIP server", got)
+	}
+
+	// An invalid config is refused, and the settings are kept
+	invalid := reloaded
+	invalid.SIPMaxConn = 0
+	if err := hub.Reload(invalid); err == nil {
+		t.Error("Reload with invalid config => nil; want error")
+	}
+	if hub.settings().config.SIPServer != newSIP.Addr() {
+		t.Error("settings changed by invalid reload")
+	}
+}
+
+// Verify that a reloaded auth token is required of new connections, and of
+// the HTTP endpoints, instead of the one the hub was started with.
+func TestReloadAuthToken(t *testing.T) {
+	cfg := Config{
+		HTTPPort:    "8899",
+		SIPServer:   "127.0.0.1:6001",
+		SIPUser:     "autouser",
+		SIPPass:     "autopass",
+		SIPMaxConn:  1,
+		RFIDPort:    "6005",
+		WSAuthToken: "s3cret",
+	}
+	h := newHub(cfg)
+	defer h.Close()
+
+	cfg.WSAuthToken = "n3w"
+	if err := h.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	serveWs(h, rec, httptest.NewRequest("GET", "/ws?token=s3cret", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GET /ws with the old token => %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeClients(rec, httptest.NewRequest("GET", "/clients?token=s3cret", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GET /clients with the old token => %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeClients(rec, httptest.NewRequest("GET", "/clients?token=n3w", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /clients with the reloaded token => %d; want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
@@ -21,6 +22,8 @@ const (
 	RFIDWaitForCheckinAlarmLeave
 	RFIDWaitForCheckoutAlarmOff
 	RFIDWaitForCheckoutAlarmLeave
+	RFIDWaitForCheckinPartLeave
+	RFIDWaitForCheckoutPartLeave
 	RFIDPreWriteStep1
 	RFIDPreWriteStep2
 	RFIDPreWriteStep3
@@ -30,12 +33,161 @@ const (
 	RFIDPreWriteStep7
 	RFIDPreWriteStep8
 	RFIDWriting
+	RFIDWaitForWriteVerify
 	RFIDWaitForTagCount
 	RFIDWaitForRetryAlarmOn
 	RFIDWaitForRetryAlarmOff
 	RFIDWaitForEndOK
+	RFIDItemInfoWaitForBegOK
+	RFIDItemInfo
+	RFIDItemInfoWaitForAlarmLeave
+	RFIDRenewWaitForBegOK
+	RFIDRenew
+	RFIDWaitForRenewAlarmLeave
+	RFIDWaitForCheckinSetInfo
+	RFIDWaitForCheckoutSetInfo
+	RFIDTestVersion
+	RFIDTestBeginScan
+	RFIDTestEndScan
+	RFIDTestAlarmOff
+	RFIDTestAlarmOn
+	RFIDWaitForCheckinRereadLeave
+	RFIDCheckinGrace
+	RFIDWaitForCheckinReread
+	RFIDWaitForCheckoutRereadLeave
+	RFIDWaitForTagIDs
+	RFIDWritingBlocks
+	RFIDWaitForBlocksVerify
+	RFIDInventoryWaitForBegOK
+	RFIDInventory
+	RFIDInventoryWaitForAlarmLeave
+	RFIDInventoryWaitForEndOK
+	RFIDExchangeWaitForBegOK
+	RFIDExchange
+	RFIDWaitForExchangeAlarm
+	RFIDWaitForExchangeAlarmLeave
+	RFIDWaitForExchangeRereadLeave
+	RFIDWaitForCheckoutEarlyAlarmOff
+	RFIDWaitForCheckoutResecure
+	RFIDWaitForCheckinTransitAlarmOff
+	RFIDWaitForPauseOK
+	RFIDPaused
+	RFIDWaitForResumeOK
+	RFIDManualAlarmWaitForBegOK
+	RFIDManualAlarm
+	RFIDWaitForManualAlarm
+	RFIDWaitForCheckinAlarmKept
+	RFIDWaitForCheckoutAlarmKept
+	RFIDWaitForExchangeAlarmKept
+	RFIDTestReadAFI
 )
 
+var rfidStateNames = [...]string{
+	"Idle",
+	"CheckinWaitForBegOK",
+	"Checkin",
+	"Checkout",
+	"CheckoutWaitForBegOK",
+	"WaitForCheckinAlarmOn",
+	"WaitForCheckinAlarmLeave",
+	"WaitForCheckoutAlarmOff",
+	"WaitForCheckoutAlarmLeave",
+	"WaitForCheckinPartLeave",
+	"WaitForCheckoutPartLeave",
+	"PreWriteStep1",
+	"PreWriteStep2",
+	"PreWriteStep3",
+	"PreWriteStep4",
+	"PreWriteStep5",
+	"PreWriteStep6",
+	"PreWriteStep7",
+	"PreWriteStep8",
+	"Writing",
+	"WaitForWriteVerify",
+	"WaitForTagCount",
+	"WaitForRetryAlarmOn",
+	"WaitForRetryAlarmOff",
+	"WaitForEndOK",
+	"ItemInfoWaitForBegOK",
+	"ItemInfo",
+	"ItemInfoWaitForAlarmLeave",
+	"RenewWaitForBegOK",
+	"Renew",
+	"WaitForRenewAlarmLeave",
+	"WaitForCheckinSetInfo",
+	"WaitForCheckoutSetInfo",
+	"TestVersion",
+	"TestBeginScan",
+	"TestEndScan",
+	"TestAlarmOff",
+	"TestAlarmOn",
+	"WaitForCheckinRereadLeave",
+	"CheckinGrace",
+	"WaitForCheckinReread",
+	"WaitForCheckoutRereadLeave",
+	"WaitForTagIDs",
+	"WritingBlocks",
+	"WaitForBlocksVerify",
+	"InventoryWaitForBegOK",
+	"Inventory",
+	"InventoryWaitForAlarmLeave",
+	"InventoryWaitForEndOK",
+	"ExchangeWaitForBegOK",
+	"Exchange",
+	"WaitForExchangeAlarm",
+	"WaitForExchangeAlarmLeave",
+	"WaitForExchangeRereadLeave",
+	"WaitForCheckoutEarlyAlarmOff",
+	"WaitForCheckoutResecure",
+	"WaitForCheckinTransitAlarmOff",
+	"WaitForPauseOK",
+	"Paused",
+	"WaitForResumeOK",
+	"ManualAlarmWaitForBegOK",
+	"ManualAlarm",
+	"WaitForManualAlarm",
+	"WaitForCheckinAlarmKept",
+	"WaitForCheckoutAlarmKept",
+	"WaitForExchangeAlarmKept",
+	"TestReadAFI",
+}
+
+func (s RFIDState) String() string {
+	if s < 0 || int(s) >= len(rfidStateNames) {
+		return "RFIDState(" + strconv.Itoa(int(s)) + ")"
+	}
+	return rfidStateNames[s]
+}
+
+// MarshalText encodes the state by its name, ex in GET /clients.
+func (s RFIDState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a state encoded by MarshalText.
+func (s *RFIDState) UnmarshalText(b []byte) error {
+	for i, name := range rfidStateNames {
+		if name == string(b) {
+			*s = RFIDState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown RFID state: %q", b)
+}
+
+// awaitsResponse reports whether the RFID-unit is expected to respond to a
+// command in the given state. While scanning, the RFID-unit is silent
+// until a tag is read, which may take any amount of time, and no command
+// is sent during the grace period of an incomplete set.
+func (s RFIDState) awaitsResponse() bool {
+	switch s {
+	case RFIDIdle, RFIDCheckin, RFIDCheckout, RFIDExchange, RFIDItemInfo, RFIDRenew, RFIDInventory, RFIDPaused, RFIDManualAlarm,
+		RFIDCheckinGrace:
+		return false
+	}
+	return true
+}
+
 type RFIDCommand int
 
 const (
@@ -51,10 +203,28 @@ const (
 	cmdTagCount
 	cmdWrite
 
+	// ISO 15693 AFI (Application Family Identifier) commands, as an
+	// alternative to the alarm commands. Data is the tag.
+	cmdSetAFISecure   // AFS<tag>|07   Set AFI to RFIDReq.AFI; reader returns OK or NOK.
+	cmdSetAFIUnsecure // AFS<tag>|C2   Set AFI to RFIDReq.AFI; reader returns OK or NOK.
+	cmdReadAFI        // AFR<tag>      Read AFI; reader returns AFI<tag>|07, or NOK.
+
+	// Read the part number of the tag, and the number of parts in its set,
+	// from the tag data. Data is the tag.
+	cmdReadSetInfo // SET<tag>  Reader returns SET<tag>|<part>|<parts>, ex SET<tag>|1|3, or NOK.
+
+	// Write and read the ISO 28560 data blocks of tags, when the hub
+	// encodes them, with Config.WriteTagBlocks. Data is the tag id. The
+	// blocks written are read back, or those of the basic block if none are
+	// given.
+	cmdReadIDs     // UID             Reader returns OK|<id>|<id>..., the ids of the tags on it, or NOK.
+	cmdWriteBlocks // WBL<id>|<hex>   Write RFIDReq.Blocks from block 0; reader returns OK or NOK.
+	cmdReadBlocks  // RBL<id>|<count> Read count blocks from block 0; reader returns BLK<id>|<hex>, or NOK.
+
 	// Initialize writer commands.
 	// SLP (Set Library Parameter) commands. Reader returns OK or NOK.
-	cmdSLPLBN // SLPLBN|02030000 (LBN: library number)
-	cmdSLPLBC // SLPLBC|NO       (LBC: library country code)
+	cmdSLPLBN // SLPLBN|02030000 (LBN: library number, RFIDReq.Data)
+	cmdSLPLBC // SLPLBC|NO       (LBC: library country code, RFIDReq.Data)
 	cmdSLPDTM // SLPDTM|DS24     (DTM: data model, "Danish Standard" / ISO28560−3)
 	cmdSLPSSB // SLPSSB|0        (SSB: set security bit when writing, 0: Reset, 1: Set)
 	cmdSLPCRD // SLPCRD|1        (CRD: check read after write: 0: No, 1: Yes)
@@ -67,9 +237,52 @@ const (
 	//cmdSLPESP // SLPESP|:        (ESP: extended ID separator: default character ’:’)
 )
 
+// RFIDProtocol is the protocol spoken by the RFID-units of a vendor. It
+// generates the requests for the commands, and parses the responses, which
+// end with FrameEnd. Implementations may keep track of the commands sent,
+// to parse the responses, until Reset.
+//
+// ParseResponse fails with an ignorable frameError on frames which are not
+// responses, ex status notifications, so that they are skipped.
+type RFIDProtocol interface {
+	GenRequest(RFIDReq) []byte
+	ParseResponse([]byte) (RFIDResp, error)
+	Reset()
+	FrameEnd() byte
+}
+
+const defaultRFIDVendor = "default"
+
+// rfidProtocols creates the supported protocols, keyed by Config.RFIDVendor.
+var rfidProtocols = map[string]func() RFIDProtocol{
+	defaultRFIDVendor: func() RFIDProtocol { return newRFIDManager() },
+}
+
+// validRFIDVendor returns an error if the given vendor is not supported.
+func validRFIDVendor(vendor string) error {
+	if _, ok := rfidProtocols[vendor]; !ok && vendor != "" {
+		return fmt.Errorf("unknown RFID vendor: %q", vendor)
+	}
+	return nil
+}
+
+// newRFIDProtocol returns the protocol of the given vendor, or of the
+// default vendor if none is given. The vendor is checked by Config.validate.
+func newRFIDProtocol(vendor string) RFIDProtocol {
+	if vendor == "" {
+		vendor = defaultRFIDVendor
+	}
+	return rfidProtocols[vendor]()
+}
+
+// RFIDManager implements the protocol of the default vendor. Commands and
+// responses are text, terminated by \r.
 type RFIDManager struct {
-	buf       bytes.Buffer
-	WriteMode bool
+	buf         bytes.Buffer
+	WriteMode   bool
+	VersionMode bool // Expecting the response to the version command
+	IDsMode     bool // Expecting the response to cmdReadIDs
+	RereadMode  bool // Expecting the response to cmdRereadTag
 }
 
 func newRFIDManager() *RFIDManager {
@@ -78,12 +291,21 @@ func newRFIDManager() *RFIDManager {
 
 func (v *RFIDManager) Reset() {
 	v.WriteMode = false
+	v.VersionMode = false
+	v.IDsMode = false
+	v.RereadMode = false
 }
 
+// FrameEnd returns the byte ending a response.
+func (v *RFIDManager) FrameEnd() byte { return '\r' }
+
 // GenRequest genereates a RFID request.
 func (v *RFIDManager) GenRequest(r RFIDReq) []byte {
+	v.RereadMode = r.Cmd == cmdRereadTag
+	v.IDsMode = r.Cmd == cmdReadIDs
 	switch r.Cmd {
 	case cmdInitVersion:
+		v.VersionMode = true
 		return []byte("VER2.00\r")
 	case cmdBeginScan:
 		return []byte("BEG\r")
@@ -124,10 +346,40 @@ func (v *RFIDManager) GenRequest(r RFIDReq) []byte {
 		// 1: single tag only
 		v.buf.Write([]byte("|0\r"))
 		return v.buf.Bytes()
+	case cmdSetAFISecure, cmdSetAFIUnsecure:
+		v.buf.Reset()
+		fmt.Fprintf(&v.buf, "AFS%s|%02X\r", r.Data, r.AFI)
+		return v.buf.Bytes()
+	case cmdReadAFI:
+		v.buf.Reset()
+		fmt.Fprintf(&v.buf, "AFR%s\r", r.Data)
+		return v.buf.Bytes()
+	case cmdReadSetInfo:
+		v.buf.Reset()
+		fmt.Fprintf(&v.buf, "SET%s\r", r.Data)
+		return v.buf.Bytes()
+	case cmdReadIDs:
+		return []byte("UID\r")
+	case cmdWriteBlocks:
+		v.buf.Reset()
+		fmt.Fprintf(&v.buf, "WBL%s|%X\r", r.Data, r.Blocks)
+		return v.buf.Bytes()
+	case cmdReadBlocks:
+		v.buf.Reset()
+		n := len(r.Blocks) / tagBlockSize
+		if n == 0 {
+			n = tagBlocks
+		}
+		fmt.Fprintf(&v.buf, "RBL%s|%d\r", r.Data, n)
+		return v.buf.Bytes()
 	case cmdSLPLBN:
-		return []byte("SLPLBN|02030000\r")
+		v.buf.Reset()
+		fmt.Fprintf(&v.buf, "SLPLBN|%s\r", r.Data)
+		return v.buf.Bytes()
 	case cmdSLPLBC:
-		return []byte("SLPLBC|NO\r")
+		v.buf.Reset()
+		fmt.Fprintf(&v.buf, "SLPLBC|%s\r", r.Data)
+		return v.buf.Bytes()
 	case cmdSLPDTM:
 		return []byte("SLPDTM|DS24\r")
 	case cmdSLPSSB:
@@ -158,18 +410,33 @@ func (v *RFIDManager) ParseResponse(r []byte) (RFIDResp, error) {
 		}
 	case l == 3:
 		if s == "NOK" {
+			if v.RereadMode {
+				// The tag was removed before it could be read again.
+				return RFIDResp{OK: false, ReadStatus: readNoTag}, nil
+			}
 			return RFIDResp{OK: false}, nil
 		}
+		if s == "RDE" {
+			return RFIDResp{OK: false, ReadStatus: readError}, nil
+		}
 	case l > 3:
 		if s[0:2] == "OK" {
 			b := strings.Split(s, "|")
 			if len(b) <= 1 {
 				break
 			}
+			if v.VersionMode {
+				// Ex: OK|RFID-U 2.03.18
+				return RFIDResp{OK: true, Version: strings.Join(b[1:], "|")}, nil
+			}
 			if v.WriteMode {
 				// Ex: OK|E004010046A847AD|E004010046A847AD
 				return RFIDResp{OK: true, WrittenIDs: b[1:]}, nil
 			}
+			if v.IDsMode {
+				// Ex: OK|E004010046A847AD|E004010046A847AE
+				return RFIDResp{OK: true, TagIDs: b[1:]}, nil
+			}
 			// Ex: OK|2
 			i, err := strconv.Atoi(b[1])
 			if err != nil {
@@ -178,8 +445,13 @@ func (v *RFIDManager) ParseResponse(r []byte) (RFIDResp, error) {
 			return RFIDResp{OK: true, TagCount: i}, nil
 		}
 		if s[0:3] == "RDT" {
+			// Ex: RDT1003010856677001:NO:02030000|0, or with the signal
+			// strength of the tag, by RFID-units reporting it:
+			// RDT1003010856677001:NO:02030000|0|-52, and with the UID of
+			// the tag, with or without the signal strength:
+			// RDT1003010856677001:NO:02030000|0||E004010046A847AD
 			b := strings.Split(s[3:l], "|")
-			if len(b) <= 1 {
+			if len(b) <= 1 || len(b) > 4 {
 				break
 			}
 			var ok bool
@@ -189,8 +461,67 @@ func (v *RFIDManager) ParseResponse(r []byte) (RFIDResp, error) {
 			if b[1] != "0" && b[1] != "1" {
 				break
 			}
+			var rssi *int
+			if len(b) >= 3 && (b[2] != "" || len(b) == 3) {
+				i, err := strconv.Atoi(b[2])
+				if err != nil {
+					break
+				}
+				rssi = &i
+			}
+			var uid string
+			if len(b) == 4 {
+				if uid = b[3]; uid == "" {
+					break
+				}
+			}
 			t := strings.Split(b[0], ":")
-			return RFIDResp{OK: ok, Tag: b[0], Barcode: t[0]}, nil
+			return RFIDResp{OK: ok, Tag: b[0], Barcode: t[0], TagID: uid, RSSI: rssi}, nil
+		}
+		if s[0:3] == "RDE" {
+			// A tag was detected, but its data failed the CRC check, ex
+			// because it lies badly on the RFID-unit. Ex: RDEE004010046A847AD
+			return RFIDResp{OK: false, TagID: s[3:l], ReadStatus: readError}, nil
+		}
+		if s[0:3] == "AFI" {
+			// Ex: AFI1003010856677001:NO:02030000|07
+			b := strings.Split(s[3:l], "|")
+			if len(b) != 2 || len(b[1]) != 2 {
+				break
+			}
+			afi, err := strconv.ParseUint(b[1], 16, 8)
+			if err != nil {
+				break
+			}
+			return RFIDResp{OK: true, Tag: b[0], AFI: byte(afi), AFIRead: true}, nil
+		}
+		if s[0:3] == "SET" {
+			// Ex: SET1003010856677001:NO:02030000|1|3
+			b := strings.Split(s[3:l], "|")
+			if len(b) != 3 {
+				break
+			}
+			part, err := strconv.Atoi(b[1])
+			if err != nil {
+				break
+			}
+			parts, err := strconv.Atoi(b[2])
+			if err != nil || part < 1 || part > parts {
+				break
+			}
+			return RFIDResp{OK: true, Tag: b[0], Part: part, SetSize: parts}, nil
+		}
+		if s[0:3] == "BLK" {
+			// Ex: BLKE004010046A847AD|11010130333031...
+			b := strings.Split(s[3:l], "|")
+			if len(b) != 2 || b[0] == "" {
+				break
+			}
+			blocks, err := hex.DecodeString(b[1])
+			if err != nil || len(blocks) == 0 || len(blocks)%tagBlockSize != 0 {
+				break
+			}
+			return RFIDResp{OK: true, TagID: b[0], Blocks: blocks}, nil
 		}
 		if s[0:3] == "NOK" {
 			b := strings.Split(s[3:l], "|")
@@ -206,21 +537,98 @@ func (v *RFIDManager) ParseResponse(r []byte) (RFIDResp, error) {
 	}
 
 	// Fall-through case:
-	return RFIDResp{}, fmt.Errorf("cannot parse RFID response: %q", r)
+	return RFIDResp{}, frameError{frame: r, ignorable: unknownFrame(s)}
+}
+
+// rfidFramePrefixes are the prefixes of the responses of the default
+// vendor.
+var rfidFramePrefixes = []string{"OK", "NOK", "RDT", "RDE", "AFI", "SET", "BLK"}
+
+// unknownFrame reports whether s is a well-formed frame which is not a
+// response, ex a status notification sent unsolicited by the RFID-unit.
+func unknownFrame(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	for _, p := range rfidFramePrefixes {
+		if strings.HasPrefix(s, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// frameError is the error of a frame from the RFID-unit which cannot be
+// parsed.
+type frameError struct {
+	frame     []byte
+	ignorable bool // The frame is not a response, and can be skipped; otherwise it is a malformed response
+}
+
+func (e frameError) Error() string {
+	if e.ignorable {
+		return fmt.Sprintf("unknown RFID frame: %q", e.frame)
+	}
+	return fmt.Sprintf("cannot parse RFID response: %q", e.frame)
+}
+
+// ignorableFrame reports whether err is the error of a frame which is not
+// a response, and can be skipped.
+func ignorableFrame(err error) bool {
+	fe, ok := err.(frameError)
+	return ok && fe.ignorable
 }
 
 // RFIDReq represents request to be sent to the RFID-unit.
 type RFIDReq struct {
 	Cmd      RFIDCommand
 	Data     []byte
+	UID      string // UID of the tag addressed by Data, if known, for protocols addressing tags by UID
 	TagCount int
+	AFI      byte   // AFI to set with cmdSetAFISecure/cmdSetAFIUnsecure
+	Blocks   []byte // Data blocks to write with cmdWriteBlocks, and whose number is read back with cmdReadBlocks
 }
 
 // RFIDResp represents a parsed response from the RFID-unit.
 type RFIDResp struct {
 	OK         bool
 	TagCount   int
-	Tag        string // 1003010530352001:NO:02030000
-	Barcode    string // 1003010530352001
+	Tag        string // Data of the tag, ex 1003010530352001:NO:02030000
+	Barcode    string // Barcode encoded in the tag data, ex 1003010530352001
 	WrittenIDs []string
+	AFI        byte // AFI read from tag, if AFIRead
+	AFIRead    bool
+	Version    string   // Firmware version, in response to the version command
+	Part       int      // Part number of the tag in its set, in response to cmdReadSetInfo
+	SetSize    int      // Number of parts in the set, in response to cmdReadSetInfo
+	TagIDs     []string // Ids of the tags on the reader, in response to cmdReadIDs
+	TagID      string   // UID (chip serial) of the tag read, if reported, whose Blocks were read, or which couldn't be read
+	Blocks     []byte   // Data blocks read, in response to cmdReadBlocks
+	RSSI       *int     // Signal strength of the tag read, in dBm, if the RFID-unit reports it
+	ReadStatus ReadStatus
+}
+
+// ReadStatus tells whether a tag was read. The RFID-unit tells a tag which
+// is missing from one it detects, but cannot read.
+type ReadStatus int
+
+const (
+	readOK    ReadStatus = iota // The tag was read, or the response is not of a tag read
+	readNoTag                   // No tag was detected, in response to cmdRereadTag
+	readError                   // A tag was detected, but its data couldn't be read
+)
+
+// tagRead reports whether r is a tag read while scanning, which the
+// RFID-unit sends unsolicited, or in response to cmdRereadTag. A tag which
+// couldn't be read is a tag read too, without the tag data.
+func (r RFIDResp) tagRead() bool {
+	if r.ReadStatus == readError {
+		return true
+	}
+	return r.Tag != "" && !r.AFIRead && r.SetSize == 0
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -19,14 +22,22 @@ func TestGenerateRFIDRequest(t *testing.T) {
 		{RFIDReq{Cmd: cmdAlarmLeave}, "OK \r"},
 		{RFIDReq{Cmd: cmdTagCount}, "TGC\r"},
 		{RFIDReq{Cmd: cmdWrite, Data: []byte("1003010650438004"), TagCount: 2}, "WRT1003010650438004|2|0\r"},
-		{RFIDReq{Cmd: cmdSLPLBN}, "SLPLBN|02030000\r"},
-		{RFIDReq{Cmd: cmdSLPLBC}, "SLPLBC|NO\r"},
+		{RFIDReq{Cmd: cmdSLPLBN, Data: []byte("02030000")}, "SLPLBN|02030000\r"},
+		{RFIDReq{Cmd: cmdSLPLBC, Data: []byte("NO")}, "SLPLBC|NO\r"},
 		{RFIDReq{Cmd: cmdSLPDTM}, "SLPDTM|DS24\r"},
 		{RFIDReq{Cmd: cmdSLPSSB}, "SLPSSB|0\r"},
 		{RFIDReq{Cmd: cmdSLPCRD}, "SLPCRD|1\r"},
 		{RFIDReq{Cmd: cmdSLPWTM}, "SLPWTM|5000\r"},
 		{RFIDReq{Cmd: cmdSLPRSS}, "SLPRSS|1\r"},
 		{RFIDReq{Cmd: cmdRetryAlarmOn, Data: []byte("1003010824124004:NO:02030000")}, "ACT1003010824124004:NO:02030000\r"},
+		{RFIDReq{Cmd: cmdSetAFISecure, Data: []byte("1003010824124004:NO:02030000"), AFI: 0x07}, "AFS1003010824124004:NO:02030000|07\r"},
+		{RFIDReq{Cmd: cmdSetAFIUnsecure, Data: []byte("1003010824124004:NO:02030000"), AFI: 0xC2}, "AFS1003010824124004:NO:02030000|C2\r"},
+		{RFIDReq{Cmd: cmdReadAFI, Data: []byte("1003010824124004:NO:02030000")}, "AFR1003010824124004:NO:02030000\r"},
+		{RFIDReq{Cmd: cmdReadSetInfo, Data: []byte("1003010824124004:NO:02030000")}, "SET1003010824124004:NO:02030000\r"},
+		{RFIDReq{Cmd: cmdReadIDs}, "UID\r"},
+		{RFIDReq{Cmd: cmdWriteBlocks, Data: []byte("E004010046A847AD"), Blocks: []byte{0x11, 0x02, 0x01, 0x30}}, "WBLE004010046A847AD|11020130\r"},
+		{RFIDReq{Cmd: cmdReadBlocks, Data: []byte("E004010046A847AD")}, "RBLE004010046A847AD|9\r"},
+		{RFIDReq{Cmd: cmdReadBlocks, Data: []byte("E004010046A847AD"), Blocks: make([]byte, 28*4)}, "RBLE004010046A847AD|28\r"},
 	}
 
 	rfid := newRFIDManager()
@@ -54,6 +65,17 @@ func TestParseResponse(t *testing.T) {
 			RFIDResp{OK: true, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000"}},
 		{"RDT1003010856677001:NO:02030000|1\r",
 			RFIDResp{OK: false, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000"}},
+		{"AFI1003010856677001:NO:02030000|C2\r",
+			RFIDResp{OK: true, Tag: "1003010856677001:NO:02030000", AFI: 0xC2, AFIRead: true}},
+		// Part and set size: single part, 1 of 3 and 3 of 3
+		{"SET1003010856677001:NO:02030000|1|1\r",
+			RFIDResp{OK: true, Tag: "1003010856677001:NO:02030000", Part: 1, SetSize: 1}},
+		{"SET1003010856677001:NO:02030000|1|3\r",
+			RFIDResp{OK: true, Tag: "1003010856677001:NO:02030000", Part: 1, SetSize: 3}},
+		{"SET1003010856677001:NO:02030000|3|3\r",
+			RFIDResp{OK: true, Tag: "1003010856677001:NO:02030000", Part: 3, SetSize: 3}},
+		{"BLKE004010046A847AD|1102013030333031\r",
+			RFIDResp{OK: true, TagID: "E004010046A847AD", Blocks: []byte{0x11, 0x02, 0x01, 0x30, 0x30, 0x33, 0x30, 0x31}}},
 	}
 
 	rfid := newRFIDManager()
@@ -68,7 +90,9 @@ func TestParseResponse(t *testing.T) {
 		}
 	}
 
-	var errTests = []string{"KOK|\r", "OKI\r", "OK|Z\r"}
+	var errTests = []string{"KOK|\r", "OKI\r", "OK|Z\r", "AFI1003010856677001|XY\r", "AFI1003010856677001\r",
+		"SET1003010856677001|1\r", "SET1003010856677001|4|3\r", "SET1003010856677001|0|3\r", "SET1003010856677001|a|3\r",
+		"BLKE004010046A847AD|110201\r", "BLKE004010046A847AD|1102013G\r", "BLK|11020130\r"}
 
 	for _, tt := range errTests {
 		r, err := rfid.ParseResponse([]byte(tt))
@@ -105,4 +129,230 @@ func TestParseResponse(t *testing.T) {
 			t.Errorf("ParseResponse(%q) => %+v; want an error", tt, r)
 		}
 	}
+
+	rfid.Reset()
+	rfid.GenRequest(RFIDReq{Cmd: cmdReadIDs})
+	in := "OK|E004010046A847AD|E004010046A847AE\r"
+	want := RFIDResp{OK: true, TagIDs: []string{"E004010046A847AD", "E004010046A847AE"}}
+	if r, err := rfid.ParseResponse([]byte(in)); err != nil || !reflect.DeepEqual(r, want) {
+		t.Errorf("ParseResponse(%q) => %+v, %v; want %+v", in, r, err, want)
+	}
+
+	// The UIDs are only expected in response to cmdReadIDs.
+	rfid.GenRequest(RFIDReq{Cmd: cmdTagCount})
+	in = "OK|2\r"
+	want = RFIDResp{OK: true, TagCount: 2}
+	if r, err := rfid.ParseResponse([]byte(in)); err != nil || !reflect.DeepEqual(r, want) {
+		t.Errorf("ParseResponse(%q) after UID => %+v, %v; want %+v", in, r, err, want)
+	}
+}
+
+func TestParseUnknownFrame(t *testing.T) {
+	var tests = []struct {
+		in        string
+		ignorable bool
+	}{
+		{"STA|READY\r", true},            // Status notification
+		{"KOK|\r", true},                 // Not a response
+		{"OKI\r", false},                 // Malformed response
+		{"RDT1003010856677001\r", false}, // Malformed tag read
+		{"\x01\xfeRDT\x00\r", false},     // Corrupt
+		{"\r", false},
+	}
+
+	rfid := newRFIDManager()
+
+	for _, tt := range tests {
+		r, err := rfid.ParseResponse([]byte(tt.in))
+		if err == nil {
+			t.Errorf("ParseResponse(%q) => %+v; want an error", tt.in, r)
+			continue
+		}
+		if got := ignorableFrame(err); got != tt.ignorable {
+			t.Errorf("ignorableFrame(ParseResponse(%q)) => %v; want %v", tt.in, got, tt.ignorable)
+		}
+	}
+}
+
+func TestParseTagSignal(t *testing.T) {
+	rssi := func(i int) *int { return &i }
+	var tests = []struct {
+		in  string
+		out RFIDResp
+	}{
+		// Without the signal strength, it is left absent
+		{"RDT1003010856677001:NO:02030000|0\r",
+			RFIDResp{OK: true, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000"}},
+		{"RDT1003010856677001:NO:02030000|0|-52\r",
+			RFIDResp{OK: true, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000", RSSI: rssi(-52)}},
+		{"RDT1003010856677001:NO:02030000|1|-81\r",
+			RFIDResp{OK: false, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000", RSSI: rssi(-81)}},
+	}
+
+	rfid := newRFIDManager()
+
+	for _, tt := range tests {
+		r, err := rfid.ParseResponse([]byte(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, tt.out) {
+			t.Errorf("ParseResponse(%q) => %+v; want %+v", tt.in, r, tt.out)
+		}
+	}
+
+	for _, tt := range []string{"RDT1003010856677001:NO:02030000|0|\r", "RDT1003010856677001:NO:02030000|0|weak\r",
+		"RDT1003010856677001:NO:02030000|0|-52|\r", "RDT1003010856677001:NO:02030000|0|-52|E004010046A847AD|1\r"} {
+		r, err := rfid.ParseResponse([]byte(tt))
+		if err == nil {
+			t.Errorf("ParseResponse(%q) => %+v; want an error", tt, r)
+		}
+	}
+
+	// Koha gets the signal strength only if reported
+	for _, tt := range []struct {
+		item Item
+		want string
+	}{
+		{Item{Barcode: "1003010856677001"}, ""},
+		{Item{Barcode: "1003010856677001", RSSI: rssi(-52)}, `"RSSI":-52`},
+	} {
+		b, err := json.Marshal(tt.item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(string(b), `"RSSI"`); got != (tt.want != "") || !strings.Contains(string(b), tt.want) {
+			t.Errorf("json.Marshal(%+v) => %s; want %q", tt.item, b, tt.want)
+		}
+	}
+}
+
+// Verify that a tag which is read, missing, or detected but unreadable are
+// told apart.
+func TestParseReadStatus(t *testing.T) {
+	var tests = []struct {
+		cmd RFIDCommand // Command the response is to, if any
+		in  string
+		out RFIDResp
+	}{
+		{cmdBeginScan, "RDT1003010856677001:NO:02030000|0\r",
+			RFIDResp{OK: true, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000", ReadStatus: readOK}},
+		{cmdRereadTag, "RDT1003010856677001:NO:02030000|0\r",
+			RFIDResp{OK: true, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000", ReadStatus: readOK}},
+		{cmdRereadTag, "NOK\r", RFIDResp{OK: false, ReadStatus: readNoTag}},
+		{cmdAlarmOn, "NOK\r", RFIDResp{OK: false, ReadStatus: readOK}},
+		{cmdBeginScan, "RDE\r", RFIDResp{OK: false, ReadStatus: readError}},
+		{cmdBeginScan, "RDEE004010046A847AD\r", RFIDResp{OK: false, TagID: "E004010046A847AD", ReadStatus: readError}},
+	}
+
+	for _, tt := range tests {
+		rfid := newRFIDManager()
+		rfid.GenRequest(RFIDReq{Cmd: tt.cmd})
+		r, err := rfid.ParseResponse([]byte(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, tt.out) {
+			t.Errorf("ParseResponse(%q) after %v => %+v; want %+v", tt.in, tt.cmd, r, tt.out)
+		}
+		if got, want := r.tagRead(), r.ReadStatus != readNoTag && tt.cmd != cmdAlarmOn; got != want {
+			t.Errorf("ParseResponse(%q).tagRead() => %v; want %v", tt.in, got, want)
+		}
+	}
+}
+
+// Verify that the UID of a tag, its hardware id, is told apart from the
+// barcode encoded in its data.
+func TestParseTagUID(t *testing.T) {
+	rssi := -52
+	var tests = []struct {
+		in  string
+		out RFIDResp
+	}{
+		{"RDT1003010856677001:NO:02030000|0\r",
+			RFIDResp{OK: true, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000"}},
+		{"RDT1003010856677001:NO:02030000|0||E004010046A847AD\r",
+			RFIDResp{OK: true, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000", TagID: "E004010046A847AD"}},
+		{"RDT1003010856677001:NO:02030000|1|-52|E004010046A847AD\r",
+			RFIDResp{OK: false, Barcode: "1003010856677001", Tag: "1003010856677001:NO:02030000", TagID: "E004010046A847AD", RSSI: &rssi}},
+		// The same tag encoded again keeps its UID
+		{"RDT1003011063175001:NO:02030000|0||E004010046A847AD\r",
+			RFIDResp{OK: true, Barcode: "1003011063175001", Tag: "1003011063175001:NO:02030000", TagID: "E004010046A847AD"}},
+	}
+
+	rfid := newRFIDManager()
+
+	for _, tt := range tests {
+		r, err := rfid.ParseResponse([]byte(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, tt.out) {
+			t.Errorf("ParseResponse(%q) => %+v; want %+v", tt.in, r, tt.out)
+		}
+	}
+}
+
+func TestParseVersionResponse(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out RFIDResp
+	}{
+		{"OK\r", RFIDResp{OK: true}},
+		{"OK|RFID-U 2.03.18\r", RFIDResp{OK: true, Version: "RFID-U 2.03.18"}},
+		{"OK|2.03|build 1187\r", RFIDResp{OK: true, Version: "2.03|build 1187"}},
+		{"NOK\r", RFIDResp{OK: false}},
+	}
+
+	for _, tt := range tests {
+		rfid := newRFIDManager()
+		rfid.GenRequest(RFIDReq{Cmd: cmdInitVersion})
+		r, err := rfid.ParseResponse([]byte(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, tt.out) {
+			t.Errorf("ParseResponse(%q) => %+v; want %+v", tt.in, r, tt.out)
+		}
+	}
+}
+
+func TestNewRFIDProtocol(t *testing.T) {
+	for _, vendor := range []string{"", "default"} {
+		if err := validRFIDVendor(vendor); err != nil {
+			t.Fatalf("validRFIDVendor(%q) => %v", vendor, err)
+		}
+		p := newRFIDProtocol(vendor)
+		if _, ok := p.(*RFIDManager); !ok {
+			t.Errorf("newRFIDProtocol(%q) => %T; want *RFIDManager", vendor, p)
+		}
+	}
+	if err := validRFIDVendor("acme"); err == nil {
+		t.Error("validRFIDVendor(\"acme\") => nil; want error")
+	}
+
+	// Each client gets its own protocol, with its own state.
+	a := newRFIDProtocol("")
+	b := newRFIDProtocol("")
+	a.GenRequest(RFIDReq{Cmd: cmdWrite, Data: []byte("1234"), TagCount: 1})
+	if resp, err := b.ParseResponse([]byte("OK|2\r")); err != nil || resp.TagCount != 2 {
+		t.Errorf("ParseResponse() => %+v, %v; want TagCount 2", resp, err)
+	}
+}
+
+func TestRFIDStateText(t *testing.T) {
+	if got := RFIDWaitForManualAlarm.String(); got != "WaitForManualAlarm" {
+		t.Errorf("RFIDWaitForManualAlarm.String() => %q; want every state named", got)
+	}
+	b, err := json.Marshal(ClientStatus{State: RFIDCheckin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"State":"Checkin"`)) {
+		t.Errorf("json.Marshal(ClientStatus) => %s; want state by name", b)
+	}
+	var got ClientStatus
+	if err := json.Unmarshal(b, &got); err != nil || got.State != RFIDCheckin {
+		t.Errorf("json.Unmarshal(%s) => %v, %v; want %v", b, got.State, err, RFIDCheckin)
+	}
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/knakk/sip"
+)
+
+// Conditions detected in SIP responses, for which the screen message of the
+// SIP server can be replaced by a configured message.
+const (
+	screenItemUnknown    = "item-unknown"    // Item is not known by the SIP server
+	screenItemBlocked    = "item-blocked"    // Item must be handled manually
+	screenCheckinFailed  = "checkin-failed"  // SIP server refused the checkin
+	screenCheckoutFailed = "checkout-failed" // SIP server refused the checkout
+	screenRenewFailed    = "renew-failed"    // SIP server refused the renewal
+	screenPatronInvalid  = "patron-invalid"  // Patron is not valid
+	screenPatronPIN      = "patron-pin"      // Patron PIN is wrong
+	screenPatronBlocked  = "patron-blocked"  // Patron is denied charge privileges
+)
+
+var screenConditions = map[string]bool{
+	screenItemUnknown:    true,
+	screenItemBlocked:    true,
+	screenCheckinFailed:  true,
+	screenCheckoutFailed: true,
+	screenRenewFailed:    true,
+	screenPatronInvalid:  true,
+	screenPatronPIN:      true,
+	screenPatronBlocked:  true,
+}
+
+// validateScreenMessages checks that the screen messages are keyed by
+// known conditions.
+func validateScreenMessages(msgs map[string]string) error {
+	for cond := range msgs {
+		if !screenConditions[cond] {
+			return fmt.Errorf("unknown screen message condition %q", cond)
+		}
+	}
+	return nil
+}
+
+// screenMessage returns the configured screen message of the condition at
+// the given branch, and whether there is one.
+func (c Config) screenMessage(branch, condition string) (string, bool) {
+	if s, ok := c.BranchScreenMessages[branch][condition]; ok {
+		return s, true
+	}
+	s, ok := c.ScreenMessages[condition]
+	return s, ok
+}
+
+// localized returns a parser which replaces the screen message of the
+// responses parsed by parser with the configured screen message of their
+// condition at the given branch. The screen message of the SIP server is
+// kept when no message is configured.
+func (c Config) localized(branch string, parser parserFunc) parserFunc {
+	if c.ScreenMessages == nil && c.BranchScreenMessages == nil {
+		return parser
+	}
+	return func(msg sip.Message) Message {
+		res := parser(msg)
+		if res.condition == "" {
+			return res
+		}
+		tmpl, ok := c.screenMessage(branch, res.condition)
+		if !ok {
+			return res
+		}
+		text := &res.Item.Status
+		if res.PatronError {
+			text = &res.ErrorMessage
+		}
+		*text = strings.NewReplacer(
+			"{message}", msg.Field(sip.FieldScreenMessage),
+			"{barcode}", res.Item.Barcode,
+			"{title}", res.Item.Label,
+		).Replace(tmpl)
+		return res
+	}
+}
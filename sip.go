@@ -1,17 +1,109 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/knakk/sip"
 )
 
+var (
+	errSIPLoginFailed   = errors.New("SIP login failed")
+	errSIPLoginRequired = errors.New("SIP login required")
+	errSIPChecksum      = errors.New("SIP response checksum mismatch")
+	errSIPSequence      = errors.New("SIP response sequence number mismatch")
+	errSIPTimeout       = errors.New("SIP server didn't respond in time")
+	errSIPDelimiter     = errors.New("SIP field data contains the field delimiter or message terminator")
+)
+
+// The field delimiter and message terminator of SIP messages, as encoded
+// and decoded by package sip.
+const (
+	sipDelimiter  = '|'
+	sipTerminator = '\r'
+)
+
+// sipSeq is the sequence number of the last SIP request sent.
+var sipSeq uint32
+
+// encodeSIPMsg encodes a SIP request, with the field delimiter and message
+// terminator of cfg. If error detection is enabled, a sequence number (AY)
+// and checksum (AZ) are appended, and the sequence number is returned for
+// validation of the response. It fails with errSIPDelimiter if field data
+// contains the delimiter or terminator.
+func encodeSIPMsg(cfg Config, msg sip.Message) ([]byte, int, error) {
+	var b bytes.Buffer
+	msg.Encode(&b)
+	req := bytes.TrimSuffix(b.Bytes(), []byte{sipTerminator})
+	delim, term := cfg.sipDelimiter(), cfg.sipTerminator()
+	if delim != sipDelimiter || term != sipTerminator {
+		if bytes.IndexByte(req, term) != -1 || (delim != sipDelimiter && bytes.IndexByte(req, delim) != -1) {
+			return nil, 0, errSIPDelimiter
+		}
+		req = bytes.Replace(req, []byte{sipDelimiter}, []byte{delim}, -1)
+	}
+	if !cfg.SIPErrorDetection {
+		return append(req, term), 0, nil
+	}
+	seq := int(atomic.AddUint32(&sipSeq, 1) % 10)
+	req = append(req, fmt.Sprintf("AY%dAZ", seq)...)
+	req = append(req, sipChecksum(req)...)
+	return append(req, term), seq, nil
+}
+
+// decodeSIPResp translates a SIP response with the field delimiter and
+// message terminator of cfg to the ones of package sip. It fails with
+// errSIPDelimiter if field data contains the delimiter of package sip,
+// which would split the field.
+func decodeSIPResp(cfg Config, resp []byte) ([]byte, error) {
+	delim, term := cfg.sipDelimiter(), cfg.sipTerminator()
+	if delim == sipDelimiter && term == sipTerminator {
+		return resp, nil
+	}
+	b := bytes.TrimSuffix(resp, []byte{term})
+	if delim != sipDelimiter {
+		if bytes.IndexByte(b, sipDelimiter) != -1 {
+			return nil, errSIPDelimiter
+		}
+		b = bytes.Replace(b, []byte{delim}, []byte{sipDelimiter}, -1)
+	}
+	return append(b, sipTerminator), nil
+}
+
+// sipChecksum computes the checksum of a SIP message, up to and including
+// the AZ field identifier: the two's complement of the sum of all bytes, as
+// four hexadecimal digits.
+func sipChecksum(b []byte) string {
+	var sum uint16
+	for _, c := range b {
+		sum += uint16(c)
+	}
+	return fmt.Sprintf("%04X", -sum)
+}
+
+// validateSIPResp checks the checksum of a SIP response, and that its
+// sequence number echoes the one of the request.
+func validateSIPResp(resp []byte, seq int) error {
+	b := bytes.TrimRight(resp, "\r\n")
+	i := bytes.LastIndex(b, []byte("AZ"))
+	if i == -1 || len(b)-i != 6 || sipChecksum(b[:i+2]) != string(b[i+2:]) {
+		return errSIPChecksum
+	}
+	j := bytes.LastIndex(b[:i], []byte("AY"))
+	if j == -1 || string(b[j+2:i]) != strconv.Itoa(seq) {
+		return errSIPSequence
+	}
+	return nil
+}
+
 func sipFormMsgLogin(user, pass, dept string) sip.Message {
 	return sip.NewMessage(sip.MsgReqLogin).AddField(
 		sip.Field{Type: sip.FieldUIDAlgorithm, Value: "0"},
@@ -36,9 +128,35 @@ func sipFormMsgCheckin(dept, barcode string) sip.Message {
 }
 
 func sipFormMsgCheckout(dept, username, barcode string) sip.Message {
-	now := time.Now().Format(sip.DateLayout)
+	return sipFormMsgCheckoutAt(dept, username, barcode, false, time.Now())
+}
+
+// sipFormMsgCheckoutAt forms a checkout request of a checkout made at the
+// given time. With noBlock, the SIP server must accept the checkout, even if
+// it would otherwise be blocked, as it was made in offline mode, and is
+// reconciled by the server later.
+func sipFormMsgCheckoutAt(dept, username, barcode string, noBlock bool, at time.Time) sip.Message {
+	nb := "N"
+	if noBlock {
+		nb = "Y"
+	}
+	date := at.Format(sip.DateLayout)
 	return sip.NewMessage(sip.MsgReqCheckout).AddField(
 		sip.Field{Type: sip.FieldRenewalPolicy, Value: "Y"},
+		sip.Field{Type: sip.FieldNoBlock, Value: nb},
+		sip.Field{Type: sip.FieldTransactionDate, Value: date},
+		sip.Field{Type: sip.FieldNbDueDate, Value: date},
+		sip.Field{Type: sip.FieldInstitutionID, Value: dept},
+		sip.Field{Type: sip.FieldPatronIdentifier, Value: username},
+		sip.Field{Type: sip.FieldItemIdentifier, Value: barcode},
+		sip.Field{Type: sip.FieldTerminalPassword, Value: ""},
+	)
+}
+
+func sipFormMsgRenew(dept, username, barcode string) sip.Message {
+	now := time.Now().Format(sip.DateLayout)
+	return sip.NewMessage(sip.MsgReqRenew).AddField(
+		sip.Field{Type: sip.FieldThirdPartyAllowed, Value: "N"},
 		sip.Field{Type: sip.FieldNoBlock, Value: "N"},
 		sip.Field{Type: sip.FieldTransactionDate, Value: now},
 		sip.Field{Type: sip.FieldNbDueDate, Value: now},
@@ -49,6 +167,47 @@ func sipFormMsgCheckout(dept, username, barcode string) sip.Message {
 	)
 }
 
+func sipFormMsgPatronStatus(dept, username, pin string) sip.Message {
+	return sip.NewMessage(sip.MsgReqPatronStatus).AddField(
+		sip.Field{Type: sip.FieldLanguage, Value: "000"},
+		sip.Field{Type: sip.FieldTransactionDate, Value: time.Now().Format(sip.DateLayout)},
+		sip.Field{Type: sip.FieldInstitutionID, Value: dept},
+		sip.Field{Type: sip.FieldPatronIdentifier, Value: username},
+		sip.Field{Type: sip.FieldTerminalPassword, Value: ""},
+		sip.Field{Type: sip.FieldPatronPassword, Value: pin},
+	)
+}
+
+// Positions of the summary of a patron information request. The position
+// of the category of items to list in the response is Y, the others blank;
+// the SIP server lists one category at a time, the first one requested.
+const (
+	summaryHoldItems = iota
+	summaryOverdueItems
+	summaryChargedItems
+	summaryFineItems
+	summaryRecallItems
+	summaryUnavailableHolds
+	summaryLen = 10
+)
+
+func sipFormMsgPatronInfo(dept, username, pin string, summary int) sip.Message {
+	flags := []byte(strings.Repeat(" ", summaryLen))
+	flags[summary] = 'Y'
+	return sip.NewMessage(sip.MsgReqPatronInformation).AddField(
+		sip.Field{Type: sip.FieldLanguage, Value: "000"},
+		sip.Field{Type: sip.FieldTransactionDate, Value: time.Now().Format(sip.DateLayout)},
+		sip.Field{Type: sip.FieldSummary, Value: string(flags)},
+		sip.Field{Type: sip.FieldInstitutionID, Value: dept},
+		sip.Field{Type: sip.FieldPatronIdentifier, Value: username},
+		sip.Field{Type: sip.FieldTerminalPassword, Value: ""},
+		sip.Field{Type: sip.FieldPatronPassword, Value: pin},
+	)
+}
+
+// sipFormMsgItemStatus forms an item information (17) request. The response
+// is parsed by itemStatusParse for transactions, and by itemInfoParse for
+// lookups.
 func sipFormMsgItemStatus(barcode string) sip.Message {
 	return sip.NewMessage(sip.MsgReqItemInformation).AddField(
 		sip.Field{Type: sip.FieldTransactionDate, Value: time.Now().Format(sip.DateLayout)},
@@ -65,44 +224,192 @@ type parserFunc func(sip.Message) Message
 // DoSIPCall performs a SIP request. It takes a SIP message as a string and a
 // parser function to transform the SIP response into a Message.
 func DoSIPCall(cfg Config, p *pool, msg sip.Message, parser parserFunc, clientIP string) (Message, error) {
-	resp, err := doSIPCall(cfg, p, msg, parser, clientIP)
+	return DoSIPCallContext(context.Background(), cfg, p, msg, parser, clientIP)
+}
+
+// DoSIPCallContext performs a SIP request like DoSIPCall, but gives up when
+// ctx is done, ex when the client disconnects, and returns ctx.Err(). The
+// connection is then discarded, as the response could otherwise be read as
+// the response to the next request.
+//
+// While the SIP server of p is down, as reported by its circuit breaker,
+// it fails fast with errSIPBreakerOpen. While Config.SIPMaxCalls are in
+// flight, it waits for one to complete, for up to Config.SIPTimeout, and
+// then fails with errSIPBusy.
+func DoSIPCallContext(ctx context.Context, cfg Config, p *pool, msg sip.Message, parser parserFunc, clientIP string) (Message, error) {
+	// Try a second time, in case the pooled connection was disconnected
+	// by the SIP server.
+	return sipCall(ctx, cfg, p, msg, parser, clientIP, 2)
+}
+
+// DoSIPCallWithRetry performs a SIP request like DoSIPCallContext, but
+// retries it up to cfg.SIPRetries times if it fails with a transient error,
+// which also covers a pooled connection disconnected by the SIP server. It
+// waits cfg.SIPRetryWait before the first retry, doubling the wait for each
+// retry. If notify is not nil, it is called with the error before each
+// retry. It gives up when ctx is done.
+func DoSIPCallWithRetry(ctx context.Context, cfg Config, p *pool, msg sip.Message, parser parserFunc, clientIP string, notify func(error)) (Message, error) {
+	if cfg.SIPRetries <= 0 {
+		return DoSIPCallContext(ctx, cfg, p, msg, parser, clientIP)
+	}
+	wait := cfg.SIPRetryWait
+	for i := 0; ; i++ {
+		resp, err := sipCall(ctx, cfg, p, msg, parser, clientIP, 1)
+		if err == nil || i >= cfg.SIPRetries || !isTransientSIPErr(err) {
+			return resp, err
+		}
+		logger.Warn("SIP call failed, retrying", "ip", clientIP, "attempt", i+1, "wait", wait, "err", err)
+		if notify != nil {
+			notify(err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// sipCall performs a SIP request for DoSIPCallContext, trying it up to
+// tries times in a row while it fails. A server which doesn't respond is
+// not tried again, as the client would be kept waiting for each try.
+func sipCall(ctx context.Context, cfg Config, p *pool, msg sip.Message, parser parserFunc, clientIP string, tries int) (Message, error) {
+	if err := p.calls.acquire(ctx, cfg.SIPTimeout); err != nil {
+		metrics.sipErrors.Inc("")
+		return Message{}, err
+	}
+	defer p.calls.release()
+	if err := p.breaker.allow(); err != nil {
+		metrics.sipErrors.Inc("")
+		return Message{}, err
+	}
+	defer func(start time.Time) { metrics.sipLatency.Observe(time.Since(start)) }(time.Now())
+	resp, err := doSIPCall(ctx, cfg, p, msg, parser, clientIP)
+	for n := 1; err != nil && n < tries && err != errSIPTimeout && ctx.Err() == nil; n++ {
+		resp, err = doSIPCall(ctx, cfg, p, msg, parser, clientIP)
+	}
 	if err == nil {
+		p.breaker.done(nil)
 		return resp, err
 	}
-	// Try a second time, in case the pooled connection was disconnected
-	// by the SIP server.
-	return doSIPCall(cfg, p, msg, parser, clientIP)
+	metrics.sipErrors.Inc("")
+	switch {
+	case ctx.Err() != nil:
+		p.breaker.abort()
+	case isTransientSIPErr(err):
+		p.breaker.done(err)
+	default:
+		// The request or response was bad, but the server is up
+		p.breaker.done(nil)
+	}
+	return resp, err
+}
+
+// isTransientSIPErr reports whether a SIP call failed with an error which
+// may go away by itself, like a timeout or a lost connection. A rejected
+// login or a malformed response is not transient.
+func isTransientSIPErr(err error) bool {
+	switch err {
+	case errSIPTimeout, errSIPLoginRequired, errSIPBusy, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
 }
 
-func doSIPCall(cfg Config, p *pool, msg sip.Message, parser parserFunc, clientIP string) (Message, error) {
+// sipErrorCode returns the ErrorCode of a failed SIP call.
+func sipErrorCode(err error) ErrorCode {
+	if err == errSIPTimeout {
+		return CodeSIPTimeout
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CodeSIPTimeout
+	}
+	return CodeSIPUnavailable
+}
+
+func doSIPCall(ctx context.Context, cfg Config, p *pool, msg sip.Message, parser parserFunc, clientIP string) (Message, error) {
 	// 0. Get connection from pool
-	conn, err := p.get()
+	conn, err := p.getContext(ctx)
 	if err != nil {
 		return Message{}, err
 	}
 	defer p.put(conn)
 
+	if cfg.SIPTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(cfg.SIPTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if ctx.Done() != nil {
+		// Cancel a blocked write or read by moving the deadline to now.
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+			if ctx.Err() != nil {
+				p.isFailing(conn)
+			}
+		}()
+	}
+
 	// 1. Send the SIP request
-	if _, err = msg.Encode(conn); err != nil {
-		p.isFailing(conn)
+	req, seq, err := encodeSIPMsg(cfg, msg)
+	if err != nil {
 		return Message{}, err
 	}
+	if _, err = conn.Write(req); err != nil {
+		p.isFailing(conn)
+		return Message{}, ctxErr(ctx, sipErr(err))
+	}
 
 	if cfg.LogSIPMessages {
-		log.Printf("-> [%s] %v", clientIP, strings.TrimSpace(msg.String()))
+		logger.Info("-> SIP", "ip", clientIP, "msg", strings.TrimSpace(string(req)))
 	}
 
 	// 2. Read SIP response
 
-	reader := bufio.NewReader(conn)
-	resp, err := reader.ReadBytes('\r')
+	reader := getReader(conn)
+	defer putReader(reader)
+	resp, err := reader.ReadBytes(cfg.sipTerminator())
 	if err != nil {
+		// The connection is discarded, also on timeout, as the response
+		// could otherwise be read as the response to the next request.
 		p.isFailing(conn)
-		return Message{}, err
+		return Message{}, ctxErr(ctx, sipErr(err))
 	}
 
 	if cfg.LogSIPMessages {
-		log.Printf("<- [%s] %v", clientIP, strings.TrimSpace(string(resp)))
+		logger.Info("<- SIP", "ip", clientIP, "msg", strings.TrimSpace(string(resp)))
+	}
+
+	if cfg.SIPErrorDetection {
+		if err := validateSIPResp(bytes.TrimSuffix(resp, []byte{cfg.sipTerminator()}), seq); err != nil {
+			// The response may be to an earlier request, so the
+			// connection is out of step, and is discarded.
+			p.isFailing(conn)
+			return Message{}, err
+		}
+	}
+	if resp, err = decodeSIPResp(cfg, resp); err != nil {
+		return Message{}, err
+	}
+	resp = cfg.remapSIPFields(resp)
+
+	// The SIP server responds with a failed login if the session has
+	// expired. The connection is discarded, so that a new connection
+	// is logged in when DoSIPCall tries again.
+	if bytes.HasPrefix(resp, []byte("940")) {
+		p.isFailing(conn)
+		return Message{}, errSIPLoginRequired
 	}
 
 	// 3. Parse the response
@@ -112,6 +419,12 @@ func doSIPCall(cfg Config, p *pool, msg sip.Message, parser parserFunc, clientIP
 	}
 
 	res := parser(respMsg)
+	if bytes.HasPrefix(resp, []byte("10")) {
+		res.Item.SortBin = sipVarField(resp, defaultSIPFields["SortBin"])
+	}
+	if bytes.HasPrefix(resp, []byte("18")) {
+		res.Item.NumTags = sipNumParts(resp)
+	}
 
 	if cfg.LogRFID {
 		if barcode := respMsg.Field(sip.FieldItemIdentifier); barcode != "" && respMsg.Field(sip.FieldOK) == "1" {
@@ -127,6 +440,21 @@ func doSIPCall(cfg Config, p *pool, msg sip.Message, parser parserFunc, clientIP
 	return res, nil
 }
 
+// sipNumParts returns the number of parts of an item, from the field of
+// an item information response given in defaultSIPFields, which package
+// sip doesn't decode. It returns 0 if the field is not given.
+func sipNumParts(resp []byte) int {
+	code := []byte(defaultSIPFields["NumTags"])
+	fields := bytes.Split(bytes.TrimSuffix(resp, []byte("\r")), []byte("|"))
+	for _, f := range fields[1:] {
+		if bytes.HasPrefix(f, code) {
+			n, _ := strconv.Atoi(string(f[2:]))
+			return n
+		}
+	}
+	return 0
+}
+
 func checkinParse(msg sip.Message) Message {
 	var (
 		fail       bool
@@ -134,6 +462,8 @@ func checkinParse(msg sip.Message) Message {
 		unknown    bool
 		date       string
 		hold       bool
+		transit    bool
+		blocked    bool
 		borrowernr string
 		biblionr   string
 	)
@@ -152,32 +482,57 @@ func checkinParse(msg sip.Message) Message {
 		borrowernr = msg.Field(sip.FieldHoldPatronIdentifier)
 		biblionr = msg.Field(sip.FieldSequenceNumber)
 	case "02": // reserved (on other branch)
-		// TODO?
+		transit = true
+		borrowernr = msg.Field(sip.FieldHoldPatronIdentifier)
 	case "04": // send to other branch
-		// TODO?
+		transit = true
 	case "99": // other: bad barcode / withdrawn
 		unknown = true
 		status = "eksemplaret finnes ikke i basen"
 	}
 
-	// Transfer either to holding branch or home branch
-	branch := msg.Field(sip.FieldDestinationLocation)
-	if branch == "" {
-		if pl := msg.Field(sip.FieldPermanentLocation); pl != msg.Field(sip.FieldInstitutionID) {
-			branch = pl
+	var condition string
+	switch {
+	case unknown:
+		condition = screenItemUnknown
+	case fail:
+		condition = screenCheckinFailed
+	}
+
+	// Other alerts on a successful checkin, ex that the item was lost or
+	// claimed returned, mean that the item must be handled manually.
+	if !fail && msg.Field(sip.FieldAlert) == "Y" {
+		switch msg.Field(sip.FieldAlertType) {
+		case "", "00", "99":
+			blocked = true
+			unknown = false
+			condition = screenItemBlocked
+			status = msg.Field(sip.FieldScreenMessage)
+			if status == "" {
+				status = "eksemplaret må behandles manuelt"
+			}
 		}
 	}
 
+	branch := checkinDestination(msg)
+
 	return Message{
-		Action: "CHECKIN",
+		Action:       "CHECKIN",
+		condition:    condition,
+		checkedOutTo: msg.Field(sip.FieldPatronIdentifier),
 		Item: Item{
 			Hold:              hold,
+			InTransit:         transit,
+			Blocked:           blocked,
 			Transfer:          branch,
 			Unknown:           unknown,
 			TransactionFailed: fail,
 			Barcode:           msg.Field(sip.FieldItemIdentifier),
 			Date:              date,
+			SIPTxID:           msg.Field(sip.FieldTransactionID),
 			Label:             msg.Field(sip.FieldTitleIdentifier),
+			MediaType:         msg.Field(sip.FieldMediaType),
+			Magnetic:          msg.Field(sip.FieldMagneticMedia) == "Y",
 			Status:            status,
 			Biblionr:          biblionr,
 			Borrowernr:        borrowernr,
@@ -185,6 +540,21 @@ func checkinParse(msg sip.Message) Message {
 	}
 }
 
+// checkinDestination returns the branch an item checked in is to be sent
+// to: the destination location (CT) given by the SIP server, ex the branch
+// of a reservation, or else the permanent location (AQ) of the item, if it
+// is owned by another branch than the one checking it in (AO). It is empty
+// if the item belongs where it was checked in.
+func checkinDestination(msg sip.Message) string {
+	if dest := msg.Field(sip.FieldDestinationLocation); dest != "" {
+		return dest
+	}
+	if home := msg.Field(sip.FieldPermanentLocation); home != msg.Field(sip.FieldInstitutionID) {
+		return home
+	}
+	return ""
+}
+
 func checkoutParse(msg sip.Message) Message {
 	var (
 		fail    bool
@@ -204,30 +574,181 @@ func checkoutParse(msg sip.Message) Message {
 		unknown = true
 	}
 
+	var condition string
+	switch {
+	case unknown:
+		condition = screenItemUnknown
+	case fail:
+		condition = screenCheckoutFailed
+	}
+
 	return Message{
+		condition: condition,
 		Item: Item{
 			Unknown:           unknown,
 			TransactionFailed: fail,
 			Barcode:           msg.Field(sip.FieldItemIdentifier),
 			Date:              date,
+			SIPTxID:           msg.Field(sip.FieldTransactionID),
+			Status:            msg.Field(sip.FieldScreenMessage),
+			Label:             msg.Field(sip.FieldTitleIdentifier),
+			MediaType:         msg.Field(sip.FieldMediaType),
+			Magnetic:          msg.Field(sip.FieldMagneticMedia) == "Y",
+		},
+	}
+}
+
+func renewParse(msg sip.Message) Message {
+	var (
+		fail bool
+		date string
+	)
+
+	if msg.Field(sip.FieldOK) == "1" {
+		// Display the new due date if renewal was successful
+		date = formatDate(msg.Field(sip.FieldDueDate))
+	} else {
+		// Renewal denied, ex. too many renewals or item is on hold;
+		// the screen message tells why.
+		fail = true
+	}
+
+	var condition string
+	if fail {
+		condition = screenRenewFailed
+	}
+
+	return Message{
+		Action:    "RENEW",
+		condition: condition,
+		Item: Item{
+			TransactionFailed: fail,
+			Barcode:           msg.Field(sip.FieldItemIdentifier),
+			Date:              date,
+			SIPTxID:           msg.Field(sip.FieldTransactionID),
 			Status:            msg.Field(sip.FieldScreenMessage),
 			Label:             msg.Field(sip.FieldTitleIdentifier),
 		},
 	}
 }
 
+// patronStatusParse parses a patron status response. The patron is rejected
+// if not valid, if the PIN is wrong, or if denied charge privileges.
+func patronStatusParse(msg sip.Message) Message {
+	var (
+		fail      bool
+		condition string
+		status    = msg.Field(sip.FieldScreenMessage)
+	)
+
+	switch {
+	case msg.Field(sip.FieldValidPatron) != "Y":
+		fail = true
+		condition = screenPatronInvalid
+		if status == "" {
+			status = "ugyldig låner"
+		}
+	case msg.Field(sip.FieldValidPatronPassword) == "N":
+		// Only given by SIP-server if PIN was supplied
+		fail = true
+		condition = screenPatronPIN
+		if status == "" {
+			status = "feil PIN"
+		}
+	case strings.HasPrefix(msg.Field(sip.FieldPatronStatus), "Y"):
+		// First position of patron status: charge privileges denied
+		fail = true
+		condition = screenPatronBlocked
+		if status == "" {
+			status = "låneren er sperret"
+		}
+	}
+
+	if !fail {
+		status = ""
+	}
+
+	return Message{
+		Action:       "CHECKOUT",
+		PatronError:  fail,
+		ErrorMessage: status,
+		condition:    condition,
+	}
+}
+
+// patronInfoParse parses a patron information response into the patron's
+// account. The patron is rejected like by patronStatusParse; the account of
+// a patron denied charge privileges is still given, as it tells why.
+func patronInfoParse(msg sip.Message) Message {
+	res := patronStatusParse(msg)
+	res.Action = "PATRON-INFO"
+	if res.condition == screenPatronInvalid || res.condition == screenPatronPIN {
+		return res
+	}
+	res.PatronInfo = &Patron{
+		Name:                 msg.Field(sip.FieldPersonalName),
+		HoldCount:            sipCount(msg.Field(sip.FieldHoldItemsCount)),
+		OverdueCount:         sipCount(msg.Field(sip.FieldOverdueItemsCount)),
+		ChargedCount:         sipCount(msg.Field(sip.FieldChargedItemsCount)),
+		FineCount:            sipCount(msg.Field(sip.FieldFineItemsCount)),
+		RecallCount:          sipCount(msg.Field(sip.FieldRecallItemsCount)),
+		UnavailableHoldCount: sipCount(msg.Field(sip.FieldUnavailableHoldsCount)),
+		FeeAmount:            msg.Field(sip.FieldFeeAmount),
+		Currency:             msg.Field(sip.FieldCurrencyType),
+		HoldItems:            patronInfoItems(msg, "AS"),
+		OverdueItems:         patronInfoItems(msg, "AT"),
+		FineItems:            patronInfoItems(msg, "AV"),
+	}
+	return res
+}
+
+// patronInfoFixedLen is the length of the message code and fixed fields of
+// a patron information response: patron status, language, transaction date
+// and the six item counts.
+const patronInfoFixedLen = 2 + 14 + 3 + 18 + 6*4
+
+// patronInfoItems returns the items of the variable field with code, ex AS
+// for hold items, of a patron information response. The field is repeated
+// for each item, of which sip.Message.Field only gives the first.
+func patronInfoItems(msg sip.Message, code string) []string {
+	s := strings.TrimRight(msg.String(), string(sipTerminator))
+	if len(s) < patronInfoFixedLen {
+		return nil
+	}
+	var items []string
+	for _, f := range strings.Split(s[patronInfoFixedLen:], string(sipDelimiter)) {
+		if strings.HasPrefix(f, code) {
+			items = append(items, f[len(code):])
+		}
+	}
+	return items
+}
+
+// sipCount parses a count of items, a fixed field of 4 digits, which is
+// blank if unknown or unsupported by the SIP server.
+func sipCount(s string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
 func itemStatusParse(msg sip.Message) Message {
 	var (
-		unknown bool
-		status  string
+		unknown   bool
+		status    string
+		condition string
 	)
 
 	if msg.Field(sip.FieldTitleIdentifier) == "" {
 		unknown = true
 		status = "eksemplaret finnes ikke i basen"
+		condition = screenItemUnknown
 	}
 
 	return Message{
+		condition: condition,
 		Item: Item{
 			TransactionFailed: true,
 			Barcode:           msg.Field(sip.FieldItemIdentifier),
@@ -238,31 +759,79 @@ func itemStatusParse(msg sip.Message) Message {
 	}
 }
 
+// itemInfoParse parses an item information response for a lookup, where
+// no transaction is performed, with the fields of interest for display
+// which the transactions don't need: the due date, the owner, and whether
+// the item waits on the hold shelf.
+func itemInfoParse(msg sip.Message) Message {
+	res := itemStatusParse(msg)
+	res.Action = "ITEM-INFO"
+	res.Item.TransactionFailed = false
+	res.Item.Date = formatDate(msg.Field(sip.FieldDueDate))
+	res.Item.HomeBranch = msg.Field(sip.FieldOwner)
+	// Circulation status 08: waiting on hold shelf
+	res.Item.Hold = msg.Field(sip.FieldCirculationStatus) == "08"
+	return res
+}
+
+// loginParse parses a SIP login response, and reports whether the login
+// was successful (941) or not (940).
+func loginParse(resp []byte) bool {
+	msg, err := sip.Decode(resp)
+	if err != nil {
+		return false
+	}
+	return msg.Type() == sip.MsgRespLogin && msg.Field(sip.FieldOK) == "1"
+}
+
 // initSIPConn is the default factory function for creating a SIP connection.
 func initSIPConn(cfg Config) func() (net.Conn, error) {
 	return func() (net.Conn, error) {
-		conn, err := net.Dial("tcp", cfg.SIPServer)
+		dialer := net.Dialer{Timeout: cfg.SIPTimeout, KeepAlive: cfg.sipKeepAlive()}
+		conn, err := dialer.Dial("tcp", cfg.SIPServer)
 		if err != nil {
 			return nil, err
 		}
+		if cfg.SIPTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(cfg.SIPTimeout))
+			defer conn.SetDeadline(time.Time{})
+		}
 
-		msg := sipFormMsgLogin(cfg.SIPUser, cfg.SIPPass, cfg.SIPDept)
+		msg, seq, err := encodeSIPMsg(cfg, sipFormMsgLogin(cfg.SIPUser, cfg.SIPPass, cfg.SIPDept))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
 
-		if _, err = msg.Encode(conn); err != nil {
-			log.Printf("ER SIP connect: %v", err)
+		if _, err = conn.Write(msg); err != nil {
+			logger.Error("SIP login write failed", "err", err)
+			conn.Close()
 			return nil, err
 		}
 
-		reader := bufio.NewReader(conn)
-		in, err := reader.ReadString('\r')
+		reader := getReader(conn)
+		in, err := reader.ReadBytes(cfg.sipTerminator())
+		putReader(reader)
 		if err != nil {
-			log.Printf("ER SIP read: %v", err)
+			logger.Error("SIP login read failed", "err", err)
+			conn.Close()
+			return nil, sipErr(err)
+		}
+
+		if cfg.SIPErrorDetection {
+			if err := validateSIPResp(bytes.TrimSuffix(in, []byte{cfg.sipTerminator()}), seq); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		if in, err = decodeSIPResp(cfg, in); err != nil {
+			conn.Close()
 			return nil, err
 		}
 
-		// fail if response == 940 (success == 941)
-		if in[2] == '0' {
-			return nil, errors.New("SIP login failed")
+		if !loginParse(in) {
+			conn.Close()
+			return nil, errSIPLoginFailed
 		}
 
 		return conn, nil
@@ -270,6 +839,46 @@ func initSIPConn(cfg Config) func() (net.Conn, error) {
 
 }
 
+// ctxErr returns ctx.Err() if ctx is done, otherwise err.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// sipErr returns errSIPTimeout if err is a timeout, otherwise err.
+func sipErr(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errSIPTimeout
+	}
+	return err
+}
+
+// checkSIPConn returns a function which checks that the SIP server
+// responds with an ACS status message (98) to a SC status message (99).
+func checkSIPConn(cfg Config) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		defer conn.SetDeadline(time.Time{})
+
+		// 99: SC status, status code 0 (OK), max print width 030, protocol version 2.00
+		if _, err := conn.Write(append([]byte("9900302.00"), cfg.sipTerminator())); err != nil {
+			return err
+		}
+		reader := getReader(conn)
+		defer putReader(reader)
+		in, err := reader.ReadString(cfg.sipTerminator())
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(in, "98") {
+			return fmt.Errorf("unexpected response to SC status: %q", in)
+		}
+		return nil
+	}
+}
+
 func formatDate(s string) string {
 	if len(s) < 9 {
 		return s
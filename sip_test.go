@@ -2,17 +2,35 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"log"
 	"net"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/knakk/sip"
 )
 
 type SIPTestServer struct {
 	sync.RWMutex
-	l       net.Listener
-	echo    []byte
-	failing bool
+	l           net.Listener
+	echo        []byte
+	respond     func(req []byte) []byte // Responds to requests instead of echo, if set
+	failing     bool
+	rejectLogin bool
+	silent      bool
+	failNext    int           // Number of requests to fail by closing the connection
+	login       []byte        // Last login request
+	last        []byte        // Last request after login
+	requests    int           // Number of requests after login
+	delay       time.Duration // Time to take to respond to requests after login
+	inFlight    int           // Requests being responded to
+	maxInFlight int           // Most requests responded to at a time
 }
 
 func newSIPTestServer() *SIPTestServer {
@@ -30,13 +48,53 @@ func (s *SIPTestServer) handle(conn net.Conn) {
 	r := bufio.NewReader(conn)
 	auth := false
 	for {
-		_, _ = r.ReadBytes('\r')
+		req, err := r.ReadBytes('\r')
+		if err != nil {
+			return
+		}
+		s.Lock()
+		if auth {
+			s.last = req
+			s.requests++
+		} else {
+			s.login = req
+		}
+		if auth && s.failNext > 0 {
+			s.failNext--
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+		s.RLock()
 		msg := s.echo
+		if auth && s.respond != nil {
+			msg = s.respond(req)
+		}
+		if auth && s.silent {
+			s.RUnlock()
+			continue
+		}
 		if !auth {
 			msg = []byte("941\r")
+			if s.rejectLogin {
+				msg = []byte("940\r")
+			}
 		}
-		_, err := conn.Write(msg)
-		if err != nil {
+		delay := s.delay
+		s.RUnlock()
+		if auth && delay > 0 {
+			s.Lock()
+			s.inFlight++
+			if s.inFlight > s.maxInFlight {
+				s.maxInFlight = s.inFlight
+			}
+			s.Unlock()
+			time.Sleep(delay)
+			s.Lock()
+			s.inFlight--
+			s.Unlock()
+		}
+		if _, err := conn.Write(msg); err != nil {
 			break
 		}
 
@@ -66,6 +124,75 @@ func (s *SIPTestServer) Respond(msg string) {
 	defer s.Unlock()
 	s.echo = []byte(msg)
 }
+
+// RespondWith makes the server respond to each request after login with
+// the response of f.
+func (s *SIPTestServer) RespondWith(f func(req []byte) []byte) {
+	s.Lock()
+	defer s.Unlock()
+	s.respond = f
+}
+
+func (s *SIPTestServer) RejectLogin() *SIPTestServer {
+	s.Lock()
+	defer s.Unlock()
+	s.rejectLogin = true
+	return s
+}
+
+// FailNext makes the server close the connection on the next n requests.
+func (s *SIPTestServer) FailNext(n int) *SIPTestServer {
+	s.Lock()
+	defer s.Unlock()
+	s.failNext = n
+	return s
+}
+
+// Delay makes the server take d to respond to each request after login.
+func (s *SIPTestServer) Delay(d time.Duration) *SIPTestServer {
+	s.Lock()
+	defer s.Unlock()
+	s.delay = d
+	return s
+}
+
+// MaxInFlight returns the most requests after login which the server has
+// been responding to at a time, with Delay.
+func (s *SIPTestServer) MaxInFlight() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.maxInFlight
+}
+
+// Silent makes the server accept logins, but never respond to other requests.
+func (s *SIPTestServer) Silent() *SIPTestServer {
+	s.Lock()
+	defer s.Unlock()
+	s.silent = true
+	return s
+}
+
+// LastRequest returns the last request received after login.
+func (s *SIPTestServer) LastRequest() string {
+	s.RLock()
+	defer s.RUnlock()
+	return string(s.last)
+}
+
+// LoginRequest returns the last login request received.
+func (s *SIPTestServer) LoginRequest() string {
+	s.RLock()
+	defer s.RUnlock()
+	return string(s.login)
+}
+
+// Requests returns the number of requests received after login.
+func (s *SIPTestServer) Requests() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.requests
+}
+
 func (s *SIPTestServer) Addr() string {
 	s.RLock()
 	defer s.RUnlock()
@@ -84,7 +211,7 @@ func TestSIPCheckin(t *testing.T) {
 	defer srv.Close()
 
 	initFn := initSIPConn(Config{SIPServer: srv.Addr(), RFIDTimeout: 1 * time.Second})
-	p := newPool(1, initFn)
+	p := newPool(0, 1, 0, initFn)
 
 	srv.Respond("101YNN20140124    093621AOHUTL|AB03011143299001|AQhvmu|AJ316 salmer og sanger|AA1|CS783.4|\r")
 
@@ -103,6 +230,19 @@ func TestSIPCheckin(t *testing.T) {
 		t.Errorf("res.Item.Date == %q; want %q", res.Item.Date, want)
 	}
 
+	if res.Item.SortBin != "" {
+		t.Errorf("res.Item.SortBin == %q; want none given", res.Item.SortBin)
+	}
+
+	srv.Respond("101YNN20140124    093621AOHUTL|AB03011143299001|AQhvmu|AJ316 salmer og sanger|CL4B|\r")
+	res, err = DoSIPCall(Config{RFIDTimeout: 1 * time.Second}, p, sipFormMsgCheckin("HUTL", "03011143299001"), checkinParse, "testIP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "4B"; res.Item.SortBin != want {
+		t.Errorf("res.Item.SortBin == %q; want %q", res.Item.SortBin, want)
+	}
+
 	srv.Respond("100NUY20140128    114702AO|AB234567890|CV99|AFItem not checked out|\r")
 	res, err = DoSIPCall(Config{RFIDTimeout: 1 * time.Second}, p, sipFormMsgCheckin("HUTL", "234567890"), checkinParse, "testIP")
 	if err != nil {
@@ -125,12 +265,65 @@ func TestSIPCheckin(t *testing.T) {
 	}
 }
 
+func TestSIPCheckinAlerts(t *testing.T) {
+	tests := []struct {
+		resp string
+		want Item
+	}{
+		// No alert
+		{"101YNN20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|AA1|CS783.4|\r",
+			Item{Barcode: "03011143299001", Label: "316 salmer og sanger", Date: "24/01/2014"}},
+		// 01: reserved for a patron at this branch
+		{"101YNY20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|CY12|DAåsen|AY8|CV01|\r",
+			Item{Barcode: "03011143299001", Label: "316 salmer og sanger", Date: "24/01/2014",
+				Hold: true, Borrowernr: "12", Biblionr: "8"}},
+		// 02: reserved for a patron at another branch
+		{"101YNY20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|CTfroa|CY11|DAåsen|CV02|\r",
+			Item{Barcode: "03011143299001", Label: "316 salmer og sanger", Date: "24/01/2014",
+				InTransit: true, Transfer: "froa", Borrowernr: "11"}},
+		// 04: send to home branch
+		{"101YNY20140124    093621AOhutl|AB03011143299001|AQfbol|AJ316 salmer og sanger|CTfbol|CV04|\r",
+			Item{Barcode: "03011143299001", Label: "316 salmer og sanger", Date: "24/01/2014",
+				InTransit: true, Transfer: "fbol"}},
+		// 99: unknown item
+		{"100NUY20140128    114702AO|AB234567890|CV99|AFItem not checked out|\r",
+			Item{Barcode: "234567890", Unknown: true, TransactionFailed: true,
+				Status: "eksemplaret finnes ikke i basen"}},
+		// Checked in, but the item was lost, and must be handled manually
+		{"101YNY20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|CV99|AFItem was lost, now found|\r",
+			Item{Barcode: "03011143299001", Label: "316 salmer og sanger", Date: "24/01/2014",
+				Blocked: true, Status: "Item was lost, now found"}},
+		// Claimed returned, with alert type 00 (unknown)
+		{"101NNY20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|CV00|AFItem was claimed returned|\r",
+			Item{Barcode: "03011143299001", Label: "316 salmer og sanger", Date: "24/01/2014",
+				Blocked: true, Status: "Item was claimed returned"}},
+		// Alert without alert type or screen message
+		{"101YNY20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|\r",
+			Item{Barcode: "03011143299001", Label: "316 salmer og sanger", Date: "24/01/2014",
+				Blocked: true, Status: "eksemplaret må behandles manuelt"}},
+		// Alerts for holds and transfers are handled, and don't block the item
+		{"101YNY20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|CY12|AY8|CV01|\r",
+			Item{Barcode: "03011143299001", Label: "316 salmer og sanger", Date: "24/01/2014",
+				Hold: true, Borrowernr: "12", Biblionr: "8"}},
+	}
+
+	for _, tt := range tests {
+		msg, err := sip.Decode([]byte(tt.resp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := checkinParse(msg).Item; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("checkinParse(%q) =>\n%+v\nwant:\n%+v", tt.resp, got, tt.want)
+		}
+	}
+}
+
 func TestSIPCheckout(t *testing.T) {
 	srv := newSIPTestServer()
 	defer srv.Close()
 
 	initFn := initSIPConn(Config{SIPServer: srv.Addr(), RFIDTimeout: 1 * time.Second})
-	p := newPool(1, initFn)
+	p := newPool(0, 1, 0, initFn)
 
 	srv.Respond("121NNY20140124    110740AOHUTL|AA2|AB03011174511003|AJKrutt-Kim|AH20140221    235900|\r")
 	res, err := DoSIPCall(Config{RFIDTimeout: 1 * time.Second}, p, sipFormMsgCheckout("HUTL", "2", "03011174511003"), checkoutParse, "testIP")
@@ -160,12 +353,125 @@ func TestSIPCheckout(t *testing.T) {
 	}
 }
 
+func TestSIPCheckoutNoBlock(t *testing.T) {
+	at := time.Date(2014, 3, 3, 11, 2, 36, 0, time.Local)
+	for _, tt := range []struct {
+		noBlock bool
+		want    string
+	}{
+		{false, "11YN20140303    11023620140303    110236AOHUTL|AA95|AB03011063175001|"},
+		{true, "11YY20140303    11023620140303    110236AOHUTL|AA95|AB03011063175001|"},
+	} {
+		req, _, err := encodeSIPMsg(Config{}, sipFormMsgCheckoutAt("HUTL", "95", "03011063175001", tt.noBlock, at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(req), tt.want) {
+			t.Errorf("sipFormMsgCheckoutAt(noBlock=%v) => %q; want prefix %q", tt.noBlock, req, tt.want)
+		}
+	}
+}
+
+func TestSIPRenew(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	initFn := initSIPConn(Config{SIPServer: srv.Addr(), RFIDTimeout: 1 * time.Second})
+	p := newPool(0, 1, 0, initFn)
+
+	srv.Respond("301YNN20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140428    235900|\r")
+	res, err := DoSIPCall(Config{RFIDTimeout: 1 * time.Second}, p, sipFormMsgRenew("HUTL", "95", "03011063175001"), renewParse, "testIP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Item.TransactionFailed {
+		t.Errorf("res.Item.TransactionFailed == true; want false")
+	}
+	if want := "28/04/2014"; res.Item.Date != want {
+		t.Errorf("res.Item.Date == %q; want %q", res.Item.Date, want)
+	}
+
+	srv.Respond("300NUN20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH|AFItem is on hold|\r")
+	res, err = DoSIPCall(Config{RFIDTimeout: 1 * time.Second}, p, sipFormMsgRenew("HUTL", "95", "03011063175001"), renewParse, "testIP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Item.TransactionFailed {
+		t.Errorf("res.Item.TransactionFailed == false; want true")
+	}
+	if want := "Item is on hold"; res.Item.Status != want {
+		t.Errorf("res.Item.Status == %q; want %q", res.Item.Status, want)
+	}
+}
+
+func TestSIPTransactionID(t *testing.T) {
+	tests := []struct {
+		resp  string
+		parse parserFunc
+		want  string
+	}{
+		{"101YNN20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|BK8812|\r",
+			checkinParse, "8812"},
+		{"100NUY20140128    114702AO|AB234567890|CV99|AFItem not checked out|BK8813|\r",
+			checkinParse, "8813"},
+		{"121NNY20140124    110740AOHUTL|AA2|AB03011174511003|AJKrutt-Kim|AH20140221    235900|BKco-771|\r",
+			checkoutParse, "co-771"},
+		{"301YNN20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140428    235900|BK9|\r",
+			renewParse, "9"},
+		// No transaction id given by the SIP server
+		{"121NNY20140124    110740AOHUTL|AA2|AB03011174511003|AJKrutt-Kim|AH20140221    235900|\r",
+			checkoutParse, ""},
+	}
+
+	for _, tt := range tests {
+		msg, err := sip.Decode([]byte(tt.resp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.parse(msg).Item.SIPTxID; got != tt.want {
+			t.Errorf("parsing %q => SIPTxID %q; want %q", tt.resp, got, tt.want)
+		}
+	}
+}
+
+func TestSIPMediaType(t *testing.T) {
+	tests := []struct {
+		resp     string
+		parse    parserFunc
+		want     string
+		magnetic bool
+	}{
+		{"101YNN20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|CK001|\r",
+			checkinParse, "001", false},
+		{"101YYN20140124    093621AOhutl|AB03011143299001|AQhutl|AJThe wall|CK005|\r",
+			checkinParse, "005", true},
+		{"101YNN20140124    093621AOhutl|AB03011143299001|AQhutl|AJKind of blue|CK006|\r",
+			checkinParse, "006", false},
+		{"101YNN20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|\r",
+			checkinParse, "", false},
+		{"121NYY20140124    110740AOHUTL|AA2|AB03011174511003|AJThe wall|AH20140221    235900|CK004|\r",
+			checkoutParse, "004", true},
+		{"121NNY20140124    110740AOHUTL|AA2|AB03011174511003|AJKrutt-Kim|AH20140221    235900|CK009|\r",
+			checkoutParse, "009", false},
+	}
+
+	for _, tt := range tests {
+		msg, err := sip.Decode([]byte(tt.resp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.parse(msg).Item; got.MediaType != tt.want || got.Magnetic != tt.magnetic {
+			t.Errorf("parsing %q => media type %q, magnetic %v; want %q, %v", tt.resp, got.MediaType, got.Magnetic, tt.want, tt.magnetic)
+		}
+	}
+}
+
 func TestSIPItemStatus(t *testing.T) {
 	srv := newSIPTestServer()
 	defer srv.Close()
 
 	initFn := initSIPConn(Config{SIPServer: srv.Addr(), RFIDTimeout: 1 * time.Second})
-	p := newPool(1, initFn)
+	p := newPool(0, 1, 0, initFn)
 
 	srv.Respond("1801010120140228    110748AB1003010856677001|AO|AJ|\r")
 
@@ -180,3 +486,493 @@ func TestSIPItemStatus(t *testing.T) {
 		t.Errorf("res.Item.Unknown == false; want true")
 	}
 }
+
+func TestSIPItemInfo(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	initFn := initSIPConn(Config{SIPServer: srv.Addr(), RFIDTimeout: 1 * time.Second})
+	p := newPool(0, 1, 0, initFn)
+
+	srv.Respond("1808000120140228    110748AB03010824124004|AO|AJHeavy metal in Baghdad|AH20140331    235900|\r")
+
+	res, err := DoSIPCall(Config{RFIDTimeout: 1 * time.Second}, p, sipFormMsgItemStatus("03010824124004"), itemInfoParse, "testIP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Item.TransactionFailed {
+		t.Errorf("res.Item.TransactionFailed == true; want false")
+	}
+	if !res.Item.Hold {
+		t.Errorf("res.Item.Hold == false; want true")
+	}
+	if want := "31/03/2014"; res.Item.Date != want {
+		t.Errorf("res.Item.Date == %q; want %q", res.Item.Date, want)
+	}
+}
+
+func TestSIPPatronInfo(t *testing.T) {
+	req := sipFormMsgPatronInfo("hutl", "patron", "1234", summaryFineItems).String()
+	// Message code, language, transaction date and summary
+	if summary := req[23:33]; !strings.HasPrefix(req, "63000") || summary != "   Y      " {
+		t.Errorf("sipFormMsgPatronInfo summary => %q; want fine items requested", summary)
+	}
+
+	tests := []struct {
+		resp string
+		want Message
+	}{
+		// Patron with fines and holds ready for pickup
+		{
+			"64              00020140124    093621000200010003000200000001AOhutl|AApatron|AEPatron Name|BLY|CQY|BHNOK|BV125.50|AS03011143299001|AS03011174511003|AVOverdue fine 03011063175001|AV Lost card|\r",
+			Message{Action: "PATRON-INFO", PatronInfo: &Patron{
+				Name: "Patron Name", HoldCount: 2, OverdueCount: 1, ChargedCount: 3, FineCount: 2, UnavailableHoldCount: 1,
+				FeeAmount: "125.50", Currency: "NOK",
+				HoldItems: []string{"03011143299001", "03011174511003"},
+				FineItems: []string{"Overdue fine 03011063175001", " Lost card"},
+			}},
+		},
+		// Blank counts, as by SIP servers which don't support them
+		{
+			"64              00020140124    093621                        AOhutl|AApatron|AEPatron Name|BLY|\r",
+			Message{Action: "PATRON-INFO", PatronInfo: &Patron{Name: "Patron Name"}},
+		},
+		// Patron denied charge privileges: the account tells why
+		{
+			"64Y             00020140124    093621000000000001000100000000AOhutl|AApatron|AEPatron Name|BLY|BV300.00|AVLost item|\r",
+			Message{Action: "PATRON-INFO", PatronError: true, ErrorMessage: "låneren er sperret", condition: screenPatronBlocked,
+				PatronInfo: &Patron{Name: "Patron Name", ChargedCount: 1, FineCount: 1, FeeAmount: "300.00", FineItems: []string{"Lost item"}}},
+		},
+		// Invalid patron: no account
+		{
+			"64              00020140124    093621000000000000000000000000AOhutl|AApatron|BLN|\r",
+			Message{Action: "PATRON-INFO", PatronError: true, ErrorMessage: "ugyldig låner", condition: screenPatronInvalid},
+		},
+	}
+	for _, tt := range tests {
+		msg, err := sip.Decode([]byte(tt.resp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := patronInfoParse(msg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("patronInfoParse(%q) =>\n%+v\nwant\n%+v", tt.resp, got, tt.want)
+		}
+	}
+}
+
+func TestItemInfoParse(t *testing.T) {
+	tests := []struct {
+		resp string
+		want Item
+	}{
+		// On loan
+		{
+			"1803020120140226    203140AB03011063175001|AJCat's cradle|AH20140331    235900|AQfhol|BGfhol|CK001|\r",
+			Item{Barcode: "03011063175001", Label: "Cat's cradle", Date: "31/03/2014", HomeBranch: "fhol"},
+		},
+		// Waiting on the hold shelf, without owner
+		{
+			"1808000120140228    110748AB03010824124004|AO|AJHeavy metal in Baghdad|AH20140331    235900|\r",
+			Item{Barcode: "03010824124004", Label: "Heavy metal in Baghdad", Date: "31/03/2014", Hold: true},
+		},
+		// Unknown
+		{
+			"1801010120140228    110748AB1003010856677001|AO|AJ|\r",
+			Item{Barcode: "1003010856677001", Unknown: true, Status: "eksemplaret finnes ikke i basen"},
+		},
+	}
+	for _, tt := range tests {
+		msg, err := sip.Decode([]byte(tt.resp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := itemInfoParse(msg); got.Action != "ITEM-INFO" || !reflect.DeepEqual(got.Item, tt.want) {
+			t.Errorf("itemInfoParse(%q) => %s %+v; want ITEM-INFO %+v", tt.resp, got.Action, got.Item, tt.want)
+		}
+	}
+}
+
+func TestSIPLoginFailure(t *testing.T) {
+	srv := newSIPTestServer().RejectLogin()
+	defer srv.Close()
+
+	initFn := initSIPConn(Config{SIPServer: srv.Addr(), RFIDTimeout: 1 * time.Second})
+	p := newPool(0, 1, 0, initFn)
+
+	_, err := DoSIPCall(Config{RFIDTimeout: 1 * time.Second}, p, sipFormMsgItemStatus("1003010856677001"), itemStatusParse, "testIP")
+	if err != errSIPLoginFailed {
+		t.Errorf("DoSIPCall with rejected login => %v; want %v", err, errSIPLoginFailed)
+	}
+}
+
+func TestSIPTimeout(t *testing.T) {
+	srv := newSIPTestServer().Silent()
+	defer srv.Close()
+
+	cfg := Config{SIPServer: srv.Addr(), SIPTimeout: 50 * time.Millisecond}
+	p := newPool(0, 1, 0, initSIPConn(cfg))
+
+	start := time.Now()
+	_, err := DoSIPCall(cfg, p, sipFormMsgItemStatus("1003010856677001"), itemStatusParse, "testIP")
+	if err != errSIPTimeout {
+		t.Errorf("DoSIPCall to silent SIP server => %v; want %v", err, errSIPTimeout)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("DoSIPCall to silent SIP server took %v; want about %v", d, cfg.SIPTimeout)
+	}
+
+	// The connection is discarded rather than returned to the pool
+	if s := p.stats(); s.Idle != 0 || s.Evicted != 1 {
+		t.Errorf("pool.stats() => %+v; want the timed out connection evicted", s)
+	}
+}
+
+func TestSIPIdleConnRecreated(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+	srv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+
+	cfg := Config{SIPServer: srv.Addr(), SIPTimeout: time.Second, SIPKeepAlive: time.Minute}
+	p := newPool(0, 1, 20*time.Millisecond, initSIPConn(cfg))
+	defer p.close()
+
+	if _, err := DoSIPCall(cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is aged past the idle timeout, and is replaced by a
+	// new one, logged in again, on the next call.
+	time.Sleep(40 * time.Millisecond)
+	if _, err := DoSIPCall(cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP"); err != nil {
+		t.Fatalf("DoSIPCall after idle timeout => %v; want success", err)
+	}
+	if s := p.stats(); s.Created != 2 || s.Evicted != 1 || s.Idle != 1 {
+		t.Errorf("pool.stats() => %+v; want idle connection evicted and recreated", s)
+	}
+}
+
+func TestSIPCallWithRetry(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	cfg := Config{SIPServer: srv.Addr(), SIPRetries: 2, SIPRetryWait: time.Millisecond}
+	p := newPool(0, 1, 0, initSIPConn(cfg))
+
+	// The first two tries fail
+	srv.FailNext(2)
+	srv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+
+	var retries []error
+	notify := func(err error) { retries = append(retries, err) }
+	res, err := DoSIPCallWithRetry(context.Background(), cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP", notify)
+	if err != nil {
+		t.Fatalf("DoSIPCallWithRetry to flaky SIP server => %v; want success", err)
+	}
+	if want := "Heavy metal in Baghdad"; res.Item.Label != want {
+		t.Errorf("res.Item.Label == %q; want %q", res.Item.Label, want)
+	}
+	if len(retries) != 2 {
+		t.Errorf("DoSIPCallWithRetry notified %d retries; want 2", len(retries))
+	}
+
+	// It gives up after SIPRetries retries, trying each only once.
+	srv.FailNext(3)
+	retries = nil
+	if _, err := DoSIPCallWithRetry(context.Background(), cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP", notify); err == nil {
+		t.Error("DoSIPCallWithRetry failing 3 times => success; want error after 2 retries")
+	}
+	if len(retries) != 2 {
+		t.Errorf("DoSIPCallWithRetry notified %d retries; want 2", len(retries))
+	}
+	res, err = DoSIPCallWithRetry(context.Background(), cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP", nil)
+	if err != nil || res.Item.Label != "Heavy metal in Baghdad" {
+		t.Errorf("DoSIPCallWithRetry after giving up => %+v, %v; want no failures left", res, err)
+	}
+
+	// Permanent errors are not retried
+	srv.RejectLogin()
+	p = newPool(0, 1, 0, initSIPConn(cfg))
+	retries = nil
+	if _, err := DoSIPCallWithRetry(context.Background(), cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP", notify); err != errSIPLoginFailed {
+		t.Errorf("DoSIPCallWithRetry with rejected login => %v; want %v", err, errSIPLoginFailed)
+	}
+	if len(retries) != 0 {
+		t.Errorf("DoSIPCallWithRetry retried a permanent error %d times; want 0", len(retries))
+	}
+}
+
+func TestSIPErrorDetection(t *testing.T) {
+	req, seq, err := encodeSIPMsg(Config{SIPErrorDetection: true}, sipFormMsgItemStatus("1003010856677001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateSIPResp(req, seq); err != nil {
+		t.Fatalf("validateSIPResp(%q, %d) => %v; want no error", req, seq, err)
+	}
+
+	tests := []struct {
+		in  string
+		seq int
+		err error
+	}{
+		{"9300CNLoginUserID|COLoginPassword|CPLocationCode|AY5AZEC7B\r", 5, nil},
+		{"9300CNLoginUserID|COLoginPassword|CPLocationCode|AY5AZEC7B\r", 4, errSIPSequence},
+		{"9300CNLoginUserID|COLoginPassword|CPLocationCode|AY5AZEC7C\r", 5, errSIPChecksum},
+		{"941\r", 0, errSIPChecksum},
+	}
+	for _, tt := range tests {
+		if err := validateSIPResp([]byte(tt.in), tt.seq); err != tt.err {
+			t.Errorf("validateSIPResp(%q, %d) => %v; want %v", tt.in, tt.seq, err, tt.err)
+		}
+	}
+}
+
+// Verify that a connection whose response fails error detection is not
+// put back in the pool, where the next call could read a stale response.
+func TestSIPErrorDetectionDiscardsConn(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	// Without login, the server answers the first request as a login,
+	// without checksum.
+	p := newPool(0, 1, 0, func() (net.Conn, error) { return net.Dial("tcp", srv.Addr()) })
+	defer p.close()
+	cfg := Config{SIPErrorDetection: true}
+	if _, err := DoSIPCall(cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP"); err != errSIPChecksum {
+		t.Fatalf("DoSIPCall with invalid checksum => %v; want %v", err, errSIPChecksum)
+	}
+	if s := p.stats(); s.Idle != 0 || s.Evicted != s.Created {
+		t.Errorf("pool stats after invalid checksum => %+v; want connections evicted", s)
+	}
+}
+
+func TestSIPDelimiter(t *testing.T) {
+	cfg := Config{SIPDelimiter: "^", SIPTerminator: "\n"}
+
+	// Forming messages
+	std, _, err := encodeSIPMsg(Config{}, sipFormMsgItemStatus("1003010856677001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _, err := encodeSIPMsg(cfg, sipFormMsgItemStatus("1003010856677001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(strings.TrimSuffix(string(std), "\r"), "|", "^", -1) + "\n"
+	if string(req) != want {
+		t.Errorf("encodeSIPMsg with delimiter ^ => %q; want %q", req, want)
+	}
+	if _, _, err := encodeSIPMsg(cfg, sipFormMsgItemStatus("10030108^6677001")); err != errSIPDelimiter {
+		t.Errorf("encodeSIPMsg with delimiter in barcode => %v; want %v", err, errSIPDelimiter)
+	}
+
+	// The checksum is of the message as sent
+	req, seq, err := encodeSIPMsg(Config{SIPDelimiter: "^", SIPErrorDetection: true}, sipFormMsgItemStatus("1003010856677001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateSIPResp(req, seq); err != nil || strings.Contains(string(req), "|") {
+		t.Errorf("validateSIPResp(%q, %d) => %v; want no error", req, seq, err)
+	}
+
+	// Parsing messages
+	resp, err := decodeSIPResp(cfg, []byte("101YNN20140226    161239AO^AB03010824124004^AQfhol^AJHeavy metal in Baghdad^\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sip.Decode(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := checkinParse(msg).Item; got.Barcode != "03010824124004" || got.Label != "Heavy metal in Baghdad" {
+		t.Errorf("checkinParse with delimiter ^ => %+v; want barcode 03010824124004 and label", got)
+	}
+	if _, err := decodeSIPResp(cfg, []byte("101YNN20140226    161239AO^AB03010824124004^AJAC|DC^\n")); err != errSIPDelimiter {
+		t.Errorf("decodeSIPResp with | in title => %v; want %v", err, errSIPDelimiter)
+	}
+
+	// Through a SIP server
+	srv := newSIPTestServer()
+	defer srv.Close()
+	srv.Respond("101YNN20140226    161239AO^AB03010824124004^AQfhol^AJHeavy metal in Baghdad^\r")
+	cfg = Config{SIPServer: srv.Addr(), SIPDelimiter: "^", SIPTimeout: time.Second}
+	p := newPool(0, 1, 0, initSIPConn(cfg))
+	defer p.close()
+	res, err := DoSIPCall(cfg, p, sipFormMsgCheckin("hutl", "03010824124004"), checkinParse, "testIP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Item.Transfer != "fhol" || res.Item.Label != "Heavy metal in Baghdad" {
+		t.Errorf("DoSIPCall with delimiter ^ => %+v; want transfer to fhol and label", res.Item)
+	}
+}
+
+// Verify that the same response is parsed with the Item attributes read
+// from the fields of Koha, or from the fields they are mapped to.
+func TestSIPFields(t *testing.T) {
+	const resp = "101YNY20140226    161239AOhutl|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CK001|ZKvideo|CTfmaj|ZDfroa|CV04|\r"
+	tests := []struct {
+		fields map[string]string
+		want   Item
+	}{
+		{nil, Item{Barcode: "03010824124004", Label: "Heavy metal in Baghdad", MediaType: "001", Transfer: "fmaj", InTransit: true, Date: "26/02/2014"}},
+		{map[string]string{"MediaType": "ZK", "Transfer": "ZD", "Barcode": "AB"},
+			Item{Barcode: "03010824124004", Label: "Heavy metal in Baghdad", MediaType: "video", Transfer: "froa", InTransit: true, Date: "26/02/2014"}},
+		// A field mapped but not given is not read from the field of Koha;
+		// the destination is then the home branch
+		{map[string]string{"Transfer": "ZT"},
+			Item{Barcode: "03010824124004", Label: "Heavy metal in Baghdad", MediaType: "001", Transfer: "fhol", InTransit: true, Date: "26/02/2014"}},
+	}
+	for _, tt := range tests {
+		msg, err := sip.Decode(Config{SIPFields: tt.fields}.remapSIPFields([]byte(resp)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := checkinParse(msg).Item; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("checkinParse with fields %v => %+v; want %+v", tt.fields, got, tt.want)
+		}
+	}
+
+	// Through a SIP server
+	srv := newSIPTestServer()
+	defer srv.Close()
+	srv.Respond(resp)
+	cfg := Config{SIPServer: srv.Addr(), SIPTimeout: time.Second, SIPFields: tests[1].fields}
+	p := newPool(0, 1, 0, initSIPConn(cfg))
+	defer p.close()
+	res, err := DoSIPCall(cfg, p, sipFormMsgCheckin("hutl", "03010824124004"), checkinParse, "testIP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Item, tests[1].want) {
+		t.Errorf("DoSIPCall with fields %v => %+v; want %+v", cfg.SIPFields, res.Item, tests[1].want)
+	}
+
+	// The number of parts, which package sip doesn't decode
+	srv.Respond("1803020120140226    203140AB03010824124004|AJHeavy metal in Baghdad|ZN2|ZP3|\r")
+	cfg.SIPFields = map[string]string{"NumTags": "ZP"}
+	res, err = DoSIPCall(cfg, p, sipFormMsgItemStatus("03010824124004"), itemStatusParse, "testIP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Item.NumTags != 3 {
+		t.Errorf("DoSIPCall with fields %v => NumTags %d; want 3", cfg.SIPFields, res.Item.NumTags)
+	}
+}
+
+func TestSIPLogging(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	initFn := initSIPConn(Config{SIPServer: srv.Addr(), RFIDTimeout: 1 * time.Second})
+	p := newPool(0, 1, 0, initFn)
+
+	srv.Respond("1801010120140228    110748AB1003010856677001|AO|AJ|\r")
+	if _, err := DoSIPCall(Config{LogSIPMessages: true}, p, sipFormMsgItemStatus("1003010856677001"), itemStatusParse, "testIP"); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), "%") {
+		t.Errorf("log output contains unexpanded verbs: %q", buf.String())
+	}
+	for _, want := range []string{`INFO -> SIP ip=testIP msg="17`, `INFO <- SIP ip=testIP msg="18`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log output %q doesn't contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestScreenMessages(t *testing.T) {
+	cfg := Config{
+		ScreenMessages: map[string]string{
+			screenItemBlocked: "Please give {title} to the staff ({message})",
+			screenPatronPIN:   "Wrong PIN",
+		},
+		BranchScreenMessages: map[string]map[string]string{
+			"fmaj": {screenItemBlocked: "Lever {barcode} i skranken"},
+		},
+	}
+	blocked := "101YNY20140124    093621AOhutl|AB03011143299001|AQhutl|AJ316 salmer og sanger|CV99|AFItem was lost, now found|\r"
+	tests := []struct {
+		resp   string
+		branch string
+		parser parserFunc
+		want   string
+	}{
+		// Mapped condition
+		{blocked, "hutl", checkinParse, "Please give 316 salmer og sanger to the staff (Item was lost, now found)"},
+		// Mapped condition, with a message of the branch
+		{blocked, "fmaj", checkinParse, "Lever 03011143299001 i skranken"},
+		// Mapped patron condition
+		{"24              00120140124    093621AOhutl|AApatron|AEPatron Name|BLY|CQN|\r", "hutl", patronStatusParse, "Wrong PIN"},
+		// Unmapped condition: the screen message of the SIP server is kept
+		{"120NUN20140124    093621AOhutl|AA2|AB1234|AJ|AFInvalid Item|\r", "hutl", checkoutParse, "Invalid Item"},
+		{"120NUN20140124    093621AOhutl|AA2|AB03011174511003|AJHeavy metal|AFItem on hold|\r", "fmaj", checkoutParse, "Item on hold"},
+	}
+
+	for _, tt := range tests {
+		msg, err := sip.Decode([]byte(tt.resp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := cfg.localized(tt.branch, tt.parser)(msg)
+		got := res.Item.Status
+		if res.PatronError {
+			got = res.ErrorMessage
+		}
+		if got != tt.want {
+			t.Errorf("localized(%q) screen message => %q; want %q", tt.resp, got, tt.want)
+		}
+	}
+}
+
+func TestBranchSIPServers(t *testing.T) {
+	var srvs []*SIPTestServer
+	for i := 0; i < 3; i++ {
+		s := newSIPTestServer()
+		defer s.Close()
+		s.Respond("1803020120140226    203140AB03011063175001|AO|AJCat's cradle|AQfhol|BGfhol|\r")
+		srvs = append(srvs, s)
+	}
+	h := newHub(Config{
+		SIPServer:  srvs[0].Addr(),
+		SIPUser:    "autouser",
+		SIPPass:    "autopass",
+		SIPMaxConn: 1,
+		SIPTimeout: time.Second,
+		BranchSIP: map[string]SIPEndpoint{
+			"fmaj": {Server: srvs[1].Addr(), User: "fmajuser", Pass: "fmajpass"},
+			"hutl": {Server: srvs[2].Addr(), Dept: "hutl"},
+		},
+	})
+	defer h.Close()
+
+	tests := []struct {
+		branch string
+		srv    int
+		login  string
+	}{
+		{"fmaj", 1, "9300CNfmajuser|COfmajpass|CP|"},
+		{"hutl", 2, "9300CNautouser|COautopass|CPhutl|"},
+		{"fbje", 0, "9300CNautouser|COautopass|CP|"},
+	}
+	want := make([]int, len(srvs))
+	for _, tt := range tests {
+		if _, err := DoSIPCall(h.config, h.sipPoolFor(tt.branch), sipFormMsgItemStatus("03011063175001"), itemStatusParse, ""); err != nil {
+			t.Fatalf("%s: DoSIPCall => %v", tt.branch, err)
+		}
+		want[tt.srv]++
+		for i, s := range srvs {
+			if got := s.Requests(); got != want[i] {
+				t.Errorf("%s: SIP server %d got %d requests; want %d", tt.branch, i, got, want[i])
+			}
+		}
+		if got := srvs[tt.srv].LoginRequest(); !strings.HasPrefix(got, tt.login) {
+			t.Errorf("%s: login => %q; want %q", tt.branch, got, tt.login)
+		}
+	}
+}
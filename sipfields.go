@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// SIP field codes of the Item attributes parsed from the variable fields
+// of SIP responses, as given by Koha. SIP servers of other ILS vendors may
+// give some of them in other fields, ex the owner of an item in the
+// permanent location (AQ), or the media type in a vendor-specific field;
+// Config.SIPFields maps an attribute to the field it is given in.
+var defaultSIPFields = map[string]string{
+	"Barcode":    "AB", // Item identifier
+	"Label":      "AJ", // Title identifier
+	"HomeBranch": "BG", // Owner
+	"Transfer":   "CT", // Destination location
+	"MediaType":  "CK", // Media type
+	"SIPTxID":    "BK", // Transaction id
+	"Borrowernr": "CY", // Hold patron id
+	"SortBin":    "CL", // Sort bin, not decoded by package sip
+	"NumTags":    "ZN", // Number of parts, not decoded by package sip; Koha gives it with a custom item field of its SIP config
+}
+
+// sipFixedLen is the length of the message code and fixed fields of the
+// SIP responses parsed, keyed by message code, after which the variable
+// fields follow.
+var sipFixedLen = map[string]int{
+	"10": 2 + 1 + 1 + 1 + 1 + 18, // Checkin
+	"12": 2 + 1 + 1 + 1 + 1 + 18, // Checkout
+	"30": 2 + 1 + 1 + 1 + 1 + 18, // Renew
+	"18": 2 + 2 + 2 + 2 + 18,     // Item information
+	"24": 2 + 14 + 3 + 18,        // Patron status
+	"64": patronInfoFixedLen,     // Patron information
+}
+
+// validateSIPFields checks that the SIP fields are mapped from Item
+// attributes which are parsed, and are two letter or digit field codes.
+func validateSIPFields(fields map[string]string) error {
+	for attr, code := range fields {
+		if _, ok := defaultSIPFields[attr]; !ok {
+			return fmt.Errorf("unknown item attribute in SIP fields: %q", attr)
+		}
+		if len(code) != 2 || !isFieldCodeChar(code[0]) || !isFieldCodeChar(code[1]) {
+			return fmt.Errorf("SIP field code of %s must be two letters or digits: %q", attr, code)
+		}
+	}
+	return nil
+}
+
+func isFieldCodeChar(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+}
+
+// remapSIPFields rewrites a SIP response, with the delimiter and terminator
+// of package sip, so that the parsers find the Item attributes mapped by
+// Config.SIPFields in the fields they read: the field of the Koha default
+// code of a remapped attribute is replaced by the mapped field, renamed to
+// the default code. Responses the fixed fields of which are not known are
+// returned as is.
+func (c Config) remapSIPFields(resp []byte) []byte {
+	if len(c.SIPFields) == 0 || len(resp) < 2 {
+		return resp
+	}
+	n, ok := sipFixedLen[string(resp[:2])]
+	b := bytes.TrimSuffix(resp, []byte{sipTerminator})
+	if !ok || len(b) < n {
+		return resp
+	}
+	fields := bytes.Split(b[n:], []byte{sipDelimiter})
+
+	// Values of the mapped fields, taken before any field is replaced, so
+	// that attributes can swap fields.
+	remapped := make(map[string][]byte) // Keyed by default code
+	for attr, code := range c.SIPFields {
+		def := defaultSIPFields[attr]
+		if code == def {
+			continue
+		}
+		remapped[def] = nil
+		for _, f := range fields {
+			if len(f) >= 2 && string(f[:2]) == code {
+				remapped[def] = append([]byte(def), f[2:]...)
+				break
+			}
+		}
+	}
+	if len(remapped) == 0 {
+		return resp
+	}
+
+	res := append([]byte(nil), b[:n]...)
+	for _, f := range fields {
+		if len(f) < 2 {
+			continue
+		}
+		if _, ok := remapped[string(f[:2])]; ok {
+			continue
+		}
+		res = append(append(res, f...), sipDelimiter)
+	}
+	defs := make([]string, 0, len(remapped))
+	for def := range remapped {
+		defs = append(defs, def)
+	}
+	sort.Strings(defs)
+	for _, def := range defs {
+		if f := remapped[def]; f != nil {
+			res = append(append(res, f...), sipDelimiter)
+		}
+	}
+	return append(res, sipTerminator)
+}
+
+// sipVarField returns the value of the first variable field with the given
+// code of a SIP response, with the delimiter and terminator of package
+// sip, for fields package sip doesn't decode. It returns "" if the field is
+// not given, or the fixed fields of the response are not known.
+func sipVarField(resp []byte, code string) string {
+	if len(resp) < 2 {
+		return ""
+	}
+	n, ok := sipFixedLen[string(resp[:2])]
+	b := bytes.TrimSuffix(resp, []byte{sipTerminator})
+	if !ok || len(b) < n {
+		return ""
+	}
+	for _, f := range bytes.Split(b[n:], []byte{sipDelimiter}) {
+		if len(f) >= 2 && string(f[:2]) == code {
+			return string(f[2:])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// rfidTracer writes the raw traffic with the RFID-units to a log of its
+// own, for protocol debugging. It traces all clients if enabled with
+// Config.RFIDTrace, or else the IPs enabled at runtime through /trace.
+// A nil rfidTracer traces nothing.
+type rfidTracer struct {
+	mu  sync.Mutex
+	all bool
+	ips map[string]bool // IPs traced
+	log *log.Logger
+}
+
+func newRFIDTracer(all bool, w io.Writer) *rfidTracer {
+	return &rfidTracer{
+		all: all,
+		ips: make(map[string]bool),
+		log: log.New(w, "", log.Ltime|log.Lmicroseconds),
+	}
+}
+
+// trace logs b, sent in the direction dir ("->" to, or "<-" from the
+// RFID-unit), if the traffic of ip is traced.
+func (t *rfidTracer) trace(ip, dir string, b []byte) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	on := t.all || t.ips[ip]
+	t.mu.Unlock()
+	if on {
+		t.log.Printf("%s [%s] %q", dir, ip, b)
+	}
+}
+
+// set starts or stops tracing the traffic of ip.
+func (t *rfidTracer) set(ip string, on bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if on {
+		t.ips[ip] = true
+	} else {
+		delete(t.ips, ip)
+	}
+}
+
+// traceReport is the response of /trace.
+type traceReport struct {
+	All bool     // All clients are traced
+	IPs []string // IPs traced
+}
+
+func (t *rfidTracer) report() traceReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := traceReport{All: t.all, IPs: make([]string, 0, len(t.ips))}
+	for ip := range t.ips {
+		r.IPs = append(r.IPs, ip)
+	}
+	sort.Strings(r.IPs)
+	return r
+}
+
+// openTrace opens the file traces are written to, if configured. Otherwise
+// they are written to stderr.
+func (h *Hub) openTrace() error {
+	if h.config.RFIDTraceFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(h.config.RFIDTraceFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open RFID trace file: %v", err)
+	}
+	h.tracer = newRFIDTracer(h.config.RFIDTrace, f)
+	return nil
+}
+
+// ServeTrace starts or stops tracing the RFID traffic of a client, with a
+// POST of the form values ip and on (true or false), and responds with the
+// IPs traced. It requires WSAuthToken, if configured.
+func (h *Hub) ServeTrace(w http.ResponseWriter, r *http.Request) {
+	if !h.settings().config.checkToken(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPost {
+		ip := r.FormValue("ip")
+		on, err := strconv.ParseBool(r.FormValue("on"))
+		if ip == "" || err != nil {
+			http.Error(w, "ip and on (true or false) are required", http.StatusBadRequest)
+			return
+		}
+		h.tracer.set(ip, on)
+		h.log.Info("RFID trace changed", "ip", ip, "on", on)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.tracer.report()); err != nil {
+		h.log.Error("cannot encode trace report", "err", err)
+	}
+}
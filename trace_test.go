@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// lockedBuffer is a bytes.Buffer which can be written and read concurrently.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRFIDTrace(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan Message)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(Config{
+		HTTPPort:    port(srv.URL),
+		SIPServer:   sipSrv.Addr(),
+		RFIDPort:    port(d.addr()),
+		RFIDTimeout: 1 * time.Second,
+	})
+	defer hub.Close()
+	var traces lockedBuffer
+	hub.tracer = newRFIDTracer(false, &traces)
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+	if s := traces.String(); s != "" {
+		t.Errorf("traced %q when disabled; want nothing", s)
+	}
+
+	// Tracing is enabled for the client at runtime.
+	rec := httptest.NewRecorder()
+	hub.ServeTrace(rec, httptest.NewRequest("POST", "/trace?ip=127.0.0.1&on=true", nil))
+	var report traceReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.All || len(report.IPs) != 1 || report.IPs[0] != "127.0.0.1" {
+		t.Errorf("POST /trace => %+v; want 127.0.0.1 traced", report)
+	}
+
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.write([]byte("OK\r"))
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // END
+
+	s := traces.String()
+	for _, want := range []string{`-> [127.0.0.1] "BEG\r"`, `<- [127.0.0.1] "OK\r"`, `-> [127.0.0.1] "END\r"`} {
+		if !strings.Contains(s, want) {
+			t.Errorf("traces %q; want %s", s, want)
+		}
+	}
+
+	// And disabled again.
+	hub.ServeTrace(httptest.NewRecorder(), httptest.NewRequest("POST", "/trace?ip=127.0.0.1&on=false", nil))
+	d.write([]byte("OK\r"))
+	if err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)); err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	if got := traces.String(); got != s {
+		t.Errorf("traced %q after disabling; want nothing more", strings.TrimPrefix(got, s))
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// Formats of the messages between Koha and the bridge, negotiated as a
+// websocket subprotocol on the upgrade. Koha asks for the formats it
+// speaks, in order of preference, with the Sec-WebSocket-Protocol header;
+// without it, or if it asks for none the bridge speaks, messages are JSON.
+//
+// With msgpack, messages are encoded with MessagePack, as binary websocket
+// messages, for deployments where bandwidth is scarce. The encoding has the
+// same fields as the JSON one, with the same names.
+const (
+	wsFormatJSON    = "rfidhub.json"
+	wsFormatMsgpack = "rfidhub.msgpack"
+)
+
+// A wsFormat encodes the messages to and from Koha.
+type wsFormat interface {
+	marshal(Message) ([]byte, error)
+	unmarshal([]byte, *Message) error
+	messageType() int // Type of the websocket messages, text or binary
+}
+
+// wsFormats are the formats of the messages, keyed by subprotocol.
+var wsFormats = map[string]wsFormat{
+	wsFormatJSON:    jsonFormat{},
+	wsFormatMsgpack: msgpackFormat{},
+}
+
+// negotiateFormat returns the subprotocol of the format to speak with
+// Koha, given the websocket upgrade request: the first one asked for which
+// the bridge speaks, or "" for JSON without a subprotocol.
+func negotiateFormat(r *http.Request) string {
+	for _, p := range websocket.Subprotocols(r) {
+		if _, ok := wsFormats[p]; ok {
+			return p
+		}
+	}
+	return ""
+}
+
+// wsFormat returns the format of the messages negotiated with Koha.
+func (c *Client) wsFormat() wsFormat {
+	if f, ok := wsFormats[c.format]; ok {
+		return f
+	}
+	return jsonFormat{}
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) marshal(msg Message) ([]byte, error)    { return json.Marshal(msg) }
+func (jsonFormat) unmarshal(b []byte, msg *Message) error { return json.Unmarshal(b, msg) }
+func (jsonFormat) messageType() int                       { return websocket.TextMessage }
+
+// msgpackFormat encodes messages with MessagePack. A message is converted
+// through its JSON encoding, so that the fields, and which are omitted,
+// are the same in both formats.
+type msgpackFormat struct{}
+
+func (msgpackFormat) messageType() int { return websocket.BinaryMessage }
+
+func (msgpackFormat) marshal(msg Message) ([]byte, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := msgpackEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackFormat) unmarshal(b []byte, msg *Message) error {
+	d := msgpackDecoder{b: b}
+	v, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	if len(d.b) > 0 {
+		return errMsgpackTrailing
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, msg)
+}
+
+var (
+	errMsgpackShort    = errors.New("msgpack: unexpected end of message")
+	errMsgpackTrailing = errors.New("msgpack: data after message")
+	errMsgpackDepth    = errors.New("msgpack: message nested too deep")
+)
+
+// msgpackMaxDepth is the deepest nesting of maps and arrays decoded.
+const msgpackMaxDepth = 16
+
+// msgpackEncode writes v, a value decoded from JSON with numbers as
+// json.Number, as MessagePack.
+func msgpackEncode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			msgpackInt(buf, i)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, u)
+		} else if f, err := v.Float64(); err == nil {
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		} else {
+			return err
+		}
+	case string:
+		msgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		msgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := msgpackEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		msgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			msgpackEncode(buf, k)
+			if err := msgpackEncode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode %T", v)
+	}
+	return nil
+}
+
+// msgpackInt writes i in the smallest integer format which holds it.
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(0xe0 | (i + 32)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// msgpackHeader writes the header of a string, array or map of n
+// elements: fix|n if n < fixMax, else the 8, 16 or 32 bit length format.
+// Arrays and maps have no 8 bit format, given as 0.
+func msgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, f8, f16, f32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(f8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(f16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(f32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackDecoder decodes MessagePack into the values decoded from JSON,
+// with integers as json.Number. Binary data is decoded as a string;
+// extension types are not supported.
+type msgpackDecoder struct {
+	b []byte // Remaining data
+}
+
+// next returns the next n bytes.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.b) {
+		return nil, errMsgpackShort
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b, nil
+}
+
+// uint returns the next unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// int returns the next signed integer of n bytes.
+func (d *msgpackDecoder) int(n int) (int64, error) {
+	u, err := d.uint(n)
+	if err != nil {
+		return 0, err
+	}
+	shift := uint(64 - 8*n)
+	return int64(u<<shift) >> shift, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errMsgpackDepth
+	}
+	h, err := d.uint(1)
+	if err != nil {
+		return nil, err
+	}
+	c := byte(h)
+	switch {
+	case c <= 0x7f:
+		return json.Number(strconv.Itoa(int(c))), nil
+	case c >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(c)))), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return d.dict(int(c&0x0f), depth)
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		return json.Number(strconv.FormatUint(u, 10)), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		i, err := d.int(1 << (c - 0xd0))
+		return json.Number(strconv.FormatInt(i, 10)), err
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		size := map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4, 0xc4: 1, 0xc5: 2, 0xc6: 4}[c]
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.dict(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) array(n, depth int) (interface{}, error) {
+	if n > len(d.b) {
+		// Every element takes at least a byte.
+		return nil, errMsgpackShort
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) dict(n, depth int) (interface{}, error) {
+	if n > len(d.b) {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key of type %T", k)
+		}
+		if m[s], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	rssi := -52
+	msgs := []Message{
+		{Action: "CONNECT", Protocol: 4, MinProtocol: 1, MaxProtocol: 4},
+		{ID: 1 << 40, Action: "CHECKIN", ErrorCode: CodeTransactionFailed,
+			Item: Item{Label: "Heavy metal in Baghdad", Barcode: "03010824124004", TransactionFailed: true,
+				Status: "Låneren har for mange purringer", RSSI: &rssi}},
+		{Action: "INVENTORY", Manifest: []Item{{Barcode: "03010824124004"}, {Tag: "E004010046A847AD", Unknown: true}}},
+		{Action: "CANCEL", Attention: []string{"03010824124004", "03011063175001"}},
+	}
+	for _, msg := range msgs {
+		var f msgpackFormat
+		b, err := f.marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, _ := jsonFormat{}.marshal(msg)
+		if len(b) >= len(j) {
+			t.Errorf("msgpack of %s is %d bytes; want less than the %d bytes of JSON", msg.Action, len(b), len(j))
+		}
+		var got Message
+		if err := f.unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("Round trip => %+v; want %+v", got, msg)
+		}
+	}
+
+	// Koha may use any encoding of a value, ex a uint8 for a small ID.
+	in := []byte{0x82, 0xa6, 'A', 'c', 't', 'i', 'o', 'n', 0xa3, 'A', 'C', 'K', 0xa2, 'I', 'D', 0xcc, 0xc8}
+	var got Message
+	if err := (msgpackFormat{}).unmarshal(in, &got); err != nil || got.Action != "ACK" || got.ID != 200 {
+		t.Errorf("unmarshal(%x) => %+v, %v; want ACK of ID 200", in, got, err)
+	}
+	for _, in := range [][]byte{
+		{},                             // Empty
+		{0x81, 0xa6, 'A', 'c'},         // Truncated
+		{0x81, 0x01, 0x02},             // Key not a string
+		{0x81, 0xa1, 'A', 0xc1},        // Reserved format
+		{0xa1, 'A', 0xa1, 'B'},         // Trailing data
+		{0xdd, 0xff, 0xff, 0xff, 0xff}, // Array longer than the data
+		bytes.Repeat([]byte{0x91}, msgpackMaxDepth+2),
+	} {
+		var got Message
+		if err := (msgpackFormat{}).unmarshal(in, &got); err == nil {
+			t.Errorf("unmarshal(%x) => %+v; want error", in, got)
+		}
+	}
+}
+
+// Verify that Koha gets the format it asks for, and JSON if it asks for
+// none, or for none which the bridge speaks.
+func TestWSFormatNegotiation(t *testing.T) {
+	for _, tt := range []struct {
+		asked  []string
+		format string // Subprotocol negotiated
+		mt     int
+	}{
+		{nil, "", websocket.TextMessage},
+		{[]string{"rfidhub.cbor"}, "", websocket.TextMessage},
+		{[]string{wsFormatJSON}, wsFormatJSON, websocket.TextMessage},
+		{[]string{wsFormatMsgpack}, wsFormatMsgpack, websocket.BinaryMessage},
+		{[]string{"rfidhub.cbor", wsFormatMsgpack, wsFormatJSON}, wsFormatMsgpack, websocket.BinaryMessage},
+	} {
+		t.Run(fmt.Sprint(tt.asked), func(t *testing.T) {
+			sipSrv := newSIPTestServer()
+			defer sipSrv.Close()
+
+			srv := httptest.NewServer(nil)
+			defer srv.Close()
+
+			d := newDummyRFIDReader()
+			defer d.Close()
+
+			hub = newHub(Config{
+				HTTPPort:    port(srv.URL),
+				SIPServer:   sipSrv.Addr(),
+				RFIDPort:    port(d.addr()),
+				RFIDTimeout: 1 * time.Second,
+			})
+			defer hub.Close()
+
+			dialer := websocket.Dialer{Subprotocols: tt.asked}
+			ws, _, err := dialer.Dial(fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			if got := ws.Subprotocol(); got != tt.format {
+				t.Errorf("Negotiated subprotocol %q; want %q", got, tt.format)
+			}
+			f := wsFormats[tt.format]
+			if f == nil {
+				f = jsonFormat{}
+			}
+
+			<-d.incoming // VER2.00
+			d.write([]byte("OK\r"))
+			mt, b, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Message
+			if err := f.unmarshal(b, &got); err != nil || mt != tt.mt || got.Action != "CONNECT" {
+				t.Fatalf("Got message of type %d: %+v, %v; want CONNECT of type %d", mt, got, err, tt.mt)
+			}
+
+			// Messages from Koha are read in the same format
+			b = []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`)
+			if tt.format == wsFormatMsgpack {
+				var buf bytes.Buffer
+				if err := msgpackEncode(&buf, map[string]interface{}{"Action": "CHECKIN", "Branch": "fmaj"}); err != nil {
+					t.Fatal(err)
+				}
+				b = buf.Bytes()
+			}
+			if err := ws.WriteMessage(tt.mt, b); err != nil {
+				t.Fatal("UI failed to send message over websocket conn")
+			}
+			if msg := <-d.incoming; string(msg) != "BEG\r" {
+				t.Errorf("RFID-unit didn't get instructed to start scanning, got %q", msg)
+			}
+		})
+	}
+}